@@ -0,0 +1,380 @@
+// Package batcher walks an id range in batches, running each batch in its own
+// database transaction, so a migration only brings the SQL of one batch. A
+// Runner hands the batches out to its workers, in fixed windows of ids or paged
+// by keyset over the rows still to process. It retries the batches failing with
+// a retryable error, reports the range below which every batch committed as its
+// checkpoint, throttles between batches and stops handing them out once its
+// context is canceled. The progress of the run, and where its checkpoint is
+// stored, are left to the hooks the command gives it.
+package batcher
+
+import (
+	"context"
+	"fmt"
+	"go-backfill/errs"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Backoff between the attempts of a batch, doubling after each one; tests
+// shorten both.
+var (
+	InitialBackoff = 500 * time.Millisecond
+	MaxBackoff     = 30 * time.Second
+)
+
+// BatchFunc processes the ids [startID, endID] in tx, returning the rows it
+// processed. When the Runner pages its ids, IDs(ctx) are the rows of the range
+// to process.
+type BatchFunc func(ctx context.Context, tx *Tx, startID, endID int) (processed int, err error)
+
+// Window is the id range [Start, End] of one batch.
+type Window struct {
+	Start, End int
+	// IDs are the rows of the range paged in for the batch, nil when it covers
+	// every id of the range
+	IDs []int
+
+	// index counts the windows in the order they were handed out
+	index int
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%d-%d", w.Start, w.End)
+}
+
+type idsKey struct{}
+
+// IDs returns the ids paged in for the batch run with ctx, nil when the batch
+// covers every id of its range.
+func IDs(ctx context.Context) []int {
+	ids, _ := ctx.Value(idsKey{}).([]int)
+	return ids
+}
+
+// Stopped is returned by Run when its context is canceled before every window
+// ran. Remaining is the range left, next to the windows that all committed.
+type Stopped struct {
+	Remaining Window
+}
+
+func (e *Stopped) Error() string {
+	return fmt.Sprintf("stopped with ids %s remaining", e.Remaining)
+}
+
+// Runner walks the ids [Start, End] in windows, from Start up, or from End down
+// when Descending.
+type Runner struct {
+	// Pool holds the connections of the batches and of the paging
+	Pool       *pgxpool.Pool
+	Start, End int
+	// Size is the number of ids of a window, or of rows with Table set
+	Size int
+	// NextSize, when set, gives the Size of every window instead, so that it
+	// can follow how long the batches take
+	NextSize   func() int
+	Descending bool
+	// Workers is the number of batches run at once, 1 when 0
+	Workers int
+	// Table and Pending, when set, page the windows by keyset: each window spans
+	// the next Size ids of Table matching the condition Pending, so gaps in the
+	// ids and rows already done cost no batches
+	Table, Pending string
+	// LockTimeout and StatementTimeout, when set, are the lock_timeout and
+	// statement_timeout of every batch's transaction
+	LockTimeout, StatementTimeout string
+	Batch                         BatchFunc
+	// Rollback discards the work of every batch instead of committing it, for
+	// dry runs
+	Rollback bool
+	// Attempts is the number of times a batch failing with a retryable error is
+	// run in total, 1 when 0
+	Attempts int
+
+	// OnRetry, when set, is called before waiting to retry the batch of w, or
+	// the paging of the range w
+	OnRetry func(w Window, attempt int, backoff time.Duration, err error)
+	// Done is called once the batch of w committed, with the rows it processed
+	// and how long it took, or failed with err. The run stops with the error Done
+	// returns, if any, so returning nil on a failure carries on with the next
+	// window.
+	Done func(w Window, processed int, elapsed time.Duration, err error) error
+	// Checkpoint, when set, is called with the range of the windows done from
+	// the first one on, every time it grows. The run stops with the error it
+	// returns, if any.
+	Checkpoint func(done Window) error
+	// Wait, when set, is called before every window is handed out, to hold it
+	// back
+	Wait func(ctx context.Context)
+	// Throttle, when set, is called after every batch that committed
+	Throttle func(ctx context.Context, processed int)
+}
+
+// Run walks the windows until they have all run, a hook returns an error or ctx
+// is canceled. The batches in flight finish even when ctx is canceled. Done and
+// Checkpoint are never called at the same time.
+func (r *Runner) Run(ctx context.Context) error {
+	if r.Size <= 0 && r.NextSize == nil {
+		return &errs.ValidationError{Field: "batch size", Reason: fmt.Sprintf("%d must be greater than 0", r.Size)}
+	}
+	workers := r.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	// Canceled by a failing batch, or by ctx
+	run, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		// Windows done out of order, until every window before them is too: the
+		// checkpoint only grows over a contiguous run of windows
+		finished    = make(map[int]Window)
+		nextInOrder = 0
+		// The windows done from the first one on, empty so far
+		done = Window{Start: r.Start, End: r.Start - 1}
+	)
+	if r.Descending {
+		done = Window{Start: r.End + 1, End: r.End}
+	}
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	// finish records the outcome of a window, and grows the checkpoint over the
+	// windows done in order.
+	finish := func(w Window, processed int, elapsed time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Done != nil {
+			err = r.Done(w, processed, elapsed, err)
+		} else if err != nil {
+			err = fmt.Errorf("failed to process batch %s: %w", w, err)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		finished[w.index] = w
+		grown := false
+		for {
+			next, ok := finished[nextInOrder]
+			if !ok {
+				break
+			}
+			delete(finished, nextInOrder)
+			nextInOrder++
+			if r.Descending {
+				done.Start = next.Start
+			} else {
+				done.End = next.End
+			}
+			grown = true
+		}
+		if grown && r.Checkpoint != nil {
+			if err := r.Checkpoint(done); err != nil {
+				fail(err)
+			}
+		}
+	}
+
+	windows := make(chan Window)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range windows {
+				// Drain the windows already handed out once a batch failed
+				if run.Err() != nil {
+					continue
+				}
+				started := time.Now()
+				processed, err := Retry(run, r.Attempts, r.onRetry(w), func() (int, error) {
+					return r.RunBatch(run, w)
+				})
+				finish(w, processed, time.Since(started), err)
+				if err == nil && r.Throttle != nil {
+					r.Throttle(run, processed)
+				}
+			}
+		}()
+	}
+
+	next := r.Start
+	if r.Descending {
+		next = r.End
+	}
+dispatch:
+	for index := 0; next >= r.Start && next <= r.End; index++ {
+		if r.Wait != nil {
+			r.Wait(run)
+		}
+		if run.Err() != nil {
+			break
+		}
+
+		w, ok, err := r.window(run, next)
+		if err != nil {
+			mu.Lock()
+			if run.Err() == nil {
+				fail(err)
+			}
+			mu.Unlock()
+			break
+		}
+		if !ok {
+			break
+		}
+		w.index = index
+
+		select {
+		case windows <- w:
+		case <-run.Done():
+			break dispatch
+		}
+
+		if r.Descending {
+			next = w.Start - 1
+		} else {
+			next = w.End + 1
+		}
+	}
+	close(windows)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if ctx.Err() != nil {
+		if r.Descending && done.Start > r.Start {
+			return &Stopped{Remaining: Window{Start: r.Start, End: done.Start - 1}}
+		}
+		if !r.Descending && done.End < r.End {
+			return &Stopped{Remaining: Window{Start: done.End + 1, End: r.End}}
+		}
+	}
+	return nil
+}
+
+// window returns the window starting at id, at its top when descending. Paged,
+// it is false once no rows are left to process.
+func (r *Runner) window(ctx context.Context, id int) (Window, bool, error) {
+	size := r.Size
+	if r.NextSize != nil {
+		size = r.NextSize()
+	}
+
+	if r.Table == "" {
+		if r.Descending {
+			return Window{Start: max(id-size+1, r.Start), End: id}, true, nil
+		}
+		return Window{Start: id, End: min(id+size-1, r.End)}, true, nil
+	}
+
+	// Page in the next ids to process past the previous window
+	lower, upper, order := id, r.End, "ASC"
+	if r.Descending {
+		lower, upper, order = r.Start, id, "DESC"
+	}
+	query := fmt.Sprintf(`
+		SELECT id
+		FROM "%s"
+		WHERE id >= $1 AND id <= $2 AND %s
+		ORDER BY id %s
+		LIMIT $3
+	`, r.Table, r.Pending, order)
+
+	var ids []int
+	_, err := Retry(ctx, r.Attempts, r.onRetry(Window{Start: lower, End: upper}), func() (int, error) {
+		rows, err := r.Pool.Query(ctx, query, lower, upper, size)
+		if err != nil {
+			return 0, errs.FromDB("failed to page the ids of "+r.Table, err)
+		}
+		ids, err = pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			return 0, errs.FromDB("failed to read the ids of "+r.Table, err)
+		}
+		return len(ids), nil
+	})
+	if err != nil || len(ids) == 0 {
+		return Window{}, false, err
+	}
+
+	// The window spans to its last id, or to the end of the range once no ids
+	// are left past it
+	last := ids[len(ids)-1]
+	if r.Descending {
+		if len(ids) < size {
+			last = r.Start
+		}
+		return Window{Start: last, End: id, IDs: ids}, true, nil
+	}
+	if len(ids) < size {
+		last = r.End
+	}
+	return Window{Start: id, End: last, IDs: ids}, true, nil
+}
+
+func (r *Runner) onRetry(w Window) func(attempt int, backoff time.Duration, err error) {
+	return func(attempt int, backoff time.Duration, err error) {
+		if r.OnRetry != nil {
+			r.OnRetry(w, attempt, backoff, err)
+		}
+	}
+}
+
+// RunBatch runs the batch of w once, in a transaction of its own that commits
+// unless Rollback is set. The transaction doesn't end with ctx, so that a batch
+// in flight finishes on a signal.
+func (r *Runner) RunBatch(ctx context.Context, w Window) (int, error) {
+	ctx = context.WithValue(context.WithoutCancel(ctx), idsKey{}, w.IDs)
+	tx := &Tx{pool: r.Pool, rollback: r.Rollback, lockTimeout: r.LockTimeout, statementTimeout: r.StatementTimeout}
+	defer tx.release(ctx)
+
+	processed, err := r.Batch(ctx, tx, w.Start, w.End)
+	if err != nil {
+		return processed, err
+	}
+	if err := tx.end(ctx); err != nil {
+		return 0, err
+	}
+	return processed, nil
+}
+
+// Retry runs batch until it succeeds, fails with an error that isn't retryable,
+// has run attempts times or ctx is canceled, waiting between attempts with an
+// exponential backoff. onRetry, when set, is called before every wait.
+func Retry(ctx context.Context, attempts int, onRetry func(attempt int, backoff time.Duration, err error), batch func() (int, error)) (int, error) {
+	backoff := InitialBackoff
+	for attempt := 1; ; attempt++ {
+		processed, err := batch()
+		if err == nil || !errs.IsRetryable(err) || attempt >= attempts {
+			return processed, err
+		}
+
+		if onRetry != nil {
+			onRetry(attempt, backoff, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return 0, err
+		}
+
+		backoff *= 2
+		if backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
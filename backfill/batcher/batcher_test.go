@@ -0,0 +1,158 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"go-backfill/errs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// failingBatch fails the batch starting at failAt with each of failures in turn,
+// then succeeds. It doesn't use its transaction, so the Runner needs no pool.
+type failingBatch struct {
+	failAt   int
+	failures []error
+
+	mu   sync.Mutex
+	runs map[int]int
+}
+
+func (b *failingBatch) run(ctx context.Context, tx *Tx, startID, endID int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.runs[startID]++
+	if startID == b.failAt && b.runs[startID] <= len(b.failures) {
+		return 0, b.failures[b.runs[startID]-1]
+	}
+	return endID - startID + 1, nil
+}
+
+func TestRunnerFailingBatch(t *testing.T) {
+	previousInitial, previousMax := InitialBackoff, MaxBackoff
+	InitialBackoff, MaxBackoff = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { InitialBackoff, MaxBackoff = previousInitial, previousMax })
+
+	transient := errs.FromDB("failed to update events", &pgconn.PgError{Code: "40001"})
+	deadlock := errs.FromDB("failed to update events", &pgconn.PgError{Code: "40P01"})
+	permanent := errs.FromDB("failed to update events", &pgconn.PgError{Code: "23505"})
+
+	// Windows of 500 ids over 1-2500; the third one is 1001-1500 either way
+	tests := []struct {
+		name       string
+		descending bool
+		failures   []error
+		// wantErr is empty when the run completes
+		wantErr        string
+		wantRetryable  bool
+		wantRuns       int
+		wantCheckpoint Window
+		// wantNotRun is a window handed out after the failing one, never run
+		wantNotRun int
+	}{
+		{
+			name:           "transient failures are retried",
+			failures:       []error{transient, deadlock},
+			wantRuns:       3,
+			wantCheckpoint: Window{Start: 1, End: 2500},
+		},
+		{
+			name:           "transient failures are retried descending",
+			descending:     true,
+			failures:       []error{transient, deadlock},
+			wantRuns:       3,
+			wantCheckpoint: Window{Start: 1, End: 2500},
+		},
+		{
+			name:           "permanent failure aborts",
+			failures:       []error{permanent},
+			wantErr:        "failed to process batch 1001-1500: failed to update events",
+			wantRuns:       1,
+			wantCheckpoint: Window{Start: 1, End: 1000},
+			wantNotRun:     1501,
+		},
+		{
+			name:           "permanent failure aborts descending",
+			descending:     true,
+			failures:       []error{permanent},
+			wantErr:        "failed to process batch 1001-1500: failed to update events",
+			wantRuns:       1,
+			wantCheckpoint: Window{Start: 1501, End: 2500},
+			wantNotRun:     501,
+		},
+		{
+			name:           "transient failures run out of attempts",
+			failures:       []error{transient, transient, transient},
+			wantErr:        "failed to process batch 1001-1500: failed to update events",
+			wantRetryable:  true,
+			wantRuns:       3,
+			wantCheckpoint: Window{Start: 1, End: 1000},
+			wantNotRun:     1501,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch := &failingBatch{failAt: 1001, failures: tt.failures, runs: make(map[int]int)}
+			var (
+				checkpoint Window
+				processed  int
+				retries    int
+			)
+			runner := &Runner{
+				Start:      1,
+				End:        2500,
+				Size:       500,
+				Descending: tt.descending,
+				Batch:      batch.run,
+				Attempts:   3,
+				OnRetry: func(w Window, attempt int, backoff time.Duration, err error) {
+					retries++
+				},
+				Checkpoint: func(done Window) error {
+					checkpoint = done
+					return nil
+				},
+				Throttle: func(ctx context.Context, n int) {
+					processed += n
+				},
+			}
+
+			err := runner.Run(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Run() = %v, want the run to complete", err)
+				}
+				if processed != 2500 {
+					t.Errorf("processed %d ids, want 2500", processed)
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() = %v, want %q", err, tt.wantErr)
+				}
+				var pgErr *pgconn.PgError
+				if !errors.As(err, &pgErr) {
+					t.Errorf("Run() = %v, want the database error of the batch", err)
+				}
+				if errs.IsRetryable(err) != tt.wantRetryable {
+					t.Errorf("IsRetryable(%v) = %v, want %v", err, !tt.wantRetryable, tt.wantRetryable)
+				}
+				if runs := batch.runs[tt.wantNotRun]; runs != 0 {
+					t.Errorf("batch %d ran %d times after the failure, want 0", tt.wantNotRun, runs)
+				}
+			}
+			if runs := batch.runs[1001]; runs != tt.wantRuns {
+				t.Errorf("batch 1001-1500 ran %d times, want %d", runs, tt.wantRuns)
+			}
+			if retries != tt.wantRuns-1 {
+				t.Errorf("OnRetry called %d times, want %d", retries, tt.wantRuns-1)
+			}
+			if checkpoint.Start != tt.wantCheckpoint.Start || checkpoint.End != tt.wantCheckpoint.End {
+				t.Errorf("checkpoint = %s, want %s", checkpoint, tt.wantCheckpoint)
+			}
+		})
+	}
+}
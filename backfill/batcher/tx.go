@@ -0,0 +1,236 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"go-backfill/errs"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Tx is the transaction of a batch. It takes a connection of the Runner's pool
+// with its first statement, so a batch can do other work before, and begins in
+// the round trip of that statement when it is sent with SendBatch. The Runner
+// commits it once the BatchFunc returned, unless the batch queued its end
+// itself with QueueEnd.
+type Tx struct {
+	pool     *pgxpool.Pool
+	conn     *pgxpool.Conn
+	rollback bool
+
+	lockTimeout, statementTimeout string
+	// begun is set once BEGIN was sent, ending once the batch queued its end
+	begun, ending bool
+}
+
+// beginning queues the statements beginning the transaction, returning the
+// message each one's failure is wrapped in. The timeouts are set with
+// set_config's is_local, so they end with the transaction and the pooled
+// connection doesn't keep them.
+func (tx *Tx) beginning(batch *pgx.Batch) []string {
+	batch.Queue(`BEGIN`)
+	failures := []string{"failed to begin transaction"}
+	if tx.lockTimeout != "" {
+		batch.Queue(`SELECT set_config('lock_timeout', $1, true)`, tx.lockTimeout)
+		failures = append(failures, "failed to set lock_timeout")
+	}
+	if tx.statementTimeout != "" {
+		batch.Queue(`SELECT set_config('statement_timeout', $1, true)`, tx.statementTimeout)
+		failures = append(failures, "failed to set statement_timeout")
+	}
+	return failures
+}
+
+func (tx *Tx) acquire(ctx context.Context) error {
+	if tx.conn != nil {
+		return nil
+	}
+	conn, err := tx.pool.Acquire(ctx)
+	if err != nil {
+		return errs.FromDB("failed to acquire connection", err)
+	}
+	tx.conn = conn
+	return nil
+}
+
+// SendBatch sends the statements queued in batch in one round trip. Sent first,
+// it also begins the transaction: the statements doing so are put ahead of
+// those of batch, and their results read before the first of batch.
+func (tx *Tx) SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults {
+	if err := tx.acquire(ctx); err != nil {
+		return &txResults{err: err}
+	}
+	if tx.begun {
+		return tx.conn.SendBatch(ctx, batch)
+	}
+
+	tx.begun = true
+	begin := &pgx.Batch{}
+	failures := tx.beginning(begin)
+	batch.QueuedQueries = append(begin.QueuedQueries, batch.QueuedQueries...)
+	return &txResults{BatchResults: tx.conn.SendBatch(ctx, batch), beginning: failures}
+}
+
+// begin begins the transaction in a round trip of its own, unless it has begun.
+func (tx *Tx) begin(ctx context.Context) error {
+	if tx.begun {
+		return nil
+	}
+	results := tx.SendBatch(ctx, &pgx.Batch{})
+	return results.Close()
+}
+
+// Exec runs the statement sql, in the round trip beginning the transaction when
+// it is the first.
+func (tx *Tx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	batch := &pgx.Batch{}
+	batch.Queue(sql, args...)
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	tag, err := results.Exec()
+	if err != nil {
+		return tag, err
+	}
+	return tag, results.Close()
+}
+
+// Query runs the query sql. The first statement of the transaction begins it in
+// a round trip of its own.
+func (tx *Tx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if err := tx.begin(ctx); err != nil {
+		return nil, err
+	}
+	return tx.conn.Query(ctx, sql, args...)
+}
+
+// QueryRow runs the query sql, returning at most one row. The first statement
+// of the transaction begins it in a round trip of its own.
+func (tx *Tx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	if err := tx.begin(ctx); err != nil {
+		return errRow{err}
+	}
+	return tx.conn.QueryRow(ctx, sql, args...)
+}
+
+// QueueEnd queues the end of the transaction at the end of batch: COMMIT, or
+// ROLLBACK when the Runner rolls its batches back. The batch then ends in the
+// round trip of its last statements, and reads the result of the end like
+// theirs; the Runner checks that the transaction ended.
+func (tx *Tx) QueueEnd(batch *pgx.Batch) {
+	if tx.rollback {
+		batch.Queue(`ROLLBACK`)
+	} else {
+		batch.Queue(`COMMIT`)
+	}
+	tx.ending = true
+}
+
+// end commits the transaction, or rolls it back, unless the batch didn't begin
+// it or queued its end.
+func (tx *Tx) end(ctx context.Context) error {
+	if !tx.begun {
+		return nil
+	}
+	if tx.ending {
+		if tx.conn.Conn().PgConn().TxStatus() != 'I' {
+			return errors.New("failed to commit transaction: the batch didn't read the result of its end")
+		}
+		return nil
+	}
+	if tx.rollback {
+		if _, err := tx.conn.Exec(ctx, `ROLLBACK`); err != nil {
+			return errs.FromDB("failed to roll back transaction", err)
+		}
+		return nil
+	}
+	tag, err := tx.conn.Exec(ctx, `COMMIT`)
+	if err != nil {
+		return errs.FromDB("failed to commit transaction", err)
+	}
+	// A transaction that failed is rolled back by its COMMIT
+	if tag.String() == "ROLLBACK" {
+		return errors.New("failed to commit transaction: it had failed and was rolled back")
+	}
+	return nil
+}
+
+// release gives the connection back to the pool, rolling back the transaction
+// left open by a failed batch.
+func (tx *Tx) release(ctx context.Context) {
+	if tx.conn == nil {
+		return
+	}
+	// A connection left in a transaction is discarded by the pool anyway
+	if tx.conn.Conn().PgConn().TxStatus() != 'I' {
+		tx.conn.Exec(ctx, `ROLLBACK`)
+	}
+	tx.conn.Release()
+}
+
+// txResults are the results of a batch, read after those of the statements
+// beginning the transaction when it began it. With err set, every result fails
+// with it.
+type txResults struct {
+	pgx.BatchResults
+	// beginning are the failure messages of the statements beginning the
+	// transaction whose results are still to read
+	beginning []string
+	err       error
+}
+
+// readBeginning reads the results of the statements beginning the transaction,
+// the first time.
+func (r *txResults) readBeginning() error {
+	for r.err == nil && len(r.beginning) > 0 {
+		failure := r.beginning[0]
+		r.beginning = r.beginning[1:]
+		if _, err := r.BatchResults.Exec(); err != nil {
+			r.err = errs.FromDB(failure, err)
+		}
+	}
+	return r.err
+}
+
+func (r *txResults) Exec() (pgconn.CommandTag, error) {
+	if err := r.readBeginning(); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return r.BatchResults.Exec()
+}
+
+func (r *txResults) Query() (pgx.Rows, error) {
+	if err := r.readBeginning(); err != nil {
+		return nil, err
+	}
+	return r.BatchResults.Query()
+}
+
+func (r *txResults) QueryRow() pgx.Row {
+	if err := r.readBeginning(); err != nil {
+		return errRow{err}
+	}
+	return r.BatchResults.QueryRow()
+}
+
+func (r *txResults) Close() error {
+	err := r.readBeginning()
+	if r.BatchResults == nil {
+		return err
+	}
+	if closeErr := r.BatchResults.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// errRow is a row failing with err.
+type errRow struct {
+	err error
+}
+
+func (r errRow) Scan(...any) error {
+	return r.err
+}
@@ -0,0 +1,167 @@
+// Package chaingraph describes the chain graphs of chainweb: which chains a block
+// braids with through its adjacent parent hashes, and from which height each
+// graph is in effect.
+package chaingraph
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Graph is an undirected chain graph, keyed by chain id.
+type Graph struct {
+	Name      string
+	adjacency map[int][]int
+}
+
+// Petersen is the 10-chain graph chainweb started with.
+var Petersen = newGraph("petersen", map[int][]int{
+	0: {2, 3, 5},
+	1: {3, 4, 6},
+	2: {0, 4, 7},
+	3: {0, 1, 8},
+	4: {1, 2, 9},
+	5: {0, 7, 8},
+	6: {1, 8, 9},
+	7: {2, 5, 9},
+	8: {3, 5, 6},
+	9: {4, 6, 7},
+})
+
+// TwentyChain is the 20-chain graph in effect since the chain count doubled.
+var TwentyChain = newGraph("twenty-chain", map[int][]int{
+	0:  {5, 10, 15},
+	1:  {6, 11, 16},
+	2:  {7, 12, 17},
+	3:  {8, 13, 18},
+	4:  {9, 14, 19},
+	5:  {0, 7, 8},
+	6:  {1, 8, 9},
+	7:  {2, 5, 9},
+	8:  {3, 5, 6},
+	9:  {4, 6, 7},
+	10: {0, 11, 19},
+	11: {1, 10, 12},
+	12: {2, 11, 13},
+	13: {3, 12, 14},
+	14: {4, 13, 15},
+	15: {0, 14, 16},
+	16: {1, 15, 17},
+	17: {2, 16, 18},
+	18: {3, 17, 19},
+	19: {4, 10, 18},
+})
+
+func newGraph(name string, adjacency map[int][]int) Graph {
+	for chain := range adjacency {
+		sort.Ints(adjacency[chain])
+	}
+	return Graph{Name: name, adjacency: adjacency}
+}
+
+// Chains returns the chain ids of the graph in order.
+func (g Graph) Chains() []int {
+	chains := make([]int, 0, len(g.adjacency))
+	for chain := range g.adjacency {
+		chains = append(chains, chain)
+	}
+	sort.Ints(chains)
+	return chains
+}
+
+// HasChain reports whether chain is part of the graph.
+func (g Graph) HasChain(chain int) bool {
+	_, ok := g.adjacency[chain]
+	return ok
+}
+
+// Neighbors returns the chains adjacent to chain, in order.
+func (g Graph) Neighbors(chain int) []int {
+	return g.adjacency[chain]
+}
+
+// IsNeighbor reports whether a and b are adjacent.
+func (g Graph) IsNeighbor(a, b int) bool {
+	for _, neighbor := range g.adjacency[a] {
+		if neighbor == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the graph is undirected and has no self loops.
+func (g Graph) Validate() error {
+	for chain, neighbors := range g.adjacency {
+		for _, neighbor := range neighbors {
+			if neighbor == chain {
+				return fmt.Errorf("%s graph: chain %d is adjacent to itself", g.Name, chain)
+			}
+			if !g.IsNeighbor(neighbor, chain) {
+				return fmt.Errorf("%s graph: chain %d lists %d but not the other way around", g.Name, chain, neighbor)
+			}
+		}
+	}
+	return nil
+}
+
+// Transition puts a graph in effect from a height on.
+type Transition struct {
+	Height int
+	Graph  Graph
+}
+
+// Schedule is the sequence of graphs of a network.
+type Schedule struct {
+	transitions []Transition
+}
+
+func NewSchedule(transitions ...Transition) Schedule {
+	sorted := append([]Transition(nil), transitions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Height < sorted[j].Height })
+	return Schedule{transitions: sorted}
+}
+
+// At returns the graph in effect at height, and false before the first
+// transition.
+func (s Schedule) At(height int) (Graph, bool) {
+	var graph Graph
+	found := false
+	for _, transition := range s.transitions {
+		if transition.Height > height {
+			break
+		}
+		graph = transition.Graph
+		found = true
+	}
+	return graph, found
+}
+
+// IsTransition reports whether a new graph takes effect at height.
+func (s Schedule) IsTransition(height int) bool {
+	for i, transition := range s.transitions {
+		if i > 0 && transition.Height == height {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduleFor returns the graphs of a network with chainCount chains. A 20-chain
+// network that started with 10 chains braids on the Petersen graph below
+// transitionHeight.
+func ScheduleFor(chainCount, transitionHeight int) (Schedule, error) {
+	switch {
+	case chainCount == 10:
+		return NewSchedule(Transition{Height: 0, Graph: Petersen}), nil
+	case chainCount == 20 && transitionHeight > 0:
+		return NewSchedule(
+			Transition{Height: 0, Graph: Petersen},
+			Transition{Height: transitionHeight, Graph: TwentyChain},
+		), nil
+	case chainCount == 20:
+		return NewSchedule(Transition{Height: 0, Graph: TwentyChain}), nil
+	default:
+		return Schedule{}, fmt.Errorf("no chain graph with %d chains", chainCount)
+	}
+}
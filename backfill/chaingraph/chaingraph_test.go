@@ -0,0 +1,165 @@
+package chaingraph
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		graph   Graph
+		wantErr string
+	}{
+		{name: "petersen", graph: Petersen},
+		{name: "twenty-chain", graph: TwentyChain},
+		{name: "self loop", graph: newGraph("loop", map[int][]int{0: {0, 1}, 1: {0}}), wantErr: "chain 0 is adjacent to itself"},
+		{name: "one way", graph: newGraph("one-way", map[int][]int{0: {1}, 1: {}}), wantErr: "chain 0 lists 1 but not the other way around"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.graph.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdjacency(t *testing.T) {
+	tests := []struct {
+		graph     Graph
+		chain     int
+		neighbors []int
+	}{
+		{graph: Petersen, chain: 0, neighbors: []int{2, 3, 5}},
+		{graph: Petersen, chain: 4, neighbors: []int{1, 2, 9}},
+		{graph: Petersen, chain: 9, neighbors: []int{4, 6, 7}},
+		{graph: TwentyChain, chain: 0, neighbors: []int{5, 10, 15}},
+		{graph: TwentyChain, chain: 7, neighbors: []int{2, 5, 9}},
+		{graph: TwentyChain, chain: 10, neighbors: []int{0, 11, 19}},
+		{graph: TwentyChain, chain: 19, neighbors: []int{4, 10, 18}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.graph.Name, tt.chain), func(t *testing.T) {
+			if got := tt.graph.Neighbors(tt.chain); fmt.Sprint(got) != fmt.Sprint(tt.neighbors) {
+				t.Errorf("Neighbors(%d) = %v, want %v", tt.chain, got, tt.neighbors)
+			}
+			for _, neighbor := range tt.neighbors {
+				if !tt.graph.IsNeighbor(neighbor, tt.chain) {
+					t.Errorf("IsNeighbor(%d, %d) = false, want true", neighbor, tt.chain)
+				}
+			}
+		})
+	}
+
+	if Petersen.IsNeighbor(0, 1) {
+		t.Error("petersen IsNeighbor(0, 1) = true, want false")
+	}
+	if got := len(Petersen.Chains()); got != 10 {
+		t.Errorf("petersen has %d chains, want 10", got)
+	}
+	if got := len(TwentyChain.Chains()); got != 20 {
+		t.Errorf("twenty-chain has %d chains, want 20", got)
+	}
+	if Petersen.HasChain(10) || !TwentyChain.HasChain(19) {
+		t.Error("HasChain() disagrees with the chain count of the graphs")
+	}
+}
+
+func TestScheduleFor(t *testing.T) {
+	tests := []struct {
+		name             string
+		chainCount       int
+		transitionHeight int
+		wantErr          bool
+		// want is the graph in effect at each height
+		want map[int]string
+	}{
+		{name: "10 chains", chainCount: 10, want: map[int]string{0: "petersen", 852054: "petersen"}},
+		{
+			name:             "20 chains with a transition",
+			chainCount:       20,
+			transitionHeight: 852054,
+			want:             map[int]string{0: "petersen", 852053: "petersen", 852054: "twenty-chain", 852055: "twenty-chain"},
+		},
+		{name: "20 chains without a transition", chainCount: 20, want: map[int]string{0: "twenty-chain", 852054: "twenty-chain"}},
+		{name: "unsupported chain count", chainCount: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ScheduleFor(tt.chainCount, tt.transitionHeight)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ScheduleFor(%d, %d) = nil error, want one", tt.chainCount, tt.transitionHeight)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ScheduleFor(%d, %d) = %v", tt.chainCount, tt.transitionHeight, err)
+			}
+			for height, want := range tt.want {
+				graph, ok := schedule.At(height)
+				if !ok || graph.Name != want {
+					t.Errorf("At(%d) = %s, %v, want %s", height, graph.Name, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	schedule := NewSchedule(
+		Transition{Height: 200, Graph: TwentyChain},
+		Transition{Height: 100, Graph: Petersen},
+	)
+	tests := []struct {
+		name   string
+		height int
+		want   string
+		wantOk bool
+	}{
+		{name: "before the first graph", height: 99},
+		{name: "at the first graph", height: 100, want: "petersen", wantOk: true},
+		{name: "before the transition", height: 199, want: "petersen", wantOk: true},
+		{name: "at the transition", height: 200, want: "twenty-chain", wantOk: true},
+		{name: "after the transition", height: 201, want: "twenty-chain", wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			graph, ok := schedule.At(tt.height)
+			if ok != tt.wantOk || graph.Name != tt.want {
+				t.Errorf("At(%d) = %q, %v, want %q, %v", tt.height, graph.Name, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestIsTransition(t *testing.T) {
+	schedule, err := ScheduleFor(20, 852054)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first graph takes effect at genesis, which isn't a transition
+	tests := map[int]bool{0: false, 852053: false, 852054: true, 852055: false}
+	for height, want := range tests {
+		if got := schedule.IsTransition(height); got != want {
+			t.Errorf("IsTransition(%d) = %v, want %v", height, got, want)
+		}
+	}
+
+	single, err := ScheduleFor(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.IsTransition(0) {
+		t.Error("IsTransition(0) = true on a single-graph schedule, want false")
+	}
+}
@@ -4,15 +4,113 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// applyDatabaseUrl sets the connection settings from a postgres:// URL. An
+// sslmode in the URL overrides DB_SSL_MODE.
+func (c *Config) applyDatabaseUrl(databaseUrl string) error {
+	parsed, err := url.Parse(databaseUrl)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "postgres" && parsed.Scheme != "postgresql" {
+		return fmt.Errorf("scheme must be postgres or postgresql, got %q", parsed.Scheme)
+	}
+
+	c.DbHost = parsed.Hostname()
+	c.DbPort = parsed.Port()
+	if c.DbPort == "" {
+		c.DbPort = "5432"
+	}
+	c.DbUser = parsed.User.Username()
+	c.DbPassword, _ = parsed.User.Password()
+	c.DbName = strings.TrimPrefix(parsed.Path, "/")
+	if c.DbHost == "" || c.DbName == "" {
+		return fmt.Errorf("host and database name are required")
+	}
+
+	query := parsed.Query()
+	if sslMode := query.Get("sslmode"); sslMode != "" {
+		c.DbSslMode = sslMode
+	}
+	if rootCert := query.Get("sslrootcert"); rootCert != "" {
+		c.DbSslRootCert = rootCert
+	}
+	return nil
+}
+
+// quoteDSNValue quotes a value of a key/value connection string.
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// DSN is the key/value connection string of the configured database, understood
+// by both lib/pq and pgx. The migrator requires TLS unless DB_SSL_MODE says
+// otherwise.
+func (c *Config) DSN() string {
+	return c.dsn("require")
+}
+
+// dsn is the connection string with defaultSslMode when DB_SSL_MODE is unset.
+func (c *Config) dsn(defaultSslMode string) string {
+	sslMode := c.DbSslMode
+	if sslMode == "" {
+		sslMode = defaultSslMode
+	}
+	settings := [][2]string{
+		{"host", c.DbHost},
+		{"port", c.DbPort},
+		{"user", c.DbUser},
+		{"password", c.DbPassword},
+		{"dbname", c.DbName},
+		{"sslmode", sslMode},
+		{"sslrootcert", c.DbSslRootCert},
+		{"sslcert", c.DbSslCert},
+		{"sslkey", c.DbSslKey},
+	}
+
+	parts := make([]string, 0, len(settings))
+	for _, setting := range settings {
+		if setting[1] == "" {
+			continue
+		}
+		parts = append(parts, setting[0]+"="+quoteDSNValue(setting[1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// HasReplica reports whether a read replica is configured.
+func (c *Config) HasReplica() bool {
+	return c.DbReplicaHost != ""
+}
+
+// ReplicaDSN is the connection string of the read replica: the primary's with
+// DB_REPLICA_HOST and DB_REPLICA_PORT, each falling back to the primary's when
+// unset.
+func (c *Config) ReplicaDSN() string {
+	replica := *c
+	if c.DbReplicaHost != "" {
+		replica.DbHost = c.DbReplicaHost
+	}
+	if c.DbReplicaPort != "" {
+		replica.DbPort = c.DbReplicaPort
+	}
+	return replica.DSN()
+}
+
+// InitDatabase opens the pool of the backfill. It connects without TLS unless
+// DB_SSL_MODE says otherwise, as it always has, so deployments without TLS keep
+// working.
 func InitDatabase() *pgxpool.Pool {
 	env := GetConfig()
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		env.DbHost, env.DbPort, env.DbUser, env.DbPassword, env.DbName)
+	connStr := env.dsn("disable")
 
 	config, err := pgxpool.ParseConfig(connStr)
 	if err != nil {
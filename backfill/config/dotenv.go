@@ -0,0 +1,195 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+type envEntry struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// loadEnvFile reads a .env file and sets every key that is not already present in
+// the process environment, the same precedence godotenv.Load uses. Malformed lines
+// are reported with their file and line number. Duplicate keys are a warning (the
+// last occurrence wins) unless strict is set, in which case they are an error.
+func loadEnvFile(path string, strict bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := parseEnvFile(path, content)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]envEntry)
+	var order []string
+	for _, entry := range entries {
+		if previous, ok := values[entry.Key]; ok {
+			if strict {
+				return fmt.Errorf("%s:%d: duplicate key %s (first defined on line %d)", path, entry.Line, entry.Key, previous.Line)
+			}
+			log.Printf("WARNING: %s:%d: duplicate key %s overrides the value from line %d", path, entry.Line, entry.Key, previous.Line)
+		} else {
+			order = append(order, entry.Key)
+		}
+		values[entry.Key] = entry
+	}
+
+	for _, key := range order {
+		if _, exists := os.LookupEnv(key); exists {
+			continue
+		}
+		if err := os.Setenv(key, values[key].Value); err != nil {
+			return fmt.Errorf("%s:%d: failed to set %s: %v", path, values[key].Line, key, err)
+		}
+	}
+
+	return nil
+}
+
+func parseEnvFile(path string, content []byte) ([]envEntry, error) {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+
+	var entries []envEntry
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(strings.TrimSuffix(scanner.Text(), "\r"))
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, err := parseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		entry.Line = lineNumber
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: failed to read env file: %v", path, err)
+	}
+
+	return entries, nil
+}
+
+func parseEnvLine(line string) (envEntry, error) {
+	if rest, ok := strings.CutPrefix(line, "export"); ok && len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t') {
+		line = strings.TrimSpace(rest)
+	}
+
+	key, rawValue, found := strings.Cut(line, "=")
+	if !found {
+		return envEntry{}, fmt.Errorf("malformed line, expected KEY=VALUE")
+	}
+
+	key = strings.TrimSpace(key)
+	if !isValidEnvKey(key) {
+		return envEntry{}, fmt.Errorf("invalid key %q", key)
+	}
+
+	// A comment after the equals sign and whitespace leaves the value empty
+	trimmed := strings.TrimSpace(rawValue)
+	if strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(rawValue, "#") {
+		trimmed = ""
+	}
+
+	value, err := parseEnvValue(trimmed)
+	if err != nil {
+		return envEntry{}, fmt.Errorf("invalid value for %s: %v", key, err)
+	}
+
+	return envEntry{Key: key, Value: value}, nil
+}
+
+func isValidEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		isLetter := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || c == '_'
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(i > 0 && (isDigit || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseEnvValue(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+
+	switch raw[0] {
+	case '"':
+		return parseQuotedEnvValue(raw, true)
+	case '\'':
+		return parseQuotedEnvValue(raw, false)
+	}
+
+	// Unquoted values end at an inline comment, which must be preceded by whitespace
+	for i := 1; i < len(raw); i++ {
+		if raw[i] == '#' && (raw[i-1] == ' ' || raw[i-1] == '\t') {
+			return strings.TrimSpace(raw[:i]), nil
+		}
+	}
+	return raw, nil
+}
+
+// parseQuotedEnvValue handles 'single' (literal) and "double" (escaped) quoted
+// values, which may be followed only by whitespace and an optional comment.
+func parseQuotedEnvValue(raw string, escapes bool) (string, error) {
+	quote := raw[0]
+
+	var sb strings.Builder
+	i := 1
+	for ; i < len(raw); i++ {
+		c := raw[i]
+		if c == quote {
+			break
+		}
+		if escapes && c == '\\' && i+1 < len(raw) {
+			i++
+			switch raw[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case '"', '\\', '$', '\'':
+				sb.WriteByte(raw[i])
+			default:
+				sb.WriteByte('\\')
+				sb.WriteByte(raw[i])
+			}
+			continue
+		}
+		sb.WriteByte(c)
+	}
+
+	if i >= len(raw) {
+		return "", fmt.Errorf("unterminated %c quote", quote)
+	}
+
+	trailing := strings.TrimSpace(raw[i+1:])
+	if trailing != "" && !strings.HasPrefix(trailing, "#") {
+		return "", fmt.Errorf("unexpected characters after closing quote: %q", trailing)
+	}
+
+	return sb.String(), nil
+}
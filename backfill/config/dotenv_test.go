@@ -0,0 +1,252 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []envEntry
+	}{
+		{
+			name:    "whitespace around keys and values",
+			content: "DB_HOST = prod-db\n  DB_PORT=5432  \n",
+			want:    []envEntry{{Key: "DB_HOST", Value: "prod-db", Line: 1}, {Key: "DB_PORT", Value: "5432", Line: 2}},
+		},
+		{
+			name:    "CRLF line endings",
+			content: "DB_HOST=db\r\nDB_NAME=\"indexer\"\r\n",
+			want:    []envEntry{{Key: "DB_HOST", Value: "db", Line: 1}, {Key: "DB_NAME", Value: "indexer", Line: 2}},
+		},
+		{
+			name:    "byte order mark",
+			content: "\xef\xbb\xbfDB_HOST=db\n",
+			want:    []envEntry{{Key: "DB_HOST", Value: "db", Line: 1}},
+		},
+		{
+			name:    "export prefix",
+			content: "export DB_HOST=db\nexport\tDB_PORT=5432\nexporter=yes\n",
+			want: []envEntry{
+				{Key: "DB_HOST", Value: "db", Line: 1},
+				{Key: "DB_PORT", Value: "5432", Line: 2},
+				{Key: "exporter", Value: "yes", Line: 3},
+			},
+		},
+		{
+			name:    "blank lines and comments keep line numbers",
+			content: "# settings\n\n   \nDB_HOST=db\n  # indented comment\nDB_PORT=5432\n",
+			want:    []envEntry{{Key: "DB_HOST", Value: "db", Line: 4}, {Key: "DB_PORT", Value: "5432", Line: 6}},
+		},
+		{
+			name:    "empty values",
+			content: "DB_PASSWORD=\nDB_SSL_MODE=\"\"\nDB_SSL_CERT=''\nDB_SSL_KEY= # none\nCOLOR=#fff \n",
+			want: []envEntry{
+				{Key: "DB_PASSWORD", Value: "", Line: 1},
+				{Key: "DB_SSL_MODE", Value: "", Line: 2},
+				{Key: "DB_SSL_CERT", Value: "", Line: 3},
+				{Key: "DB_SSL_KEY", Value: "", Line: 4},
+				{Key: "COLOR", Value: "#fff", Line: 5},
+			},
+		},
+		{
+			name:    "duplicate keys are all returned",
+			content: "DB_NAME=first\nDB_NAME=second\n",
+			want:    []envEntry{{Key: "DB_NAME", Value: "first", Line: 1}, {Key: "DB_NAME", Value: "second", Line: 2}},
+		},
+		{
+			name:    "empty file",
+			content: "",
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEnvFile(".env", []byte(tt.content))
+			if err != nil {
+				t.Fatalf("parseEnvFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEnvFile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "missing equals",
+			content: "DB_HOST=db\nDB_PORT\n",
+			wantErr: ".env:2: malformed line, expected KEY=VALUE",
+		},
+		{
+			name:    "invalid key",
+			content: "\n1DB=x\n",
+			wantErr: `.env:2: invalid key "1DB"`,
+		},
+		{
+			name:    "empty key",
+			content: "=x\n",
+			wantErr: `.env:1: invalid key ""`,
+		},
+		{
+			name:    "unterminated double quote",
+			content: "DB_HOST=db\r\n\r\nDB_PASSWORD=\"secret\r\n",
+			wantErr: `.env:3: invalid value for DB_PASSWORD: unterminated " quote`,
+		},
+		{
+			name:    "unterminated single quote",
+			content: "DB_PASSWORD='secret\n",
+			wantErr: `.env:1: invalid value for DB_PASSWORD: unterminated ' quote`,
+		},
+		{
+			name:    "characters after closing quote",
+			content: "DB_PASSWORD=\"secret\" trailing\n",
+			wantErr: `.env:1: invalid value for DB_PASSWORD: unexpected characters after closing quote: "trailing"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseEnvFile(".env", []byte(tt.content))
+			if err == nil {
+				t.Fatalf("parseEnvFile() error = nil, want %s", tt.wantErr)
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("parseEnvFile() error = %s, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseEnvValue(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "unquoted", raw: "prod-db", want: "prod-db"},
+		{name: "unquoted with inline comment", raw: "prod-db   # the primary", want: "prod-db"},
+		{name: "hash without whitespace is kept", raw: "pass#word", want: "pass#word"},
+		{name: "leading hash is kept", raw: "#fff", want: "#fff"},
+		{name: "single quotes are literal", raw: `'a\nb $HOME "x"'`, want: `a\nb $HOME "x"`},
+		{name: "single quotes with comment", raw: `'a # b' # comment`, want: "a # b"},
+		{name: "double quotes keep spaces and hashes", raw: `"  a # b  "`, want: "  a # b  "},
+		{name: "double quote escapes", raw: `"a\nb\rc\td\"e\\f\$g\'h"`, want: "a\nb\rc\td\"e\\f$g'h"},
+		{name: "unknown escape keeps its backslash", raw: `"C:\path\u00e9"`, want: `C:\path\u00e9`},
+		{name: "double quotes with comment", raw: `"value" # comment`, want: "value"},
+		{name: "equals in value", raw: "a=b=c", want: "a=b=c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEnvValue(tt.raw)
+			if err != nil {
+				t.Fatalf("parseEnvValue(%s) error = %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseEnvValue(%s) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	// Keys the tests set, cleared and restored around each case by t.Setenv
+	keys := []string{"DOTENV_TEST_HOST", "DOTENV_TEST_NAME", "DOTENV_TEST_EMPTY"}
+
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		strict  bool
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "sets keys from the file",
+			content: "DOTENV_TEST_HOST = db\r\nexport DOTENV_TEST_NAME=\"indexer\"\r\nDOTENV_TEST_EMPTY=\r\n",
+			want:    map[string]string{"DOTENV_TEST_HOST": "db", "DOTENV_TEST_NAME": "indexer", "DOTENV_TEST_EMPTY": ""},
+		},
+		{
+			name:    "duplicate key last one wins",
+			content: "DOTENV_TEST_NAME=first\nDOTENV_TEST_HOST=db\nDOTENV_TEST_NAME=second\n",
+			want:    map[string]string{"DOTENV_TEST_HOST": "db", "DOTENV_TEST_NAME": "second"},
+		},
+		{
+			name:    "duplicate key is an error when strict",
+			content: "DOTENV_TEST_NAME=first\nDOTENV_TEST_HOST=db\nDOTENV_TEST_NAME=second\n",
+			strict:  true,
+			wantErr: "duplicate key DOTENV_TEST_NAME (first defined on line 1)",
+		},
+		{
+			name:    "environment is not overridden",
+			content: "DOTENV_TEST_HOST=file-db\nDOTENV_TEST_NAME=indexer\n",
+			env:     map[string]string{"DOTENV_TEST_HOST": "env-db"},
+			want:    map[string]string{"DOTENV_TEST_HOST": "env-db", "DOTENV_TEST_NAME": "indexer"},
+		},
+		{
+			name:    "empty environment value is not overridden",
+			content: "DOTENV_TEST_EMPTY=from-file\n",
+			env:     map[string]string{"DOTENV_TEST_EMPTY": ""},
+			want:    map[string]string{"DOTENV_TEST_EMPTY": ""},
+		},
+		{
+			name:    "malformed line",
+			content: "DOTENV_TEST_HOST=db\nnot a setting\n",
+			wantErr: ":2: malformed line, expected KEY=VALUE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range keys {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			path := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := loadEnvFile(path, tt.strict)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadEnvFile() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadEnvFile() error = %v", err)
+			}
+
+			got := map[string]string{}
+			for _, key := range keys {
+				if value, ok := os.LookupEnv(key); ok {
+					got[key] = value
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("environment = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnvFileMissing(t *testing.T) {
+	err := loadEnvFile(filepath.Join(t.TempDir(), ".env"), false)
+	if !os.IsNotExist(err) {
+		t.Errorf("loadEnvFile() error = %v, want a not-exist error", err)
+	}
+}
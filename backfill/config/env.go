@@ -1,11 +1,13 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"strconv"
-
-	"github.com/joho/godotenv"
+	"strings"
 )
 
 type Config struct {
@@ -14,6 +16,10 @@ type Config struct {
 	DbName                    string
 	DbHost                    string
 	DbPort                    string
+	DbSslMode                 string
+	DbSslRootCert             string
+	DbSslCert                 string
+	DbSslKey                  string
 	CertPath                  string
 	Network                   string
 	ChainId                   int
@@ -24,36 +30,175 @@ type Config struct {
 	SyncAttemptsIntervalInMs  int
 	IsDevelopment             bool
 	IsSingleChain             bool
+	StatusToken               string
+	JsonMaxDepth              int
+	JsonMaxStringLength       int
+	JsonMaxBytes              int
+	ProductionHostPattern     string
+	SnapshotMaskColumns       string
+	LogFormat                 string
+	BatchLockTimeout          string
+	BatchStatementTimeout     string
+	LogLevel                  string
+	DbReplicaHost             string
+	DbReplicaPort             string
+	NodeRequestTimeout        string
+	NotifyWebhookUrl          string
+	NetworkInfo               NetworkInfo
 }
 
 var config *Config
 
-func InitEnv(envFilePath string) {
+// InvalidConfigError lists every setting that is missing or invalid.
+type InvalidConfigError struct {
+	Problems []string
+}
+
+func (e *InvalidConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// InitEnv reads and validates the configuration. It fails with an
+// *InvalidConfigError listing the problems of the settings, or with the error of
+// an env file that exists but can't be read.
+func InitEnv(envFilePath string) error {
+	return initEnv(envFilePath, false)
+}
+
+// InitEnvStrict behaves like InitEnv but fails on duplicate keys in the env file
+// instead of warning about them.
+func InitEnvStrict(envFilePath string) error {
+	return initEnv(envFilePath, true)
+}
+
+func initEnv(envFilePath string, strict bool) error {
+	loaded, problems, err := readConfig(envFilePath, strict)
+	if err != nil {
+		return fmt.Errorf("failed to load env file: %w", err)
+	}
+	if len(problems) > 0 {
+		return &InvalidConfigError{Problems: problems}
+	}
+	config = loaded
+	return nil
+}
+
+// readConfig reads the configuration from the env file at envFilePath and the
+// process environment, whose variables take precedence. It returns every
+// setting that is missing or invalid, and an error only when the env file
+// exists but can't be read.
+func readConfig(envFilePath string, strict bool) (*Config, []string, error) {
 	IsDevelopment := true
-	if err := godotenv.Load(envFilePath); err != nil {
+	envFileMissing := false
+	if err := loadEnvFile(envFilePath, strict); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+		// Settings can all come from the process environment, as in a container
 		IsDevelopment = false
+		envFileMissing = true
 		log.Printf("No .env file found at %s, falling back to system environment variables", envFilePath)
 	}
 
-	config = &Config{
-		DbUser:                    getEnv("DB_USERNAME"),
-		DbPassword:                getEnv("DB_PASSWORD"),
-		DbName:                    getEnv("DB_NAME"),
-		DbHost:                    getEnv("DB_HOST"),
-		DbPort:                    getEnv("DB_PORT"),
-		CertPath:                  getEnv("CERT_PATH"),
-		Network:                   getEnv("NETWORK"),
-		ChainId:                   getEnvAsInt("CHAIN_ID"),
-		SyncBaseUrl:               getEnv("SYNC_BASE_URL"),
-		SyncMinHeight:             getEnvAsInt("SYNC_MIN_HEIGHT"),
-		SyncFetchIntervalInBlocks: getEnvAsInt("SYNC_FETCH_INTERVAL_IN_BLOCKS"),
-		SyncAttemptsMaxRetry:      getEnvAsInt("SYNC_ATTEMPTS_MAX_RETRY"),
-		SyncAttemptsIntervalInMs:  getEnvAsInt("SYNC_ATTEMPTS_INTERVAL_IN_MS"),
-		IsSingleChain:             getEnvAsBool("IS_SINGLE_CHAIN_RUN"),
+	env := &envLoader{}
+	cfg := &Config{
+		DbSslMode:                 getEnvOrDefault("DB_SSL_MODE", ""),
+		DbSslRootCert:             getEnvOrDefault("DB_SSL_ROOT_CERT", ""),
+		DbSslCert:                 getEnvOrDefault("DB_SSL_CERT", ""),
+		DbSslKey:                  getEnvOrDefault("DB_SSL_KEY", ""),
+		CertPath:                  env.get("CERT_PATH"),
+		Network:                   env.get("NETWORK"),
+		ChainId:                   env.getInt("CHAIN_ID"),
+		SyncBaseUrl:               env.get("SYNC_BASE_URL"),
+		SyncMinHeight:             env.getInt("SYNC_MIN_HEIGHT"),
+		SyncFetchIntervalInBlocks: env.getInt("SYNC_FETCH_INTERVAL_IN_BLOCKS"),
+		SyncAttemptsMaxRetry:      env.getInt("SYNC_ATTEMPTS_MAX_RETRY"),
+		SyncAttemptsIntervalInMs:  env.getInt("SYNC_ATTEMPTS_INTERVAL_IN_MS"),
+		IsSingleChain:             env.getBool("IS_SINGLE_CHAIN_RUN"),
 		IsDevelopment:             IsDevelopment,
+		StatusToken:               getEnvOrDefault("STATUS_TOKEN", ""),
+		JsonMaxDepth:              env.getIntOrDefault("JSON_MAX_DEPTH", 128),
+		JsonMaxStringLength:       env.getIntOrDefault("JSON_MAX_STRING_LENGTH", 1<<20),
+		JsonMaxBytes:              env.getIntOrDefault("JSON_MAX_BYTES", 16<<20),
+		ProductionHostPattern:     getEnvOrDefault("PRODUCTION_HOST_PATTERN", ""),
+		SnapshotMaskColumns:       getEnvOrDefault("SNAPSHOT_MASK_COLUMNS", ""),
+		LogFormat:                 getEnvOrDefault("LOG_FORMAT", "text"),
+		BatchLockTimeout:          getEnvOrDefault("BATCH_LOCK_TIMEOUT", "5s"),
+		BatchStatementTimeout:     getEnvOrDefault("BATCH_STATEMENT_TIMEOUT", "60s"),
+		LogLevel:                  getEnvOrDefault("LOG_LEVEL", "info"),
+		DbReplicaHost:             getEnvOrDefault("DB_REPLICA_HOST", ""),
+		DbReplicaPort:             getEnvOrDefault("DB_REPLICA_PORT", ""),
+		NodeRequestTimeout:        getEnvOrDefault("NODE_REQUEST_TIMEOUT", "30s"),
+		NotifyWebhookUrl:          getEnvOrDefault("NOTIFY_WEBHOOK_URL", ""),
+	}
+
+	// DATABASE_URL, as the indexer uses it, takes precedence over the DB_* variables
+	if databaseUrl := getEnvOrDefault("DATABASE_URL", ""); databaseUrl != "" {
+		if err := cfg.applyDatabaseUrl(databaseUrl); err != nil {
+			env.problem("DATABASE_URL is invalid: %v", err)
+		}
+	} else {
+		cfg.DbUser = env.get("DB_USERNAME")
+		cfg.DbPassword = env.get("DB_PASSWORD")
+		cfg.DbName = env.get("DB_NAME")
+		cfg.DbHost = env.get("DB_HOST")
+		cfg.DbPort = getEnvOrDefault("DB_PORT", "")
 	}
+	if cfg.DbPort == "" {
+		cfg.DbPort = "5432"
+	}
+
+	if cfg.Network != "" {
+		networkInfo, err := GetNetwork(cfg.Network)
+		if err != nil {
+			env.problem("invalid network configuration: %v", err)
+		}
+		cfg.NetworkInfo = networkInfo
+	}
+
+	problems := append(env.problems, cfg.validate()...)
+	if len(problems) > 0 && envFileMissing {
+		problems = append(problems, fmt.Sprintf("no env file was found at %s, so every required variable must be set in the environment", envFilePath))
+	}
+	return cfg, problems, nil
 }
 
+// validate returns the problems of the settings that were read but can't be
+// used, such as a port that isn't a number.
+func (c *Config) validate() []string {
+	var problems []string
+	if !validPort(c.DbPort) {
+		problems = append(problems, fmt.Sprintf("DB_PORT must be a port number between 1 and 65535, but got: %s", c.DbPort))
+	}
+	if c.DbReplicaPort != "" && !validPort(c.DbReplicaPort) {
+		problems = append(problems, fmt.Sprintf("DB_REPLICA_PORT must be a port number between 1 and 65535, but got: %s", c.DbReplicaPort))
+	}
+	switch c.DbSslMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		problems = append(problems, fmt.Sprintf("DB_SSL_MODE must be one of disable, allow, prefer, require, verify-ca, verify-full, but got: %s", c.DbSslMode))
+	}
+	return problems
+}
+
+func validPort(port string) bool {
+	value, err := strconv.Atoi(port)
+	return err == nil && value >= 1 && value <= 65535
+}
+
+// Redacted returns a copy of the configuration with its secrets masked, for
+// printing.
+func (c *Config) Redacted() Config {
+	redacted := *c
+	for _, secret := range []*string{&redacted.DbPassword, &redacted.StatusToken, &redacted.NotifyWebhookUrl} {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+	return redacted
+}
+
+// GetConfig returns the configuration InitEnv read and validated.
 func GetConfig() *Config {
 	if config == nil {
 		log.Fatal("Config not initialized. Call InitEnv first.")
@@ -61,83 +206,64 @@ func GetConfig() *Config {
 	return config
 }
 
-func getEnv(key string) string {
+// envLoader reads the settings of the environment, collecting every missing or
+// invalid one so they are all reported at once.
+type envLoader struct {
+	problems []string
+}
+
+func (l *envLoader) problem(format string, args ...any) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+func (l *envLoader) get(key string) string {
 	value := os.Getenv(key)
 	if value == "" {
-		log.Fatalf("Environment variable %s is required but not set", key)
+		l.problem("environment variable %s is required but not set", key)
 	}
 	return value
 }
 
-func getEnvAsInt(key string) int {
-	valueStr := getEnv(key)
+func getEnvOrDefault(key string, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return defaultValue
+}
+
+func (l *envLoader) getInt(key string) int {
+	valueStr := l.get(key)
+	if valueStr == "" {
+		return 0
+	}
 	value, err := strconv.Atoi(valueStr)
 	if err != nil {
-		log.Fatalf("Environment variable %s must be an integer, but got: %s", key, valueStr)
+		l.problem("environment variable %s must be an integer, but got: %s", key, valueStr)
 	}
 	return value
 }
 
-func getEnvAsBool(key string) bool {
-	valueStr := getEnv(key)
-	value, err := strconv.ParseBool(valueStr)
+func (l *envLoader) getIntOrDefault(key string, defaultValue int) int {
+	valueStr, ok := os.LookupEnv(key)
+	if !ok || valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(valueStr)
 	if err != nil {
-		log.Fatalf("Environment variable %s must be a boolean, but got: %s", key, valueStr)
+		l.problem("environment variable %s must be an integer, but got: %s", key, valueStr)
+		return defaultValue
 	}
 	return value
 }
 
-func GetMinHeights(network string) map[int]int {
-	minHeights := make(map[int]int)
-	if network == "mainnet01" {
-		minHeights = map[int]int{
-			0:  0,
-			1:  0,
-			2:  0,
-			3:  0,
-			4:  0,
-			5:  0,
-			6:  0,
-			7:  0,
-			8:  0,
-			9:  0,
-			10: 852054,
-			11: 852054,
-			12: 852054,
-			13: 852054,
-			14: 852054,
-			15: 852054,
-			16: 852054,
-			17: 852054,
-			18: 852054,
-			19: 852054,
-		}
+func (l *envLoader) getBool(key string) bool {
+	valueStr := l.get(key)
+	if valueStr == "" {
+		return false
 	}
-
-	if network == "testnet04" {
-		minHeights = map[int]int{
-			0:  0,
-			1:  0,
-			2:  0,
-			3:  0,
-			4:  0,
-			5:  0,
-			6:  0,
-			7:  0,
-			8:  0,
-			9:  0,
-			10: 332604,
-			11: 332604,
-			12: 332604,
-			13: 332604,
-			14: 332604,
-			15: 332604,
-			16: 332604,
-			17: 332604,
-			18: 332604,
-			19: 332604,
-		}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		l.problem("environment variable %s must be a boolean, but got: %s", key, valueStr)
 	}
-
-	return minHeights
+	return value
 }
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NetworkInfo describes the chains of a network: how many there are, the height
+// each one starts at and the height the 20-chain graph took effect at.
+type NetworkInfo struct {
+	Name             string
+	ChainCount       int
+	GenesisHeights   map[int]int
+	TransitionHeight int
+}
+
+// GenesisHeight returns the first height of chain.
+func (n NetworkInfo) GenesisHeight(chain int) int {
+	return n.GenesisHeights[chain]
+}
+
+// HasChain reports whether chain is one of the chains of the network.
+func (n NetworkInfo) HasChain(chain int) bool {
+	return chain >= 0 && chain < n.ChainCount
+}
+
+// networks are the known networks. Devnets are described through
+// NETWORK_CHAIN_COUNT, NETWORK_GENESIS_HEIGHTS and NETWORK_TRANSITION_HEIGHT.
+var networks = map[string]NetworkInfo{
+	"mainnet01": twentyChainNetwork("mainnet01", 852054),
+	"testnet04": twentyChainNetwork("testnet04", 332604),
+}
+
+// twentyChainNetwork has chains 0-9 from genesis and chains 10-19 from the
+// transition height on.
+func twentyChainNetwork(name string, transitionHeight int) NetworkInfo {
+	genesisHeights := make(map[int]int, 20)
+	for chain := 0; chain < 20; chain++ {
+		if chain >= 10 {
+			genesisHeights[chain] = transitionHeight
+		} else {
+			genesisHeights[chain] = 0
+		}
+	}
+	return NetworkInfo{
+		Name:             name,
+		ChainCount:       20,
+		GenesisHeights:   genesisHeights,
+		TransitionHeight: transitionHeight,
+	}
+}
+
+// GetNetwork returns the description of network with the NETWORK_* overrides
+// applied. It fails for an unknown network unless NETWORK_CHAIN_COUNT describes
+// it.
+func GetNetwork(network string) (NetworkInfo, error) {
+	info, known := networks[network]
+	info.Name = network
+
+	chainCount, hasChainCount, err := lookupEnvInt("NETWORK_CHAIN_COUNT")
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	if !known && !hasChainCount {
+		return NetworkInfo{}, fmt.Errorf("unknown network %q: set NETWORK_CHAIN_COUNT, and NETWORK_GENESIS_HEIGHTS or NETWORK_TRANSITION_HEIGHT if needed, to describe it", network)
+	}
+
+	transitionHeight, hasTransition, err := lookupEnvInt("NETWORK_TRANSITION_HEIGHT")
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	if hasTransition {
+		info.TransitionHeight = transitionHeight
+	}
+
+	if hasChainCount || hasTransition {
+		if hasChainCount {
+			info.ChainCount = chainCount
+		}
+		if info.ChainCount == 20 {
+			info.GenesisHeights = twentyChainNetwork(network, info.TransitionHeight).GenesisHeights
+		} else {
+			info.GenesisHeights = make(map[int]int, info.ChainCount)
+			for chain := 0; chain < info.ChainCount; chain++ {
+				info.GenesisHeights[chain] = 0
+			}
+		}
+	}
+
+	if value := os.Getenv("NETWORK_GENESIS_HEIGHTS"); value != "" {
+		overrides, err := ParseGenesisHeights(value)
+		if err != nil {
+			return NetworkInfo{}, fmt.Errorf("invalid NETWORK_GENESIS_HEIGHTS: %v", err)
+		}
+		heights := make(map[int]int, len(info.GenesisHeights))
+		for chain, height := range info.GenesisHeights {
+			heights[chain] = height
+		}
+		for chain, height := range overrides {
+			heights[chain] = height
+		}
+		info.GenesisHeights = heights
+	}
+
+	if info.ChainCount <= 0 {
+		return NetworkInfo{}, fmt.Errorf("network %q has %d chains", network, info.ChainCount)
+	}
+	for chain := range info.GenesisHeights {
+		if !info.HasChain(chain) {
+			return NetworkInfo{}, fmt.Errorf("network %q has %d chains but a genesis height for chain %d", network, info.ChainCount, chain)
+		}
+	}
+	return info, nil
+}
+
+// ParseGenesisHeights parses genesis heights written as "chain=height" pairs
+// separated by commas, e.g. "10=852054,11=852054".
+func ParseGenesisHeights(value string) (map[int]int, error) {
+	heights := make(map[int]int)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		chainStr, heightStr, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("expected chain=height, got %q", pair)
+		}
+		chain, err := strconv.Atoi(strings.TrimSpace(chainStr))
+		if err != nil || chain < 0 {
+			return nil, fmt.Errorf("invalid chain %q", chainStr)
+		}
+		height, err := strconv.Atoi(strings.TrimSpace(heightStr))
+		if err != nil || height < 0 {
+			return nil, fmt.Errorf("invalid height %q of chain %d", heightStr, chain)
+		}
+		heights[chain] = height
+	}
+	return heights, nil
+}
+
+// FormatGenesisHeights renders genesis heights the way ParseGenesisHeights reads
+// them, in chain order.
+func FormatGenesisHeights(heights map[int]int) string {
+	chains := make([]int, 0, len(heights))
+	for chain := range heights {
+		chains = append(chains, chain)
+	}
+	sort.Ints(chains)
+
+	pairs := make([]string, len(chains))
+	for i, chain := range chains {
+		pairs[i] = fmt.Sprintf("%d=%d", chain, heights[chain])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func lookupEnvInt(key string) (int, bool, error) {
+	valueStr, ok := os.LookupEnv(key)
+	if !ok || valueStr == "" {
+		return 0, false, nil
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		return 0, false, fmt.Errorf("environment variable %s must be an integer, but got: %s", key, valueStr)
+	}
+	return value, true, nil
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGenesisHeightsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		heights map[int]int
+		want    string
+	}{
+		{name: "empty", heights: map[int]int{}, want: ""},
+		{name: "one chain", heights: map[int]int{0: 0}, want: "0=0"},
+		{name: "chains in order", heights: map[int]int{11: 852054, 2: 0, 10: 852054}, want: "2=0,10=852054,11=852054"},
+		{name: "mainnet01", heights: networks["mainnet01"].GenesisHeights,
+			want: "0=0,1=0,2=0,3=0,4=0,5=0,6=0,7=0,8=0,9=0,10=852054,11=852054,12=852054,13=852054,14=852054,15=852054,16=852054,17=852054,18=852054,19=852054"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatted := FormatGenesisHeights(tt.heights)
+			if formatted != tt.want {
+				t.Errorf("FormatGenesisHeights() = %s, want %s", formatted, tt.want)
+			}
+			parsed, err := ParseGenesisHeights(formatted)
+			if err != nil {
+				t.Fatalf("ParseGenesisHeights(%s) error = %v", formatted, err)
+			}
+			if !reflect.DeepEqual(parsed, tt.heights) {
+				t.Errorf("ParseGenesisHeights(%s) = %v, want %v", formatted, parsed, tt.heights)
+			}
+		})
+	}
+}
+
+func TestParseGenesisHeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[int]int
+		wantErr string
+	}{
+		{name: "whitespace and empty pairs", value: " 10 = 852054 ,, 11=852054, ", want: map[int]int{10: 852054, 11: 852054}},
+		{name: "last pair of a chain wins", value: "3=10,3=20", want: map[int]int{3: 20}},
+		{name: "missing equals", value: "10=1,11", wantErr: `expected chain=height, got "11"`},
+		{name: "chain not a number", value: "ten=1", wantErr: `invalid chain "ten"`},
+		{name: "negative chain", value: "-1=1", wantErr: `invalid chain "-1"`},
+		{name: "height not a number", value: "10=tip", wantErr: `invalid height "tip" of chain 10`},
+		{name: "negative height", value: "10=-5", wantErr: `invalid height "-5" of chain 10`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGenesisHeights(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("ParseGenesisHeights(%s) error = %v, want %s", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseGenesisHeights(%s) error = %v", tt.value, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseGenesisHeights(%s) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		env     map[string]string
+		// want is the chain count, transition height and genesis heights, as
+		// FormatGenesisHeights writes them
+		wantChains     int
+		wantTransition int
+		wantHeights    string
+		wantErr        string
+	}{
+		{
+			name:           "testnet04",
+			network:        "testnet04",
+			wantChains:     20,
+			wantTransition: 332604,
+			wantHeights:    "0=0,1=0,2=0,3=0,4=0,5=0,6=0,7=0,8=0,9=0,10=332604,11=332604,12=332604,13=332604,14=332604,15=332604,16=332604,17=332604,18=332604,19=332604",
+		},
+		{
+			name:        "devnet with a chain count",
+			network:     "devnet",
+			env:         map[string]string{"NETWORK_CHAIN_COUNT": "4"},
+			wantChains:  4,
+			wantHeights: "0=0,1=0,2=0,3=0",
+		},
+		{
+			name:           "devnet with 20 chains and a transition",
+			network:        "devnet",
+			env:            map[string]string{"NETWORK_CHAIN_COUNT": "20", "NETWORK_TRANSITION_HEIGHT": "100"},
+			wantChains:     20,
+			wantTransition: 100,
+			wantHeights:    "0=0,1=0,2=0,3=0,4=0,5=0,6=0,7=0,8=0,9=0,10=100,11=100,12=100,13=100,14=100,15=100,16=100,17=100,18=100,19=100",
+		},
+		{
+			name:        "genesis heights override",
+			network:     "devnet",
+			env:         map[string]string{"NETWORK_CHAIN_COUNT": "3", "NETWORK_GENESIS_HEIGHTS": "1=50, 2=75"},
+			wantChains:  3,
+			wantHeights: "0=0,1=50,2=75",
+		},
+		{
+			name:           "known network with an override",
+			network:        "mainnet01",
+			env:            map[string]string{"NETWORK_GENESIS_HEIGHTS": "19=900000"},
+			wantChains:     20,
+			wantTransition: 852054,
+			wantHeights:    "0=0,1=0,2=0,3=0,4=0,5=0,6=0,7=0,8=0,9=0,10=852054,11=852054,12=852054,13=852054,14=852054,15=852054,16=852054,17=852054,18=852054,19=900000",
+		},
+		{
+			name:    "unknown network",
+			network: "devnet",
+			wantErr: `unknown network "devnet": set NETWORK_CHAIN_COUNT, and NETWORK_GENESIS_HEIGHTS or NETWORK_TRANSITION_HEIGHT if needed, to describe it`,
+		},
+		{
+			name:    "chain count not a number",
+			network: "devnet",
+			env:     map[string]string{"NETWORK_CHAIN_COUNT": "many"},
+			wantErr: "environment variable NETWORK_CHAIN_COUNT must be an integer, but got: many",
+		},
+		{
+			name:    "no chains",
+			network: "devnet",
+			env:     map[string]string{"NETWORK_CHAIN_COUNT": "-1"},
+			wantErr: `network "devnet" has -1 chains`,
+		},
+		{
+			name:    "genesis height of a missing chain",
+			network: "devnet",
+			env:     map[string]string{"NETWORK_CHAIN_COUNT": "2", "NETWORK_GENESIS_HEIGHTS": "2=10"},
+			wantErr: `network "devnet" has 2 chains but a genesis height for chain 2`,
+		},
+		{
+			name:    "invalid genesis heights",
+			network: "mainnet01",
+			env:     map[string]string{"NETWORK_GENESIS_HEIGHTS": "19"},
+			wantErr: `invalid NETWORK_GENESIS_HEIGHTS: expected chain=height, got "19"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"NETWORK_CHAIN_COUNT", "NETWORK_TRANSITION_HEIGHT", "NETWORK_GENESIS_HEIGHTS"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			info, err := GetNetwork(tt.network)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("GetNetwork() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetNetwork() error = %v", err)
+			}
+			if info.Name != tt.network || info.ChainCount != tt.wantChains || info.TransitionHeight != tt.wantTransition {
+				t.Errorf("GetNetwork() = %s with %d chains from %d, want %s with %d chains from %d",
+					info.Name, info.ChainCount, info.TransitionHeight, tt.network, tt.wantChains, tt.wantTransition)
+			}
+			if got := FormatGenesisHeights(info.GenesisHeights); got != tt.wantHeights {
+				t.Errorf("GetNetwork() genesis heights = %s, want %s", got, tt.wantHeights)
+			}
+		})
+	}
+}
+
+func TestGetNetworkLeavesKnownNetworksAlone(t *testing.T) {
+	t.Setenv("NETWORK_GENESIS_HEIGHTS", "0=1")
+	if _, err := GetNetwork("mainnet01"); err != nil {
+		t.Fatal(err)
+	}
+	if height := networks["mainnet01"].GenesisHeight(0); height != 0 {
+		t.Errorf("mainnet01 genesis height of chain 0 = %d after an override, want 0", height)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"strings"
+)
+
+const (
+	accountTimelineBatchSize    = 1000
+	accountTimelineWatermarkKey = "build-account-timeline"
+)
+
+// This script materializes the AccountTimeline table: everything an account did,
+// one row per action, ordered across chains by height, then chain, then the
+// transaction's ordinal within its block (its rank by id among the block's
+// transactions). Action kinds are derived from the tables already backfilled:
+//
+//	send, receive        Transfers between two accounts (receive also covers mints)
+//	xchain-start         Transfers to no account from a non-continuation step
+//	xchain-finish        Transfers from no account in a continuation step
+//	deploy               transactions whose code defines a module or interface
+//	rotate               GuardChanges rows, when backfill-rotations has run
+//	failed               transactions whose result status is failure
+//
+// Rows are keyed by (kind, sourceId, account), where sourceId is the id of the row
+// the action comes from, so re-running a range or an account replaces rows instead
+// of duplicating them.
+
+type timelineFilter struct {
+	// Transactions restricts the "Transactions" t rows considered
+	Transactions string
+	// Account restricts the account of every action
+	Account string
+	Args    []interface{}
+}
+
+func buildAccountTimeline() error {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createAccountTimelineTable(db); err != nil {
+		return err
+	}
+
+	codeExpr, err := codeTextExpression(db)
+	if err != nil {
+		return err
+	}
+
+	hasGuardChanges, err := tableExists(db, "GuardChanges")
+	if err != nil {
+		return err
+	}
+	if !hasGuardChanges {
+		log.Println("No GuardChanges table found; rotations are left out until backfill-rotations has run")
+	}
+
+	if *timelineAccount != "" {
+		return rebuildAccountTimeline(db, codeExpr, hasGuardChanges, *timelineAccount)
+	}
+
+	lastId, err := readWatermark(db, accountTimelineWatermarkKey)
+	if err != nil {
+		return err
+	}
+
+	var maxTransactionId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "Transactions"`).Scan(&maxTransactionId); err != nil {
+		return fmt.Errorf("failed to get max transaction ID: %w", err)
+	}
+
+	maxTransactionId, err = capToLiveWatermark(db, "Transactions", maxTransactionId, false)
+	if err != nil {
+		return err
+	}
+
+	if maxTransactionId <= lastId {
+		logNothingToDo("Transactions", lastId+1, maxTransactionId)
+		log.Printf("Account timeline is up to date (watermark at id %d)", lastId)
+		log.Println("Completed processing. Total timeline rows written: 0 (100.0%)")
+		return nil
+	}
+
+	totalRows := 0
+	totalIds := maxTransactionId - lastId
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to build the account timeline from transaction ID %d to %d", lastId+1, maxTransactionId)
+
+	for currentId := lastId + 1; currentId <= maxTransactionId; currentId += accountTimelineBatchSize {
+		batchEnd := currentId + accountTimelineBatchSize - 1
+		if batchEnd > maxTransactionId {
+			batchEnd = maxTransactionId
+		}
+
+		filter := timelineFilter{
+			Transactions: `t.id >= $1 AND t.id <= $2`,
+			Account:      `TRUE`,
+			Args:         []interface{}{currentId, batchEnd},
+		}
+		written, err := processAccountTimelineBatch(db, codeExpr, hasGuardChanges, filter, func(tx *sql.Tx) error {
+			return writeWatermark(tx, accountTimelineWatermarkKey, batchEnd)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to process batch %d-%d: %w", currentId, batchEnd, err)
+		}
+		totalRows += written
+
+		progressPercent := percentOf(batchEnd-lastId, totalIds)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, timeline rows written: %d", progressPercent, totalRows)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total timeline rows written: %d (100.0%%)", totalRows)
+	return nil
+}
+
+// rebuildAccountTimeline replaces the whole timeline of one account, e.g. after its
+// data was repaired. The watermark is left alone.
+func rebuildAccountTimeline(db *sql.DB, codeExpr string, hasGuardChanges bool, account string) error {
+	sources := []string{
+		`SELECT "transactionId" FROM "Transfers" WHERE from_acct = $1 OR to_acct = $1`,
+		`SELECT id FROM "Transactions" WHERE sender = $1`,
+	}
+	if hasGuardChanges {
+		sources = append(sources, `SELECT "transactionId" FROM "GuardChanges" WHERE account = $1`)
+	}
+
+	filter := timelineFilter{
+		Transactions: `t.id IN (` + strings.Join(sources, " UNION ") + `)`,
+		Account:      `account = $1`,
+		Args:         []interface{}{account},
+	}
+
+	log.Printf("Rebuilding the timeline of account %s", account)
+
+	written, err := processAccountTimelineBatch(db, codeExpr, hasGuardChanges, filter, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM "AccountTimeline" WHERE account = $1`, account); err != nil {
+			return fmt.Errorf("failed to clear the timeline of %s: %w", account, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Completed processing. Total timeline rows written for %s: %d (100.0%%)", account, written)
+	return nil
+}
+
+func createAccountTimelineTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "AccountTimeline" (
+			id BIGSERIAL PRIMARY KEY,
+			account TEXT NOT NULL,
+			height BIGINT NOT NULL,
+			"chainId" INTEGER NOT NULL,
+			"transactionId" INTEGER NOT NULL,
+			ordinal INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			"sourceId" BIGINT NOT NULL,
+			requestkey TEXT NOT NULL,
+			counterparty TEXT,
+			amount NUMERIC,
+			module TEXT,
+			"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (kind, "sourceId", account)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create AccountTimeline table: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS accounttimeline_account_order_idx
+		ON "AccountTimeline" (account, height, "chainId", ordinal, kind, "sourceId")
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create AccountTimeline account index: %w", err)
+	}
+
+	if err := addLineageColumn(db, "AccountTimeline"); err != nil {
+		return err
+	}
+	return createWatermarksTable(db)
+}
+
+// accountTimelineQuery selects the actions of the transactions matching the
+// filter; its columns follow the AccountTimeline insert below.
+func accountTimelineQuery(codeExpr string, hasGuardChanges bool, filter timelineFilter) string {
+	kinds := []string{
+		`SELECT tr.from_acct, txs.*, 'send', tr.id::bigint, tr.to_acct, tr.amount::numeric, tr.modulename
+		FROM txs JOIN "Transfers" tr ON tr."transactionId" = txs.tx_id
+		WHERE tr.from_acct <> '' AND tr.to_acct <> ''`,
+
+		`SELECT tr.to_acct, txs.*, 'receive', tr.id::bigint, NULLIF(tr.from_acct, ''), tr.amount::numeric, tr.modulename
+		FROM txs JOIN "Transfers" tr ON tr."transactionId" = txs.tx_id
+		WHERE tr.to_acct <> '' AND (tr.from_acct <> '' OR NOT txs.continuation)`,
+
+		`SELECT tr.from_acct, txs.*, 'xchain-start', tr.id::bigint, NULL, tr.amount::numeric, tr.modulename
+		FROM txs JOIN "Transfers" tr ON tr."transactionId" = txs.tx_id
+		WHERE tr.from_acct <> '' AND tr.to_acct = '' AND NOT txs.continuation`,
+
+		`SELECT tr.to_acct, txs.*, 'xchain-finish', tr.id::bigint, NULL, tr.amount::numeric, tr.modulename
+		FROM txs JOIN "Transfers" tr ON tr."transactionId" = txs.tx_id
+		WHERE tr.to_acct <> '' AND tr.from_acct = '' AND txs.continuation`,
+
+		fmt.Sprintf(`SELECT txs.sender, txs.*, 'deploy', td.id::bigint, NULL, NULL::numeric, NULL
+		FROM txs JOIN "TransactionDetails" td ON td."transactionId" = txs.tx_id
+		WHERE txs.sender <> '' AND %s ~ '\(\s*(module|interface)\s'`, codeExpr),
+
+		`SELECT txs.sender, txs.*, 'failed', txs.tx_id::bigint, NULL, NULL::numeric, NULL
+		FROM txs
+		WHERE txs.sender <> '' AND txs.result->>'status' = 'failure'`,
+	}
+	if hasGuardChanges {
+		kinds = append(kinds, `SELECT gc.account, txs.*, 'rotate', gc.id::bigint, NULL, NULL::numeric, gc.module
+		FROM txs JOIN "GuardChanges" gc ON gc."transactionId" = txs.tx_id`)
+	}
+
+	return fmt.Sprintf(`
+		WITH txs AS (
+			SELECT t.id AS tx_id, b.height, t."chainId",
+				(SELECT COUNT(*) FROM "Transactions" o WHERE o."blockId" = t."blockId" AND o.id < t.id) AS ordinal,
+				t.requestkey, t.sender, t.result,
+				COALESCE(td.step, 0) > 0 AS continuation
+			FROM "Transactions" t
+			JOIN "Blocks" b ON b.id = t."blockId"
+			LEFT JOIN "TransactionDetails" td ON td."transactionId" = t.id
+			WHERE %s AND b.canonical = true
+		),
+		actions (account, tx_id, height, "chainId", ordinal, requestkey, sender, result, continuation,
+			kind, "sourceId", counterparty, amount, module) AS (
+			%s
+		)
+		SELECT account, height, "chainId", tx_id, ordinal, kind, "sourceId", requestkey, counterparty, amount, module
+		FROM actions
+		WHERE %s
+	`, filter.Transactions, strings.Join(kinds, "\n\t\t\tUNION ALL\n\t\t\t"), filter.Account)
+}
+
+// processAccountTimelineBatch writes the actions matching filter in a single
+// transaction, after running before in it.
+func processAccountTimelineBatch(db *sql.DB, codeExpr string, hasGuardChanges bool, filter timelineFilter, before func(tx *sql.Tx) error) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	if err := before(tx); err != nil {
+		return 0, err
+	}
+
+	// The run id follows the filter's arguments
+	args := append(append([]interface{}{}, filter.Args...), runId)
+	insert := `
+		INSERT INTO "AccountTimeline" (account, height, "chainId", "transactionId", ordinal, kind, "sourceId",
+			requestkey, counterparty, amount, module, "updatedAt", "lastRunId")
+		SELECT *, CURRENT_TIMESTAMP, ` + fmt.Sprintf("$%d", len(args)) + ` FROM (` + accountTimelineQuery(codeExpr, hasGuardChanges, filter) + `) a
+		ON CONFLICT (kind, "sourceId", account) DO UPDATE SET
+			height = EXCLUDED.height,
+			"chainId" = EXCLUDED."chainId",
+			"transactionId" = EXCLUDED."transactionId",
+			ordinal = EXCLUDED.ordinal,
+			requestkey = EXCLUDED.requestkey,
+			counterparty = EXCLUDED.counterparty,
+			amount = EXCLUDED.amount,
+			module = EXCLUDED.module,
+			"updatedAt" = EXCLUDED."updatedAt",
+			"lastRunId" = EXCLUDED."lastRunId"
+	`
+
+	result, err := tx.Exec(insert, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write timeline rows: %w", err)
+	}
+	written, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return int(written), nil
+}
+
+func BuildAccountTimeline(ctx context.Context, cfg *config.Config) error {
+	return buildAccountTimeline()
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	activeAddressesBatchSize    = 5000
+	activeAddressesWatermarkKey = "build-active-addresses"
+)
+
+// This script maintains one HyperLogLog sketch of active addresses per UTC day and
+// chain in the ActiveAddressSketches table. An address is active on a day when it
+// sent a canonical transaction or took part in one of its transfers. Adding an
+// address to a sketch twice has no effect, so reprocessing a range is harmless and
+// incremental runs simply continue from the watermark.
+
+// activeDayExpression is the UTC day of transaction t. The CASE keeps malformed
+// creation times from reaching the cast, whatever order the planner picks.
+const activeDayExpression = `CASE WHEN t.creationtime ~ '^[0-9]+(\.[0-9]+)?$'
+	THEN (to_timestamp(t.creationtime::numeric) AT TIME ZONE 'UTC')::date END`
+
+// activeAddressesQuery selects the distinct (day, chain, address) triples of the
+// canonical transactions matching the filter on "Transactions" t.
+var activeAddressesQuery = `
+	WITH txs AS (
+		SELECT t.id, t."chainId", t.sender, ` + activeDayExpression + ` AS day
+		FROM "Transactions" t
+		WHERE %s AND t.canonical = true
+	)
+	SELECT day::text, "chainId", sender FROM txs WHERE day IS NOT NULL AND sender <> ''
+	UNION
+	SELECT txs.day::text, txs."chainId", tr.from_acct
+	FROM "Transfers" tr JOIN txs ON txs.id = tr."transactionId"
+	WHERE txs.day IS NOT NULL AND tr.from_acct <> ''
+	UNION
+	SELECT txs.day::text, txs."chainId", tr.to_acct
+	FROM "Transfers" tr JOIN txs ON txs.id = tr."transactionId"
+	WHERE txs.day IS NOT NULL AND tr.to_acct <> ''
+`
+
+type sketchKey struct {
+	Day     string
+	ChainId int
+}
+
+func buildActiveAddresses() (bool, error) {
+	switch *activeRollup {
+	case "", "day", "week", "month":
+	default:
+		return false, &errs.ValidationError{Field: "-active-rollup", Reason: fmt.Sprintf("%q, expected day, week or month", *activeRollup)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return false, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if *activeVerifyDays == 0 && *activeRollup == "" {
+		if err := createActiveAddressSketchesTable(db); err != nil {
+			return false, err
+		}
+		return true, updateActiveAddresses(db)
+	}
+
+	// Verification and rollups only read, so they don't create anything
+	exists, err := tableExists(db, "ActiveAddressSketches")
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		log.Println("No ActiveAddressSketches table found; run build-active-addresses first")
+		return true, nil
+	}
+
+	if *activeVerifyDays > 0 {
+		return verifyActiveAddresses(db, *activeVerifyDays)
+	}
+	return true, reportActiveAddresses(db, *activeRollup)
+}
+
+func createActiveAddressSketchesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "ActiveAddressSketches" (
+			day DATE NOT NULL,
+			"chainId" INTEGER NOT NULL,
+			sketch BYTEA NOT NULL,
+			"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (day, "chainId")
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ActiveAddressSketches table: %w", err)
+	}
+
+	if err := addLineageColumn(db, "ActiveAddressSketches"); err != nil {
+		return err
+	}
+	return createWatermarksTable(db)
+}
+
+func updateActiveAddresses(db *sql.DB) error {
+	if *activeFull {
+		log.Println("Full rebuild: dropping existing sketches and the watermark")
+		if err := resetActiveAddresses(db); err != nil {
+			return err
+		}
+	}
+
+	lastId, err := readWatermark(db, activeAddressesWatermarkKey)
+	if err != nil {
+		return err
+	}
+
+	var maxTransactionId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "Transactions"`).Scan(&maxTransactionId); err != nil {
+		return fmt.Errorf("failed to get max transaction ID: %w", err)
+	}
+
+	maxTransactionId, err = capToLiveWatermark(db, "Transactions", maxTransactionId, false)
+	if err != nil {
+		return err
+	}
+
+	if maxTransactionId <= lastId {
+		logNothingToDo("Transactions", lastId+1, maxTransactionId)
+		log.Printf("Active address sketches are up to date (watermark at id %d)", lastId)
+		log.Println("Completed processing. Total sketches updated: 0 (100.0%)")
+		return nil
+	}
+
+	totalSketches := 0
+	totalIds := maxTransactionId - lastId
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to build active address sketches from transaction ID %d to %d", lastId+1, maxTransactionId)
+
+	for currentId := lastId + 1; currentId <= maxTransactionId; currentId += activeAddressesBatchSize {
+		batchEnd := currentId + activeAddressesBatchSize - 1
+		if batchEnd > maxTransactionId {
+			batchEnd = maxTransactionId
+		}
+
+		updated, err := processActiveAddressesBatch(db, currentId, batchEnd)
+		if err != nil {
+			return fmt.Errorf("failed to process batch %d-%d: %w", currentId, batchEnd, err)
+		}
+		totalSketches += updated
+
+		progressPercent := percentOf(batchEnd-lastId, totalIds)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, sketch updates: %d", progressPercent, totalSketches)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total sketches updated: %d (100.0%%)", totalSketches)
+	log.Printf("Estimates carry a standard error of %.2f%% (about %.2f%% at 3 sigma)",
+		hllStandardError()*100, 3*hllStandardError()*100)
+	return nil
+}
+
+func resetActiveAddresses(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	if _, err := tx.Exec(`TRUNCATE "ActiveAddressSketches"`); err != nil {
+		return fmt.Errorf("failed to truncate ActiveAddressSketches: %w", err)
+	}
+	if err := writeWatermark(tx, activeAddressesWatermarkKey, 0); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errs.FromDB("failed to commit transaction", err)
+	}
+	return nil
+}
+
+func processActiveAddressesBatch(db *sql.DB, startId, endId int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	query := fmt.Sprintf(activeAddressesQuery, `t.id >= $1 AND t.id <= $2`)
+	rows, err := tx.Query(query, startId, endId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query active addresses: %w", err)
+	}
+
+	sketches := make(map[sketchKey]*hyperLogLog)
+	for rows.Next() {
+		var (
+			key     sketchKey
+			address string
+		)
+		if err := rows.Scan(&key.Day, &key.ChainId, &address); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan active address: %w", err)
+		}
+
+		sketch, ok := sketches[key]
+		if !ok {
+			sketch = newHyperLogLog()
+			sketches[key] = sketch
+		}
+		sketch.Add(address)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("error iterating active addresses: %w", err)
+	}
+	rows.Close()
+
+	for key, sketch := range sketches {
+		// Fold in what earlier batches recorded for the same day and chain
+		var stored []byte
+		err := tx.QueryRow(`SELECT sketch FROM "ActiveAddressSketches" WHERE day = $1 AND "chainId" = $2 FOR UPDATE`,
+			key.Day, key.ChainId).Scan(&stored)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("failed to read sketch of %s chain %d: %w", key.Day, key.ChainId, err)
+		}
+		if err == nil {
+			existing := &hyperLogLog{}
+			if err := existing.UnmarshalBinary(stored); err != nil {
+				return 0, fmt.Errorf("failed to decode sketch of %s chain %d: %w", key.Day, key.ChainId, err)
+			}
+			if err := sketch.Merge(existing); err != nil {
+				return 0, fmt.Errorf("failed to merge sketch of %s chain %d: %w", key.Day, key.ChainId, err)
+			}
+		}
+
+		data, err := sketch.MarshalBinary()
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode sketch of %s chain %d: %w", key.Day, key.ChainId, err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO "ActiveAddressSketches" (day, "chainId", sketch, "updatedAt", "lastRunId")
+			VALUES ($1, $2, $3, CURRENT_TIMESTAMP, $4)
+			ON CONFLICT (day, "chainId") DO UPDATE SET sketch = EXCLUDED.sketch, "updatedAt" = EXCLUDED."updatedAt",
+				"lastRunId" = EXCLUDED."lastRunId"
+		`, key.Day, key.ChainId, data, runId)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store sketch of %s chain %d: %w", key.Day, key.ChainId, err)
+		}
+	}
+
+	if err := writeWatermark(tx, activeAddressesWatermarkKey, endId); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return len(sketches), nil
+}
+
+// verifyActiveAddresses compares the estimate of a random sample of stored day
+// sketches with an exact COUNT(DISTINCT) and fails when any estimate falls outside
+// three standard errors. Exact counts scan the day's transactions, so keep the
+// sample small on large databases.
+func verifyActiveAddresses(db *sql.DB, sampleSize int) (bool, error) {
+	rows, err := db.Query(`
+		SELECT day::text, "chainId", sketch
+		FROM "ActiveAddressSketches"
+		ORDER BY random()
+		LIMIT $1
+	`, sampleSize)
+	if err != nil {
+		return false, fmt.Errorf("failed to sample sketches: %w", err)
+	}
+
+	type sample struct {
+		Key    sketchKey
+		Sketch *hyperLogLog
+	}
+	var samples []sample
+	for rows.Next() {
+		var (
+			key  sketchKey
+			data []byte
+		)
+		if err := rows.Scan(&key.Day, &key.ChainId, &data); err != nil {
+			rows.Close()
+			return false, fmt.Errorf("failed to scan sketch: %w", err)
+		}
+		sketch := &hyperLogLog{}
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			rows.Close()
+			return false, fmt.Errorf("failed to decode sketch of %s chain %d: %w", key.Day, key.ChainId, err)
+		}
+		samples = append(samples, sample{Key: key, Sketch: sketch})
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return false, fmt.Errorf("error iterating sketches: %w", err)
+	}
+	rows.Close()
+
+	if len(samples) == 0 {
+		log.Println("No active address sketches found; nothing to verify")
+		return true, nil
+	}
+
+	bound := 3 * hllStandardError()
+	withinBound := true
+	exactQuery := fmt.Sprintf(`SELECT COUNT(DISTINCT sender) FROM (%s) a`,
+		fmt.Sprintf(activeAddressesQuery, `t."chainId" = $1 AND `+activeDayExpression+` = $2::date`))
+
+	for _, s := range samples {
+		var exact int
+		if err := db.QueryRow(exactQuery, s.Key.ChainId, s.Key.Day).Scan(&exact); err != nil {
+			return false, fmt.Errorf("failed to count active addresses of %s chain %d: %w", s.Key.Day, s.Key.ChainId, err)
+		}
+
+		estimate := s.Sketch.Estimate()
+		relativeError := 0.0
+		if exact > 0 {
+			relativeError = math.Abs(estimate-float64(exact)) / float64(exact)
+		}
+
+		status := "ok"
+		if relativeError > bound {
+			status = "OUTSIDE BOUND"
+			withinBound = false
+		}
+		log.Printf("%s chain %d: exact %d, estimate %.0f, error %.2f%% (%s)",
+			s.Key.Day, s.Key.ChainId, exact, estimate, relativeError*100, status)
+	}
+
+	log.Printf("Verified %d sketches against a bound of %.2f%%", len(samples), bound*100)
+	return withinBound, nil
+}
+
+// reportActiveAddresses merges the stored day sketches into one estimate per
+// period, across all chains and per chain.
+func reportActiveAddresses(db *sql.DB, period string) error {
+	rows, err := db.Query(`SELECT day, "chainId", sketch FROM "ActiveAddressSketches" ORDER BY day, "chainId"`)
+	if err != nil {
+		return fmt.Errorf("failed to query sketches: %w", err)
+	}
+	defer rows.Close()
+
+	type periodKey struct {
+		Period  string
+		ChainId int
+	}
+	const allChains = -1
+	merged := make(map[periodKey]*hyperLogLog)
+
+	for rows.Next() {
+		var (
+			day     time.Time
+			chainId int
+			data    []byte
+		)
+		if err := rows.Scan(&day, &chainId, &data); err != nil {
+			return fmt.Errorf("failed to scan sketch: %w", err)
+		}
+		sketch := &hyperLogLog{}
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("failed to decode sketch of %s chain %d: %w", day.Format("2006-01-02"), chainId, err)
+		}
+
+		label := periodLabel(day, period)
+		for _, key := range []periodKey{{label, chainId}, {label, allChains}} {
+			target, ok := merged[key]
+			if !ok {
+				target = newHyperLogLog()
+				merged[key] = target
+			}
+			if err := target.Merge(sketch); err != nil {
+				return fmt.Errorf("failed to merge sketch of %s chain %d: %w", day.Format("2006-01-02"), chainId, err)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating sketches: %w", err)
+	}
+
+	keys := make([]periodKey, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Period != keys[j].Period {
+			return keys[i].Period < keys[j].Period
+		}
+		return keys[i].ChainId < keys[j].ChainId
+	})
+
+	for _, key := range keys {
+		if key.ChainId == allChains {
+			log.Printf("%s all chains: ~%.0f active addresses", key.Period, merged[key].Estimate())
+			continue
+		}
+		log.Printf("%s chain %d: ~%.0f active addresses", key.Period, key.ChainId, merged[key].Estimate())
+	}
+
+	log.Printf("Estimates carry a standard error of %.2f%%", hllStandardError()*100)
+	return nil
+}
+
+func periodLabel(day time.Time, period string) string {
+	switch period {
+	case "week":
+		year, week := day.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case "month":
+		return day.Format("2006-01")
+	default:
+		return day.Format("2006-01-02")
+	}
+}
+
+func BuildActiveAddresses(ctx context.Context, cfg *config.Config) error {
+	withinBound, err := buildActiveAddresses()
+	if err != nil {
+		return err
+	}
+	if !withinBound {
+		return errors.New("verification failed: some estimates fall outside the error bound")
+	}
+	return nil
+}
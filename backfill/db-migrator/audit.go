@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"time"
+)
+
+const auditVerifyBatchSize = 1000
+
+// Audit mode records, for every row a batch modifies, an md5 hash of the full row
+// before and after the change into the AuditTrail table. Both hashes are computed
+// inside the batch transaction, so the trail commits or rolls back together with
+// the change. Rows whose hash didn't change are dropped from the trail.
+
+// auditableTables are the tables audit mode may hash; the names end up in SQL.
+var auditableTables = map[string]bool{
+	"TransactionDetails": true,
+	"Events":             true,
+	"Transfers":          true,
+}
+
+// runId identifies this process in the audit trail.
+var runId = fmt.Sprintf("%d", time.Now().UnixNano())
+
+func createAuditTrailTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "AuditTrail" (
+			id BIGSERIAL PRIMARY KEY,
+			"runId" TEXT NOT NULL,
+			command TEXT NOT NULL,
+			"tableName" TEXT NOT NULL,
+			"rowId" BIGINT NOT NULL,
+			"beforeHash" TEXT NOT NULL,
+			"afterHash" TEXT,
+			"recordedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create AuditTrail table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS audittrail_table_row_idx ON "AuditTrail" ("tableName", "rowId")`)
+	if err != nil {
+		return fmt.Errorf("failed to create AuditTrail row index: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS audittrail_run_idx ON "AuditTrail" ("runId", "tableName")`)
+	if err != nil {
+		return fmt.Errorf("failed to create AuditTrail run index: %w", err)
+	}
+
+	log.Printf("Audit mode enabled, recording row hashes under run id %s", runId)
+	return nil
+}
+
+// auditStatement is a statement of audit mode, with the message its failure is
+// wrapped in.
+type auditStatement struct {
+	query   string
+	args    []interface{}
+	failure string
+}
+
+// auditBefore hashes the rows of table whose rangeColumn lies in [startId, endId]
+// ahead of the batch's change.
+func auditBefore(ctx context.Context, tx *batcher.Tx, table, rangeColumn string, startId, endId int) error {
+	statements, err := auditBeforeStatements(table, rangeColumn, startId, endId)
+	if err != nil {
+		return err
+	}
+	return execAudit(ctx, tx, statements)
+}
+
+// auditAfter completes the rows recorded by auditBefore with the hash after the
+// change and removes the rows the batch left untouched.
+func auditAfter(ctx context.Context, tx *batcher.Tx, table, rangeColumn string, startId, endId int) error {
+	statements, err := auditAfterStatements(table, rangeColumn, startId, endId)
+	if err != nil {
+		return err
+	}
+	return execAudit(ctx, tx, statements)
+}
+
+func execAudit(ctx context.Context, tx *batcher.Tx, statements []auditStatement) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(ctx, statement.query, statement.args...); err != nil {
+			return errs.FromDB(statement.failure, err)
+		}
+	}
+	return nil
+}
+
+// auditBeforeStatements are the statements of auditBefore, for callers queuing
+// them in a pipeline.
+func auditBeforeStatements(table, rangeColumn string, startId, endId int) ([]auditStatement, error) {
+	if !auditableTables[table] {
+		return nil, fmt.Errorf("table %s cannot be audited", table)
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO "AuditTrail" ("runId", command, "tableName", "rowId", "beforeHash")
+		SELECT $1, $2, $3, t.id, md5(to_jsonb(t)::text)
+		FROM "%s" t
+		WHERE t."%s" >= $4 AND t."%s" <= $5
+	`, table, rangeColumn, rangeColumn)
+
+	return []auditStatement{{
+		query:   query,
+		args:    []interface{}{runId, *command, table, startId, endId},
+		failure: fmt.Sprintf("failed to record audit hashes before change in %s", table),
+	}}, nil
+}
+
+// auditAfterStatements are the statements of auditAfter, for callers queuing them
+// in a pipeline.
+func auditAfterStatements(table, rangeColumn string, startId, endId int) ([]auditStatement, error) {
+	if !auditableTables[table] {
+		return nil, fmt.Errorf("table %s cannot be audited", table)
+	}
+
+	update := fmt.Sprintf(`
+		UPDATE "AuditTrail" a
+		SET "afterHash" = md5(to_jsonb(t)::text)
+		FROM "%s" t
+		WHERE a."runId" = $1 AND a."tableName" = $2 AND a."rowId" = t.id
+		AND a."afterHash" IS NULL
+		AND t."%s" >= $3 AND t."%s" <= $4
+	`, table, rangeColumn, rangeColumn)
+
+	cleanup := fmt.Sprintf(`
+		DELETE FROM "AuditTrail" a
+		USING "%s" t
+		WHERE a."runId" = $1 AND a."tableName" = $2 AND a."rowId" = t.id
+		AND a."afterHash" = a."beforeHash"
+		AND t."%s" >= $3 AND t."%s" <= $4
+	`, table, rangeColumn, rangeColumn)
+
+	return []auditStatement{
+		{
+			query:   update,
+			args:    []interface{}{runId, table, startId, endId},
+			failure: fmt.Sprintf("failed to record audit hashes after change in %s", table),
+		},
+		{
+			query:   cleanup,
+			args:    []interface{}{runId, table, startId, endId},
+			failure: fmt.Sprintf("failed to drop unchanged audit rows of %s", table),
+		},
+	}, nil
+}
+
+func verifyAuditTrail() (bool, error) {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return false, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	exists, err := tableExists(db, "AuditTrail")
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		log.Println("No AuditTrail table found; nothing to verify")
+		return true, nil
+	}
+
+	if *auditRun != "" {
+		log.Printf("Verifying audit trail of run %s", *auditRun)
+	}
+
+	allMatched := true
+	for table := range auditableTables {
+		matched, modified, deleted, err := verifyAuditTable(db, table)
+		if err != nil {
+			return false, err
+		}
+		if matched+modified+deleted == 0 {
+			continue
+		}
+
+		log.Printf("%s: %d rows match their recorded hash, %d modified since, %d deleted since",
+			table, matched, modified, deleted)
+		if modified+deleted > 0 {
+			allMatched = false
+		}
+	}
+
+	return allMatched, nil
+}
+
+// verifyAuditTable re-hashes the current state of every audited row of table and
+// compares it with the after-hash of the most recent audit record for that row.
+func verifyAuditTable(db *sql.DB, table string) (int, int, int, error) {
+	query := fmt.Sprintf(`
+		SELECT a.id, a."rowId", a."runId", a."afterHash", md5(to_jsonb(t)::text)
+		FROM "AuditTrail" a
+		LEFT JOIN "%s" t ON t.id = a."rowId"
+		WHERE a."tableName" = $1 AND a.id > $2
+		AND a."afterHash" IS NOT NULL
+		AND ($3 = '' OR a."runId" = $3)
+		AND NOT EXISTS (
+			SELECT 1 FROM "AuditTrail" newer
+			WHERE newer."tableName" = a."tableName" AND newer."rowId" = a."rowId" AND newer.id > a.id
+		)
+		ORDER BY a.id
+		LIMIT $4
+	`, table)
+
+	matched, modified, deleted := 0, 0, 0
+	reported := 0
+	lastAuditId := int64(0)
+
+	for {
+		rows, err := db.Query(query, table, lastAuditId, *auditRun, auditVerifyBatchSize)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to query audit trail of %s: %w", table, err)
+		}
+
+		count := 0
+		for rows.Next() {
+			var (
+				auditId     int64
+				rowId       int64
+				auditRunId  string
+				afterHash   string
+				currentHash sql.NullString
+			)
+			if err := rows.Scan(&auditId, &rowId, &auditRunId, &afterHash, &currentHash); err != nil {
+				rows.Close()
+				return 0, 0, 0, fmt.Errorf("failed to scan audit row: %w", err)
+			}
+			count++
+			lastAuditId = auditId
+
+			switch {
+			case !currentHash.Valid:
+				deleted++
+				if reported < *auditMaxReported {
+					log.Printf("%s row %d (run %s) was deleted since it was audited", table, rowId, auditRunId)
+					reported++
+				}
+			case currentHash.String != afterHash:
+				modified++
+				if reported < *auditMaxReported {
+					log.Printf("%s row %d (run %s) was modified since it was audited", table, rowId, auditRunId)
+					reported++
+				}
+			default:
+				matched++
+			}
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return 0, 0, 0, fmt.Errorf("error iterating audit trail of %s: %w", table, err)
+		}
+		rows.Close()
+
+		if count < auditVerifyBatchSize {
+			return matched, modified, deleted, nil
+		}
+	}
+}
+
+func VerifyAuditTrail(ctx context.Context, cfg *config.Config) error {
+	allMatched, err := verifyAuditTrail()
+	if err != nil {
+		return err
+	}
+	if !allMatched {
+		return errors.New("audit verification failed: some audited rows changed after the audited run")
+	}
+	log.Println("All audited rows still match their recorded hashes")
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go-backfill/config"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Every command starts by printing a banner with its target and the safety
+// settings in effect, so an operator sees at a glance what the run is about to do.
+// A destructive run against a host matching PRODUCTION_HOST_PATTERN also waits for
+// the database name to be typed back, unless -no-banner-confirm is set.
+
+func commandIsDestructive(name string) bool {
+	switch name {
+	case "finalize-code-to-text":
+		// Drops the jsonb code column
+		return !*dryRun && !*finalizeSkipDrop
+	case "normalize-json":
+		// Rewrites values in place
+		return !*dryRun && !*jsonVerify
+	case "build-active-addresses":
+		// Truncates the stored sketches
+		return *activeFull
+	case "rollback-code-to-text":
+		// Throws converted values away
+		return true
+	case "cleanup-code":
+		// Throws the jsonb code away
+		return true
+	default:
+		return false
+	}
+}
+
+func onOff(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func bannerLines(name string) []string {
+	env := config.GetConfig()
+
+	watermark := "off"
+	if *belowLiveWatermark {
+		watermark = fmt.Sprintf("margin %d, allow tip: %s", *liveMargin, onOff(*allowTip))
+	}
+	status := "off"
+	if *statusAddr != "" {
+		status = *statusAddr
+	}
+
+	metricsStatus := "off"
+	if *metricsAddr != "" {
+		metricsStatus = *metricsAddr
+	}
+
+	return []string{
+		fmt.Sprintf("command:         %s", name),
+		fmt.Sprintf("target:          %s@%s:%s/%s", env.DbUser, env.DbHost, env.DbPort, env.DbName),
+		fmt.Sprintf("network:         %s (%d chains, graph transition at %d)", env.NetworkInfo.Name, env.NetworkInfo.ChainCount, env.NetworkInfo.TransitionHeight),
+		fmt.Sprintf("env file:        %s (strict: %s)", *envFile, onOff(*strictEnv)),
+		fmt.Sprintf("writes:          %s", onOff(commandWrites(name))),
+		fmt.Sprintf("dry run:         %s", onOff(*dryRun)),
+		fmt.Sprintf("destructive:     %s", onOff(commandIsDestructive(name))),
+		fmt.Sprintf("live watermark:  %s", watermark),
+		fmt.Sprintf("audit:           %s", onOff(*auditMode)),
+		fmt.Sprintf("allow standby:   %s", onOff(*allowStandby)),
+		fmt.Sprintf("status server:   %s", status),
+		fmt.Sprintf("metrics server:  %s", metricsStatus),
+	}
+}
+
+// dangerousRun reports why the run needs an extra confirmation, if it does.
+func dangerousRun(name string) (string, error) {
+	env := config.GetConfig()
+	if !commandIsDestructive(name) || env.ProductionHostPattern == "" {
+		return "", nil
+	}
+
+	pattern, err := regexp.Compile(env.ProductionHostPattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid PRODUCTION_HOST_PATTERN %q: %w", env.ProductionHostPattern, err)
+	}
+	if !pattern.MatchString(env.DbHost) {
+		return "", nil
+	}
+	return fmt.Sprintf("%s is destructive and %s looks like a production host", name, env.DbHost), nil
+}
+
+func printBanner(name string) error {
+	warning, err := dangerousRun(name)
+	if err != nil {
+		return err
+	}
+
+	rule := strings.Repeat("=", 60)
+	log.Println(rule)
+	for _, line := range bannerLines(name) {
+		log.Println(line)
+	}
+	if warning != "" {
+		log.Println(highlight("!!! WARNING: " + warning + " !!!"))
+	}
+	log.Println(rule)
+
+	if warning == "" || *noBannerConfirm {
+		return nil
+	}
+	return confirmDatabaseName()
+}
+
+func confirmDatabaseName() error {
+	env := config.GetConfig()
+	fmt.Fprintf(os.Stderr, "Type the database name (%s) to continue: ", env.DbName)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return fmt.Errorf("no confirmation given; pass -no-banner-confirm for unattended runs")
+	}
+	if strings.TrimSpace(answer) != env.DbName {
+		return fmt.Errorf("confirmation %q doesn't match database %s", strings.TrimSpace(answer), env.DbName)
+	}
+	return nil
+}
+
+// highlight renders text in bold red when the log goes to a terminal.
+func highlight(text string) string {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return text
+	}
+	return "\033[1;31m" + text + "\033[0m"
+}
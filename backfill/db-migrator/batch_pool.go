@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The commands run on a batcher.Runner page their ids and run their batches on a
+// pgx pool instead of database/sql: pgx sends the statements of a batch together
+// (pgx.Batch) and reads their results in one round trip, where lib/pq waits for
+// each statement in turn. The pool is opened from the same DSN as every other
+// connection. Only this hot path moved to pgx: the bookkeeping around the
+// batches, such as watermarks and baselines, and the other commands stay on
+// database/sql and lib/pq. With DB_REPLICA_HOST set, a second pool on the
+// replica serves the validation reads of code-to-text.
+
+// openBatchPool opens a pgx pool of at most size connections to the database
+// at connStr.
+func openBatchPool(connStr string, size int) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse connection string: %w", err)
+	}
+	poolConfig.MaxConns = int32(size)
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	return pool, nil
+}
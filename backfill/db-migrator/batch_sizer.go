@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"go-backfill/errs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With -target-batch-ms, code-to-text sizes its windows by the latency it
+// observes instead of keeping -batch-size: it starts at -batch-size, grows the
+// next window by half when a batch commits under the target, and scales it down
+// to the target when one takes longer. A batch failing on a lock, a deadlock or a
+// timeout halves it. The size always stays within -min-batch-size and
+// -max-batch-size.
+
+const (
+	defaultMinBatchSize = 50
+	defaultMaxBatchSize = 20000
+)
+
+// lockOrTimeoutSQLStates are the PostgreSQL error codes telling that a batch held
+// or waited for locks too long.
+var lockOrTimeoutSQLStates = map[string]bool{
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available, e.g. lock_timeout
+	"57014": true, // query_canceled, e.g. statement_timeout
+}
+
+type batchSizer struct {
+	target           time.Duration
+	minSize, maxSize int
+
+	mu      sync.Mutex
+	current int
+	// How many windows were handed out at every size
+	used map[int]int
+}
+
+// newBatchSizer returns a sizer starting at size, which keeps to size when target
+// is 0.
+func newBatchSizer(size int, target time.Duration, minSize, maxSize int) *batchSizer {
+	return &batchSizer{target: target, minSize: minSize, maxSize: maxSize, current: size, used: make(map[int]int)}
+}
+
+func (s *batchSizer) adaptive() bool {
+	return s.target > 0
+}
+
+// next returns the size of the next window.
+func (s *batchSizer) next() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used[s.current]++
+	return s.current
+}
+
+// observe adjusts the size after an attempt at a window of size that took
+// elapsed and failed with err, if it did.
+func (s *batchSizer) observe(size int, elapsed time.Duration, err error) {
+	if !s.adaptive() {
+		return
+	}
+
+	next := s.current
+	switch {
+	case err != nil && isLockOrTimeout(err):
+		next = size / 2
+	case err != nil:
+		return
+	case elapsed < s.target:
+		next = size + (size+1)/2
+	case elapsed > s.target:
+		next = int(float64(size) * float64(s.target) / float64(elapsed))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = clampInt(next, s.minSize, s.maxSize)
+}
+
+// describe formats the current size for a progress line.
+func (s *batchSizer) describe() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("batch size %d", s.current)
+}
+
+// summary formats the minimum, maximum and median size of the windows handed out.
+func (s *batchSizer) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sizes := make([]int, 0, len(s.used))
+	windows := 0
+	for size, n := range s.used {
+		sizes = append(sizes, size)
+		windows += n
+	}
+	if windows == 0 {
+		return "Batch sizes: no batch was handed out"
+	}
+	sort.Ints(sizes)
+
+	median, seen := 0, 0
+	for _, size := range sizes {
+		seen += s.used[size]
+		if seen*2 >= windows {
+			median = size
+			break
+		}
+	}
+	return fmt.Sprintf("Batch sizes over %d batches: min %d, median %d, max %d", windows, sizes[0], median, sizes[len(sizes)-1])
+}
+
+func validateBatchSizing(batchSize int, target time.Duration, minSize, maxSize int) error {
+	if target < 0 {
+		return &errs.ValidationError{Field: "-target-batch-ms", Reason: fmt.Sprintf("%d must not be negative", target.Milliseconds())}
+	}
+	if target == 0 {
+		return nil
+	}
+	if minSize <= 0 {
+		return &errs.ValidationError{Field: "-min-batch-size", Reason: fmt.Sprintf("%d must be greater than 0", minSize)}
+	}
+	if maxSize < minSize {
+		return &errs.ValidationError{Field: "-max-batch-size", Reason: fmt.Sprintf("%d is below -min-batch-size %d", maxSize, minSize)}
+	}
+	if batchSize < minSize || batchSize > maxSize {
+		return &errs.ValidationError{Field: "-batch-size", Reason: fmt.Sprintf("%d is outside -min-batch-size %d and -max-batch-size %d", batchSize, minSize, maxSize)}
+	}
+	return nil
+}
+
+func isLockOrTimeout(err error) bool {
+	return lockOrTimeoutSQLStates[errs.SQLState(err)]
+}
+
+func clampInt(value, lower, upper int) int {
+	if value < lower {
+		return lower
+	}
+	if value > upper {
+		return upper
+	}
+	return value
+}
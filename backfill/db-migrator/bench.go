@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// This script benchmarks a batch command over a bounded id range for every
+// combination of batch size and worker count, so production runs can be tuned on
+// a restored snapshot first. The benchmarked commands really write (the updates
+// are idempotent, so every configuration repeats the same work), which is why the
+// target database name must be confirmed with -i-confirm-disposable. code-to-text
+// leaves converted rows alone, so its codetext is cleared over the range before
+// every configuration, outside the measurement.
+
+// benchedCommand is the batch of a benchmarked command, and whether it runs with
+// the lock and statement timeouts of the code batches.
+type benchedCommand struct {
+	batch    batcher.BatchFunc
+	timeouts bool
+}
+
+var benchCommands = map[string]benchedCommand{
+	"code-to-text":  {batch: convertCodeRange, timeouts: true},
+	"creation-time": {batch: processBatch},
+}
+
+// benchResets undo what a configuration of a command did over [startId, endId],
+// for the commands that skip the work already done.
+var benchResets = map[string]func(db *sql.DB, startId, endId int) error{
+	"code-to-text": func(db *sql.DB, startId, endId int) error {
+		_, err := db.Exec(`UPDATE "TransactionDetails" SET codetext = NULL WHERE id >= $1 AND id <= $2 AND codetext IS NOT NULL`, startId, endId)
+		if err != nil {
+			return fmt.Errorf("failed to clear codetext before benchmarking: %w", err)
+		}
+		return nil
+	},
+}
+
+// benchTables are the tables the benchmarked commands iterate, for their
+// throughput baselines.
+var benchTables = map[string]string{
+	"code-to-text":  "TransactionDetails",
+	"creation-time": "Transactions",
+}
+
+type benchResult struct {
+	BatchSize    int     `json:"batchSize"`
+	Workers      int     `json:"workers"`
+	Rows         int     `json:"rows"`
+	Batches      int     `json:"batches"`
+	DurationSec  float64 `json:"durationSec"`
+	RowsPerSec   float64 `json:"rowsPerSec"`
+	P95BatchMs   float64 `json:"p95BatchMs"`
+	WalBytes     int64   `json:"walBytes"`
+	WalBytesNote string  `json:"walBytesNote,omitempty"`
+	// Throughput of earlier runs at this batch size, and the duration of a run
+	// over the whole table it predicts
+	BaselineIdsPerSec   float64 `json:"baselineIdsPerSec,omitempty"`
+	EstimatedFullRunSec float64 `json:"estimatedFullRunSec,omitempty"`
+}
+
+type benchReport struct {
+	Command     string        `json:"command"`
+	Database    string        `json:"database"`
+	Host        string        `json:"host"`
+	StartId     int           `json:"startId"`
+	EndId       int           `json:"endId"`
+	TableMaxId  int           `json:"tableMaxId"`
+	StartedAt   time.Time     `json:"startedAt"`
+	Results     []benchResult `json:"results"`
+	Recommended *benchResult  `json:"recommended,omitempty"`
+}
+
+func parseIntList(value string) ([]int, error) {
+	var values []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid value %q, expected a positive integer", part)
+		}
+		values = append(values, n)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("empty list")
+	}
+	return values, nil
+}
+
+func runBench() error {
+	env := config.GetConfig()
+
+	if *benchConfirmDisposable != env.DbName {
+		return fmt.Errorf("refusing to benchmark database %q: pass -i-confirm-disposable=%s to confirm it is a disposable copy",
+			env.DbName, env.DbName)
+	}
+
+	benched, ok := benchCommands[*benchCommand]
+	if !ok {
+		return &errs.ValidationError{Field: "-bench-command", Reason: fmt.Sprintf("%s cannot be benchmarked, supported commands: code-to-text, creation-time", *benchCommand)}
+	}
+
+	if *benchStartId <= 0 {
+		return &errs.ValidationError{Field: "-bench-start-id", Reason: fmt.Sprintf("%d must be at least 1", *benchStartId)}
+	}
+	if *benchEndId < *benchStartId {
+		return &errs.ValidationError{Field: "-bench-end-id", Reason: fmt.Sprintf("%d is below -bench-start-id %d", *benchEndId, *benchStartId)}
+	}
+
+	batchSizes, err := parseIntList(*benchBatchSizes)
+	if err != nil {
+		return &errs.ValidationError{Field: "-bench-batch-sizes", Reason: err.Error()}
+	}
+	workerCounts, err := parseIntList(*benchWorkers)
+	if err != nil {
+		return &errs.ValidationError{Field: "-bench-workers", Reason: err.Error()}
+	}
+
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	maxWorkers := 0
+	for _, workers := range workerCounts {
+		maxWorkers = max(maxWorkers, workers)
+	}
+	pool, err := openBatchPool(connStr, maxWorkers)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	if *benchCommand == "code-to-text" {
+		if _, err := db.Exec(`ALTER TABLE "TransactionDetails" ADD COLUMN IF NOT EXISTS codetext TEXT`); err != nil {
+			return fmt.Errorf("failed to create codetext column: %w", err)
+		}
+	}
+
+	table := benchTables[*benchCommand]
+	if err := createPerfBaselinesTable(db); err != nil {
+		return err
+	}
+	var tableMaxId int
+	if err := db.QueryRow(fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM "%s"`, table)).Scan(&tableMaxId); err != nil {
+		return fmt.Errorf("failed to get max %s ID: %w", table, err)
+	}
+
+	report := benchReport{
+		Command:    *benchCommand,
+		Database:   env.DbName,
+		Host:       env.DbHost,
+		StartId:    *benchStartId,
+		EndId:      *benchEndId,
+		TableMaxId: tableMaxId,
+		StartedAt:  time.Now().UTC(),
+	}
+
+	for _, batchSize := range batchSizes {
+		for _, workers := range workerCounts {
+			log.Printf("Benchmarking %s with batch size %d and %d workers over ids %d-%d",
+				*benchCommand, batchSize, workers, *benchStartId, *benchEndId)
+
+			// Read the baseline before recording this measurement into it
+			baseline, hasBaseline, err := loadPerfBaseline(db, *benchCommand, table, batchSize)
+			if err != nil {
+				return err
+			}
+
+			if reset, ok := benchResets[*benchCommand]; ok {
+				if err := reset(db, *benchStartId, *benchEndId); err != nil {
+					return err
+				}
+			}
+
+			result, err := benchConfiguration(db, pool, benched, batchSize, workers)
+			if err != nil {
+				return fmt.Errorf("benchmark with batch size %d and %d workers failed: %w", batchSize, workers, err)
+			}
+
+			ids := *benchEndId - *benchStartId + 1
+			rate := 0.0
+			if result.DurationSec > 0 {
+				rate = float64(ids) / result.DurationSec
+			}
+			if hasBaseline {
+				result.BaselineIdsPerSec = baseline.IdsPerSec
+				rate = baseline.IdsPerSec
+			}
+			if rate > 0 {
+				result.EstimatedFullRunSec = float64(tableMaxId) / rate
+			}
+
+			// The commands run with a single worker, so only that configuration
+			// makes a baseline for them
+			if workers == 1 {
+				if err := recordPerfBaseline(db, *benchCommand, table, batchSize, ids,
+					time.Duration(result.DurationSec*float64(time.Second)), "bench"); err != nil {
+					return err
+				}
+			}
+			report.Results = append(report.Results, result)
+		}
+	}
+
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].RowsPerSec > report.Results[j].RowsPerSec
+	})
+	if len(report.Results) > 0 && report.Results[0].Rows == 0 {
+		// Every configuration timed empty batches; a ranking would be noise
+		logNothingToDo(*benchCommand, *benchStartId, *benchEndId)
+	} else if len(report.Results) > 0 {
+		report.Recommended = &report.Results[0]
+	}
+
+	printBenchReport(report)
+
+	if *benchOutput != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode benchmark report: %w", err)
+		}
+		if err := os.WriteFile(*benchOutput, data, 0644); err != nil {
+			return fmt.Errorf("failed to write benchmark report: %w", err)
+		}
+		log.Printf("Benchmark report written to %s", *benchOutput)
+	}
+
+	return nil
+}
+
+func benchConfiguration(db *sql.DB, pool *pgxpool.Pool, benched benchedCommand, batchSize, workers int) (benchResult, error) {
+	walBefore, walErr := currentWalLsn(db)
+
+	var (
+		latencies []time.Duration
+		rows      int
+	)
+	runner := &batcher.Runner{
+		Pool:     pool,
+		Start:    *benchStartId,
+		End:      *benchEndId,
+		Size:     batchSize,
+		Workers:  workers,
+		Batch:    benched.batch,
+		Rollback: *dryRun,
+		Done: func(w batcher.Window, processed int, elapsed time.Duration, err error) error {
+			if err != nil {
+				return fmt.Errorf("batch %s: %w", w, err)
+			}
+			rows += processed
+			latencies = append(latencies, elapsed)
+			return nil
+		},
+	}
+	if benched.timeouts {
+		runner.LockTimeout, runner.StatementTimeout = codeBatchTimeouts()
+	}
+
+	started := time.Now()
+	if err := runner.Run(context.Background()); err != nil {
+		return benchResult{}, err
+	}
+	duration := time.Since(started)
+
+	result := benchResult{
+		BatchSize:   batchSize,
+		Workers:     workers,
+		Rows:        rows,
+		Batches:     len(latencies),
+		DurationSec: duration.Seconds(),
+		P95BatchMs:  float64(percentileDuration(latencies, 0.95).Microseconds()) / 1000.0,
+	}
+	if duration > 0 {
+		result.RowsPerSec = float64(rows) / duration.Seconds()
+	}
+
+	walAfter, err := currentWalLsn(db)
+	if walErr != nil || err != nil {
+		result.WalBytesNote = "WAL position unavailable"
+	} else {
+		if err := db.QueryRow(`SELECT pg_wal_lsn_diff($1, $2)::bigint`, walAfter, walBefore).Scan(&result.WalBytes); err != nil {
+			result.WalBytesNote = "WAL position unavailable"
+		}
+	}
+
+	return result, nil
+}
+
+func currentWalLsn(db *sql.DB) (string, error) {
+	var lsn string
+	err := db.QueryRow(`SELECT pg_current_wal_lsn()::text`).Scan(&lsn)
+	return lsn, err
+}
+
+func percentileDuration(values []time.Duration, percentile float64) time.Duration {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	index := int(float64(len(sorted))*percentile+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+func printBenchReport(report benchReport) {
+	log.Printf("Benchmark results for %s over ids %d-%d (fastest first):", report.Command, report.StartId, report.EndId)
+	log.Printf("%4s  %10s  %7s  %12s  %12s  %14s  %13s  %14s", "rank", "batch size", "workers", "rows/sec", "p95 batch ms", "WAL bytes", "baseline id/s", "est. full run")
+	for i, result := range report.Results {
+		wal := strconv.FormatInt(result.WalBytes, 10)
+		if result.WalBytesNote != "" {
+			wal = "n/a"
+		}
+		baseline := "n/a"
+		if result.BaselineIdsPerSec > 0 {
+			baseline = fmt.Sprintf("%.1f", result.BaselineIdsPerSec)
+		}
+		estimate := "n/a"
+		if result.EstimatedFullRunSec > 0 {
+			estimate = (time.Duration(result.EstimatedFullRunSec) * time.Second).String()
+		}
+		log.Printf("%4d  %10d  %7d  %12.1f  %12.1f  %14s  %13s  %14s", i+1, result.BatchSize, result.Workers, result.RowsPerSec, result.P95BatchMs, wal, baseline, estimate)
+	}
+
+	if report.Recommended != nil {
+		log.Printf("Recommended: batch size %d with %d workers", report.Recommended.BatchSize, report.Recommended.Workers)
+	}
+}
+
+func Bench(ctx context.Context, cfg *config.Config) error {
+	return runBench()
+}
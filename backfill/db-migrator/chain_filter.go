@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -chains restricts code-to-text, creation-time and reconcile to some chains,
+// e.g. those a bad deployment touched. Their WHERE clauses select the rows of the
+// given chainId values, through Transactions where a table has no chainId of its
+// own, and their progress counts the rows of those chains only. The ids are
+// checked against the chains of the configured network once it is loaded, since
+// a devnet may have fewer than the 20 of mainnet.
+
+// chainFilter is the value of -chains: the chain ids to restrict the rows to,
+// sorted and without duplicates, every chain when empty.
+type chainFilter []int
+
+// chainFilterFlag defines a -chains style flag, like flag.String does.
+func chainFilterFlag(name, usage string) *chainFilter {
+	filter := &chainFilter{}
+	flag.Var(filter, name, usage)
+	return filter
+}
+
+func (f *chainFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, len(*f))
+	for i, chain := range *f {
+		parts[i] = strconv.Itoa(chain)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *chainFilter) Set(value string) error {
+	chains, err := parseChainList(value)
+	if err != nil {
+		return err
+	}
+	seen := make(map[int]bool, len(chains))
+	filter := make(chainFilter, 0, len(chains))
+	for _, chain := range chains {
+		if !seen[int(chain)] {
+			seen[int(chain)] = true
+			filter = append(filter, int(chain))
+		}
+	}
+	sort.Ints(filter)
+	*f = filter
+	return nil
+}
+
+// validate checks that every chain is one of those of network.
+func (f chainFilter) validate(network config.NetworkInfo) error {
+	for _, chain := range f {
+		if !network.HasChain(chain) {
+			return &errs.ValidationError{Field: "-chains",
+				Reason: fmt.Sprintf("invalid chain %d: %s has chains 0-%d", chain, network.Name, network.ChainCount-1)}
+		}
+	}
+	return nil
+}
+
+// active reports whether the rows are restricted to some chains.
+func (f chainFilter) active() bool {
+	return len(f) > 0
+}
+
+// condition selects the rows whose chainId column is one of the chains, every
+// row without -chains. The ids are integers checked by Set, so they are inlined.
+func (f chainFilter) condition(column string) string {
+	if !f.active() {
+		return "TRUE"
+	}
+	return fmt.Sprintf("%s IN (%s)", column, f.String())
+}
+
+// transactionCondition selects the rows whose transactionId column references a
+// transaction of one of the chains, for the tables without a chainId.
+func (f chainFilter) transactionCondition(column string) string {
+	if !f.active() {
+		return "TRUE"
+	}
+	return fmt.Sprintf(`%s IN (SELECT id FROM "Transactions" WHERE %s)`, column, f.condition(`"chainId"`))
+}
+
+// describe names the chains for the logs.
+func (f chainFilter) describe() string {
+	if !f.active() {
+		return "all chains"
+	}
+	return "chains " + f.String()
+}
+
+// countChainRows counts the rows of table, which has a chainId column, with ids
+// in [startId, endId] on the chains.
+func countChainRows(db *sql.DB, table string, startId, endId int) (int, error) {
+	var count int
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM "%s" WHERE id >= $1 AND id <= $2 AND %s`, table, chains.condition(`"chainId"`))
+	if err := db.QueryRow(query, startId, endId).Scan(&count); err != nil {
+		return 0, errs.FromDB(fmt.Sprintf("failed to count the %s rows of %s", table, chains.describe()), err)
+	}
+	return count, nil
+}
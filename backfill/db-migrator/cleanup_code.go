@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+)
+
+const codeCleanupCheckpointKey = "cleanup-code"
+
+// This script reclaims the space of the jsonb code column once code-to-text is
+// done and verified, without waiting for finalize-code-to-text to drop it. It
+// sets code to NULL on the rows whose codetext holds its conversion, leaving the
+// codetext as the only copy; finalize-code-to-text, verify-code-to-text and
+// rollback-code-to-text know those rows by their NULL code and set codetext.
+// Every batch checks again that the code is a string whose conversion is the
+// codetext, so a row changed since it was verified keeps its code.
+//
+// It runs as a descendingRun like code-to-text, its checkpoint being
+// cleanup-code, and only with -yes. It refuses to run unless the last
+// verify-code-to-text run found no mismatch, and clears no row above the range
+// that run covered; -force overrides both. With -vacuum, VACUUM (ANALYZE) runs on
+// the table at the end, so the space freed can be reused.
+
+// codeCleanupCondition selects the rows whose code can be cleared: a string
+// whose conversion is the codetext.
+const codeCleanupCondition = codeCandidateCondition + ` AND (` + codeConvertibleCondition + `) AND codetext IS NOT NULL AND codetext = (` + codeTextConversion + `)`
+
+func cleanupCode(ctx context.Context, cfg *config.Config) error {
+	if !*rollbackYes {
+		return &errs.ValidationError{Field: "-yes", Reason: "cleanup-code clears the jsonb code and only runs with -yes"}
+	}
+	pause, targetBatch, err := validateDescendingFlags()
+	if err != nil {
+		return err
+	}
+
+	connStr := cfg.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	codeType, err := columnType(db, "TransactionDetails", "code")
+	if err != nil {
+		return err
+	}
+	codeTextType, err := columnType(db, "TransactionDetails", "codetext")
+	if err != nil {
+		return err
+	}
+	if codeType != "jsonb" || codeTextType != "text" {
+		return &errs.SchemaError{Missing: "TransactionDetails.codetext",
+			Reason: fmt.Sprintf("expected jsonb code and text codetext columns, found code %q and codetext %q; there is no jsonb code left to clean up", codeType, codeTextType)}
+	}
+
+	verifiedEndId, err := checkCodeVerified(db)
+	if err != nil {
+		return err
+	}
+
+	if err := createWatermarksTable(db); err != nil {
+		return err
+	}
+
+	maxTransactionID, err := descendingEndId(db, codeCleanupCheckpointKey)
+	if err != nil {
+		return err
+	}
+	if verifiedEndId > 0 && maxTransactionID > verifiedEndId {
+		log.Printf("Capping at id %d, the last id verify-code-to-text checked", verifiedEndId)
+		maxTransactionID = verifiedEndId
+	}
+
+	if maxTransactionID < *codeStart {
+		logNothingToDo("TransactionDetails", *codeStart, maxTransactionID)
+		log.Println("Completed processing. Total TransactionDetails code cleared: 0 (100.0%)")
+		return nil
+	}
+
+	// Every worker holds one connection for its batch transaction, and paging
+	// the next batch takes one more
+	pool, err := openBatchPool(connStr, *codeWorkers+1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	run := &descendingRun{
+		command:    "cleanup-code",
+		table:      "TransactionDetails",
+		checkpoint: codeCleanupCheckpointKey,
+		pending:    codeCleanupCondition,
+		candidate:  `codetext IS NOT NULL`,
+		verb:       "clean up",
+		done:       "cleaned up",
+		startId:    *codeStart,
+		endId:      maxTransactionID,
+		batchSize:  *codeBatch,
+		workers:    *codeWorkers,
+		throttle:   newCodeThrottle(*maxRowsPerSec, *sleepBetweenBatches, pause),
+		sizer:      newBatchSizer(*codeBatch, targetBatch, *minBatchSize, *maxBatchSize),
+		batch:      clearCodeBatch,
+		summary: func(totals descendingTotals) {
+			log.Printf("Completed processing. Total TransactionDetails code cleared: %d (100.0%%)", totals.processed)
+			log.Printf("Already cleared or not matching their codetext, left alone: %d", totals.alreadyDone)
+		},
+	}
+	if err := run.run(ctx, db, pool); err != nil {
+		return fmt.Errorf("failed to process transactions: %w", err)
+	}
+
+	if *cleanupVacuum {
+		log.Println(`Running VACUUM (ANALYZE) on "TransactionDetails"; it needs to be run by the table's owner or a superuser`)
+		if _, err := db.Exec(`VACUUM (ANALYZE) "TransactionDetails"`); err != nil {
+			return errs.FromDB("code was cleared but VACUUM (ANALYZE) failed; run it as the table's owner", err)
+		}
+		log.Println("VACUUM (ANALYZE) done: the space freed is reusable by the table, VACUUM FULL would return it to the system")
+	}
+
+	log.Printf("Successfully cleared the code of TransactionDetails up to id %d", maxTransactionID)
+	log.Println("Run finalize-code-to-text to swap codetext into place")
+	return nil
+}
+
+// checkCodeVerified checks the last verify-code-to-text run covers -start-id and
+// found no mismatch, returning the last id it checked. With -force it only warns,
+// returning 0.
+func checkCodeVerified(db *sql.DB) (int, error) {
+	v, err := readVerification(db, "verify-code-to-text")
+	if err != nil {
+		return 0, err
+	}
+
+	var problem string
+	switch {
+	case v == nil:
+		problem = "verify-code-to-text has not been run"
+	case v.Mismatched > 0:
+		problem = fmt.Sprintf("verify-code-to-text found %d mismatched rows on %s", v.Mismatched, v.VerifiedAt.Format("2006-01-02 15:04:05"))
+	case *codeStart < v.StartId:
+		problem = fmt.Sprintf("verify-code-to-text checked ids %d-%d only, not from -start-id %d", v.StartId, v.EndId, *codeStart)
+	}
+	if problem == "" {
+		log.Printf("verify-code-to-text checked ids %d-%d on %s without mismatch", v.StartId, v.EndId, v.VerifiedAt.Format("2006-01-02 15:04:05"))
+		return v.EndId, nil
+	}
+	if !*forceRun {
+		return 0, fmt.Errorf("refusing to clean up code: %s; run verify-code-to-text, or pass -force", problem)
+	}
+	log.Printf("WARNING: %s, continuing because -force is set", problem)
+	return 0, nil
+}
+
+// clearCodeBatch sets the code of the rows of the batch matching pending to NULL.
+func clearCodeBatch(ctx context.Context, tx *batcher.Tx, startId, endId int, pending string) (codeBatchResult, error) {
+	ids := batcher.IDs(ctx)
+	updated, err := execBatchUpdate(ctx, tx, fmt.Sprintf(`
+		UPDATE "TransactionDetails"
+		SET code = NULL
+		WHERE id = ANY($1::int[]) AND %s
+	`, pending), ids)
+	if err != nil {
+		return codeBatchResult{}, err
+	}
+
+	// The ids paged in whose code changed since
+	result := codeBatchResult{updated: updated, alreadyDone: len(ids) - updated}
+	log.Printf("Processed %d records in batch %d-%d, %d left alone", result.updated, startId, endId, result.alreadyDone)
+	return result, nil
+}
+
+func CleanupCode(ctx context.Context, cfg *config.Config) error {
+	return cleanupCode(ctx, cfg)
+}
@@ -1,228 +1,567 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"go-backfill/batcher"
 	"go-backfill/config"
+	"go-backfill/errs"
 	"log"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
 
 const (
+	// Defaults of -batch-size and -start-id
 	codeBatchSize             = 500
 	startTransactionIdForCode = 1
+	codeCheckpointKey         = "code-to-text"
 )
 
 // This script was created to convert the code column in the TransactionDetails table to text.
 // Use it ONLY if the migration 20251010161634-change-code-column-type-in-transactiondetails doesn't work
 // properly due lack of memory in the machine.
+// It fills the codetext column; finalize-code-to-text then swaps it into place.
+//
+// It runs as a descendingRun, its checkpoint being code-to-text. A row whose
+// codetext is already set is never rewritten; with -repair, one whose codetext
+// doesn't match its code is.
+
+// codeTextConversion is the text value codetext must hold for a jsonb code.
+const codeTextConversion = `CASE WHEN code IS NULL OR code = '{}'::jsonb THEN NULL ELSE code #>> '{}' END`
+
+// codeValidationChunk is how many rows of a batch are validated per query.
+const codeValidationChunk = 1000
+
+// codeConvertibleCondition holds for the code values code-to-text converts: a
+// NULL, a {} or a string.
+const codeConvertibleCondition = `code IS NULL OR code = '{}'::jsonb OR jsonb_typeof(code) = 'string'`
+
+// codeCandidateCondition selects the rows whose codetext isn't NULL once
+// converted; a NULL or {} code never has to be.
+const codeCandidateCondition = `code IS NOT NULL AND code <> '{}'::jsonb`
+
+// codeCleanedCondition holds for the rows whose code cleanup-code cleared: a
+// NULL code with a codetext. A NULL code converts to a NULL codetext, so
+// code-to-text never leaves one, and the checks comparing codetext with its code
+// leave them out.
+const codeCleanedCondition = `code IS NULL AND codetext IS NOT NULL`
+
+// codeRoundTripQuery returns the lowest id, 0 for none, of a random sample of
+// string code values of the rows selected whose codetext doesn't turn back into
+// the code. Its last parameter is the sample size.
+func codeRoundTripQuery(selection string, sampleParam int) string {
+	return fmt.Sprintf(`
+		SELECT COALESCE(MIN(id), 0)
+		FROM (
+			SELECT id, to_jsonb(codetext) IS DISTINCT FROM code AS mismatched
+			FROM "TransactionDetails"
+			WHERE %s AND jsonb_typeof(code) = 'string'
+			ORDER BY random()
+			LIMIT $%d
+		) sample
+		WHERE mismatched
+	`, selection, sampleParam)
+}
 
-func updateCodeToText() error {
-	env := config.GetConfig()
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		env.DbHost, env.DbPort, env.DbUser, env.DbPassword, env.DbName)
-
-	db, err := sql.Open("postgres", connStr)
+// codePendingCondition returns the condition selecting the rows still to
+// convert: the candidates without a codetext, or with -repair every row whose
+// codetext isn't its conversion but those cleanup-code cleared. A dry run doesn't add codetext, so without it
+// every candidate is.
+func codePendingCondition(db *sql.DB) (string, error) {
+	codeTextType, err := columnType(db, "TransactionDetails", "codetext")
 	if err != nil {
-		return fmt.Errorf("failed to connect to database: %v", err)
+		return "", err
 	}
-	defer db.Close()
-
-	log.Println("Connected to database")
+	return codePendingConditionFor(codeTextType != ""), nil
+}
 
-	// Test database connection
-	if err := db.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %v", err)
+func codePendingConditionFor(hasCodeText bool) string {
+	switch {
+	case !hasCodeText:
+		return codeCandidateCondition
+	case *codeRepair:
+		return `codetext IS DISTINCT FROM (` + codeTextConversion + `) AND NOT (` + codeCleanedCondition + `)`
 	}
+	return codeCandidateCondition + ` AND codetext IS NULL`
+}
 
-	// Create codetext column if it doesn't exist
-	_, err = db.Exec(`
-		ALTER TABLE "TransactionDetails" 
-		ADD COLUMN IF NOT EXISTS codetext TEXT
-	`)
+// updateCodeToText runs code-to-text on db until it is done or ctx is canceled.
+// Its batches run on a pool of their own, connected to connStr, and are
+// validated on the replica at replicaConnStr unless it is empty.
+func updateCodeToText(ctx context.Context, db *sql.DB, connStr, replicaConnStr string) error {
+	pause, targetBatch, err := validateDescendingFlags()
 	if err != nil {
-		return fmt.Errorf("failed to create codetext column: %v", err)
+		return err
 	}
-
-	// Get max transaction ID to determine processing range
-	var maxTransactionID int
-	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "TransactionDetails"`).Scan(&maxTransactionID); err != nil {
-		return fmt.Errorf("failed to get max transaction ID: %v", err)
+	if !onInvalidModes[*onInvalid] {
+		return &errs.ValidationError{Field: "-on-invalid", Reason: fmt.Sprintf("%q is not one of abort, skip, quarantine", *onInvalid)}
 	}
-
-	if maxTransactionID == 0 {
-		log.Println("No transaction details found; nothing to update")
-		return nil
+	if *codeRoundTripSample < 0 {
+		return &errs.ValidationError{Field: "-verify-round-trip", Reason: fmt.Sprintf("%d must not be negative", *codeRoundTripSample)}
+	}
+	var backupComplete int64
+	if *backupFile != "" {
+		complete, err := checkCodeBackup(*backupFile)
+		if err != nil {
+			return err
+		}
+		backupComplete = complete
 	}
 
-	// Process transactions in batches
-	if err := processTransactionsBatchForCode(db, startTransactionIdForCode, maxTransactionID); err != nil {
-		return fmt.Errorf("failed to process transactions: %v", err)
+	if *codeCountOnly {
+		return countCodeToText(db)
 	}
 
-	// Drop code column
-	_, err = db.Exec(`
-		ALTER TABLE "TransactionDetails" 
-		DROP COLUMN IF EXISTS code
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to drop code column: %v", err)
+	if *dryRun {
+		log.Println("Dry run: invalid code values are reported, nothing is updated")
+	} else {
+		if *auditMode {
+			if err := createAuditTrailTable(db); err != nil {
+				return err
+			}
+		}
+
+		// Create codetext column if it doesn't exist
+		_, err := db.Exec(`
+			ALTER TABLE "TransactionDetails" 
+			ADD COLUMN IF NOT EXISTS codetext TEXT
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to create codetext column: %w", err)
+		}
+
+		if err := createWatermarksTable(db); err != nil {
+			return err
+		}
+
+		if *onInvalid == onInvalidQuarantine {
+			if err := createCodeQuarantineTable(db); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Rename codetext column to code
-	_, err = db.Exec(`
-		ALTER TABLE "TransactionDetails" 
-		RENAME COLUMN codetext TO code
-	`)
+	// Get the top of the processing range, from -end-id or the max id and the checkpoint
+	maxTransactionID, err := descendingEndId(db, codeCheckpoint())
 	if err != nil {
-		return fmt.Errorf("failed to rename codetext column: %v", err)
+		return err
 	}
 
-	log.Println("Successfully updated all TransactionDetails code values to text")
-	log.Printf("Max(TransactionDetails.id) processed: %d", maxTransactionID)
-	return nil
-}
-
-func processTransactionsBatchForCode(db *sql.DB, startId, endId int) error {
-	currentMaxId := endId
-	totalProcessed := 0
-	totalTransactions := endId - startId + 1
-	lastProgressPrinted := -1.0
-
-	log.Printf("Starting to process transactions from ID %d down to %d", endId, startId)
-	log.Printf("Total transactions to process: %d", totalTransactions)
+	if maxTransactionID < *codeStart {
+		logNothingToDo("TransactionDetails", *codeStart, maxTransactionID)
+		log.Println("Completed processing. Total TransactionDetails updated: 0 (100.0%)")
+		return nil
+	}
 
-	for currentMaxId >= startId {
-		// Calculate this batch's lower bound (inclusive)
-		batchMinId := currentMaxId - codeBatchSize + 1
-		if batchMinId < startId {
-			batchMinId = startId
+	var backup *codeBackup
+	if *backupFile != "" && !*dryRun {
+		backup, err = openCodeBackup(*backupFile, backupComplete, *codeStart, maxTransactionID)
+		if err != nil {
+			return err
 		}
+		// Also on a failed or interrupted run
+		onExit(func() { backup.Close() })
+		defer backup.Close()
+		log.Printf("Backing up the code of updated rows to %s", *backupFile)
+	}
 
-		// Process this batch [batchMinId, currentMaxId]
-		processed, err := processBatchForCode(db, batchMinId, currentMaxId)
+	// Every worker holds one connection for its batch transaction, and paging
+	// the next batch takes one more
+	pool, err := openBatchPool(connStr, *codeWorkers+1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// Workers validate their batch on the replica, when there is one, before
+	// taking their primary connection
+	var replica *pgxpool.Pool
+	if replicaConnStr != "" {
+		replica, err = openBatchPool(replicaConnStr, *codeWorkers)
 		if err != nil {
-			return fmt.Errorf("failed to process batch %d-%d: %v", batchMinId, currentMaxId, err)
+			return fmt.Errorf("replica: %w", err)
 		}
+		defer replica.Close()
+		log.Println("Validating batches on the replica")
+	}
 
-		totalProcessed += processed
-
-		// Move to next window (just below the batch we processed)
-		currentMaxId = batchMinId - 1
+	// Process transactions in batches
+	throttle := newCodeThrottle(*maxRowsPerSec, *sleepBetweenBatches, pause)
+	sizer := newBatchSizer(*codeBatch, targetBatch, *minBatchSize, *maxBatchSize)
+	if err := processTransactionsBatchForCode(ctx, db, pool, replica, *codeStart, maxTransactionID, *codeBatch, *codeWorkers, throttle, sizer, backup); err != nil {
+		return fmt.Errorf("failed to process transactions: %w", err)
+	}
 
-		// Calculate progress percentage based on covered ID space
-		processedSpan := endId - currentMaxId // how many IDs from the top have been covered
-		if processedSpan > totalTransactions {
-			processedSpan = totalTransactions
-		}
-		progressPercent := (float64(processedSpan) / float64(totalTransactions)) * 100.0
+	if *dryRun {
+		return nil
+	}
 
-		// Only print progress if it has increased by at least 0.1%
-		if progressPercent-lastProgressPrinted >= 0.1 {
-			log.Printf("Progress: %.1f%%, currentMaxId: %d", progressPercent, currentMaxId)
-			lastProgressPrinted = progressPercent
+	if backup != nil {
+		if err := backup.Close(); err != nil {
+			return err
 		}
 	}
 
-	log.Printf("Completed processing. Total TransactionDetails updated: %d (100.0%%)", totalProcessed)
+	log.Println("Successfully converted all TransactionDetails code values into codetext")
+	log.Printf("Max(TransactionDetails.id) processed: %d", maxTransactionID)
+	log.Println("Run finalize-code-to-text to swap codetext into place")
 	return nil
 }
 
-func processBatchForCode(db *sql.DB, startId, endId int) (int, error) {
-	// Begin transaction for atomic operation
-	tx, err := db.Begin()
+// codeCheckpoint is the watermark key of the code-to-text checkpoint.
+func codeCheckpoint() string {
+	return chainCheckpoint(codeCheckpointKey)
+}
+
+func processTransactionsBatchForCode(ctx context.Context, db *sql.DB, pool, replica *pgxpool.Pool, startId, endId, batchSize, workers int, throttle *codeThrottle, sizer *batchSizer, backup *codeBackup) error {
+	pending, err := codePendingCondition(db)
 	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+		return err
 	}
-	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
 
-	// Get all records in this batch and validate them
-	rows, err := tx.Query(`
-		SELECT id, code
+	run := &descendingRun{
+		command:    "code-to-text",
+		table:      "TransactionDetails",
+		checkpoint: codeCheckpoint(),
+		pending:    pending,
+		candidate:  codeCandidateCondition,
+		verb:       "convert",
+		done:       "converted",
+		startId:    startId,
+		endId:      endId,
+		batchSize:  batchSize,
+		workers:    workers,
+		throttle:   throttle,
+		sizer:      sizer,
+		batch: func(ctx context.Context, tx *batcher.Tx, startId, endId int, pending string) (codeBatchResult, error) {
+			return convertCodeBatch(ctx, tx, replica, startId, endId, pending, backup)
+		},
+		summary: func(totals descendingTotals) {
+			log.Printf("Completed processing. Total TransactionDetails updated: %d (100.0%%)", totals.processed)
+			log.Printf("Already converted and left alone: %d", totals.alreadyDone)
+			if replica != nil {
+				log.Printf("Left out as no longer a string or {} on the primary: %d", totals.unsafe)
+			}
+		},
+		leftOut: logInvalidCodes,
+	}
+	return run.run(ctx, db, pool)
+}
+
+// codeBatchTimeouts returns the lock_timeout and statement_timeout of a batch,
+// from the flags or else the environment.
+func codeBatchTimeouts() (string, string) {
+	env := config.GetConfig()
+	lockTimeout, statementTimeout := *batchLockTimeout, *batchStatementTimeout
+	if lockTimeout == "" {
+		lockTimeout = env.BatchLockTimeout
+	}
+	if statementTimeout == "" {
+		statementTimeout = env.BatchStatementTimeout
+	}
+	return lockTimeout, statementTimeout
+}
+
+// processBatchForCode converts the rows of the batch [startId, endId] still to
+// convert on pool, leaving out the invalid code values as -on-invalid says.
+func processBatchForCode(pool *pgxpool.Pool, startId, endId int) (int, error) {
+	lockTimeout, statementTimeout := codeBatchTimeouts()
+	runner := &batcher.Runner{Pool: pool, LockTimeout: lockTimeout, StatementTimeout: statementTimeout, Batch: convertCodeRange}
+	return runner.RunBatch(context.Background(), batcher.Window{Start: startId, End: endId})
+}
+
+// convertCodeRange converts every row of [startId, endId] still to convert in tx.
+func convertCodeRange(ctx context.Context, tx *batcher.Tx, startId, endId int) (int, error) {
+	// bench adds codetext before the first batch
+	result, err := convertCodeBatch(ctx, tx, nil, startId, endId, codePendingConditionFor(true), nil)
+	return result.updated, err
+}
+
+// convertCodeBatch converts the rows of the batch matching pending in tx,
+// validating them on replica when there is one and in tx otherwise. With a backup, the
+// update returns the code of the rows it updates, which is written to the backup
+// before the batch commits; a failed write aborts the batch.
+//
+// The batch takes two round trips on the primary: one beginning the transaction
+// and validating the first chunk of rows, and one updating the rows and
+// committing. Batches of more than codeValidationChunk rows take one more per
+// further chunk. Validated on a replica, it takes one round trip on the primary.
+// With -verify-round-trip or a backup, the commit takes one more.
+func convertCodeBatch(ctx context.Context, tx *batcher.Tx, replica *pgxpool.Pool, startId, endId int, pending string, backup *codeBackup) (codeBatchResult, error) {
+	// The ids paged in, or every row of the range
+	selection, args := `id >= $1 AND id <= $2`, []interface{}{startId, endId}
+	if ids := batcher.IDs(ctx); ids != nil {
+		selection, args = `id = ANY($1::int[])`, []interface{}{ids}
+	}
+
+	// Validate the records of this batch in chunks, each checked server-side, so
+	// no code value is read whatever its size or the batch size
+	validateQuery := fmt.Sprintf(`
+		SELECT id, %[1]s, %[2]s, %[3]s
 		FROM "TransactionDetails"
-		WHERE id >= $1 AND id <= $2
+		WHERE %[4]s AND id < $%[5]d
 		ORDER BY id DESC
-	`, startId, endId)
-	if err != nil {
-		log.Fatalf("Failed to query records: %v", err)
+		LIMIT %[6]d
+	`, pending, codeCandidateCondition, codeConvertibleCondition, selection, len(args)+1, codeValidationChunk)
+
+	// The update covers every pending row selected but the invalid ones
+	var (
+		result  = codeBatchResult{invalidIds: []int{}}
+		inRange int
+		below   = endId + 1
+	)
+	validate := func(rows pgx.Rows) (int, error) {
+		defer rows.Close()
+		chunk := 0
+		for rows.Next() {
+			var (
+				id                     int
+				isPending, isCandidate bool
+				// A NULL, a {} or a string
+				convertible bool
+			)
+			if err := rows.Scan(&id, &isPending, &isCandidate, &convertible); err != nil {
+				return 0, errs.FromDB("failed to scan record", err)
+			}
+			chunk++
+			below = id
+
+			// Rows already converted are neither checked nor rewritten
+			if !isPending {
+				if isCandidate {
+					result.alreadyDone++
+				}
+				continue
+			}
+			inRange++
+
+			// If neither string nor {}, abort unless told otherwise
+			if !convertible {
+				if *onInvalid == onInvalidAbort {
+					return 0, &errs.ValidationError{RowID: int64(id), Field: "code", Reason: "neither a string nor {}"}
+				}
+				result.invalidIds = append(result.invalidIds, id)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return 0, errs.FromDB("error iterating records", err)
+		}
+		return chunk, nil
 	}
-	defer rows.Close()
 
-	// Check each record in the batch
-	for rows.Next() {
-		var (
-			id   int
-			code []byte
-		)
-		if err := rows.Scan(&id, &code); err != nil {
-			log.Fatalf("Failed to scan record: %v", err)
+	// Validate every chunk on the replica before taking a primary connection
+	if replica != nil {
+		replicaConn, err := replica.Acquire(ctx)
+		if err != nil {
+			return codeBatchResult{}, errs.FromDB("failed to acquire replica connection", err)
 		}
-
-		// Skip NULL values
-		if code == nil {
-			continue
+		for chunk := codeValidationChunk; chunk == codeValidationChunk; {
+			rows, err := replicaConn.Query(ctx, validateQuery, append(args, below)...)
+			if err != nil {
+				replicaConn.Release()
+				return codeBatchResult{}, errs.FromDB("failed to query records on the replica", err)
+			}
+			if chunk, err = validate(rows); err != nil {
+				replicaConn.Release()
+				return codeBatchResult{}, err
+			}
 		}
+		replicaConn.Release()
+	}
 
-		// Check if it's a string or {}
-		isString := false
-		isEmptyObject := string(code) == "{}"
+	if replica == nil {
+		// The first chunk is validated in the round trip beginning the transaction
+		begin := &pgx.Batch{}
+		begin.Queue(validateQuery, append(args, below)...)
 
-		if !isEmptyObject {
-			// If it's not {}, check if it's a string
-			isString = string(code)[0] == '"' && string(code)[len(string(code))-1] == '"'
+		results := tx.SendBatch(ctx, begin)
+		rows, err := results.Query()
+		if err != nil {
+			results.Close()
+			return codeBatchResult{}, errs.FromDB("failed to query records", err)
 		}
-
-		// If neither string nor {}, abort
-		if !isString && !isEmptyObject {
-			log.Fatalf("ABORTING: Found invalid code value at id %d", id)
+		chunk, err := validate(rows)
+		results.Close()
+		if err != nil {
+			return codeBatchResult{}, err
+		}
+		for chunk == codeValidationChunk {
+			rows, err := tx.Query(ctx, validateQuery, append(args, below)...)
+			if err != nil {
+				return codeBatchResult{}, errs.FromDB("failed to query records", err)
+			}
+			if chunk, err = validate(rows); err != nil {
+				return codeBatchResult{}, err
+			}
 		}
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatalf("Error iterating records: %v", err)
+
+	if *dryRun {
+		result.updated = inRange - len(result.invalidIds)
+		return result, nil
 	}
-	rows.Close()
 
-	// If we get here, all values in this batch are valid (string or {})
+	// If we get here, all values in this batch are valid (string or {}) or left out
 	log.Printf("About to update batch: startId=%d, endId=%d", startId, endId)
 
-	updateQuery := `
+	// Validated on the replica, the update begins the transaction
+	update := &pgx.Batch{}
+	quarantine := *onInvalid == onInvalidQuarantine && len(result.invalidIds) > 0
+	if quarantine {
+		queueQuarantineCodes(update, result.invalidIds)
+	}
+
+	var (
+		hashBefore, hashAfter []auditStatement
+		err                   error
+	)
+	if *auditMode {
+		if hashBefore, err = auditBeforeStatements("TransactionDetails", "id", startId, endId); err != nil {
+			return codeBatchResult{}, err
+		}
+		if hashAfter, err = auditAfterStatements("TransactionDetails", "id", startId, endId); err != nil {
+			return codeBatchResult{}, err
+		}
+	}
+	for _, statement := range hashBefore {
+		update.Queue(statement.query, statement.args...)
+	}
+
+	// The update checks again that every code is a NULL, a {} or a string, so
+	// that a row changed since it was validated, on a lagging replica in
+	// particular, is never converted
+	leftOut := len(args) + 1
+	returning := "id"
+	if backup != nil {
+		// code-to-text never changes code, so this is the value backed up
+		returning = "id, code"
+	}
+	updateQuery := fmt.Sprintf(`
 		UPDATE "TransactionDetails"
-		SET codetext = CASE
-			WHEN code IS NULL OR code = '{}'::jsonb THEN NULL
-			ELSE code #>> '{}'
-		END
-		WHERE id >= $1 AND id <= $2
-		RETURNING id
-	`
-
-	updateRows, err := tx.Query(updateQuery, startId, endId)
+		SET codetext = %s
+		WHERE %s AND %s AND (%s) AND id <> ALL($%d::int[])
+		RETURNING %s
+	`, codeTextConversion, selection, pending, codeConvertibleCondition, leftOut, returning)
+	update.Queue(updateQuery, append(args, result.invalidIds)...)
+	if replica != nil {
+		// The rows the check above left out are still pending
+		update.Queue(fmt.Sprintf(`
+			SELECT COUNT(*)
+			FROM "TransactionDetails"
+			WHERE %s AND %s AND NOT (%s) AND id <> ALL($%d::int[])
+		`, selection, pending, codeConvertibleCondition, leftOut), append(args, result.invalidIds)...)
+	}
+
+	// With -verify-round-trip the batch commits once its sample checked out, and
+	// with a backup once the file has the rows, in a round trip of its own
+	roundTrip := *codeRoundTripSample > 0
+	commitApart := roundTrip || backup != nil
+	if roundTrip {
+		update.Queue(codeRoundTripQuery(selection, len(args)+1), append(args, *codeRoundTripSample)...)
+	}
+
+	for _, statement := range hashAfter {
+		update.Queue(statement.query, statement.args...)
+	}
+	if !commitApart {
+		tx.QueueEnd(update)
+	}
+
+	// The results are read in the order queued
+	results := tx.SendBatch(ctx, update)
+	defer results.Close()
+
+	if quarantine {
+		if _, err := results.Exec(); err != nil {
+			return codeBatchResult{}, errs.FromDB(fmt.Sprintf("failed to quarantine %d invalid code values", len(result.invalidIds)), err)
+		}
+	}
+	for _, statement := range hashBefore {
+		if _, err := results.Exec(); err != nil {
+			return codeBatchResult{}, errs.FromDB(statement.failure, err)
+		}
+	}
+
+	updateRows, err := results.Query()
 	if err != nil {
-		log.Fatalf("Failed to update records: %v", err)
+		return codeBatchResult{}, errs.FromDB("failed to update records", err)
+	}
+	if backup != nil {
+		if result.updated, err = backup.writeRows(updateRows); err != nil {
+			return codeBatchResult{}, err
+		}
+	} else {
+		for updateRows.Next() {
+			result.updated++
+		}
+		updateRows.Close()
+		if err := updateRows.Err(); err != nil {
+			return codeBatchResult{}, errs.FromDB("error iterating update rows", err)
+		}
 	}
-	defer updateRows.Close()
 
-	var processed int
-	for updateRows.Next() {
-		processed++
+	if replica != nil {
+		if err := results.QueryRow().Scan(&result.unsafe); err != nil {
+			return codeBatchResult{}, errs.FromDB("failed to count the rows left out by the safety check", err)
+		}
 	}
 
-	log.Printf("Processed %d records in this batch", processed)
+	if roundTrip {
+		var mismatchedId int
+		if err := results.QueryRow().Scan(&mismatchedId); err != nil {
+			return codeBatchResult{}, errs.FromDB("failed to check that codetext round-trips", err)
+		}
+		if mismatchedId != 0 {
+			return codeBatchResult{}, &errs.ValidationError{RowID: int64(mismatchedId), Field: "codetext", Reason: "to_jsonb(codetext) doesn't give back the code"}
+		}
+	}
 
-	if err := updateRows.Err(); err != nil {
-		log.Fatalf("Error iterating update rows: %v", err)
+	log.Printf("Processed %d records in this batch, %d already converted", result.updated, result.alreadyDone)
+	if result.unsafe > 0 {
+		log.Printf("Warning: left out %d rows of batch %d-%d whose code is no longer a string or {} on the primary", result.unsafe, startId, endId)
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		log.Fatalf("Failed to commit transaction: %v", err)
+	for _, statement := range hashAfter {
+		if _, err := results.Exec(); err != nil {
+			return codeBatchResult{}, errs.FromDB(statement.failure, err)
+		}
 	}
 
-	return processed, nil
+	// Commit the transaction, or with commitApart leave it to the runner
+	if !commitApart {
+		if _, err := results.Exec(); err != nil {
+			return codeBatchResult{}, errs.FromDB("failed to commit transaction", err)
+		}
+	}
+	if err := results.Close(); err != nil {
+		return codeBatchResult{}, errs.FromDB("failed to commit transaction", err)
+	}
+	return result, nil
 }
 
-func CodeToText() {
-	if err := updateCodeToText(); err != nil {
-		log.Fatalf("Error: %v", err)
+func CodeToText(ctx context.Context, cfg *config.Config) error {
+	connStr := cfg.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	var replicaConnStr string
+	if cfg.HasReplica() {
+		replicaConnStr = cfg.ReplicaDSN()
 	}
+	return updateCodeToText(ctx, db, connStr, replicaConnStr)
 }
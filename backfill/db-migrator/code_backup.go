@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backfill/errs"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// With -backup-file, code-to-text keeps the (id, code) pairs of every row it
+// updates in a gzip-compressed NDJSON file. Each run appends a header record
+// naming the command, the time and the id range; rows follow as
+// {"id":…,"code":…}, code being the raw jsonb value and left out when it is NULL.
+// The update of a batch returns the code of the rows it updates, which is
+// streamed to the file a row at a time before the batch commits, so no row is
+// updated without its code in the file and no batch is held in memory. A batch
+// failing after its rows were written leaves them in the file with the code
+// they still have, which restoring writes back as is. The header and every batch are gzip members
+// of their own, so a run killed while writing one only leaves that member cut
+// short: readers stop at its last whole row, and the next run cuts the file back
+// to the last complete member before appending.
+// The file is checked before the first update: a run against an unwritable path,
+// or a file that doesn't read back as gzip-compressed NDJSON, does not start.
+
+// codeBackupRow is the code of a row, left out when it is NULL.
+type codeBackupRow struct {
+	Id   int             `json:"id"`
+	Code json.RawMessage `json:"code,omitempty"`
+}
+
+type codeBackupHeader struct {
+	Type      string    `json:"type"`
+	Command   string    `json:"command"`
+	Timestamp time.Time `json:"timestamp"`
+	StartId   int       `json:"startId"`
+	EndId     int       `json:"endId"`
+}
+
+type codeBackup struct {
+	path string
+
+	mu     sync.Mutex
+	file   *os.File
+	gz     *gzip.Writer
+	closed bool
+}
+
+// checkCodeBackup makes sure the backup file at path can be appended to: it
+// either doesn't exist yet or reads back whole up to a last member cut short, and
+// it can be opened for writing. It returns the length of the complete members.
+func checkCodeBackup(path string) (int64, error) {
+	writable, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, &errs.ValidationError{Field: "-backup-file", Reason: err.Error()}
+	}
+	writable.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, &errs.ValidationError{Field: "-backup-file", Reason: err.Error()}
+	}
+	defer file.Close()
+
+	complete, truncated, err := scanCodeBackup(file, func(line int, record []byte) error {
+		if !json.Valid(record) {
+			return &errs.ValidationError{Field: "-backup-file", Reason: fmt.Sprintf("%s holds invalid JSON on line %d", path, line)}
+		}
+		return nil
+	})
+	var formatErr *backupFormatError
+	if errors.As(err, &formatErr) {
+		return 0, &errs.ValidationError{Field: "-backup-file", Reason: fmt.Sprintf("%s is corrupted: %v; move it aside to start a new one", path, err)}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if truncated {
+		log.Printf("Warning: %s ends with a batch cut short by a killed run; the file is cut back to its %d complete bytes before appending", path, complete)
+	}
+	return complete, nil
+}
+
+// openCodeBackup opens the backup file at path for appending after its complete
+// members, as checkCodeBackup found them, and writes the header of a run over
+// [startId, endId].
+func openCodeBackup(path string, complete int64, startId, endId int) (*codeBackup, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, &errs.ValidationError{Field: "-backup-file", Reason: err.Error()}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, &errs.ValidationError{Field: "-backup-file", Reason: err.Error()}
+	}
+	// A member cut short would make everything appended after it unreadable
+	if info.Size() > complete {
+		if err := file.Truncate(complete); err != nil {
+			file.Close()
+			return nil, &errs.ValidationError{Field: "-backup-file", Reason: fmt.Sprintf("failed to cut %s back to its complete members: %v", path, err)}
+		}
+	}
+
+	b := &codeBackup{path: path, file: file, gz: gzip.NewWriter(file)}
+	header := codeBackupHeader{Type: "header", Command: "code-to-text", Timestamp: time.Now().UTC(), StartId: startId, EndId: endId}
+	if err := b.writeRecords([]interface{}{header}); err != nil {
+		file.Close()
+		return nil, &errs.ValidationError{Field: "-backup-file", Reason: err.Error()}
+	}
+	return b, nil
+}
+
+// writeRows appends the (id, code) rows read from rows as a gzip member of its
+// own, and returns how many there were. rows are those an update returns, read
+// before its transaction commits.
+func (b *codeBackup) writeRows(rows pgx.Rows) (int, error) {
+	defer rows.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, fmt.Errorf("backup file %s is already closed", b.path)
+	}
+	encoder := json.NewEncoder(b.gz)
+	written := 0
+	for rows.Next() {
+		var (
+			row  codeBackupRow
+			code []byte
+		)
+		if err := rows.Scan(&row.Id, &code); err != nil {
+			return 0, errs.FromDB("failed to scan code to back up", err)
+		}
+		// A NULL, or an empty value that wouldn't encode as JSON, is left out
+		if len(code) > 0 {
+			row.Code = code
+		}
+		if err := encoder.Encode(row); err != nil {
+			return 0, fmt.Errorf("failed to write backup file %s: %w", b.path, err)
+		}
+		written++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, errs.FromDB("error iterating code to back up", err)
+	}
+	if written == 0 {
+		return 0, nil
+	}
+	return written, b.endMember()
+}
+
+func (b *codeBackup) writeRecords(records []interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("backup file %s is already closed", b.path)
+	}
+	encoder := json.NewEncoder(b.gz)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to write backup file %s: %w", b.path, err)
+		}
+	}
+	return b.endMember()
+}
+
+// endMember completes the gzip member written so far, and starts the next one.
+// The caller holds mu.
+func (b *codeBackup) endMember() error {
+	if err := b.gz.Close(); err != nil {
+		return fmt.Errorf("failed to write backup file %s: %w", b.path, err)
+	}
+	b.gz.Reset(b.file)
+	return nil
+}
+
+// Close closes the file; every member written is complete already. Only the
+// first call does anything.
+func (b *codeBackup) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if err := b.file.Close(); err != nil {
+		return fmt.Errorf("failed to close backup file %s: %w", b.path, err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// backupFormatError is a backup file that doesn't read back as gzip-compressed
+// NDJSON.
+type backupFormatError struct {
+	err error
+}
+
+func (e *backupFormatError) Error() string {
+	return e.err.Error()
+}
+
+// scanCodeBackup calls record for every line of the backup file read from r,
+// numbered from 1 across members, and returns the first error record returns. A
+// last member cut short ends the scan like the end of the file after its last
+// whole line, and sets truncated. complete is the length of the complete
+// members. A file that isn't gzip-compressed NDJSON fails with a
+// *backupFormatError.
+func scanCodeBackup(r io.Reader, record func(line int, data []byte) error) (complete int64, truncated bool, err error) {
+	counter := &countingReader{r: r}
+	// gzip reads a byte reader without buffering past the end of a member, so
+	// counter.n - Buffered() is where the member ended
+	source := bufio.NewReader(counter)
+	if _, err := source.Peek(1); err == io.EOF {
+		return 0, false, nil
+	}
+	gz, err := gzip.NewReader(source)
+	if err != nil {
+		return 0, false, &backupFormatError{fmt.Errorf("not gzip-compressed: %w", err)}
+	}
+
+	line := 0
+	for {
+		gz.Multistream(false)
+		lines := bufio.NewReaderSize(gz, 64*1024)
+		for {
+			data, err := lines.ReadBytes('\n')
+			if err == nil {
+				line++
+				if err := record(line, bytes.TrimSuffix(data, []byte("\n"))); err != nil {
+					return complete, false, err
+				}
+				continue
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return complete, true, nil
+			}
+			if err != io.EOF {
+				return complete, false, &backupFormatError{fmt.Errorf("after line %d: %w", line, err)}
+			}
+			if len(bytes.TrimSpace(data)) > 0 {
+				// The encoder ends every record with a newline
+				return complete, false, &backupFormatError{fmt.Errorf("line %d has no newline", line+1)}
+			}
+			break
+		}
+		complete = counter.n - int64(source.Buffered())
+
+		if err := gz.Reset(source); err == io.EOF {
+			return complete, false, nil
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			return complete, true, nil
+		} else if err != nil {
+			return complete, false, &backupFormatError{fmt.Errorf("after line %d: %w", line, err)}
+		}
+	}
+}
+
+// readCodeBackup calls row for every row record of the backup file at path, in
+// file order, skipping the headers. A last batch cut short by a killed run ends
+// the file after its last whole row, and sets truncated.
+func readCodeBackup(path string, row func(codeBackupRow) error) (truncated bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, &errs.ValidationError{Field: "-from-backup", Reason: err.Error()}
+	}
+	defer file.Close()
+
+	_, truncated, err = scanCodeBackup(file, func(line int, data []byte) error {
+		var record struct {
+			Type string          `json:"type"`
+			Id   int             `json:"id"`
+			Code json.RawMessage `json:"code"`
+		}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return &errs.ValidationError{Field: "-from-backup", Reason: fmt.Sprintf("%s holds invalid JSON on line %d: %v", path, line, err)}
+		}
+		if record.Type == "header" {
+			return nil
+		}
+		if record.Id <= 0 {
+			return &errs.ValidationError{Field: "-from-backup", Reason: fmt.Sprintf("%s has a row without an id on line %d", path, line)}
+		}
+		return row(codeBackupRow{Id: record.Id, Code: record.Code})
+	})
+	var formatErr *backupFormatError
+	if errors.As(err, &formatErr) {
+		return false, &errs.ValidationError{Field: "-from-backup", Reason: fmt.Sprintf("%s is corrupted: %v", path, err)}
+	}
+	return truncated, err
+}
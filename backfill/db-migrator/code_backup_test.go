@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestBackup writes a run over the batches to a new backup file, every
+// batch a member of its own, and returns the path and file size after each
+// member.
+func writeTestBackup(t *testing.T, batches [][]codeBackupRow) (string, []int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backup.ndjson.gz")
+	return path, appendTestRun(t, path, batches)
+}
+
+func appendTestRun(t *testing.T, path string, batches [][]codeBackupRow) []int64 {
+	t.Helper()
+	complete, err := checkCodeBackup(path)
+	if err != nil {
+		t.Fatalf("checkCodeBackup: %v", err)
+	}
+	backup, err := openCodeBackup(path, complete, 1, 100)
+	if err != nil {
+		t.Fatalf("openCodeBackup: %v", err)
+	}
+	defer backup.Close()
+
+	sizes := []int64{fileSize(t, path)}
+	for _, batch := range batches {
+		records := make([]interface{}, len(batch))
+		for i, row := range batch {
+			records[i] = row
+		}
+		if err := backup.writeRecords(records); err != nil {
+			t.Fatalf("writeRecords: %v", err)
+		}
+		sizes = append(sizes, fileSize(t, path))
+	}
+	return sizes
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func readTestBackup(t *testing.T, path string, wantTruncated bool) []int {
+	t.Helper()
+	var ids []int
+	truncated, err := readCodeBackup(path, func(row codeBackupRow) error {
+		ids = append(ids, row.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readCodeBackup: %v", err)
+	}
+	if truncated != wantTruncated {
+		t.Errorf("readCodeBackup truncated = %v, want %v", truncated, wantTruncated)
+	}
+	return ids
+}
+
+func backupRows(ids ...int) []codeBackupRow {
+	rows := make([]codeBackupRow, len(ids))
+	for i, id := range ids {
+		rows[i] = codeBackupRow{Id: id, Code: json.RawMessage(`"(coin.details \"k\")"`)}
+	}
+	return rows
+}
+
+func TestCodeBackupReadsEveryMember(t *testing.T) {
+	path, _ := writeTestBackup(t, [][]codeBackupRow{backupRows(9, 8), backupRows(7), {{Id: 6}}})
+	appendTestRun(t, path, [][]codeBackupRow{backupRows(5)})
+
+	if got, want := readTestBackup(t, path, false), []int{9, 8, 7, 6, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("read ids %v, want %v", got, want)
+	}
+}
+
+func TestCodeBackupCutShort(t *testing.T) {
+	path, sizes := writeTestBackup(t, [][]codeBackupRow{backupRows(9, 8), backupRows(7, 6, 5)})
+	lastComplete := sizes[1]
+
+	// Cuts inside the last member: its header, its rows and its trailer
+	for _, cut := range []int64{lastComplete + 3, (lastComplete + sizes[2]) / 2, sizes[2] - 2} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cutPath := filepath.Join(t.TempDir(), "cut.ndjson.gz")
+		if err := os.WriteFile(cutPath, data[:cut], 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		ids := readTestBackup(t, cutPath, true)
+		if len(ids) < 2 || !reflect.DeepEqual(ids[:2], []int{9, 8}) {
+			t.Errorf("cut at %d: read ids %v, want 9 and 8 first", cut, ids)
+		}
+
+		complete, err := checkCodeBackup(cutPath)
+		if err != nil {
+			t.Fatalf("cut at %d: checkCodeBackup: %v", cut, err)
+		}
+		if complete != lastComplete {
+			t.Errorf("cut at %d: complete = %d, want %d", cut, complete, lastComplete)
+		}
+
+		// The next run appends after the last complete member
+		appendTestRun(t, cutPath, [][]codeBackupRow{backupRows(4)})
+		if got, want := readTestBackup(t, cutPath, false), []int{9, 8, 4}; !reflect.DeepEqual(got, want) {
+			t.Errorf("cut at %d: after appending, read ids %v, want %v", cut, got, want)
+		}
+	}
+}
+
+func TestCodeBackupRejectsCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	notGzip := filepath.Join(dir, "plain.ndjson")
+	if err := os.WriteFile(notGzip, []byte(`{"id":1}`+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkCodeBackup(notGzip); err == nil {
+		t.Error("checkCodeBackup accepted a file that isn't gzip-compressed")
+	}
+	if _, err := readCodeBackup(notGzip, func(codeBackupRow) error { return nil }); err == nil {
+		t.Error("readCodeBackup accepted a file that isn't gzip-compressed")
+	}
+
+	empty := filepath.Join(dir, "empty.ndjson.gz")
+	if complete, err := checkCodeBackup(empty); err != nil || complete != 0 {
+		t.Errorf("checkCodeBackup of a missing file = %d, %v, want 0, nil", complete, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// The benchmarks compare a code-to-text batch on lib/pq, each statement waiting
+// for its own round trip as before the move to pgx, with the pipelined batch on
+// pgx, over a fixture of codeBenchRows rows in the database at
+// TEST_DATABASE_URL. They are skipped when it isn't set:
+//
+//	TEST_DATABASE_URL=... go test ./db-migrator/ -run '^$' -bench CodeBatch
+//
+// Round trips only show on a database with some latency, so run them against a
+// Postgres on another host, or on a local one behind tc netem.
+
+const codeBenchRows = 1_000_000
+
+var codeBenchFixture sync.Once
+
+// codeBenchDB returns the database at TEST_DATABASE_URL with the fixture in
+// place, creating it on the first call.
+func codeBenchDB(b *testing.B) (*sql.DB, string) {
+	b.Helper()
+	codeBenchFixture.Do(func() {
+		integrationDB(b, fmt.Sprintf(`
+			INSERT INTO "TransactionDetails" (id, code)
+			SELECT id, to_jsonb('(coin.transfer "k:' || id || '" "k:bob" 1.0)')
+			FROM generate_series(1, %d) id
+		`, codeBenchRows), `ANALYZE "TransactionDetails"`)
+	})
+
+	connStr := testDatabaseURL(b)
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		b.Fatalf("failed to connect to TEST_DATABASE_URL: %v", err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db, connStr
+}
+
+// benchmarkCodeBatches runs batch over consecutive windows of the fixture, one
+// per iteration, clearing the codetext of a window outside the measurement.
+func benchmarkCodeBatches(b *testing.B, db *sql.DB, batch func(startId, endId int) (int, error)) {
+	const size = codeBatchSize
+	rows := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		startId := (i*size)%codeBenchRows + 1
+		endId := startId + size - 1
+
+		b.StopTimer()
+		if _, err := db.Exec(`UPDATE "TransactionDetails" SET codetext = NULL WHERE id >= $1 AND id <= $2`, startId, endId); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		updated, err := batch(startId, endId)
+		if err != nil {
+			b.Fatalf("batch %d-%d failed: %v", startId, endId, err)
+		}
+		rows += updated
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(rows)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func BenchmarkCodeBatchLibPq(b *testing.B) {
+	db, _ := codeBenchDB(b)
+	benchmarkCodeBatches(b, db, func(startId, endId int) (int, error) {
+		return convertCodeBatchLibPq(db, startId, endId)
+	})
+}
+
+func BenchmarkCodeBatchPgx(b *testing.B) {
+	db, connStr := codeBenchDB(b)
+	pool, err := openBatchPool(connStr, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Close()
+	benchmarkCodeBatches(b, db, func(startId, endId int) (int, error) {
+		return processBatchForCode(pool, startId, endId)
+	})
+}
+
+// convertCodeBatchLibPq converts the rows of [startId, endId] the way batches
+// did on lib/pq: BEGIN, the two timeouts, a validation query per chunk, the
+// UPDATE and COMMIT, each a round trip of its own.
+func convertCodeBatchLibPq(db *sql.DB, startId, endId int) (int, error) {
+	ctx := context.Background()
+	pending := codePendingConditionFor(true)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	lockTimeout, statementTimeout := codeBatchTimeouts()
+	if _, err := tx.Exec(fmt.Sprintf(`SET LOCAL lock_timeout = '%s'`, lockTimeout)); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`SET LOCAL statement_timeout = '%s'`, statementTimeout)); err != nil {
+		return 0, err
+	}
+
+	validateQuery := fmt.Sprintf(`
+		SELECT id, %s, %s
+		FROM "TransactionDetails"
+		WHERE id >= $1 AND id <= $2 AND id < $3
+		ORDER BY id DESC
+		LIMIT %d
+	`, pending, codeConvertibleCondition, codeValidationChunk)
+	invalidIds := []int{}
+	for below := endId + 1; ; {
+		rows, err := tx.Query(validateQuery, startId, endId, below)
+		if err != nil {
+			return 0, err
+		}
+		chunk := 0
+		for rows.Next() {
+			var (
+				id                     int
+				isPending, convertible bool
+			)
+			if err := rows.Scan(&id, &isPending, &convertible); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			chunk++
+			below = id
+			if isPending && !convertible {
+				invalidIds = append(invalidIds, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		if chunk < codeValidationChunk {
+			break
+		}
+	}
+
+	result, err := tx.Exec(fmt.Sprintf(`
+		UPDATE "TransactionDetails"
+		SET codetext = %s
+		WHERE id >= $1 AND id <= $2 AND %s AND id <> ALL($3::int[])
+	`, codeTextConversion, pending), startId, endId, pq.Array(invalidIds))
+	if err != nil {
+		return 0, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(updated), tx.Commit()
+}
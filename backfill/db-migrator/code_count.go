@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backfill/errs"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// code-to-text -count-only reports the work left without touching anything: the
+// rows still to convert between -start-id and -end-id on -chains, their id
+// bounds and an estimated duration. The estimate rests on -assume-rows-per-sec
+// when given, else on the recorded throughput baseline of code-to-text, else on
+// a -count-sample run converting real batches from the top in a read-only
+// transaction. A sample reads and converts but doesn't write, so a real run is
+// slower than it suggests. No column or checkpoint is written. A count that may
+// sample loads the database like a run, so it takes the code-to-text instance
+// lock and is recorded in MigratorRuns; one with -count-sample 0 or
+// -assume-rows-per-sec writes nothing at all. With -json the report is printed
+// as JSON.
+
+// Sources of the estimate of a count
+const (
+	codeCountAssumed  = "assumed"
+	codeCountBaseline = "baseline"
+	codeCountSampled  = "sampled"
+)
+
+type codeCountReport struct {
+	Remaining int64 `json:"remaining"`
+	// MinId and MaxId bound the rows remaining, nil when there are none
+	MinId *int64 `json:"minId"`
+	MaxId *int64 `json:"maxId"`
+	// RowsPerSec is the throughput the estimate assumes, from EstimateSource;
+	// both are empty when there was nothing to estimate from
+	RowsPerSec       float64 `json:"rowsPerSec,omitempty"`
+	EstimateSource   string  `json:"estimateSource,omitempty"`
+	EstimatedSeconds float64 `json:"estimatedSeconds,omitempty"`
+}
+
+func countCodeToText(db *sql.DB) error {
+	if *assumeRowsPerSec < 0 {
+		return &errs.ValidationError{Field: "-assume-rows-per-sec", Reason: fmt.Sprintf("%d must not be negative", *assumeRowsPerSec)}
+	}
+	if *countSample < 0 {
+		return &errs.ValidationError{Field: "-count-sample", Reason: fmt.Sprintf("%s must not be negative", *countSample)}
+	}
+
+	pending, err := codePendingCondition(db)
+	if err != nil {
+		return err
+	}
+	if chains.active() {
+		pending = "(" + pending + ") AND " + chains.transactionCondition(`"transactionId"`)
+	}
+	endId := *codeEnd
+	if endId == 0 {
+		endId = math.MaxInt32
+	}
+
+	var (
+		report       codeCountReport
+		minId, maxId sql.NullInt64
+	)
+	err = db.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*), MIN(id), MAX(id)
+		FROM "TransactionDetails"
+		WHERE id >= $1 AND id <= $2 AND %s
+	`, pending), *codeStart, endId).Scan(&report.Remaining, &minId, &maxId)
+	if err != nil {
+		return errs.FromDB("failed to count the rows to convert", err)
+	}
+	if minId.Valid {
+		report.MinId, report.MaxId = &minId.Int64, &maxId.Int64
+	}
+
+	if report.Remaining > 0 {
+		report.RowsPerSec, report.EstimateSource, err = codeCountRate(db, pending, int(maxId.Int64))
+		if err != nil {
+			return err
+		}
+		if report.RowsPerSec > 0 {
+			report.EstimatedSeconds = float64(report.Remaining) / report.RowsPerSec
+		}
+	}
+
+	if *statusJson {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode count: %w", err)
+		}
+		fmt.Fprintln(os.Stdout, string(data))
+		return nil
+	}
+
+	log.Printf("Rows left to convert on %s: %d", chains.describe(), report.Remaining)
+	if report.MinId != nil {
+		log.Printf("Id bounds of the rows left: %d-%d", *report.MinId, *report.MaxId)
+	}
+	switch {
+	case report.Remaining == 0:
+		log.Println("Nothing left to convert")
+	case report.EstimateSource == "":
+		log.Println("No throughput to estimate from: pass -assume-rows-per-sec, or a -count-sample above 0")
+	default:
+		estimate := time.Duration(report.EstimatedSeconds * float64(time.Second))
+		log.Printf("Estimated duration: %s at %.0f rows/s (%s)", estimate.Round(time.Second), report.RowsPerSec, report.EstimateSource)
+		if report.EstimateSource == codeCountSampled {
+			log.Println("The sample doesn't write, so a real run takes longer; a completed run records a baseline used instead")
+		}
+	}
+	return nil
+}
+
+// codeCountRate returns the throughput of code-to-text to estimate from, and
+// where it comes from, empty when there is none.
+func codeCountRate(db *sql.DB, pending string, topId int) (float64, string, error) {
+	if *assumeRowsPerSec > 0 {
+		return float64(*assumeRowsPerSec), codeCountAssumed, nil
+	}
+
+	// A baseline is only read: a database without one doesn't get the table
+	exists, err := tableExists(db, "PerfBaselines")
+	if err != nil {
+		return 0, "", err
+	}
+	if exists {
+		baseline, ok, err := loadPerfBaseline(db, "code-to-text", "TransactionDetails", *codeBatch)
+		if err != nil {
+			return 0, "", err
+		}
+		if ok {
+			return baseline.IdsPerSec, codeCountBaseline, nil
+		}
+	}
+
+	if *countSample == 0 {
+		return 0, "", nil
+	}
+	rate, err := sampleCodeConversion(db, pending, topId)
+	if err != nil || rate == 0 {
+		return 0, "", err
+	}
+	return rate, codeCountSampled, nil
+}
+
+// sampleCodeConversion converts batches of -batch-size pending rows from topId
+// down for -count-sample, in a read-only transaction, and returns the rows
+// converted per second.
+func sampleCodeConversion(db *sql.DB, pending string, topId int) (float64, error) {
+	log.Printf("Sampling the conversion of batches of %d rows for %s, reading only", *codeBatch, *countSample)
+	ctx, cancel := context.WithTimeout(shutdownCtx, *countSample)
+	defer cancel()
+
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return 0, errs.FromDB("failed to begin the sample transaction", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`
+		SELECT id, %s
+		FROM "TransactionDetails"
+		WHERE id >= $1 AND id <= $2 AND %s
+		ORDER BY id DESC
+		LIMIT $3
+	`, codeTextConversion, pending)
+
+	started := time.Now()
+	var (
+		sampled int
+		elapsed time.Duration
+	)
+	for currentMaxId := topId; currentMaxId >= *codeStart && ctx.Err() == nil; {
+		rows, err := tx.QueryContext(ctx, query, *codeStart, currentMaxId, *codeBatch)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return 0, errs.FromDB("failed to sample the conversion", err)
+		}
+		lowest, inBatch := 0, 0
+		for rows.Next() {
+			var (
+				id       int
+				codeText sql.NullString
+			)
+			if err := rows.Scan(&id, &codeText); err != nil {
+				rows.Close()
+				return 0, errs.FromDB("failed to scan the sample", err)
+			}
+			lowest = id
+			inBatch++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return 0, errs.FromDB("failed to sample the conversion", err)
+		}
+		// A batch cut off by the end of the sample isn't counted, nor its time
+		sampled += inBatch
+		elapsed = time.Since(started)
+		if inBatch < *codeBatch {
+			break
+		}
+		currentMaxId = lowest - 1
+	}
+
+	if sampled == 0 || elapsed <= 0 {
+		return 0, nil
+	}
+	log.Printf("Sampled %d rows in %s", sampled, elapsed.Round(time.Millisecond))
+	return float64(sampled) / elapsed.Seconds(), nil
+}
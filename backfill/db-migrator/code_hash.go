@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const codeHashCheckpointKey = "code-hash"
+
+// This script fills the codehash column of TransactionDetails with the
+// hex-encoded sha256 of codetext, so identical Pact code can be found by digest.
+// Once finalize-code-to-text swapped codetext into place, the text code column is
+// hashed instead. A row whose codehash is set is never rewritten, and a NULL
+// codetext leaves codehash NULL.
+//
+// It runs as a descendingRun like code-to-text, its checkpoint being code-hash.
+// With -hash-with client (the default) every batch reads its rows' code and
+// hashes it in the migrator; with -hash-with pgcrypto the database hashes it
+// with digest(), which needs the pgcrypto extension, and no code leaves it.
+
+// -hash-with values
+const (
+	codeHashClient   = "client"
+	codeHashPgcrypto = "pgcrypto"
+)
+
+// codeHashSource returns the text column of TransactionDetails to hash:
+// codetext, or code once codetext has been swapped into place.
+func codeHashSource(db *sql.DB) (string, error) {
+	codeTextType, err := columnType(db, "TransactionDetails", "codetext")
+	if err != nil {
+		return "", err
+	}
+	if codeTextType != "" {
+		return "codetext", nil
+	}
+	codeType, err := columnType(db, "TransactionDetails", "code")
+	if err != nil {
+		return "", err
+	}
+	if codeType == "text" {
+		return "code", nil
+	}
+	return "", &errs.SchemaError{Missing: "TransactionDetails.codetext", Reason: "run code-to-text first"}
+}
+
+// codeHashPendingCondition selects the rows still to hash. A dry run doesn't add
+// codehash, so without it every row with code is.
+func codeHashPendingCondition(db *sql.DB, source string) (string, error) {
+	codeHashType, err := columnType(db, "TransactionDetails", "codehash")
+	if err != nil {
+		return "", err
+	}
+	if codeHashType == "" {
+		return source + ` IS NOT NULL`, nil
+	}
+	return source + ` IS NOT NULL AND codehash IS NULL`, nil
+}
+
+func updateCodeHash() error {
+	pause, targetBatch, err := validateDescendingFlags()
+	if err != nil {
+		return err
+	}
+	if *hashWith != codeHashClient && *hashWith != codeHashPgcrypto {
+		return &errs.ValidationError{Field: "-hash-with", Reason: fmt.Sprintf("%q is not one of client, pgcrypto", *hashWith)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if *hashWith == codeHashPgcrypto {
+		var installed bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pgcrypto')`).Scan(&installed); err != nil {
+			return errs.FromDB("failed to check for the pgcrypto extension", err)
+		}
+		if !installed {
+			return &errs.SchemaError{Missing: "extension pgcrypto", Reason: "CREATE EXTENSION pgcrypto, or hash with -hash-with client"}
+		}
+	}
+
+	source, err := codeHashSource(db)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Println("Dry run: the rows to hash are counted, nothing is updated")
+	} else {
+		// Create codehash column if it doesn't exist
+		_, err = db.Exec(`
+			ALTER TABLE "TransactionDetails"
+			ADD COLUMN IF NOT EXISTS codehash TEXT
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to create codehash column: %w", err)
+		}
+
+		if err := createWatermarksTable(db); err != nil {
+			return err
+		}
+	}
+
+	checkpoint := chainCheckpoint(codeHashCheckpointKey)
+	maxTransactionID, err := descendingEndId(db, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if maxTransactionID < *codeStart {
+		logNothingToDo("TransactionDetails", *codeStart, maxTransactionID)
+		log.Println("Completed processing. Total TransactionDetails hashed: 0 (100.0%)")
+		return nil
+	}
+
+	pending, err := codeHashPendingCondition(db, source)
+	if err != nil {
+		return err
+	}
+
+	// Every worker holds one connection for its batch transaction, and paging
+	// the next batch takes one more
+	pool, err := openBatchPool(connStr, *codeWorkers+1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	log.Printf("Hashing %s with %s", source, *hashWith)
+	run := &descendingRun{
+		command:    "code-hash",
+		table:      "TransactionDetails",
+		checkpoint: checkpoint,
+		pending:    pending,
+		candidate:  source + ` IS NOT NULL`,
+		verb:       "hash",
+		done:       "hashed",
+		startId:    *codeStart,
+		endId:      maxTransactionID,
+		batchSize:  *codeBatch,
+		workers:    *codeWorkers,
+		throttle:   newCodeThrottle(*maxRowsPerSec, *sleepBetweenBatches, pause),
+		sizer:      newBatchSizer(*codeBatch, targetBatch, *minBatchSize, *maxBatchSize),
+		batch: func(ctx context.Context, tx *batcher.Tx, startId, endId int, pending string) (codeBatchResult, error) {
+			return hashCodeBatch(ctx, tx, startId, endId, source, pending)
+		},
+		summary: func(totals descendingTotals) {
+			log.Printf("Completed processing. Total TransactionDetails hashed: %d (100.0%%)", totals.processed)
+			log.Printf("Already hashed and skipped: %d", totals.alreadyDone)
+		},
+	}
+	if err := run.run(shutdownCtx, db, pool); err != nil {
+		return fmt.Errorf("failed to process transactions: %w", err)
+	}
+
+	if *dryRun {
+		return nil
+	}
+
+	log.Printf("Successfully hashed all TransactionDetails %s values into codehash", source)
+	log.Printf("Max(TransactionDetails.id) processed: %d", maxTransactionID)
+	return nil
+}
+
+// hashCodeBatch sets the codehash of the rows of the batch matching pending, in
+// tx.
+func hashCodeBatch(ctx context.Context, tx *batcher.Tx, startId, endId int, source, pending string) (codeBatchResult, error) {
+	ids := batcher.IDs(ctx)
+	if *dryRun {
+		var count int
+		query := fmt.Sprintf(`SELECT COUNT(*) FROM "TransactionDetails" WHERE id = ANY($1::int[]) AND %s`, pending)
+		if err := tx.QueryRow(ctx, query, ids).Scan(&count); err != nil {
+			return codeBatchResult{}, errs.FromDB("failed to count the rows to hash", err)
+		}
+		return codeBatchResult{updated: count, alreadyDone: len(ids) - count}, nil
+	}
+
+	var (
+		result codeBatchResult
+		err    error
+	)
+	if *hashWith == codeHashPgcrypto {
+		result.updated, err = hashCodeInDatabase(ctx, tx, ids, source, pending)
+	} else {
+		result.updated, err = hashCodeInClient(ctx, tx, ids, source, pending)
+	}
+	if err != nil {
+		return codeBatchResult{}, err
+	}
+
+	// The ids paged in that were hashed meanwhile, or whose code was cleared
+	result.alreadyDone = len(ids) - result.updated
+	log.Printf("Processed %d records in batch %d-%d, %d already hashed", result.updated, startId, endId, result.alreadyDone)
+	return result, nil
+}
+
+// hashCodeInDatabase hashes the batch with pgcrypto's digest() in one round trip.
+func hashCodeInDatabase(ctx context.Context, tx *batcher.Tx, ids []int, source, pending string) (int, error) {
+	return execBatchUpdate(ctx, tx, fmt.Sprintf(`
+		UPDATE "TransactionDetails"
+		SET codehash = encode(digest(%[1]s, 'sha256'), 'hex')
+		WHERE id = ANY($1::int[]) AND %[2]s
+	`, source, pending), ids)
+}
+
+// hashCodeInClient reads the code of the batch, locking its rows, and writes back
+// the hashes computed here; two round trips. The code is hashed as it is read, so
+// only the hashes of the batch are held in memory.
+func hashCodeInClient(ctx context.Context, tx *batcher.Tx, ids []int, source, pending string) (int, error) {
+	begin := &pgx.Batch{}
+	begin.Queue(fmt.Sprintf(`
+		SELECT id, %[1]s
+		FROM "TransactionDetails"
+		WHERE id = ANY($1::int[]) AND %[2]s
+		ORDER BY id DESC
+		FOR UPDATE
+	`, source, pending), ids)
+
+	results := tx.SendBatch(ctx, begin)
+	rows, err := results.Query()
+	if err != nil {
+		results.Close()
+		return 0, errs.FromDB("failed to query records", err)
+	}
+	var (
+		hashed []int
+		hashes []string
+		code   []byte
+	)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id, &code); err != nil {
+			rows.Close()
+			results.Close()
+			return 0, errs.FromDB("failed to scan record", err)
+		}
+		sum := sha256.Sum256(code)
+		hashed = append(hashed, id)
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		results.Close()
+		return 0, errs.FromDB("error iterating records", err)
+	}
+	if err := results.Close(); err != nil {
+		return 0, errs.FromDB("failed to query records", err)
+	}
+
+	update := &pgx.Batch{}
+	update.Queue(`
+		UPDATE "TransactionDetails" AS t
+		SET codehash = h.codehash
+		FROM unnest($1::int[], $2::text[]) AS h(id, codehash)
+		WHERE t.id = h.id
+	`, hashed, hashes)
+	tx.QueueEnd(update)
+
+	results = tx.SendBatch(ctx, update)
+	defer results.Close()
+
+	tag, err := results.Exec()
+	if err != nil {
+		return 0, errs.FromDB("failed to update records", err)
+	}
+	if _, err := results.Exec(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+	if err := results.Close(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func CodeHash(ctx context.Context, cfg *config.Config) error {
+	return updateCodeHash()
+}
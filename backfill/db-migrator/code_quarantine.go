@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A code value that is neither a string nor {} can't be converted. By default it
+// aborts code-to-text (-on-invalid abort). With skip, the row is left out of its
+// batch's update, keeping a NULL codetext, and its id is listed at the end. With
+// quarantine, it is also copied with its raw bytes to CodeMigrationQuarantine in
+// the batch's transaction, to be inspected and fixed later. Left-out rows keep
+// finalize-code-to-text from running until they are fixed and converted.
+
+const (
+	onInvalidAbort      = "abort"
+	onInvalidSkip       = "skip"
+	onInvalidQuarantine = "quarantine"
+
+	// invalidCodesMaxListed caps the ids listed in the final summary
+	invalidCodesMaxListed = 100
+)
+
+var onInvalidModes = map[string]bool{
+	onInvalidAbort:      true,
+	onInvalidSkip:       true,
+	onInvalidQuarantine: true,
+}
+
+func createCodeQuarantineTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "CodeMigrationQuarantine" (
+			id INTEGER PRIMARY KEY,
+			code BYTEA NOT NULL,
+			"detectedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create CodeMigrationQuarantine table: %w", err)
+	}
+	return nil
+}
+
+// queueQuarantineCodes queues the copy of the invalid values of a batch, at ids,
+// to CodeMigrationQuarantine in the batch's transaction, without reading them. A
+// value quarantined again is refreshed.
+func queueQuarantineCodes(batch *pgx.Batch, ids []int) {
+	batch.Queue(`
+		INSERT INTO "CodeMigrationQuarantine" (id, code)
+		SELECT id, convert_to(code::text, 'UTF8') FROM "TransactionDetails" WHERE id = ANY($1::int[])
+		ON CONFLICT (id) DO UPDATE SET code = EXCLUDED.code, "detectedAt" = CURRENT_TIMESTAMP
+	`, ids)
+}
+
+// logInvalidCodes lists the ids of the invalid code values left out of the run.
+func logInvalidCodes(ids []int) {
+	if *onInvalid == onInvalidAbort {
+		return
+	}
+
+	// Already counted in the metrics as each batch committed
+	skipped := skipCounts{skipWrongType: len(ids)}
+	logSkipSummary("code values", skipped)
+	if len(ids) == 0 {
+		return
+	}
+
+	listed := ids
+	if len(listed) > invalidCodesMaxListed {
+		listed = listed[:invalidCodesMaxListed]
+	}
+	parts := make([]string, len(listed))
+	for i, id := range listed {
+		parts[i] = fmt.Sprint(id)
+	}
+	log.Printf("Invalid code values left out at ids: %s", strings.Join(parts, ", "))
+	if len(ids) > len(listed) {
+		log.Printf("Listed %d of %d ids", len(listed), len(ids))
+	}
+	if *onInvalid == onInvalidQuarantine && !*dryRun {
+		log.Println(`Their raw values are in "CodeMigrationQuarantine"`)
+	}
+}
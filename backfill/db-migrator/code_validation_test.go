@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-backfill/errs"
+	"reflect"
+	"testing"
+)
+
+// codeValidationCases are code values as the jsonb literals stored in
+// TransactionDetails, with whether code-to-text converts them and the codetext
+// they convert to. A nil code is a NULL.
+var codeValidationCases = []struct {
+	name        string
+	code        *string
+	convertible bool
+	codetext    *string
+}{
+	{name: "pact code", code: text(`"(coin.transfer \"alice\" \"bob\" 1.0)"`), convertible: true, codetext: text(`(coin.transfer "alice" "bob" 1.0)`)},
+	{name: "escaped quotes and backslashes", code: text(`"(a \"\\\" b)"`), convertible: true, codetext: text(`(a "\" b)`)},
+	{name: "newline and tab escapes", code: text(`"(a\n\tb)"`), convertible: true, codetext: text("(a\n\tb)")},
+	{name: "unicode escape", code: text(`"caf\u00e9"`), convertible: true, codetext: text("café")},
+	{name: "surrogate pair", code: text(`"\ud83d\ude00"`), convertible: true, codetext: text("😀")},
+	{name: "raw multibyte", code: text(`"naïve ✓"`), convertible: true, codetext: text("naïve ✓")},
+	{name: "whitespace around the literal", code: text("  \n\"(a)\"  "), convertible: true, codetext: text("(a)")},
+	{name: "leading whitespace in the string", code: text(`"  (a)"`), convertible: true, codetext: text("  (a)")},
+	{name: "empty string", code: text(`""`), convertible: true, codetext: text("")},
+	{name: "empty object", code: text(`{}`), convertible: true, codetext: nil},
+	{name: "empty object with whitespace", code: text(`{ }`), convertible: true, codetext: nil},
+	{name: "NULL", code: nil, convertible: true, codetext: nil},
+	{name: "JSON null", code: text(`null`), convertible: false},
+	{name: "number", code: text(`42`), convertible: false},
+	{name: "boolean", code: text(`true`), convertible: false},
+	{name: "array", code: text(`["(a)"]`), convertible: false},
+	{name: "object", code: text(`{"code": "(a)"}`), convertible: false},
+}
+
+// TestIntegrationCodeValidation checks the validity condition and the
+// conversion of code-to-text, evaluated server-side, over every case.
+func TestIntegrationCodeValidation(t *testing.T) {
+	db, _ := integrationDB(t)
+	for _, tt := range codeValidationCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				convertible bool
+				codetext    *string
+				roundTrips  *bool
+			)
+			err := db.QueryRow(`
+				SELECT `+codeConvertibleCondition+`, `+codeTextConversion+`, to_jsonb(`+codeTextConversion+`) = code
+				FROM (SELECT $1::jsonb AS code) c
+			`, tt.code).Scan(&convertible, &codetext, &roundTrips)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if convertible != tt.convertible {
+				t.Errorf("convertible = %t, want %t", convertible, tt.convertible)
+			}
+			if !tt.convertible {
+				return
+			}
+			if !reflect.DeepEqual(codetext, tt.codetext) {
+				t.Errorf("codetext = %s, want %s", describeColumn(map[int]*string{0: codetext}), describeColumn(map[int]*string{0: tt.codetext}))
+			}
+			// A string turns back into its code
+			if tt.codetext != nil && (roundTrips == nil || !*roundTrips) {
+				t.Errorf("to_jsonb(codetext) isn't the code")
+			}
+		})
+	}
+}
+
+// TestIntegrationCodeToTextOnInvalid runs code-to-text over every case with each
+// -on-invalid mode.
+func TestIntegrationCodeToTextOnInvalid(t *testing.T) {
+	fixture := `INSERT INTO "TransactionDetails" (id, code) VALUES `
+	var (
+		args           []interface{}
+		converted      = map[int]*string{}
+		invalidIds     []int
+		highestInvalid int
+	)
+	for i, tt := range codeValidationCases {
+		id := i + 1
+		if i > 0 {
+			fixture += ", "
+		}
+		fixture += fmt.Sprintf("(%d, $%d::jsonb)", id, id)
+		args = append(args, tt.code)
+		if tt.convertible {
+			converted[id] = tt.codetext
+		} else {
+			converted[id] = nil
+			invalidIds = append(invalidIds, id)
+			highestInvalid = id
+		}
+	}
+
+	tests := []struct {
+		mode string
+		// want are the codetext values by id
+		want            map[int]*string
+		wantQuarantined []int
+	}{
+		{mode: onInvalidSkip, want: converted},
+		{mode: onInvalidQuarantine, want: converted, wantQuarantined: invalidIds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			db, connStr := integrationDB(t, `CREATE TABLE "CodeMigrationQuarantine" (id INTEGER PRIMARY KEY, code BYTEA NOT NULL,
+				"detectedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP)`)
+			if _, err := db.Exec(fixture, args...); err != nil {
+				t.Fatal(err)
+			}
+			setFlag(t, codeBatch, 5)
+			setFlag(t, onInvalid, tt.mode)
+
+			if err := updateCodeToText(context.Background(), db, connStr, ""); err != nil {
+				t.Fatalf("code-to-text failed: %v", err)
+			}
+			if got := queryColumn(t, db, `SELECT id, codetext FROM "TransactionDetails"`); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("codetext = %s, want %s", describeColumn(got), describeColumn(tt.want))
+			}
+			// The raw value, as jsonb writes it
+			quarantined := queryColumn(t, db, `SELECT id, convert_from(code, 'UTF8') FROM "CodeMigrationQuarantine"`)
+			want := map[int]*string{}
+			for _, id := range tt.wantQuarantined {
+				var normalized string
+				if err := db.QueryRow(`SELECT code::text FROM "TransactionDetails" WHERE id = $1`, id).Scan(&normalized); err != nil {
+					t.Fatal(err)
+				}
+				want[id] = &normalized
+			}
+			if !reflect.DeepEqual(quarantined, want) {
+				t.Errorf("CodeMigrationQuarantine = %s, want %s", describeColumn(quarantined), describeColumn(want))
+			}
+		})
+	}
+
+	t.Run(onInvalidAbort, func(t *testing.T) {
+		db, connStr := integrationDB(t)
+		if _, err := db.Exec(fixture, args...); err != nil {
+			t.Fatal(err)
+		}
+		setFlag(t, codeBatch, 100)
+		setFlag(t, onInvalid, onInvalidAbort)
+
+		err := updateCodeToText(context.Background(), db, connStr, "")
+		var validationErr *errs.ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("code-to-text error = %v, want a ValidationError", err)
+		}
+		// Rows are validated from the top of the batch down
+		if validationErr.RowID != int64(highestInvalid) || validationErr.Field != "code" {
+			t.Errorf("ValidationError = %+v, want the code of row %d", validationErr, highestInvalid)
+		}
+		if errs.ExitCode(err) != errs.ExitValidation {
+			t.Errorf("exit code = %d, want %d", errs.ExitCode(err), errs.ExitValidation)
+		}
+		var converted int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM "TransactionDetails" WHERE codetext IS NOT NULL`).Scan(&converted); err != nil {
+			t.Fatal(err)
+		}
+		if converted != 0 {
+			t.Errorf("%d rows converted, want the aborted batch rolled back", converted)
+		}
+	})
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go-backfill/config"
+	"os"
+	"strings"
+)
+
+// Every command is registered below with the flags it accepts. It is run as
+// `db-migrator <command> [flags]`, and parses its own flag set: the common flags
+// plus its own. The flags themselves are defined once in main.go, so a flag
+// shared by several commands is the same variable in every set. The older
+// `db-migrator -command <command> [flags]` form still works, accepting every flag,
+// and logs a deprecation warning.
+
+// Command is a migrator command.
+type Command struct {
+	Name        string
+	Description string
+	// Flags are the names of the flags the command accepts besides commonFlags
+	Flags []string
+	// Lineage declares the derived tables the command writes and the tables it
+	// reads; it is nil for commands writing no derived table
+	Lineage *lineageDeclaration
+	Run     func(ctx context.Context, cfg *config.Config) error
+}
+
+// commonFlags are accepted by every command.
+var commonFlags = []string{
+	"env", "strict-env", "below-live-watermark", "live-margin", "allow-tip", "allow-standby",
+	"snapshot-sample", "snapshot-file", "baseline-max-age", "no-banner-confirm", "status-addr",
+	"metrics-addr", "force", "report-file", "notify-every-percent", "print-config",
+	"stale-after",
+}
+
+var commands = []*Command{
+	{
+		Name:        "code-to-text",
+		Description: "Convert code fields to text type",
+		Flags: []string{
+			"resume", "batch-size", "start-id", "end-id", "workers", "target-batch-ms", "min-batch-size", "max-batch-size",
+			"max-rows-per-sec", "sleep-between-batches", "pause-window",
+			"batch-lock-timeout", "batch-statement-timeout", "backup-file", "on-invalid", "batch-attempts", "dry-run", "audit",
+			"repair", "chains", "count-only", "assume-rows-per-sec", "count-sample", "json",
+			"verify-round-trip",
+		},
+		Run: CodeToText,
+	},
+	{
+		Name:        "code-hash",
+		Description: "Fill the codehash column with the sha256 of codetext",
+		Flags: []string{
+			"resume", "batch-size", "start-id", "end-id", "workers", "target-batch-ms", "min-batch-size", "max-batch-size",
+			"max-rows-per-sec", "sleep-between-batches", "pause-window",
+			"batch-lock-timeout", "batch-statement-timeout", "batch-attempts", "dry-run", "chains", "hash-with",
+		},
+		Run: CodeHash,
+	},
+	{
+		Name:        "gas-backfill",
+		Description: "Fill missing gas, gaslimit and gasprice from node payloads and fee events",
+		Flags: []string{
+			"resume", "batch-size", "start-id", "end-id", "workers", "target-batch-ms", "min-batch-size", "max-batch-size",
+			"max-rows-per-sec", "sleep-between-batches", "pause-window",
+			"batch-lock-timeout", "batch-statement-timeout", "batch-attempts", "dry-run", "chains",
+			"from-height", "to-height", "from-date", "to-date", "node-url", "node-concurrency",
+		},
+		Run: GasBackfill,
+	},
+	{
+		Name:        "finalize-code-to-text",
+		Description: "Verify the conversion and swap codetext into place as the code column",
+		Flags:       []string{"skip-drop", "finalize-views", "finalize-lock-timeout", "dry-run"},
+		Run:         FinalizeCodeToText,
+	},
+	{
+		Name:        "verify-code-to-text",
+		Description: "Check, without writing, that every migrated codetext matches its code",
+		Flags:       []string{"start-id", "end-id", "verify-code-max-reported"},
+		Run:         VerifyCodeToText,
+	},
+	{
+		Name:        "rollback-code-to-text",
+		Description: "Undo code-to-text before finalizing, from a backup file or by clearing codetext",
+		Flags:       []string{"from-backup", "clear-codetext", "yes", "start-id", "end-id", "batch-size", "batch-attempts"},
+		Run:         RollbackCodeToText,
+	},
+	{
+		Name:        "cleanup-code",
+		Description: "Reclaim the space of the jsonb code column once codetext is verified, by setting code to NULL",
+		Flags: []string{
+			"yes", "vacuum", "resume", "batch-size", "start-id", "end-id", "workers", "target-batch-ms", "min-batch-size", "max-batch-size",
+			"max-rows-per-sec", "sleep-between-batches", "pause-window",
+			"batch-lock-timeout", "batch-statement-timeout", "batch-attempts",
+		},
+		Run: CleanupCode,
+	},
+	{
+		Name:        "creation-time",
+		Description: "Add creation time to events and transfers",
+		Flags:       []string{"dry-run", "audit", "chains", "batch-attempts"},
+		Run:         DuplicateCreationTimes,
+	},
+	{
+		Name:        "verify-creation-time",
+		Description: "Check, without writing, that every event and transfer carries its transaction's creation time",
+		Flags:       []string{"json", "verify-creation-max-reported"},
+		Run:         VerifyCreationTime,
+	},
+	{
+		Name:        "reconcile",
+		Description: "Insert transfers through the reconcile event",
+		Flags: []string{
+			"dry-run", "chains", "from-height", "to-height", "from-date", "to-date",
+			"node-url", "report-only", "node-concurrency",
+		},
+		Run: InsertReconcileEvents,
+	},
+	{
+		Name:        "backfill-memos",
+		Description: "Extract memos from transfer-with-memo style calls into the Memos table",
+		Flags:       []string{"memo-functions", "memo-max-length"},
+		Lineage: &lineageDeclaration{
+			Outputs: []string{"Memos"},
+			Inputs:  []string{"TransactionDetails", "Transfers"},
+		},
+		Run: BackfillMemos,
+	},
+	{
+		Name:        "backfill-rotations",
+		Description: "Record account guard rotations with the old and new guard in the GuardChanges table",
+		Flags:       []string{"rotation-events"},
+		Lineage: &lineageDeclaration{
+			Outputs: []string{"GuardChanges"},
+			Inputs:  []string{"Events", "TransactionDetails", "Transactions", "Blocks"},
+		},
+		Run: BackfillRotations,
+	},
+	{
+		Name:        "audit-verify",
+		Description: "Check that rows recorded by -audit still match their after-change hash",
+		Flags:       []string{"audit-run", "audit-max-reported"},
+		Run:         VerifyAuditTrail,
+	},
+	{
+		Name:        "normalize-json",
+		Description: "Rewrite jsonb columns into a canonical serialization",
+		Flags:       []string{"json-columns", "json-verify", "dry-run"},
+		Run:         NormalizeJson,
+	},
+	{
+		Name:        "bench",
+		Description: "Benchmark a batch command over a matrix of batch sizes and worker counts on a disposable database",
+		Flags:       []string{"bench-command", "bench-start-id", "bench-end-id", "bench-batch-sizes", "bench-workers", "bench-output", "i-confirm-disposable"},
+		Run:         Bench,
+	},
+	{
+		Name:        "build-active-addresses",
+		Description: "Maintain per-day, per-chain HyperLogLog sketches of active addresses",
+		Flags:       []string{"active-full", "active-verify-days", "active-rollup"},
+		Lineage: &lineageDeclaration{
+			Outputs: []string{"ActiveAddressSketches"},
+			Inputs:  []string{"Transactions", "Transfers"},
+		},
+		Run: BuildActiveAddresses,
+	},
+	{
+		Name:        "verify-requestkeys",
+		Description: "Detect request keys carrying different payloads on the same chain",
+		Flags:       []string{"requestkeys-output", "requestkeys-samples", "requestkeys-max-reported"},
+		Run:         VerifyRequestKeys,
+	},
+	{
+		Name:        "verify-braiding",
+		Description: "Check that every block's adjacent hashes match the chain graph",
+		Flags:       []string{"braiding-start-height", "braiding-end-height", "braiding-sample", "braiding-max-reported"},
+		Run:         VerifyBraiding,
+	},
+	{
+		Name:        "rollup-module-activity",
+		Description: "Maintain per-day, per-chain event counts by module",
+		Lineage: &lineageDeclaration{
+			Outputs: []string{"ModuleActivity"},
+			Inputs:  []string{"Blocks", "Transactions", "Events"},
+		},
+		Run: RollupModuleActivity,
+	},
+	{
+		Name:        "detect-event-schema-drift",
+		Description: "Record the params signature of every event name over height ranges",
+		Flags:       []string{"drift-window-heights", "drift-samples"},
+		Lineage: &lineageDeclaration{
+			Outputs: []string{"EventSchemas"},
+			Inputs:  []string{"Events", "Transactions", "Blocks"},
+		},
+		Run: DetectEventSchemaDrift,
+	},
+	{
+		Name:        "build-account-timeline",
+		Description: "Materialize every account's actions across chains, in order",
+		Flags:       []string{"account"},
+		Lineage: &lineageDeclaration{
+			Outputs: []string{"AccountTimeline"},
+			Inputs:  []string{"Transactions", "Blocks", "TransactionDetails", "Transfers", "GuardChanges"},
+		},
+		Run: BuildAccountTimeline,
+	},
+	{
+		Name:        "build-tx-order",
+		Description: "Record each transaction's position in its block and its defpact edges",
+		Flags:       []string{"from-node", "tx-order-max-reported"},
+		Lineage: &lineageDeclaration{
+			Outputs: []string{"TxDependencies"},
+			Inputs:  []string{"Transactions", "TransactionDetails", "Blocks"},
+		},
+		Run: BuildTxOrder,
+	},
+	{
+		Name:        "export-pending-crosschain",
+		Description: "Export cross-chain transfers that were started but never finished, as CSV or JSON",
+		Flags:       []string{"pending-output", "pending-chains", "min-age", "pending-finality-depth"},
+		Run:         ExportPendingCrossChain,
+	},
+	{
+		Name:        "reindex",
+		Description: "Rebuild the indexes of one table",
+		Flags:       []string{"reindex-table"},
+		Run:         ReindexTable,
+	},
+	{
+		Name:        "snapshot-diff",
+		Description: "Compare the rows sampled by -snapshot-sample with their current values",
+		Flags:       []string{"snapshot-max-reported"},
+		Run:         SnapshotDiff,
+	},
+	{
+		Name:        "lineage",
+		Description: "Trace which runs, and from which tables, produced a row of a derived table",
+		Flags:       []string{"lineage-table", "lineage-id", "lineage-run"},
+		Run:         PrintLineage,
+	},
+	{
+		Name:        "serve-status",
+		Description: "Serve read-only migrator status as JSON until interrupted",
+		Run:         ServeStatus,
+	},
+	{
+		Name:        "status",
+		Description: "Report how many rows code-to-text, creation-time and reconcile have left",
+		Flags:       []string{"json", "exit-nonzero-if-incomplete", "sample"},
+		Run:         MigrationStatus,
+	},
+}
+
+func lookupCommand(name string) (*Command, bool) {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return nil, false
+}
+
+// flagSet returns the flags of the command, sharing their values with the flags
+// defined in main.go.
+func (c *Command) flagSet() *flag.FlagSet {
+	set := flag.NewFlagSet(c.Name, flag.ExitOnError)
+	for _, name := range append(append([]string{}, c.Flags...), commonFlags...) {
+		defined := flag.Lookup(name)
+		if defined == nil {
+			panic(fmt.Sprintf("command %s declares the undefined flag -%s", c.Name, name))
+		}
+		set.Var(defined.Value, defined.Name, defined.Usage)
+	}
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: db-migrator %s [flags]\n\n%s\n\nFlags:\n", c.Name, c.Description)
+		set.PrintDefaults()
+	}
+	return set
+}
+
+// printCommands lists every command with its own flags, then the common flags.
+func printCommands() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: db-migrator <command> [flags]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-26s %s\n", cmd.Name, cmd.Description)
+		if len(cmd.Flags) > 0 {
+			fmt.Fprintf(out, "  %-26s flags: -%s\n", "", strings.Join(cmd.Flags, ", -"))
+		}
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Flags of every command:")
+	common := flag.NewFlagSet("common", flag.ContinueOnError)
+	common.SetOutput(out)
+	for _, name := range commonFlags {
+		defined := flag.Lookup(name)
+		common.Var(defined.Value, defined.Name, defined.Usage)
+	}
+	common.PrintDefaults()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Run db-migrator <command> -h for the flags of one command.")
+}
+
+// parsedFlags is the flag set the command line was parsed with.
+var parsedFlags *flag.FlagSet
+
+// parseCommand selects the command from the arguments and parses its flags.
+// Without a command it lists the commands and exits.
+func parseCommand(args []string) *Command {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, ok := lookupCommand(args[0])
+		if !ok {
+			fmt.Fprintf(flag.CommandLine.Output(), "Unknown command: %s\n\n", args[0])
+			printCommands()
+			os.Exit(2)
+		}
+		parsedFlags = cmd.flagSet()
+		parsedFlags.Parse(args[1:])
+		*command = cmd.Name
+		return cmd
+	}
+
+	flag.Usage = printCommands
+	parsedFlags = flag.CommandLine
+	flag.CommandLine.Parse(args)
+	if *command == "" {
+		printCommands()
+		os.Exit(2)
+	}
+	cmd, ok := lookupCommand(*command)
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command: %s\n\n", *command)
+		printCommands()
+		os.Exit(2)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "Warning: -command is deprecated, run `db-migrator %s [flags]` instead\n", cmd.Name)
+	return cmd
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var (
+	commandName = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+	// lineageColumn matches the call adding "lastRunId" to a derived table
+	lineageColumn = regexp.MustCompile(`addLineageColumn\(\w+, "(\w+)"\)`)
+)
+
+func TestCommandNamesAreUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for _, cmd := range commands {
+		if !commandName.MatchString(cmd.Name) {
+			t.Errorf("command %q is not a lowercase, dash-separated name", cmd.Name)
+		}
+		if seen[cmd.Name] {
+			t.Errorf("command %s is registered twice", cmd.Name)
+		}
+		seen[cmd.Name] = true
+
+		if cmd.Description == "" {
+			t.Errorf("command %s has no description", cmd.Name)
+		}
+		if cmd.Run == nil {
+			t.Errorf("command %s has no Run", cmd.Name)
+		}
+		if found, ok := lookupCommand(cmd.Name); !ok || found != cmd {
+			t.Errorf("lookupCommand(%s) doesn't find the command", cmd.Name)
+		}
+	}
+	if _, ok := lookupCommand("no-such-command"); ok {
+		t.Errorf("lookupCommand() found a command that isn't registered")
+	}
+}
+
+func TestCommandFlagsDontCollide(t *testing.T) {
+	common := map[string]bool{}
+	for _, name := range commonFlags {
+		if common[name] {
+			t.Errorf("common flag -%s is listed twice", name)
+		}
+		common[name] = true
+		if flag.Lookup(name) == nil {
+			t.Errorf("common flag -%s is not defined", name)
+		}
+	}
+
+	for _, cmd := range commands {
+		own := map[string]bool{}
+		for _, name := range cmd.Flags {
+			if own[name] {
+				t.Errorf("command %s lists -%s twice", cmd.Name, name)
+			}
+			own[name] = true
+			if common[name] {
+				t.Errorf("command %s lists -%s, which every command accepts already", cmd.Name, name)
+			}
+			if flag.Lookup(name) == nil {
+				t.Errorf("command %s declares the undefined flag -%s", cmd.Name, name)
+			}
+		}
+
+		// Building the set panics on a flag defined twice, or an undefined one
+		if err := buildFlagSet(cmd); err != nil {
+			t.Errorf("command %s: %v", cmd.Name, err)
+		}
+	}
+}
+
+// TestEveryFlagBelongsToACommand fails for a flag defined in main.go that no
+// command accepts, which only the deprecated -command form could pass.
+func TestEveryFlagBelongsToACommand(t *testing.T) {
+	accepted := map[string]bool{"command": true}
+	for _, name := range commonFlags {
+		accepted[name] = true
+	}
+	for _, cmd := range commands {
+		for _, name := range cmd.Flags {
+			accepted[name] = true
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !accepted[f.Name] && !strings.HasPrefix(f.Name, "test.") {
+			t.Errorf("flag -%s is accepted by no command", f.Name)
+		}
+	})
+}
+
+func TestCommandFlagSetsShareValues(t *testing.T) {
+	cmd, ok := lookupCommand("code-to-text")
+	if !ok {
+		t.Fatal("code-to-text is not registered")
+	}
+	previous := *codeBatch
+	t.Cleanup(func() { *codeBatch = previous })
+
+	set := cmd.flagSet()
+	if err := set.Parse([]string{"-batch-size", "123"}); err != nil {
+		t.Fatal(err)
+	}
+	if *codeBatch != 123 {
+		t.Errorf("-batch-size parsed into the command's set = %d, want 123 in the shared flag", *codeBatch)
+	}
+	if set.Lookup("env") == nil {
+		t.Errorf("the flag set of code-to-text has no common flag -env")
+	}
+	if set.Lookup("hash-with") != nil {
+		t.Errorf("the flag set of code-to-text has -hash-with, a flag of code-hash")
+	}
+}
+
+// TestDerivedTableWritersDeclareLineage fails for a command stamping a derived
+// table with its run id, in the file of its Run, without a lineage declaration
+// listing that table, and for a stamped table no command declares writing.
+func TestDerivedTableWritersDeclareLineage(t *testing.T) {
+	stamped := map[string]bool{}
+	sources, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range sources {
+		if strings.HasSuffix(source, "_test.go") {
+			continue
+		}
+		for _, table := range stampedTables(t, source) {
+			stamped[table] = true
+		}
+	}
+
+	producers := map[string]string{}
+	for _, cmd := range commands {
+		pc := reflect.ValueOf(cmd.Run).Pointer()
+		source, _ := runtime.FuncForPC(pc).FileLine(pc)
+		writes := stampedTables(t, filepath.Base(source))
+		if cmd.Lineage == nil {
+			if len(writes) > 0 {
+				t.Errorf("command %s writes %s but has no lineage declaration", cmd.Name, strings.Join(writes, ", "))
+			}
+			continue
+		}
+
+		if len(cmd.Lineage.Outputs) == 0 || len(cmd.Lineage.Inputs) == 0 {
+			t.Errorf("the lineage declaration of %s lists no outputs or no inputs", cmd.Name)
+		}
+		outputs := map[string]bool{}
+		for _, output := range cmd.Lineage.Outputs {
+			outputs[output] = true
+			if producer, ok := producers[output]; ok {
+				t.Errorf("both %s and %s declare writing %s", producer, cmd.Name, output)
+			}
+			producers[output] = cmd.Name
+			if !stamped[output] {
+				t.Errorf("command %s declares writing %s, which has no lastRunId column", cmd.Name, output)
+			}
+		}
+		for _, table := range writes {
+			if !outputs[table] {
+				t.Errorf("command %s writes %s in %s but doesn't declare it", cmd.Name, table, filepath.Base(source))
+			}
+		}
+		for _, input := range cmd.Lineage.Inputs {
+			if outputs[input] {
+				t.Errorf("command %s declares %s as both an input and an output", cmd.Name, input)
+			}
+		}
+	}
+	for table := range stamped {
+		if _, ok := producers[table]; !ok {
+			t.Errorf("%s has a lastRunId column but no command declares writing it", table)
+		}
+	}
+}
+
+// stampedTables returns the derived tables source adds a lastRunId column to.
+func stampedTables(t *testing.T, source string) []string {
+	t.Helper()
+	content, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for _, match := range lineageColumn.FindAllStringSubmatch(string(content), -1) {
+		tables = append(tables, match[1])
+	}
+	return tables
+}
+
+func buildFlagSet(cmd *Command) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	cmd.flagSet()
+	return nil
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"go-backfill/batcher"
 	"go-backfill/config"
+	"go-backfill/errs"
 	"log"
+	"time"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
@@ -18,83 +23,150 @@ const (
 // This script was created to duplicate the creation time of transaction to the events and transfers tables.
 // The main motivation was to improve the performance of the events and transfers queries.
 
-func updateCreationTimes() error {
-	env := config.GetConfig()
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		env.DbHost, env.DbPort, env.DbUser, env.DbPassword, env.DbName)
+// updateCreationTimes runs creation-time on db until it is done or ctx is
+// canceled. Its batches run on a pool of their own, connected to connStr.
+func updateCreationTimes(ctx context.Context, db *sql.DB, connStr string) error {
+	if *batchAttempts <= 0 {
+		return &errs.ValidationError{Field: "-batch-attempts", Reason: fmt.Sprintf("%d must be greater than 0", *batchAttempts)}
+	}
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to database: %v", err)
+	if *auditMode && !*dryRun {
+		if err := createAuditTrailTable(db); err != nil {
+			return err
+		}
 	}
-	defer db.Close()
 
-	log.Println("Connected to database")
+	endId, err := capToLiveWatermark(db, "Transactions", endTransactionId, true)
+	if err != nil {
+		return err
+	}
 
-	// Test database connection
-	if err := db.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %v", err)
+	hasRows, err := hasRowsInRange(db, "Transactions", startTransactionId, endId)
+	if err != nil {
+		return err
+	}
+	if !hasRows {
+		logNothingToDo("Transactions", startTransactionId, endId)
+		log.Println("Completed processing. Total records updated: 0 (100.0%)")
+		return nil
 	}
 
 	// Process transactions in batches
-	if err := processTransactionsBatch(db); err != nil {
-		return fmt.Errorf("failed to process transactions: %v", err)
+	if err := processTransactionsBatch(ctx, db, connStr, endId); err != nil {
+		return fmt.Errorf("failed to process transactions: %w", err)
 	}
 
 	log.Println("Successfully updated all events and transfers creation times")
 	return nil
 }
 
-func processTransactionsBatch(db *sql.DB) error {
-	currentId := startTransactionId
+func processTransactionsBatch(ctx context.Context, db *sql.DB, connStr string, endId int) error {
+	pool, err := openBatchPool(connStr, 1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
 	totalProcessed := 0
-	totalTransactions := endTransactionId - startTransactionId + 1
+	totalTransactions := endId - startTransactionId + 1
 	lastProgressPrinted := -1.0
 
-	log.Printf("Starting to process transactions from ID %d to %d",
-		startTransactionId, endTransactionId)
-	log.Printf("Total transactions to process: %d", totalTransactions)
-
-	for currentId <= endTransactionId {
-		// Calculate batch end
-		batchEnd := currentId + creationTimeBatchSize - 1
-		if batchEnd > endTransactionId {
-			batchEnd = endTransactionId
-		}
-
-		// Process this batch
-		processed, err := processBatch(db, currentId, batchEnd)
-		if err != nil {
-			return fmt.Errorf("failed to process batch %d-%d: %v", currentId, batchEnd, err)
+	// Restricted to some chains, progress counts their transactions instead of
+	// the ids spanned
+	if chains.active() {
+		if totalTransactions, err = countChainRows(db, "Transactions", startTransactionId, endId); err != nil {
+			return err
 		}
+	}
+	transactionsProcessed := 0
 
-		totalProcessed += processed
+	log.Printf("Starting to process transactions from ID %d to %d on %s",
+		startTransactionId, endId, chains.describe())
+	log.Printf("Total transactions to process: %d", totalTransactions)
+	eta := startEta(db, "creation-time", "Transactions", creationTimeBatchSize, totalTransactions)
 
-		// Calculate progress percentage
-		transactionsProcessed := batchEnd - startTransactionId + 1
-		progressPercent := (float64(transactionsProcessed) / float64(totalTransactions)) * 100.0
+	var report *dryRunReport
+	if *dryRun {
+		report = newDryRunReport("events and transfers")
+	}
 
-		// Only print progress if it has increased by at least 0.1%
-		if progressPercent-lastProgressPrinted >= 0.1 {
-			log.Printf("Progress: %.1f%%", progressPercent)
-			lastProgressPrinted = progressPercent
+	runner := &batcher.Runner{
+		Pool:     pool,
+		Start:    startTransactionId,
+		End:      endId,
+		Size:     creationTimeBatchSize,
+		Batch:    processBatch,
+		Rollback: *dryRun,
+		Attempts: *batchAttempts,
+		OnRetry: func(w batcher.Window, attempt int, backoff time.Duration, err error) {
+			logBatchRetry(w.String(), attempt, backoff, err)
+		},
+		Done: func(w batcher.Window, processed int, elapsed time.Duration, err error) error {
+			switch {
+			case err != nil && report != nil:
+				report.abort(w.String(), err)
+			case err != nil:
+				return &batchError{start: w.Start, end: w.End, err: err}
+			case report != nil:
+				report.batch(w.String(), processed)
+			default:
+				totalProcessed += processed
+				metrics.batchCommitted(processed, elapsed)
+			}
+
+			// Calculate progress percentage
+			if chains.active() {
+				inBatch, err := countChainRows(db, "Transactions", w.Start, w.End)
+				if err != nil {
+					return err
+				}
+				transactionsProcessed += inBatch
+				metrics.examined(inBatch)
+			} else {
+				transactionsProcessed = w.End - startTransactionId + 1
+				metrics.examined(w.End - w.Start + 1)
+			}
+			metrics.setCursor(w.End)
+			progressPercent := percentOf(transactionsProcessed, totalTransactions)
+
+			// Only print progress if it has increased by at least 0.1%
+			if progressPercent-lastProgressPrinted >= 0.1 {
+				logProgress(fmt.Sprintf("Progress: %.1f%%, %s", progressPercent, eta.describe(transactionsProcessed)),
+					w.Start, w.End, int64(totalProcessed), progressPercent, perSecond(int64(totalProcessed), eta.started))
+				lastProgressPrinted = progressPercent
+			}
+			return nil
+		},
+	}
+	if err := runner.Run(ctx); err != nil {
+		var stopped *batcher.Stopped
+		if errors.As(err, &stopped) {
+			log.Printf("Stopped: last completed batch ended at id %d, ids %d-%d remain", stopped.Remaining.Start-1, stopped.Remaining.Start, stopped.Remaining.End)
+			return &errs.Interrupted{Done: fmt.Sprintf("Transactions ids %d-%d remain", stopped.Remaining.Start, stopped.Remaining.End)}
 		}
+		return err
+	}
 
-		// Move to next batch
-		currentId = batchEnd + 1
+	if report != nil {
+		return report.finish()
 	}
 
 	log.Printf("Completed processing. Total records updated: %d (100.0%%)", totalProcessed)
+	finishEta(db, eta, "creation-time", "Transactions", creationTimeBatchSize)
 	return nil
 }
 
-func processBatch(db *sql.DB, startId, endId int) (int, error) {
-	// Begin transaction for atomic operation
-	tx, err := db.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+// processBatch duplicates the creation time of the transactions [startId, endId]
+// to their events and transfers in tx.
+func processBatch(ctx context.Context, tx *batcher.Tx, startId, endId int) (int, error) {
+	audit := *auditMode && !*dryRun
+	if audit {
+		for _, table := range []string{"Events", "Transfers"} {
+			if err := auditBefore(ctx, tx, table, "transactionId", startId, endId); err != nil {
+				return 0, err
+			}
+		}
 	}
-	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
 
 	// Update events with creation time from transactions
 	eventsUpdateQuery := `
@@ -103,17 +175,14 @@ func processBatch(db *sql.DB, startId, endId int) (int, error) {
 		FROM "Transactions" t
 		WHERE "Events"."transactionId" = t.id 
 		AND t.id >= $1 AND t.id <= $2
+		AND ` + chains.condition(`t."chainId"`) + `
 	`
 
-	eventsResult, err := tx.Exec(eventsUpdateQuery, startId, endId)
+	eventsResult, err := tx.Exec(ctx, eventsUpdateQuery, startId, endId)
 	if err != nil {
-		return 0, fmt.Errorf("failed to update events: %v", err)
-	}
-
-	eventsRowsAffected, err := eventsResult.RowsAffected()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get events rows affected: %v", err)
+		return 0, errs.FromDB("failed to update events", err)
 	}
+	eventsRowsAffected := eventsResult.RowsAffected()
 
 	// Update transfers with creation time from transactions
 	transfersUpdateQuery := `
@@ -122,29 +191,42 @@ func processBatch(db *sql.DB, startId, endId int) (int, error) {
 		FROM "Transactions" t
 		WHERE "Transfers"."transactionId" = t.id 
 		AND t.id >= $1 AND t.id <= $2
+		AND ` + chains.condition(`t."chainId"`) + `
 	`
 
-	transfersResult, err := tx.Exec(transfersUpdateQuery, startId, endId)
+	transfersResult, err := tx.Exec(ctx, transfersUpdateQuery, startId, endId)
 	if err != nil {
-		return 0, fmt.Errorf("failed to update transfers: %v", err)
+		return 0, errs.FromDB("failed to update transfers", err)
 	}
+	transfersRowsAffected := transfersResult.RowsAffected()
 
-	transfersRowsAffected, err := transfersResult.RowsAffected()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get transfers rows affected: %v", err)
+	if audit {
+		for _, table := range []string{"Events", "Transfers"} {
+			if err := auditAfter(ctx, tx, table, "transactionId", startId, endId); err != nil {
+				return 0, err
+			}
+		}
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	// A dry run's updates are rolled back by the runner
+	return int(eventsRowsAffected + transfersRowsAffected), nil
+}
+
+func DuplicateCreationTimes(ctx context.Context, cfg *config.Config) error {
+	connStr := cfg.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
 	}
+	defer db.Close()
 
-	totalRowsAffected := int(eventsRowsAffected + transfersRowsAffected)
-	return totalRowsAffected, nil
-}
+	log.Println("Connected to database")
 
-func DuplicateCreationTimes() {
-	if err := updateCreationTimes(); err != nil {
-		log.Fatalf("Error: %v", err)
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
 	}
+
+	return updateCreationTimes(ctx, db, connStr)
 }
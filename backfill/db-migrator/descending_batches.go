@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/errs"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The batch commands on TransactionDetails walk it the same way, as a
+// descendingRun over a batcher.Runner. Batches are handed out from the highest id
+// down to -workers goroutines. Each is the next -batch-size ids matching the
+// command's pending condition below the previous one, paged by id, so gaps in the
+// ids and rows done by an earlier run cost no batches. Once a batch and every
+// batch above it have committed, its lower bound is stored as the command's
+// checkpoint in MigratorWatermarks, so the checkpoint never gets ahead of
+// committed work. With -resume a run continues below the checkpoint instead of
+// starting over from MAX(id); without it any stale checkpoint is cleared first.
+// The Runner does the paging, the workers, the retries and the stop between
+// batches; a descendingRun adds the counts, the progress lines, the checkpoint
+// storage and the dry-run report, and the command brings its conditions and the
+// SQL of a batch.
+
+// validateDescendingFlags checks the flags shared by the commands run as a
+// descendingRun, returning the -pause-window and -target-batch-ms they give.
+func validateDescendingFlags() (*pauseWindow, time.Duration, error) {
+	if *codeBatch <= 0 {
+		return nil, 0, &errs.ValidationError{Field: "-batch-size", Reason: fmt.Sprintf("%d must be greater than 0", *codeBatch)}
+	}
+	if *batchAttempts <= 0 {
+		return nil, 0, &errs.ValidationError{Field: "-batch-attempts", Reason: fmt.Sprintf("%d must be greater than 0", *batchAttempts)}
+	}
+	if *codeWorkers <= 0 {
+		return nil, 0, &errs.ValidationError{Field: "-workers", Reason: fmt.Sprintf("%d must be greater than 0", *codeWorkers)}
+	}
+	if *codeStart < 1 {
+		return nil, 0, &errs.ValidationError{Field: "-start-id", Reason: fmt.Sprintf("%d must be at least 1", *codeStart)}
+	}
+	if *codeEnd != 0 && *codeEnd < *codeStart {
+		return nil, 0, &errs.ValidationError{Field: "-end-id", Reason: fmt.Sprintf("%d is below -start-id %d", *codeEnd, *codeStart)}
+	}
+	if *maxRowsPerSec < 0 {
+		return nil, 0, &errs.ValidationError{Field: "-max-rows-per-sec", Reason: fmt.Sprintf("%d must not be negative", *maxRowsPerSec)}
+	}
+	if *sleepBetweenBatches < 0 {
+		return nil, 0, &errs.ValidationError{Field: "-sleep-between-batches", Reason: fmt.Sprintf("%s must not be negative", *sleepBetweenBatches)}
+	}
+	pause, err := parsePauseWindow(*pauseWindowFlag)
+	if err != nil {
+		return nil, 0, err
+	}
+	lockTimeout, statementTimeout := codeBatchTimeouts()
+	if !lockTimeoutPattern.MatchString(lockTimeout) {
+		return nil, 0, &errs.ValidationError{Field: "-batch-lock-timeout", Reason: fmt.Sprintf("%q, expected e.g. 500ms, 5s or 1min", lockTimeout)}
+	}
+	if !lockTimeoutPattern.MatchString(statementTimeout) {
+		return nil, 0, &errs.ValidationError{Field: "-batch-statement-timeout", Reason: fmt.Sprintf("%q, expected e.g. 500ms, 5s or 1min", statementTimeout)}
+	}
+	targetBatch := time.Duration(*targetBatchMs) * time.Millisecond
+	if err := validateBatchSizing(*codeBatch, targetBatch, *minBatchSize, *maxBatchSize); err != nil {
+		return nil, 0, err
+	}
+	return pause, targetBatch, nil
+}
+
+// descendingEndId returns the highest TransactionDetails id a run processes:
+// -end-id or MAX(id), capped to the live watermark and, with -resume, to below
+// the checkpoint at key. Without -resume a stale checkpoint is cleared.
+func descendingEndId(db *sql.DB, key string) (int, error) {
+	endId := *codeEnd
+	if endId == 0 {
+		if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "TransactionDetails"`).Scan(&endId); err != nil {
+			return 0, fmt.Errorf("failed to get max transaction ID: %w", err)
+		}
+	}
+
+	endId, err := capToLiveWatermark(db, "TransactionDetails", endId, *codeEnd != 0)
+	if err != nil {
+		return 0, err
+	}
+
+	if *resume {
+		checkpoint, err := readCheckpoint(db, key)
+		if err != nil {
+			return 0, err
+		}
+		if checkpoint > 0 {
+			log.Printf("Resuming below the checkpoint at id %d", checkpoint)
+			if checkpoint-1 < endId {
+				endId = checkpoint - 1
+			}
+		} else {
+			log.Println("No checkpoint found, starting from the max id")
+		}
+	} else if !*dryRun {
+		if err := clearWatermark(db, key); err != nil {
+			return 0, err
+		}
+	}
+	return endId, nil
+}
+
+// readCheckpoint reads the checkpoint at key, 0 when there is none. A dry run
+// doesn't create MigratorWatermarks, so it may not exist yet.
+func readCheckpoint(db *sql.DB, key string) (int, error) {
+	exists, err := tableExists(db, "MigratorWatermarks")
+	if err != nil || !exists {
+		return 0, err
+	}
+	return readWatermark(db, key)
+}
+
+// chainCheckpoint is the watermark key of the checkpoint of command. A run
+// restricted by -chains keeps its own, since the rows of the other chains below
+// it are still to process.
+func chainCheckpoint(command string) string {
+	if !chains.active() {
+		return command
+	}
+	return command + " " + chains.describe()
+}
+
+// codeBatchResult is what a batch of a descendingRun did.
+type codeBatchResult struct {
+	updated int
+	// Candidates found done when the batch ran
+	alreadyDone int
+	// Rows validated on the replica that the primary's safety check left out
+	unsafe int
+	// The invalid code values left out by -on-invalid
+	invalidIds []int
+}
+
+// descendingRun walks the rows of table in [startId, endId] that pending
+// selects, from the highest id down.
+type descendingRun struct {
+	command string
+	table   string
+	// inChains restricts the rows of table to -chains, the TransactionDetails
+	// rows of their transactions when empty
+	inChains string
+	// checkpoint is the watermark key of the run, none is kept when empty
+	checkpoint string
+	// updates says what the batches write, for the dry-run report; table when
+	// empty
+	updates string
+	// pending selects the rows still to process, candidate the rows the command
+	// applies to; a candidate that isn't pending was done before the run
+	pending, candidate string
+	// verb and done say what a batch does to a row, for the logs: convert and
+	// converted
+	verb, done string
+
+	startId, endId, batchSize, workers int
+	throttle                           *codeThrottle
+	sizer                              *batchSizer
+
+	// batch processes the rows batcher.IDs(ctx) of [startId, endId] matching
+	// pending, which also holds the -chains restriction, in tx. It is retried
+	// whole on a retryable database error.
+	batch func(ctx context.Context, tx *batcher.Tx, startId, endId int, pending string) (codeBatchResult, error)
+	// summary logs the totals of a completed run, before its throughput
+	summary func(totals descendingTotals)
+	// leftOut, when set, is given the invalid ids the batches left out, once
+	// they all ran
+	leftOut func(ids []int)
+}
+
+// descendingTotals adds up the batches of a run.
+type descendingTotals struct {
+	processed int64
+	// Candidates done before the run, and those found done when their batch ran
+	alreadyDone int64
+	unsafe      int64
+}
+
+// run processes the rows until they are all done, a batch fails or stop is
+// canceled; the batches in flight then finish.
+func (r *descendingRun) run(stop context.Context, db *sql.DB, pool *pgxpool.Pool) error {
+	pending := r.pending
+	// Restricted to some chains, only their rows are counted, paged and processed
+	inChains := r.inChains
+	if inChains == "" {
+		inChains = chains.transactionCondition(`"transactionId"`)
+	}
+	if chains.active() {
+		pending = "(" + pending + ") AND " + inChains
+	}
+
+	// Progress counts the rows to process, not the ids spanned
+	var total, doneBefore int
+	err := db.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*) FILTER (WHERE %s), COUNT(*) FILTER (WHERE %s AND NOT (%s))
+		FROM "%s"
+		WHERE id >= $1 AND id <= $2 AND %s
+	`, pending, r.candidate, pending, r.table, inChains), r.startId, r.endId).Scan(&total, &doneBefore)
+	if err != nil {
+		return errs.FromDB("failed to count the rows to "+r.verb, err)
+	}
+	if total == 0 {
+		logNothingToDo(r.table, r.startId, r.endId)
+		if !*dryRun {
+			r.summary(descendingTotals{alreadyDone: int64(doneBefore)})
+		}
+		return nil
+	}
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to process %s from ID %d down to %d on %s with %d workers", r.table, r.endId, r.startId, chains.describe(), r.workers)
+	log.Printf("Total %s rows to process: %d, already %s: %d", r.table, total, r.done, doneBefore)
+	eta := startEta(db, r.command, r.table, r.batchSize, total)
+	throughput := newThroughputTracker(total)
+	throughput.throttle = r.throttle
+
+	var report *dryRunReport
+	if *dryRun {
+		updates := r.updates
+		if updates == "" {
+			updates = r.table
+		}
+		report = newDryRunReport(updates)
+	}
+
+	var (
+		totals      = descendingTotals{alreadyDone: int64(doneBefore)}
+		coveredSpan int
+		// The result of the last attempt at the batch of each window in flight,
+		// by the window's start
+		results sync.Map
+		// Ids of the invalid code values left out by -on-invalid
+		leftOut []int
+		// The throughput window is reset between batches while they complete
+		mu sync.Mutex
+	)
+
+	// The batches give up on rows the live indexer holds instead of blocking it
+	lockTimeout, statementTimeout := codeBatchTimeouts()
+	runner := &batcher.Runner{
+		Pool:             pool,
+		LockTimeout:      lockTimeout,
+		StatementTimeout: statementTimeout,
+		Start:            r.startId,
+		End:              r.endId,
+		NextSize:         r.sizer.next,
+		Descending:       true,
+		Workers:          r.workers,
+		Table:            r.table,
+		Pending:          pending,
+		Rollback:         *dryRun,
+		Attempts:         *batchAttempts,
+		Batch: func(ctx context.Context, tx *batcher.Tx, startId, endId int) (int, error) {
+			started := time.Now()
+			result, err := r.batch(ctx, tx, startId, endId, pending)
+			r.sizer.observe(len(batcher.IDs(ctx)), time.Since(started), err)
+			results.Store(startId, result)
+			return result.updated, err
+		},
+		OnRetry: func(w batcher.Window, attempt int, backoff time.Duration, err error) {
+			logBatchRetry(w.String(), attempt, backoff, err)
+		},
+		Wait: func(ctx context.Context) {
+			if r.throttle.waitOutsidePause(ctx) {
+				mu.Lock()
+				throughput.resetWindow()
+				mu.Unlock()
+			}
+		},
+		Throttle: r.throttle.afterBatch,
+		Done: func(w batcher.Window, processed int, elapsed time.Duration, err error) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			stored, _ := results.LoadAndDelete(w.Start)
+			result, _ := stored.(codeBatchResult)
+			if err == nil {
+				leftOut = append(leftOut, result.invalidIds...)
+				metrics.skipped(len(result.invalidIds))
+				metrics.invalid(len(result.invalidIds))
+				metrics.examined(len(w.IDs))
+				throughput.add(len(w.IDs), processed)
+			}
+
+			switch {
+			case err != nil && report != nil:
+				report.abort(w.String(), err)
+			case err != nil:
+				return &batchError{start: w.Start, end: w.End, err: err}
+			case report != nil:
+				report.batch(w.String(), processed)
+			default:
+				metrics.batchCommitted(processed, elapsed)
+				totals.processed += int64(processed)
+				totals.alreadyDone += int64(result.alreadyDone)
+				totals.unsafe += int64(result.unsafe)
+			}
+
+			// Calculate progress percentage based on the rows to process handed out
+			coveredSpan += len(w.IDs)
+			progressPercent := percentOf(coveredSpan, total)
+
+			// Only print progress if it has increased by at least 0.1%
+			if progressPercent-lastProgressPrinted >= 0.1 {
+				line := fmt.Sprintf("Progress: %.1f%% | %s | batch %s", progressPercent, throughput.describe(), w)
+				if r.sizer.adaptive() {
+					line += " | " + r.sizer.describe()
+				}
+				// The live ETA only, unless an earlier run left a baseline to blend in
+				if eta.hasBaseline {
+					line += " | " + eta.describe(coveredSpan)
+				}
+				logProgress(line, w.Start, w.End, totals.processed, progressPercent, throughput.rowsPerSec())
+				lastProgressPrinted = progressPercent
+			}
+			return nil
+		},
+		Checkpoint: func(done batcher.Window) error {
+			if report != nil {
+				return nil
+			}
+			if r.checkpoint != "" {
+				if err := writeWatermark(db, r.checkpoint, done.Start); err != nil {
+					return err
+				}
+			}
+			metrics.setLowestProcessedId(done.Start)
+			return nil
+		},
+	}
+	err = runner.Run(stop)
+	var stopped *batcher.Stopped
+	if err != nil && !errors.As(err, &stopped) {
+		return err
+	}
+
+	if r.leftOut != nil {
+		r.leftOut(leftOut)
+	}
+
+	if stopped != nil {
+		remaining := stopped.Remaining
+		if remaining.End < r.endId {
+			log.Printf("Stopped: last completed batchMinId %d, ids %d-%d are done and %d-%d remain", remaining.End+1, remaining.End+1, r.endId, remaining.Start, remaining.End)
+		} else {
+			log.Println("Stopped before any batch completed")
+		}
+		if report != nil {
+			report.finish()
+		}
+		remain := fmt.Sprintf("ids %s remain", remaining)
+		if r.checkpoint != "" {
+			remain += fmt.Sprintf("; rerun with -start-id %d -end-id %d, or with -resume", remaining.Start, remaining.End)
+		} else {
+			remain += fmt.Sprintf("; rerun with -start-id %d -end-id %d", remaining.Start, remaining.End)
+		}
+		return &errs.Interrupted{Done: remain}
+	}
+
+	if report != nil {
+		// A dry run's throughput says nothing about a real one
+		return report.finish()
+	}
+
+	r.summary(totals)
+	log.Println(throughput.summary())
+	if r.sizer.adaptive() {
+		log.Println(r.sizer.summary())
+	}
+	// Nor does a throttled one's
+	if !r.throttle.active() {
+		finishEta(db, eta, r.command, r.table, r.batchSize)
+	}
+	return nil
+}
+
+// execBatchUpdate runs query, a single statement updating the rows of a batch,
+// in tx and ends the transaction in the same round trip, returning the rows it
+// updated.
+func execBatchUpdate(ctx context.Context, tx *batcher.Tx, query string, args ...interface{}) (int, error) {
+	batch := &pgx.Batch{}
+	batch.Queue(query, args...)
+	tx.QueueEnd(batch)
+
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	tag, err := results.Exec()
+	if err != nil {
+		return 0, errs.FromDB("failed to update records", err)
+	}
+	if _, err := results.Exec(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+	if err := results.Close(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
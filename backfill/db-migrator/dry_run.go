@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"go-backfill/errs"
+	"log"
+)
+
+// With -dry-run, code-to-text, creation-time and reconcile still read and
+// validate every batch, but nothing is kept: code-to-text skips its UPDATE, and
+// creation-time and reconcile run theirs in a transaction that is always rolled
+// back. Instead of aborting on the first failing batch, a dry run records it and
+// continues, then exits non-zero once the report is printed, so it can serve as a
+// pre-flight check.
+
+// dryRunReport counts the rows a dry run would have written and the batches that
+// would have aborted.
+type dryRunReport struct {
+	what    string
+	total   int
+	batches int
+	aborted []string
+}
+
+func newDryRunReport(what string) *dryRunReport {
+	return &dryRunReport{what: what}
+}
+
+// batch records that the batch labeled label would have written n rows.
+func (r *dryRunReport) batch(label string, n int) {
+	r.batches++
+	r.total += n
+	log.Printf("Dry run: batch %s would update %d %s", label, n, r.what)
+}
+
+// abort records that the batch labeled label would have aborted with err.
+func (r *dryRunReport) abort(label string, err error) {
+	r.batches++
+	r.aborted = append(r.aborted, label)
+	log.Printf("Dry run: batch %s would abort: %v", label, err)
+}
+
+// finish logs the totals, and returns an error when any batch would have
+// aborted.
+func (r *dryRunReport) finish() error {
+	log.Printf("Completed processing. Total %s that would be updated: %d (100.0%%)", r.what, r.total)
+	log.Printf("Dry run: %d batches checked, %d would abort, nothing was modified", r.batches, len(r.aborted))
+	if len(r.aborted) == 0 {
+		return nil
+	}
+	return &errs.ValidationError{
+		Field:  "-dry-run",
+		Reason: fmt.Sprintf("%d of %d batches would abort, the first at %s", len(r.aborted), r.batches, r.aborted[0]),
+	}
+}
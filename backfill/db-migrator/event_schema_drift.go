@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"go-backfill/safejson"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	eventSchemaWatermarkKey  = "detect-event-schema-drift"
+	eventSchemaMaxDepth      = 4
+	eventSchemaReportedNames = 10
+)
+
+// This script infers the structural signature (arity and value types) of the
+// params of every qualified event name from samples taken in height windows and
+// stores each signature with the height range it was seen in into the
+// EventSchemas table. An event whose signature changes over time, typically
+// because a module upgrade changed its parameter layout, ends up with several
+// rows; ordered by firstHeight they tell which layout applies at a given height,
+// which is what a decoder needs to pick the right version. The watermark holds
+// the last height processed (not an id).
+
+func detectEventSchemaDrift() error {
+	if *driftWindowHeights <= 0 {
+		return &errs.ValidationError{Field: "-drift-window-heights", Reason: fmt.Sprintf("%d must be greater than 0", *driftWindowHeights)}
+	}
+	if *driftSamples <= 0 {
+		return &errs.ValidationError{Field: "-drift-samples", Reason: fmt.Sprintf("%d must be greater than 0", *driftSamples)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createEventSchemasTable(db); err != nil {
+		return err
+	}
+
+	lastHeight, err := readWatermark(db, eventSchemaWatermarkKey)
+	if err != nil {
+		return err
+	}
+
+	// The live watermark is on block ids; translate it into a height
+	upperBlockId, err := capToLiveWatermark(db, "Blocks", math.MaxInt32, false)
+	if err != nil {
+		return err
+	}
+	var maxHeight int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(height), 0) FROM "Blocks" WHERE id <= $1`, upperBlockId).Scan(&maxHeight); err != nil {
+		return fmt.Errorf("failed to get max block height: %w", err)
+	}
+
+	startHeight := 0
+	if lastHeight > 0 {
+		startHeight = lastHeight + 1
+	}
+	if maxHeight < startHeight {
+		logNothingToDo("Blocks heights", startHeight, maxHeight)
+		log.Println("Completed processing. Total events sampled: 0 (100.0%)")
+		return logEventSchemaDrift(db)
+	}
+
+	totalSampled := 0
+	totalHeights := maxHeight - startHeight + 1
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to sample event params from height %d to %d", startHeight, maxHeight)
+
+	for currentHeight := startHeight; currentHeight <= maxHeight; currentHeight += *driftWindowHeights {
+		windowEnd := currentHeight + *driftWindowHeights - 1
+		if windowEnd > maxHeight {
+			windowEnd = maxHeight
+		}
+
+		sampled, err := processEventSchemaWindow(db, currentHeight, windowEnd)
+		if err != nil {
+			return fmt.Errorf("failed to process heights %d-%d: %w", currentHeight, windowEnd, err)
+		}
+		totalSampled += sampled
+
+		progressPercent := percentOf(windowEnd-startHeight+1, totalHeights)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, height: %d, events sampled: %d", progressPercent, windowEnd, totalSampled)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total events sampled: %d (100.0%%)", totalSampled)
+	return logEventSchemaDrift(db)
+}
+
+func createEventSchemasTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "EventSchemas" (
+			id SERIAL PRIMARY KEY,
+			qualname TEXT NOT NULL,
+			signature TEXT NOT NULL,
+			"firstHeight" INTEGER NOT NULL,
+			"lastHeight" INTEGER NOT NULL,
+			"firstEventId" BIGINT NOT NULL,
+			samples INTEGER NOT NULL,
+			"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (qualname, signature)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create EventSchemas table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS eventschemas_qualname_height_idx ON "EventSchemas" (qualname, "firstHeight")`)
+	if err != nil {
+		return fmt.Errorf("failed to create EventSchemas height index: %w", err)
+	}
+
+	if err := addLineageColumn(db, "EventSchemas"); err != nil {
+		return err
+	}
+	return createWatermarksTable(db)
+}
+
+type eventSchemaObservation struct {
+	Qualname     string
+	Signature    string
+	FirstHeight  int
+	LastHeight   int
+	FirstEventId int64
+	Samples      int
+}
+
+// processEventSchemaWindow samples up to -drift-samples events per qualified name
+// among the canonical blocks in [startHeight, endHeight] and merges their
+// signatures into EventSchemas.
+func processEventSchemaWindow(db *sql.DB, startHeight, endHeight int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	// The first occurrence in the window is always kept so ranges start where a
+	// signature really starts; the rest is a deterministic spread over the window.
+	rows, err := tx.Query(`
+		SELECT qualname, height, id, params::text
+		FROM (
+			SELECT e.qualname, b.height, e.id, e.params,
+				row_number() OVER (PARTITION BY e.qualname ORDER BY b.height, e.id) AS first,
+				row_number() OVER (PARTITION BY e.qualname ORDER BY md5(e.id::text)) AS spread
+			FROM "Events" e
+			JOIN "Transactions" t ON t.id = e."transactionId"
+			JOIN "Blocks" b ON b.id = t."blockId"
+			WHERE b.height >= $1 AND b.height <= $2 AND b.canonical = true
+		) s
+		WHERE first = 1 OR spread < $3
+	`, startHeight, endHeight, *driftSamples)
+	if err != nil {
+		return 0, fmt.Errorf("failed to sample events: %w", err)
+	}
+
+	observations := make(map[string]*eventSchemaObservation)
+	sampled := 0
+	for rows.Next() {
+		var (
+			qualname string
+			height   int
+			eventId  int64
+			params   []byte
+		)
+		if err := rows.Scan(&qualname, &height, &eventId, &params); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan event: %w", err)
+		}
+		sampled++
+
+		signature := paramsSignature(params)
+		key := qualname + "\x00" + signature
+		observation, ok := observations[key]
+		if !ok {
+			observation = &eventSchemaObservation{
+				Qualname:     qualname,
+				Signature:    signature,
+				FirstHeight:  height,
+				LastHeight:   height,
+				FirstEventId: eventId,
+			}
+			observations[key] = observation
+		}
+		observation.Samples++
+		if height < observation.FirstHeight || (height == observation.FirstHeight && eventId < observation.FirstEventId) {
+			observation.FirstHeight = height
+			observation.FirstEventId = eventId
+		}
+		if height > observation.LastHeight {
+			observation.LastHeight = height
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("error iterating events: %w", err)
+	}
+	rows.Close()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO "EventSchemas" (qualname, signature, "firstHeight", "lastHeight", "firstEventId", samples, "updatedAt", "lastRunId")
+		VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP, $7)
+		ON CONFLICT (qualname, signature) DO UPDATE SET
+			"firstEventId" = CASE WHEN EXCLUDED."firstHeight" < "EventSchemas"."firstHeight"
+				THEN EXCLUDED."firstEventId" ELSE "EventSchemas"."firstEventId" END,
+			"firstHeight" = LEAST("EventSchemas"."firstHeight", EXCLUDED."firstHeight"),
+			"lastHeight" = GREATEST("EventSchemas"."lastHeight", EXCLUDED."lastHeight"),
+			samples = "EventSchemas".samples + EXCLUDED.samples,
+			"updatedAt" = EXCLUDED."updatedAt",
+			"lastRunId" = EXCLUDED."lastRunId"
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, o := range observations {
+		if _, err := stmt.Exec(o.Qualname, o.Signature, o.FirstHeight, o.LastHeight, o.FirstEventId, o.Samples, runId); err != nil {
+			return 0, fmt.Errorf("failed to store signature of %s: %w", o.Qualname, err)
+		}
+	}
+
+	if err := writeWatermark(tx, eventSchemaWatermarkKey, endHeight); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return sampled, nil
+}
+
+// paramsSignature renders the structure of an event's params: the arity and type
+// of every parameter, e.g. (string,string,decimal).
+func paramsSignature(params []byte) string {
+	if err := safejson.Check(params, jsonLimits()); err != nil {
+		return "over-limit"
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "invalid"
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return "not-a-list:" + valueSignature(value, 0)
+	}
+
+	parts := make([]string, len(list))
+	for i, param := range list {
+		parts[i] = valueSignature(param, 0)
+	}
+	return "(" + strings.Join(parts, ",") + ")"
+}
+
+func valueSignature(value interface{}, depth int) string {
+	if depth >= eventSchemaMaxDepth {
+		return "..."
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case []interface{}:
+		// Nested lists vary in length, only the element types matter
+		seen := make(map[string]bool)
+		for _, element := range v {
+			seen[valueSignature(element, depth+1)] = true
+		}
+		types := make([]string, 0, len(seen))
+		for t := range seen {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return "[" + strings.Join(types, "|") + "]"
+	case map[string]interface{}:
+		// Pact encodes some literals as single-key objects
+		if len(v) == 1 {
+			for _, special := range []string{"int", "decimal", "time", "timep"} {
+				if _, ok := v[special]; ok {
+					return special
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := make([]string, len(keys))
+		for i, key := range keys {
+			fields[i] = key + ":" + valueSignature(v[key], depth+1)
+		}
+		return "{" + strings.Join(fields, ",") + "}"
+	default:
+		return "unknown"
+	}
+}
+
+// logEventSchemaDrift lists the event names with the most signatures and the
+// heights at which their signature changed.
+func logEventSchemaDrift(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT qualname, COUNT(*) AS signatures
+		FROM "EventSchemas"
+		GROUP BY qualname
+		HAVING COUNT(*) > 1
+		ORDER BY signatures DESC, qualname
+		LIMIT $1
+	`, eventSchemaReportedNames)
+	if err != nil {
+		return fmt.Errorf("failed to query drifting events: %w", err)
+	}
+
+	type drift struct {
+		Qualname   string
+		Signatures int
+	}
+	var drifting []drift
+	for rows.Next() {
+		var d drift
+		if err := rows.Scan(&d.Qualname, &d.Signatures); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan drifting event: %w", err)
+		}
+		drifting = append(drifting, d)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("error iterating drifting events: %w", err)
+	}
+	rows.Close()
+
+	if len(drifting) == 0 {
+		log.Println("No event changed its params signature")
+		return nil
+	}
+
+	log.Printf("Events with the most signature drift (top %d):", eventSchemaReportedNames)
+	for _, d := range drifting {
+		log.Printf("  %s: %d signatures", d.Qualname, d.Signatures)
+
+		changes, err := db.Query(`
+			SELECT signature, "firstHeight", "lastHeight"
+			FROM "EventSchemas"
+			WHERE qualname = $1
+			ORDER BY "firstHeight", signature
+		`, d.Qualname)
+		if err != nil {
+			return fmt.Errorf("failed to query signatures of %s: %w", d.Qualname, err)
+		}
+		for changes.Next() {
+			var (
+				signature               string
+				firstHeight, lastHeight int
+			)
+			if err := changes.Scan(&signature, &firstHeight, &lastHeight); err != nil {
+				changes.Close()
+				return fmt.Errorf("failed to scan signature of %s: %w", d.Qualname, err)
+			}
+			log.Printf("    heights %d-%d: %s", firstHeight, lastHeight, signature)
+		}
+		if err := changes.Err(); err != nil {
+			changes.Close()
+			return fmt.Errorf("error iterating signatures of %s: %w", d.Qualname, err)
+		}
+		changes.Close()
+	}
+	return nil
+}
+
+func DetectEventSchemaDrift(ctx context.Context, cfg *config.Config) error {
+	return detectEventSchemaDrift()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"go-backfill/errs"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// exitHooks run before fatal exits, for what must not wait for the process to end.
+var (
+	exitHooks     []func()
+	exitHooksOnce sync.Once
+)
+
+// onExit registers hook to run when fatal exits.
+func onExit(hook func()) {
+	exitHooks = append(exitHooks, hook)
+}
+
+// fatal logs err and exits with the code of its category, so that schedulers can
+// tell a retryable failure from one that needs an operator.
+func fatal(err error) {
+	runExitHooks()
+	finishRun(err)
+	logEvent(slog.LevelError, fmt.Sprintf("Error: %v", err), append(errorAttrs(err), "error", err.Error(), "exit_code", errs.ExitCode(err))...)
+	finishRunReport(err)
+	os.Exit(errs.ExitCode(err))
+}
+
+// exitInterrupted exits on a signal the command doesn't wait out, recording the
+// run as stopped by err first.
+func exitInterrupted(err *errs.Interrupted) {
+	runExitHooks()
+	finishRun(err)
+	finishRunReport(err)
+	os.Exit(errs.ExitInterrupted)
+}
+
+// runExitHooks runs the exit hooks. Only the first call does anything, so a
+// signal arriving while fatal exits doesn't run them twice.
+func runExitHooks() {
+	exitHooksOnce.Do(func() {
+		for _, hook := range exitHooks {
+			hook()
+		}
+	})
+}
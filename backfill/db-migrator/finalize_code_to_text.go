@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var lockTimeoutPattern = regexp.MustCompile(`^[0-9]+(ms|s|min)?$`)
+
+// This script completes the code-to-text migration. It first checks, in batches
+// and without locks, that every codetext value matches the conversion of its jsonb
+// code. Then, in a single transaction holding an exclusive lock on
+// TransactionDetails for as short as possible, it converts the rows the live
+// indexer inserted since the check and swaps codetext into place: the jsonb code
+// column is dropped (or renamed to code_jsonb with -skip-drop) and codetext is
+// renamed to code. Views depending on either column block the swap unless they are
+// declared with -finalize-views, in which case they are recreated from their
+// current definition, under their schema. A row inserted since the check whose
+// code code-to-text wouldn't convert aborts the swap. Every statement is logged
+// verbatim for the change record.
+
+func finalizeCodeToText() error {
+	if !lockTimeoutPattern.MatchString(*finalizeLockTimeout) {
+		return &errs.ValidationError{Field: "-finalize-lock-timeout", Reason: fmt.Sprintf("%q, expected e.g. 500ms, 5s or 1min", *finalizeLockTimeout)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	codeType, err := columnType(db, "TransactionDetails", "code")
+	if err != nil {
+		return err
+	}
+	codeTextType, err := columnType(db, "TransactionDetails", "codetext")
+	if err != nil {
+		return err
+	}
+
+	if codeType == "text" && codeTextType == "" {
+		log.Println("TransactionDetails.code is already text; nothing to finalize")
+		return nil
+	}
+	if codeType != "jsonb" || codeTextType != "text" {
+		return &errs.SchemaError{Missing: "TransactionDetails.codetext",
+			Reason: fmt.Sprintf("expected jsonb code and text codetext columns, found code %q and codetext %q; run code-to-text first", codeType, codeTextType)}
+	}
+
+	views, err := dependentViews(db)
+	if err != nil {
+		return err
+	}
+	declared := make(map[string]bool)
+	for _, name := range strings.Split(*finalizeViews, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			declared[name] = true
+		}
+	}
+	var undeclared []string
+	for _, view := range views {
+		if !view.declaredIn(declared) {
+			undeclared = append(undeclared, view.String())
+		}
+	}
+	if len(undeclared) > 0 {
+		return fmt.Errorf("views depend on TransactionDetails.code or codetext: %s; declare them with -finalize-views to have them recreated",
+			strings.Join(undeclared, ", "))
+	}
+
+	verifiedMaxId, err := verifyCodeTextConversion(db)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Println("Dry run: the conversion is complete; these statements would be executed:")
+		definitions := make(map[dependentView]string, len(views))
+		for _, view := range views {
+			definitions[view] = "<current definition>"
+		}
+		for _, statement := range finalizeStatements(verifiedMaxId, views, definitions) {
+			log.Printf("  %s", statement)
+		}
+		return nil
+	}
+
+	return swapCodeText(db, verifiedMaxId, views)
+}
+
+// dependentView is a view referencing TransactionDetails.code or codetext.
+type dependentView struct {
+	schema, name string
+}
+
+// qualified is the quoted schema-qualified name of the view, for the statements
+// recreating it.
+func (v dependentView) qualified() string {
+	return fmt.Sprintf(`"%s"."%s"`, v.schema, v.name)
+}
+
+func (v dependentView) String() string {
+	return v.schema + "." + v.name
+}
+
+// declaredIn reports whether -finalize-views declares the view, by its name or
+// its schema-qualified name.
+func (v dependentView) declaredIn(declared map[string]bool) bool {
+	return declared[v.name] || declared[v.String()]
+}
+
+// dependentViews lists the views that reference TransactionDetails.code or
+// codetext, which would make the column swap fail.
+func dependentViews(db *sql.DB) ([]dependentView, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT n.nspname, v.relname
+		FROM pg_depend d
+		JOIN pg_rewrite r ON r.oid = d.objid
+		JOIN pg_class v ON v.oid = r.ev_class
+		JOIN pg_namespace n ON n.oid = v.relnamespace
+		JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE d.refobjid = '"TransactionDetails"'::regclass AND a.attname IN ('code', 'codetext') AND v.oid <> d.refobjid
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up dependent views: %w", err)
+	}
+	defer rows.Close()
+
+	var views []dependentView
+	for rows.Next() {
+		var view dependentView
+		if err := rows.Scan(&view.schema, &view.name); err != nil {
+			return nil, fmt.Errorf("failed to scan dependent view: %w", err)
+		}
+		views = append(views, view)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating dependent views: %w", err)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].String() < views[j].String() })
+	return views, nil
+}
+
+// verifyCodeTextConversion checks every row up to the current max id, as
+// verify-code-to-text does, and returns that id. It fails when any row is
+// unconverted or holds a different value; the rows cleanup-code cleared the code
+// of hold none to compare with.
+func verifyCodeTextConversion(db *sql.DB) (int, error) {
+	var maxId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "TransactionDetails"`).Scan(&maxId); err != nil {
+		return 0, fmt.Errorf("failed to get max transaction details ID: %w", err)
+	}
+	if maxId < 1 {
+		return 0, nil
+	}
+
+	counts, err := verifyCodeTextRange(db, 1, maxId)
+	if err != nil {
+		return 0, err
+	}
+	if counts.NotMigrated > 0 || counts.Mismatched > 0 {
+		return 0, fmt.Errorf("refusing to finalize: %d rows unconverted and %d rows mismatched; re-run code-to-text",
+			counts.NotMigrated, counts.Mismatched)
+	}
+
+	log.Printf("All codetext values up to id %d match their code", maxId)
+	return maxId, nil
+}
+
+// finalizeStatements returns the statements of the swap transaction in order.
+// The SELECT counts the rows inserted since the check that code-to-text wouldn't
+// convert, which abort the swap.
+func finalizeStatements(verifiedMaxId int, views []dependentView, definitions map[dependentView]string) []string {
+	statements := []string{
+		fmt.Sprintf(`SET LOCAL lock_timeout = '%s'`, *finalizeLockTimeout),
+		`LOCK TABLE "TransactionDetails" IN ACCESS EXCLUSIVE MODE`,
+		fmt.Sprintf(`SELECT COUNT(*), COALESCE(MIN(id), 0) FROM "TransactionDetails" WHERE id > %d AND NOT (%s)`, verifiedMaxId, codeConvertibleCondition),
+		fmt.Sprintf(`UPDATE "TransactionDetails" SET codetext = %s WHERE id > %d AND (%s)`, codeTextConversion, verifiedMaxId, codeConvertibleCondition),
+	}
+	for _, view := range views {
+		statements = append(statements, fmt.Sprintf(`DROP VIEW %s`, view.qualified()))
+	}
+	if *finalizeSkipDrop {
+		statements = append(statements, `ALTER TABLE "TransactionDetails" RENAME COLUMN code TO code_jsonb`)
+	} else {
+		statements = append(statements, `ALTER TABLE "TransactionDetails" DROP COLUMN code`)
+	}
+	statements = append(statements, `ALTER TABLE "TransactionDetails" RENAME COLUMN codetext TO code`)
+	for _, view := range views {
+		statements = append(statements, fmt.Sprintf(`CREATE VIEW %s AS %s`, view.qualified(), strings.TrimSuffix(strings.TrimSpace(definitions[view]), ";")))
+	}
+	return statements
+}
+
+func swapCodeText(db *sql.DB, verifiedMaxId int, views []dependentView) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	definitions := make(map[dependentView]string, len(views))
+	for _, view := range views {
+		var definition string
+		if err := tx.QueryRow(`SELECT pg_get_viewdef(to_regclass($1), true)`, view.qualified()).Scan(&definition); err != nil {
+			return fmt.Errorf("failed to read definition of view %s: %w", view, err)
+		}
+		definitions[view] = definition
+	}
+
+	log.Println("Executing the swap in a single transaction:")
+	for _, statement := range finalizeStatements(verifiedMaxId, views, definitions) {
+		log.Printf("  %s", statement)
+		if strings.HasPrefix(statement, "SELECT") {
+			var leftOut, firstId int
+			if err := tx.QueryRow(statement).Scan(&leftOut, &firstId); err != nil {
+				return errs.FromDB(fmt.Sprintf("failed to execute %q", statement), err)
+			}
+			if leftOut > 0 {
+				return fmt.Errorf("refusing to finalize: %d rows inserted since verification hold a code code-to-text doesn't convert (first at id %d); fix them and run code-to-text again",
+					leftOut, firstId)
+			}
+			continue
+		}
+		result, err := tx.Exec(statement)
+		if err != nil {
+			return errs.FromDB(fmt.Sprintf("failed to execute %q", statement), err)
+		}
+		if strings.HasPrefix(statement, "UPDATE") {
+			affected, err := result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("failed to get affected rows: %w", err)
+			}
+			log.Printf("  -- converted %d rows inserted since verification", affected)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errs.FromDB("failed to commit transaction", err)
+	}
+
+	log.Println("Successfully swapped codetext into place: TransactionDetails.code is now text")
+	return nil
+}
+
+func FinalizeCodeToText(ctx context.Context, cfg *config.Config) error {
+	return finalizeCodeToText()
+}
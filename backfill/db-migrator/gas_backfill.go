@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"go-backfill/process"
+	"go-backfill/safejson"
+	"log"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const gasBackfillCheckpointKey = "gas-backfill"
+
+// This script fills the gas, gaslimit and gasprice of the TransactionDetails rows
+// indexed without them. A value already set is never rewritten. The database
+// keeps no copy of the signed command, so the values come from two places:
+//
+//   - With -node-url, the payload of the transaction's block is fetched from the
+//     node, and gaslimit and gasprice are read from the command's meta and gas from
+//     its output, as the indexer does. Blocks whose payload can't be fetched are
+//     logged and left to the events, as are transactions that can't be
+//     decoded.
+//   - A row knowing one of gas and gasprice gets the other from the fee, the
+//     amount of the last coin TRANSFER its sender paid to the block's miner
+//     account: gas is the fee over gasprice, gasprice the fee over gas. A value is
+//     only written when it divides the fee exactly.
+//
+// gaslimit only comes from the payload, so without -node-url it isn't looked at:
+// a row is pending, and counted as left NULL after its batch, only when it misses
+// a value the active sources can fill.
+//
+// It runs as a descendingRun like code-hash, restricted by -chains and the
+// -from-height/-to-height or -from-date/-to-date window of the blocks, its
+// checkpoint being gas-backfill, followed by the scope of a restricted run. A dry
+// run does all the work of every batch in a transaction that is rolled back.
+
+// gasBackfillPending selects the rows missing a gas value the sources can fill:
+// all three with the payloads, gas and gasprice from the events alone.
+func gasBackfillPending(withPayloads bool) string {
+	if withPayloads {
+		return `(gas IS NULL OR gaslimit IS NULL OR gasprice IS NULL)`
+	}
+	return `(gas IS NULL OR gasprice IS NULL)`
+}
+
+// gasBackfillTotals counts the rows filled from each source, across workers.
+type gasBackfillTotals struct {
+	fromPayload, fromEvents, leftNull int64
+	// Blocks whose payload couldn't be fetched
+	nodeFailures int64
+}
+
+// gasPayload is the gas of a transaction in its block's payload.
+type gasPayload struct {
+	gas, gasLimit, gasPrice string
+}
+
+func backfillGas() error {
+	pause, targetBatch, err := validateDescendingFlags()
+	if err != nil {
+		return err
+	}
+	scope, err := parseReconcileScope()
+	if err != nil {
+		return err
+	}
+	if *reconcileNodeJobs <= 0 {
+		return &errs.ValidationError{Field: "-node-concurrency", Reason: fmt.Sprintf("%d must be greater than 0", *reconcileNodeJobs)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	var node *nodeClient
+	if *reconcileNodeURL != "" {
+		node, err = newNodeClient(env, *reconcileNodeURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if *dryRun {
+		log.Println("Dry run: every batch is rolled back, nothing is updated")
+	} else if err := createWatermarksTable(db); err != nil {
+		return err
+	}
+
+	fillable := gasBackfillPending(node != nil)
+	pending := fillable
+	checkpoint := gasBackfillCheckpointKey
+	if scope.bounded {
+		pending += ` AND EXISTS (
+			SELECT 1 FROM "Transactions" t JOIN "Blocks" b ON b.id = t."blockId"
+			WHERE t.id = "TransactionDetails"."transactionId" AND ` + scope.condition + `
+		)`
+		checkpoint += " " + scope.description
+	}
+
+	maxTransactionID, err := descendingEndId(db, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if maxTransactionID < *codeStart {
+		logNothingToDo("TransactionDetails", *codeStart, maxTransactionID)
+		log.Println("Completed processing. Total TransactionDetails filled: 0 (100.0%)")
+		return nil
+	}
+
+	// Every worker holds one connection for its batch transaction, and paging
+	// the next batch takes one more
+	pool, err := openBatchPool(connStr, *codeWorkers+1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	if node != nil {
+		log.Printf("Filling gas on %s from the node's payloads and the fee events", scope.description)
+	} else {
+		log.Printf("Filling gas on %s from the fee events; gaslimit needs -node-url", scope.description)
+	}
+	var totals gasBackfillTotals
+	run := &descendingRun{
+		command:    "gas-backfill",
+		table:      "TransactionDetails",
+		checkpoint: checkpoint,
+		pending:    pending,
+		candidate:  `"transactionId" IS NOT NULL`,
+		verb:       "fill",
+		done:       "filled",
+		startId:    *codeStart,
+		endId:      maxTransactionID,
+		batchSize:  *codeBatch,
+		workers:    *codeWorkers,
+		throttle:   newCodeThrottle(*maxRowsPerSec, *sleepBetweenBatches, pause),
+		sizer:      newBatchSizer(*codeBatch, targetBatch, *minBatchSize, *maxBatchSize),
+		batch: func(ctx context.Context, tx *batcher.Tx, startId, endId int, pending string) (codeBatchResult, error) {
+			return fillGasBatch(ctx, tx, pool, node, startId, endId, pending, fillable, &totals)
+		},
+		summary: func(done descendingTotals) {
+			log.Printf("Completed processing. Total TransactionDetails filled: %d (100.0%%)", done.processed)
+			log.Printf("Already complete and skipped: %d", done.alreadyDone)
+		},
+	}
+	if err := run.run(shutdownCtx, db, pool); err != nil {
+		return fmt.Errorf("failed to process transactions: %w", err)
+	}
+
+	log.Printf("Filled from payload: %d, derived from events: %d, left NULL without source data: %d",
+		atomic.LoadInt64(&totals.fromPayload), atomic.LoadInt64(&totals.fromEvents), atomic.LoadInt64(&totals.leftNull))
+	if failures := atomic.LoadInt64(&totals.nodeFailures); failures > 0 {
+		log.Printf("Blocks whose payload couldn't be fetched: %d", failures)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	log.Printf("Max(TransactionDetails.id) processed: %d", maxTransactionID)
+	return nil
+}
+
+// fillGasBatch fills the gas of the rows of the batch matching pending, in tx:
+// from the payloads fetched on pool before it begins, then from the fee events.
+// The rows still matching fillable afterwards are left NULL.
+func fillGasBatch(ctx context.Context, tx *batcher.Tx, pool *pgxpool.Pool, node *nodeClient, startId, endId int, pending, fillable string, totals *gasBackfillTotals) (codeBatchResult, error) {
+	ids := batcher.IDs(ctx)
+	var (
+		payloadIds                []int
+		gas, gasLimits, gasPrices []string
+		err                       error
+	)
+	if node != nil {
+		payloadIds, gas, gasLimits, gasPrices, err = gasFromPayloads(ctx, pool, node, ids, pending, totals)
+		if err != nil {
+			return codeBatchResult{}, err
+		}
+	}
+
+	batch := &pgx.Batch{}
+	if len(payloadIds) > 0 {
+		batch.Queue(`
+			UPDATE "TransactionDetails"
+			SET gas = COALESCE(gas, NULLIF(p.new_gas, '')),
+				gaslimit = COALESCE(gaslimit, NULLIF(p.new_gaslimit, '')),
+				gasprice = COALESCE(gasprice, NULLIF(p.new_gasprice, '')),
+				"updatedAt" = CURRENT_TIMESTAMP
+			FROM unnest($1::int[], $2::text[], $3::text[], $4::text[]) AS p(detail_id, new_gas, new_gaslimit, new_gasprice)
+			WHERE "TransactionDetails".id = p.detail_id AND `+pending+`
+				AND ((gas IS NULL AND p.new_gas <> '') OR (gaslimit IS NULL AND p.new_gaslimit <> '')
+					OR (gasprice IS NULL AND p.new_gasprice <> ''))
+			RETURNING "TransactionDetails".id
+		`, payloadIds, gas, gasLimits, gasPrices)
+	}
+	// The amount of a TRANSFER is a number, or {"decimal": "..."} past the
+	// precision of one; anything else is left alone rather than failing the cast
+	batch.Queue(`
+		WITH fees AS (
+			SELECT d.id AS detail_id, d.gas IS NULL AS gas_missing,
+				CASE WHEN d.gas ~ '^[0-9]+$' THEN d.gas::numeric END AS used,
+				CASE WHEN d.gasprice ~ '^[0-9]+(\.[0-9]+)?$' THEN d.gasprice::numeric END AS price,
+				(
+					SELECT CASE WHEN a.amount ~ '^[0-9]+(\.[0-9]+)?$' THEN a.amount::numeric END
+					FROM "Events" e
+					CROSS JOIN LATERAL (
+						SELECT CASE jsonb_typeof(e.params->2)
+							WHEN 'number' THEN e.params->>2
+							WHEN 'object' THEN e.params->2->>'decimal'
+						END AS amount
+					) a
+					WHERE e."transactionId" = d."transactionId" AND e.module = 'coin' AND e.name = 'TRANSFER'
+						AND e.params->>0 = t.sender AND e.params->>1 = b."minerData"->>'account'
+					ORDER BY e."orderIndex" DESC
+					LIMIT 1
+				) AS fee
+			FROM "TransactionDetails" d
+			JOIN "Transactions" t ON t.id = d."transactionId"
+			JOIN "Blocks" b ON b.id = t."blockId"
+			WHERE d.id = ANY($1::int[]) AND (d.gas IS NULL) <> (d.gasprice IS NULL)
+		), derived AS (
+			SELECT detail_id,
+				CASE WHEN gas_missing AND price > 0 AND fee > 0 AND mod(fee, price) = 0
+					THEN trunc(fee / price)::text END AS gas_value,
+				CASE WHEN NOT gas_missing AND used > 0 AND fee > 0 AND trim_scale(fee / used) * used = fee
+					THEN trim_scale(fee / used)::text END AS gasprice_value
+			FROM fees
+		)
+		UPDATE "TransactionDetails"
+		SET gas = COALESCE(gas, derived.gas_value), gasprice = COALESCE(gasprice, derived.gasprice_value),
+			"updatedAt" = CURRENT_TIMESTAMP
+		FROM derived
+		WHERE "TransactionDetails".id = derived.detail_id
+			AND (derived.gas_value IS NOT NULL OR derived.gasprice_value IS NOT NULL)
+		RETURNING "TransactionDetails".id
+	`, ids)
+	batch.Queue(`SELECT COUNT(*) FROM "TransactionDetails" WHERE id = ANY($1::int[]) AND `+fillable, ids)
+	tx.QueueEnd(batch)
+
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	// A row can be filled from its payload and then from its events
+	var (
+		updated                           = make(map[int]bool)
+		fromPayload, fromEvents, leftNull int
+	)
+	if len(payloadIds) > 0 {
+		fromPayload, err = readUpdatedIds(results, updated)
+		if err != nil {
+			return codeBatchResult{}, errs.FromDB("failed to fill gas from payloads", err)
+		}
+	}
+	fromEvents, err = readUpdatedIds(results, updated)
+	if err != nil {
+		return codeBatchResult{}, errs.FromDB("failed to derive gas from events", err)
+	}
+	if err := results.QueryRow().Scan(&leftNull); err != nil {
+		return codeBatchResult{}, errs.FromDB("failed to count the rows left NULL", err)
+	}
+	if _, err := results.Exec(); err != nil {
+		return codeBatchResult{}, errs.FromDB("failed to commit transaction", err)
+	}
+	if err := results.Close(); err != nil {
+		return codeBatchResult{}, errs.FromDB("failed to commit transaction", err)
+	}
+
+	atomic.AddInt64(&totals.fromPayload, int64(fromPayload))
+	atomic.AddInt64(&totals.fromEvents, int64(fromEvents))
+	atomic.AddInt64(&totals.leftNull, int64(leftNull))
+	log.Printf("Processed batch %d-%d: %d filled from payload, %d derived from events, %d left NULL",
+		startId, endId, fromPayload, fromEvents, leftNull)
+	return codeBatchResult{updated: len(updated)}, nil
+}
+
+// readUpdatedIds reads the ids an UPDATE of the batch returned into updated, and
+// returns how many there were.
+func readUpdatedIds(results pgx.BatchResults, updated map[int]bool) (int, error) {
+	rows, err := results.Query()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		updated[id] = true
+		count++
+	}
+	return count, rows.Err()
+}
+
+// gasFromPayloads fetches the payloads of the blocks of the rows ids matching
+// pending, and returns the ids of the rows found in them with their gas, gaslimit
+// and gasprice.
+func gasFromPayloads(ctx context.Context, pool *pgxpool.Pool, node *nodeClient, ids []int, pending string, totals *gasBackfillTotals) ([]int, []string, []string, []string, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT "TransactionDetails".id, t.requestkey, b.id, b."chainId", b."payloadHash"
+		FROM "TransactionDetails"
+		JOIN "Transactions" t ON t.id = "TransactionDetails"."transactionId"
+		JOIN "Blocks" b ON b.id = t."blockId"
+		WHERE "TransactionDetails".id = ANY($1::int[]) AND `+pending, ids)
+	if err != nil {
+		return nil, nil, nil, nil, errs.FromDB("failed to load the blocks of the batch", err)
+	}
+	var (
+		blocks     []nodeBlock
+		blockIndex = make(map[int]int)
+		detailIds  []int
+		detailKeys []blockRequestKey
+	)
+	for rows.Next() {
+		var (
+			id    int
+			key   blockRequestKey
+			block nodeBlock
+		)
+		if err := rows.Scan(&id, &key.requestKey, &block.id, &block.chainId, &block.payloadHash); err != nil {
+			rows.Close()
+			return nil, nil, nil, nil, errs.FromDB("failed to scan the blocks of the batch", err)
+		}
+		key.blockId = block.id
+		if _, ok := blockIndex[block.id]; !ok {
+			blockIndex[block.id] = len(blocks)
+			blocks = append(blocks, block)
+		}
+		detailIds = append(detailIds, id)
+		detailKeys = append(detailKeys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, nil, errs.FromDB("error iterating the blocks of the batch", err)
+	}
+
+	payloads := make(map[blockRequestKey]gasPayload)
+	for i, err := range fetchNodePayloads(ctx, node, blocks) {
+		block := blocks[i]
+		if err != nil {
+			log.Printf("Warning: couldn't fetch the payload of block %d: %v", block.id, err)
+			atomic.AddInt64(&totals.nodeFailures, 1)
+			continue
+		}
+		for j, parts := range block.payload.Transactions {
+			reqKey, values, err := decodeGasPayload(parts)
+			if err != nil {
+				log.Printf("Warning: couldn't decode transaction %d of block %d: %v", j, block.id, err)
+				continue
+			}
+			payloads[blockRequestKey{blockId: block.id, requestKey: reqKey}] = values
+		}
+	}
+
+	var found []int
+	var gas, gasLimits, gasPrices []string
+	for i, key := range detailKeys {
+		values, ok := payloads[key]
+		if !ok {
+			continue
+		}
+		found = append(found, detailIds[i])
+		gas = append(gas, values.gas)
+		gasLimits = append(gasLimits, values.gasLimit)
+		gasPrices = append(gasPrices, values.gasPrice)
+	}
+	return found, gas, gasLimits, gasPrices, nil
+}
+
+// decodeGasPayload returns the request key of a transaction of a payload and its
+// gas, read the way the indexer reads them.
+func decodeGasPayload(parts [2]string) (string, gasPayload, error) {
+	decoded, err := decodeBase64(parts[0])
+	if err != nil {
+		return "", gasPayload{}, fmt.Errorf("failed to decode the signed command: %w", err)
+	}
+	var part0 TransactionPart0
+	if err := safejson.Unmarshal(decoded, &part0, jsonLimits()); err != nil {
+		return "", gasPayload{}, fmt.Errorf("failed to parse the signed command: %w", err)
+	}
+	var rawCmd string
+	if err := json.Unmarshal(part0.Cmd, &rawCmd); err != nil {
+		return "", gasPayload{}, fmt.Errorf("failed to parse the command: %w", err)
+	}
+	var cmd process.CmdData
+	if err := safejson.Unmarshal([]byte(rawCmd), &cmd, jsonLimits()); err != nil {
+		return "", gasPayload{}, fmt.Errorf("failed to parse the command: %w", err)
+	}
+
+	decoded, err = decodeBase64(parts[1])
+	if err != nil {
+		return "", gasPayload{}, fmt.Errorf("failed to decode the output: %w", err)
+	}
+	var part1 TransactionPart1
+	if err := safejson.Unmarshal(decoded, &part1, jsonLimits()); err != nil {
+		return "", gasPayload{}, fmt.Errorf("failed to parse the output: %w", err)
+	}
+
+	return part1.ReqKey, gasPayload{
+		gas:      strconv.Itoa(part1.Gas),
+		gasLimit: string(cmd.Meta.GasLimit),
+		gasPrice: string(cmd.Meta.GasPrice),
+	}, nil
+}
+
+func GasBackfill(ctx context.Context, cfg *config.Config) error {
+	return backfillGas()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// A HyperLogLog sketch estimates the number of distinct values added to it in a
+// fixed amount of memory, and two sketches merge by taking the register-wise
+// maximum, so daily sketches roll up into weekly or monthly estimates without
+// rescanning. With 2^12 registers the standard error is 1.04/sqrt(4096), about
+// 1.6%.
+//
+// Serialized format (stored in the database, keep it stable):
+//
+//	byte 0     format version, currently 1
+//	byte 1     precision p (number of registers is 2^p)
+//	byte 2     encoding: 0 dense, 1 sparse
+//	dense      2^p register bytes
+//	sparse     uint16 count, then count pairs of uint16 register index and byte
+//	           value, all big-endian, indexes ascending
+//
+// Values are hashed with 64-bit FNV-1a followed by the murmur3 finalizer.
+
+const (
+	hllVersion      = 1
+	hllPrecision    = 12
+	hllEncodeDense  = 0
+	hllEncodeSparse = 1
+)
+
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{
+		precision: hllPrecision,
+		registers: make([]uint8, 1<<hllPrecision),
+	}
+}
+
+// hllStandardError is the relative standard error of an estimate.
+func hllStandardError() float64 {
+	return 1.04 / math.Sqrt(float64(int(1)<<hllPrecision))
+}
+
+func hllHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+
+	// murmur3 fmix64, FNV alone doesn't spread short similar keys well enough
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (s *hyperLogLog) Add(value string) {
+	x := hllHash(value)
+	index := x >> (64 - s.precision)
+	rest := x<<s.precision | 1<<(s.precision-1) // the guard bit bounds the rank
+	rank := uint8(bits.LeadingZeros64(rest)) + 1
+	if rank > s.registers[index] {
+		s.registers[index] = rank
+	}
+}
+
+func (s *hyperLogLog) Merge(other *hyperLogLog) error {
+	if other.precision != s.precision {
+		return fmt.Errorf("cannot merge sketches of precision %d and %d", s.precision, other.precision)
+	}
+	for i, rank := range other.registers {
+		if rank > s.registers[i] {
+			s.registers[i] = rank
+		}
+	}
+	return nil
+}
+
+func (s *hyperLogLog) Estimate() float64 {
+	m := float64(len(s.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range s.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// Small cardinalities: linear counting is more accurate
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+func (s *hyperLogLog) MarshalBinary() ([]byte, error) {
+	nonZero := 0
+	for _, rank := range s.registers {
+		if rank != 0 {
+			nonZero++
+		}
+	}
+
+	// A sparse pair takes 3 bytes, so it only pays off below a third of the registers
+	if nonZero*3 < len(s.registers) {
+		data := make([]byte, 5, 5+nonZero*3)
+		data[0], data[1], data[2] = hllVersion, s.precision, hllEncodeSparse
+		binary.BigEndian.PutUint16(data[3:5], uint16(nonZero))
+		for i, rank := range s.registers {
+			if rank != 0 {
+				data = binary.BigEndian.AppendUint16(data, uint16(i))
+				data = append(data, rank)
+			}
+		}
+		return data, nil
+	}
+
+	data := make([]byte, 3, 3+len(s.registers))
+	data[0], data[1], data[2] = hllVersion, s.precision, hllEncodeDense
+	return append(data, s.registers...), nil
+}
+
+func (s *hyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < 3 {
+		return fmt.Errorf("sketch too short: %d bytes", len(data))
+	}
+	if data[0] != hllVersion {
+		return fmt.Errorf("unsupported sketch version %d", data[0])
+	}
+	precision := data[1]
+	if precision < 4 || precision > 16 {
+		return fmt.Errorf("invalid sketch precision %d", precision)
+	}
+	registers := make([]uint8, 1<<precision)
+
+	switch data[2] {
+	case hllEncodeDense:
+		if len(data) != 3+len(registers) {
+			return fmt.Errorf("dense sketch has %d bytes, expected %d", len(data), 3+len(registers))
+		}
+		copy(registers, data[3:])
+	case hllEncodeSparse:
+		if len(data) < 5 {
+			return fmt.Errorf("sparse sketch too short: %d bytes", len(data))
+		}
+		count := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) != 5+count*3 {
+			return fmt.Errorf("sparse sketch has %d bytes, expected %d", len(data), 5+count*3)
+		}
+		for i := 0; i < count; i++ {
+			pair := data[5+i*3:]
+			index := int(binary.BigEndian.Uint16(pair[0:2]))
+			if index >= len(registers) {
+				return fmt.Errorf("sparse sketch register %d out of range", index)
+			}
+			registers[index] = pair[2]
+		}
+	default:
+		return fmt.Errorf("unknown sketch encoding %d", data[2])
+	}
+
+	s.precision = precision
+	s.registers = registers
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// The sketches are stored in ActiveAddressSketches and merged with the ones
+// later runs build, so a change to the hash or the encoding silently corrupts
+// every estimate over existing rows. The golden values below pin both; a test
+// failing here means the format changed, not the test.
+
+func TestHllHashIsStable(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint64
+	}{
+		{value: "", want: 0xefd01f60ba992926},
+		{value: "k:alice", want: 0xe03db46bac83b2f4},
+		{value: "k:bob", want: 0xa5b91747ebae0bba},
+		{value: "coin", want: 0xc1f168760068bf9c},
+	}
+	for _, tt := range tests {
+		if got := hllHash(tt.value); got != tt.want {
+			t.Errorf("hllHash(%q) = %#016x, want %#016x", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHyperLogLogMarshalIsStable(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		data, err := newHyperLogLog().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte{hllVersion, hllPrecision, hllEncodeSparse, 0x00, 0x00}; !bytes.Equal(data, want) {
+			t.Errorf("MarshalBinary() = %#v, want %#v", data, want)
+		}
+	})
+
+	t.Run("sparse", func(t *testing.T) {
+		sketch := newHyperLogLog()
+		sketch.Add("k:bob")
+		sketch.Add("k:alice")
+		sketch.Add("k:bob")
+		data, err := sketch.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Two registers, in index order: 0xa5b (k:bob) and 0xe03 (k:alice), both rank 1
+		want := []byte{hllVersion, hllPrecision, hllEncodeSparse, 0x00, 0x02, 0x0a, 0x5b, 0x01, 0x0e, 0x03, 0x01}
+		if !bytes.Equal(data, want) {
+			t.Errorf("MarshalBinary() = %#v, want %#v", data, want)
+		}
+	})
+
+	t.Run("dense", func(t *testing.T) {
+		sketch := newHyperLogLog()
+		for i := 0; i < 10000; i++ {
+			sketch.Add(fmt.Sprintf("k:%d", i))
+		}
+		data, err := sketch.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 3+1<<hllPrecision {
+			t.Fatalf("MarshalBinary() has %d bytes, want %d", len(data), 3+1<<hllPrecision)
+		}
+		if header := data[:3]; !bytes.Equal(header, []byte{hllVersion, hllPrecision, hllEncodeDense}) {
+			t.Errorf("MarshalBinary() header = %#v", header)
+		}
+		sum := sha256.Sum256(data)
+		if got, want := hex.EncodeToString(sum[:]), "5be0402d8a8b4fdf96f947d907c1ecb2bdbd350ee9521bc0d66d4fe6cbae839d"; got != want {
+			t.Errorf("MarshalBinary() sha256 = %s, want %s", got, want)
+		}
+	})
+}
+
+func TestHyperLogLogRoundTrip(t *testing.T) {
+	// The encoding switches to dense at a third of the registers
+	sparseLimit := (1<<hllPrecision - 1) / 3
+	tests := []struct {
+		name     string
+		values   int
+		encoding byte
+	}{
+		{name: "empty", values: 0, encoding: hllEncodeSparse},
+		{name: "one value", values: 1, encoding: hllEncodeSparse},
+		{name: "sparse", values: 500, encoding: hllEncodeSparse},
+		{name: "dense", values: 100000, encoding: hllEncodeDense},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sketch := newHyperLogLog()
+			for i := 0; i < tt.values; i++ {
+				sketch.Add(fmt.Sprintf("k:%d", i))
+			}
+			data, err := sketch.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[2] != tt.encoding {
+				t.Errorf("encoding = %d, want %d", data[2], tt.encoding)
+			}
+
+			decoded := &hyperLogLog{}
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary() error = %v", err)
+			}
+			if !reflect.DeepEqual(decoded, sketch) {
+				t.Errorf("UnmarshalBinary() registers differ from the sketch marshaled")
+			}
+			again, err := decoded.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Errorf("MarshalBinary() after a round trip differs")
+			}
+		})
+	}
+
+	t.Run("encoding boundary", func(t *testing.T) {
+		for _, nonZero := range []int{sparseLimit, sparseLimit + 1} {
+			sketch := newHyperLogLog()
+			for i := 0; i < nonZero; i++ {
+				sketch.registers[i] = uint8(i%50 + 1)
+			}
+			data, err := sketch.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := byte(hllEncodeSparse)
+			if nonZero*3 >= len(sketch.registers) {
+				want = hllEncodeDense
+			}
+			if data[2] != want {
+				t.Errorf("%d registers set: encoding = %d, want %d", nonZero, data[2], want)
+			}
+			decoded := &hyperLogLog{}
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, sketch) {
+				t.Errorf("%d registers set: round trip differs", nonZero)
+			}
+		}
+	})
+}
+
+func TestHyperLogLogUnmarshalErrors(t *testing.T) {
+	dense := append([]byte{hllVersion, hllPrecision, hllEncodeDense}, make([]byte, 1<<hllPrecision)...)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "empty", data: nil, wantErr: "sketch too short: 0 bytes"},
+		{name: "unknown version", data: []byte{2, hllPrecision, hllEncodeSparse, 0, 0}, wantErr: "unsupported sketch version 2"},
+		{name: "precision too small", data: []byte{hllVersion, 3, hllEncodeSparse, 0, 0}, wantErr: "invalid sketch precision 3"},
+		{name: "precision too large", data: []byte{hllVersion, 17, hllEncodeSparse, 0, 0}, wantErr: "invalid sketch precision 17"},
+		{name: "unknown encoding", data: []byte{hllVersion, hllPrecision, 2}, wantErr: "unknown sketch encoding 2"},
+		{name: "dense cut short", data: dense[:len(dense)-1], wantErr: "dense sketch has 4098 bytes, expected 4099"},
+		{name: "dense with trailing bytes", data: append(dense[:len(dense):len(dense)], 0), wantErr: "dense sketch has 4100 bytes, expected 4099"},
+		{name: "sparse without count", data: []byte{hllVersion, hllPrecision, hllEncodeSparse, 0}, wantErr: "sparse sketch too short: 4 bytes"},
+		{name: "sparse cut short", data: []byte{hllVersion, hllPrecision, hllEncodeSparse, 0, 2, 0x0a, 0x5b, 1}, wantErr: "sparse sketch has 8 bytes, expected 11"},
+		{name: "sparse register out of range", data: []byte{hllVersion, hllPrecision, hllEncodeSparse, 0, 1, 0x10, 0x00, 1}, wantErr: "sparse sketch register 4096 out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sketch := newHyperLogLog()
+			err := sketch.UnmarshalBinary(tt.data)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("UnmarshalBinary() error = %v, want %s", err, tt.wantErr)
+			}
+			// A failed decode leaves the sketch as it was
+			if !reflect.DeepEqual(sketch, newHyperLogLog()) {
+				t.Errorf("UnmarshalBinary() changed the sketch on error")
+			}
+		})
+	}
+}
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{10, 1000, 10000, 200000} {
+		sketch := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			sketch.Add(fmt.Sprintf("k:%d", i))
+		}
+		// Three standard errors, which a correct sketch stays within almost always
+		if got := sketch.Estimate(); math.Abs(got-float64(n)) > 3*hllStandardError()*float64(n)+1 {
+			t.Errorf("Estimate() of %d values = %.0f, outside 3 standard errors", n, got)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	all, first, second := newHyperLogLog(), newHyperLogLog(), newHyperLogLog()
+	for i := 0; i < 30000; i++ {
+		value := fmt.Sprintf("k:%d", i)
+		all.Add(value)
+		// The halves overlap on a third of the values
+		if i < 20000 {
+			first.Add(value)
+		}
+		if i >= 10000 {
+			second.Add(value)
+		}
+	}
+
+	// Merging a decoded sketch, as the incremental mode does
+	data, err := second.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &hyperLogLog{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Merge(decoded); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if !reflect.DeepEqual(first, all) {
+		t.Errorf("Merge() of the halves differs from the sketch of all values")
+	}
+
+	other := &hyperLogLog{precision: 10, registers: make([]uint8, 1<<10)}
+	if err := all.Merge(other); err == nil || err.Error() != "cannot merge sketches of precision 12 and 10" {
+		t.Errorf("Merge() of precision 10 error = %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"log"
+	"sync"
+)
+
+// Only one migrator process at a time may run a given writing command. It holds a
+// session-level advisory lock keyed on the command on a dedicated connection, so
+// the lock goes away with the process however it ends. Who holds it and since
+// when is told by the run's heartbeat row in MigratorRuns. A second process
+// finding the lock taken exits with that row in its message, unless -force makes
+// it run anyway, without the lock.
+
+// instanceLockKey is the advisory lock key of a command, shared by all migrator
+// processes
+const instanceLockKey = `hashtext('go-backfill migrator command ' || $1)`
+
+type instanceLock struct {
+	db     *sql.DB
+	conn   *sql.Conn
+	closed sync.Once
+}
+
+// lockCommandInstance takes the instance lock of a writing command. It fails
+// when another process holds it, unless -force is set.
+func lockCommandInstance(name string) (*instanceLock, error) {
+	if !commandWrites(name) {
+		return nil, nil
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open instance lock connection: %w", err)
+	}
+
+	var acquired bool
+	err = conn.QueryRowContext(context.Background(), fmt.Sprintf(`SELECT pg_try_advisory_lock(%s)`, instanceLockKey), name).Scan(&acquired)
+	if err != nil {
+		conn.Close()
+		db.Close()
+		return nil, fmt.Errorf("failed to take the instance lock of %s: %w", name, err)
+	}
+
+	if !acquired {
+		holder := describeInstance(db, name)
+		conn.Close()
+		db.Close()
+		if !*forceRun {
+			return nil, fmt.Errorf("refusing to run %s: another migrator instance is running it (%s); pass -force to run anyway", name, holder)
+		}
+		log.Printf("Warning: another migrator instance is running %s (%s); running anyway because of -force", name, holder)
+		return nil, nil
+	}
+
+	return &instanceLock{db: db, conn: conn}, nil
+}
+
+// describeInstance tells who holds the instance lock of a command, from the
+// heartbeat of its latest run still running.
+func describeInstance(db *sql.DB, name string) string {
+	runs, err := loadRunningRuns(db, `command = $1`, name)
+	if err != nil || len(runs) == 0 {
+		return "no heartbeat recorded"
+	}
+	return runs[len(runs)-1].String()
+}
+
+// Close releases the lock by ending the session. Only the first call does
+// anything.
+func (l *instanceLock) Close() {
+	l.closed.Do(func() {
+		l.conn.Close()
+		l.db.Close()
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"go-backfill/config"
+	"go-backfill/safejson"
+)
+
+// jsonLimits are the safejson limits configured through JSON_MAX_DEPTH,
+// JSON_MAX_STRING_LENGTH and JSON_MAX_BYTES.
+func jsonLimits() safejson.Limits {
+	env := config.GetConfig()
+	return safejson.Limits{
+		MaxDepth:        env.JsonMaxDepth,
+		MaxStringLength: env.JsonMaxStringLength,
+		MaxBytes:        env.JsonMaxBytes,
+	}
+}
+
+// jsonLimitBreached returns the name of the limit err reports, if it is a
+// safejson.LimitError.
+func jsonLimitBreached(err error) (string, bool) {
+	var limitErr *safejson.LimitError
+	if errors.As(err, &limitErr) {
+		return limitErr.Limit, true
+	}
+	return "", false
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Commands writing derived tables stamp every row they write with their run id in
+// a "lastRunId" column; their runs are recorded in MigratorRuns with the build
+// version, like those of every writing command. Each such command declares in its
+// registration in commands.go which derived tables it writes and which tables it
+// reads, so the lineage command can walk from a row back through the runs that
+// produced it and, for every derived input, the latest run of its producer that
+// finished before it started, down to the tables the indexer fills itself.
+
+type lineageDeclaration struct {
+	Outputs []string
+	Inputs  []string
+}
+
+// commandLineage holds the lineage declarations of the registered commands, by
+// command name.
+var commandLineage = map[string]lineageDeclaration{}
+
+func init() {
+	for _, cmd := range commands {
+		if cmd.Lineage != nil {
+			commandLineage[cmd.Name] = *cmd.Lineage
+		}
+	}
+}
+
+// tableProducer returns the command whose declared outputs include table.
+func tableProducer(table string) (string, bool) {
+	for name, declaration := range commandLineage {
+		for _, output := range declaration.Outputs {
+			if output == table {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// buildVersion is the VCS revision the migrator was built from, or its module
+// version when that isn't stamped.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+}
+
+func createMigratorRunsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "MigratorRuns" (
+			"runId" TEXT PRIMARY KEY,
+			command TEXT NOT NULL,
+			version TEXT NOT NULL,
+			"startedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			"finishedAt" TIMESTAMP WITH TIME ZONE
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create MigratorRuns table: %w", err)
+	}
+
+	// Tables created before runs had heartbeats get their columns
+	_, err = db.Exec(`
+		ALTER TABLE "MigratorRuns"
+		ADD COLUMN IF NOT EXISTS host TEXT,
+		ADD COLUMN IF NOT EXISTS pid INTEGER,
+		ADD COLUMN IF NOT EXISTS "heartbeatAt" TIMESTAMP WITH TIME ZONE,
+		ADD COLUMN IF NOT EXISTS "lastProcessedId" BIGINT,
+		ADD COLUMN IF NOT EXISTS state TEXT
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to add the heartbeat columns to MigratorRuns: %w", err)
+	}
+
+	// Heartbeats used to go to a MigratorInstances table of their own
+	if _, err := db.Exec(`DROP TABLE IF EXISTS "MigratorInstances"`); err != nil {
+		return fmt.Errorf("failed to drop the MigratorInstances table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS migratorruns_command_idx ON "MigratorRuns" (command, "finishedAt")`)
+	if err != nil {
+		return fmt.Errorf("failed to create MigratorRuns command index: %w", err)
+	}
+	return nil
+}
+
+// addLineageColumn adds the "lastRunId" column to a derived table.
+func addLineageColumn(db *sql.DB, table string) error {
+	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS "lastRunId" TEXT`, table))
+	if err != nil {
+		return fmt.Errorf("failed to add lastRunId column to %s: %w", table, err)
+	}
+	return nil
+}
+
+type lineageRun struct {
+	RunId      string     `json:"runId"`
+	Command    string     `json:"command"`
+	Version    string     `json:"version"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+// lineageNode is one step of a production chain: a table and the run that
+// produced it, with the inputs of that run. Run is nil for tables the indexer
+// fills and for derived tables whose producer hadn't run yet.
+type lineageNode struct {
+	Table  string         `json:"table"`
+	Run    *lineageRun    `json:"run"`
+	Inputs []*lineageNode `json:"inputs,omitempty"`
+}
+
+// rowLineage returns the production chain of a row of a derived table.
+func rowLineage(db *sql.DB, table string, id int64) (*lineageNode, error) {
+	if _, ok := tableProducer(table); !ok {
+		return nil, &errs.ValidationError{Field: "-lineage-table", Reason: fmt.Sprintf("%s is not a derived table, derived tables: %s", table, strings.Join(derivedTables(), ", "))}
+	}
+	idType, err := columnType(db, table, "id")
+	if err != nil {
+		return nil, err
+	}
+	if idType == "" {
+		return nil, &errs.ValidationError{Field: "-lineage-table", Reason: fmt.Sprintf(`%s has no id column; look up the "lastRunId" of the row and pass it as -lineage-run`, table)}
+	}
+
+	var rowRunId sql.NullString
+	err = db.QueryRow(fmt.Sprintf(`SELECT "lastRunId" FROM "%s" WHERE id = $1`, table), id).Scan(&rowRunId)
+	if err == sql.ErrNoRows {
+		return nil, &errs.ValidationError{Field: "-lineage-id", Reason: fmt.Sprintf("%s has no row %d", table, id)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lastRunId of %s row %d: %w", table, id, err)
+	}
+	if !rowRunId.Valid {
+		return &lineageNode{Table: table}, nil
+	}
+	return runLineage(db, table, rowRunId.String)
+}
+
+// runLineage returns the production chain of what run wrote into table.
+func runLineage(db *sql.DB, table, runIdToWalk string) (*lineageNode, error) {
+	run, err := loadLineageRun(db, `WHERE "runId" = $1`, runIdToWalk)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, &errs.ValidationError{Field: "-lineage-run", Reason: fmt.Sprintf("run %s is not recorded in MigratorRuns", runIdToWalk)}
+	}
+	if table == "" {
+		table = strings.Join(commandLineage[run.Command].Outputs, ", ")
+	}
+	return walkLineage(db, table, run, map[string]bool{})
+}
+
+func walkLineage(db *sql.DB, table string, run *lineageRun, visited map[string]bool) (*lineageNode, error) {
+	node := &lineageNode{Table: table, Run: run}
+	if visited[run.RunId] {
+		return node, nil
+	}
+	visited[run.RunId] = true
+
+	for _, input := range commandLineage[run.Command].Inputs {
+		producer, derived := tableProducer(input)
+		if !derived {
+			node.Inputs = append(node.Inputs, &lineageNode{Table: input})
+			continue
+		}
+
+		inputRun, err := loadLineageRun(db, `WHERE command = $1 AND "finishedAt" <= $2 ORDER BY "finishedAt" DESC LIMIT 1`, producer, run.StartedAt)
+		if err != nil {
+			return nil, err
+		}
+		if inputRun == nil {
+			node.Inputs = append(node.Inputs, &lineageNode{Table: input})
+			continue
+		}
+		inputNode, err := walkLineage(db, input, inputRun, visited)
+		if err != nil {
+			return nil, err
+		}
+		node.Inputs = append(node.Inputs, inputNode)
+	}
+	return node, nil
+}
+
+// loadLineageRun returns the MigratorRuns row matching where, nil when there is
+// none.
+func loadLineageRun(db *sql.DB, where string, args ...interface{}) (*lineageRun, error) {
+	if exists, err := tableExists(db, "MigratorRuns"); err != nil || !exists {
+		return nil, err
+	}
+
+	var (
+		run        lineageRun
+		finishedAt sql.NullTime
+	)
+	err := db.QueryRow(`SELECT "runId", command, version, "startedAt", "finishedAt" FROM "MigratorRuns" `+where, args...).
+		Scan(&run.RunId, &run.Command, &run.Version, &run.StartedAt, &finishedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrator run: %w", err)
+	}
+	if finishedAt.Valid {
+		run.FinishedAt = &finishedAt.Time
+	}
+	return &run, nil
+}
+
+func derivedTables() []string {
+	var tables []string
+	for _, declaration := range commandLineage {
+		tables = append(tables, declaration.Outputs...)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func logLineage(node *lineageNode, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch {
+	case node.Run == nil && depth == 0:
+		log.Printf("%s%s: written before lineage was recorded", indent, node.Table)
+	case node.Run == nil:
+		if _, derived := tableProducer(node.Table); derived {
+			log.Printf("%s%s: no completed run of its producer before this one", indent, node.Table)
+		} else {
+			log.Printf("%s%s: indexed by the backfill", indent, node.Table)
+		}
+	default:
+		finished := "unfinished"
+		if node.Run.FinishedAt != nil {
+			finished = "finished " + node.Run.FinishedAt.Format(time.RFC3339)
+		}
+		log.Printf("%s%s: run %s of %s (version %s), started %s, %s", indent, node.Table, node.Run.RunId,
+			node.Run.Command, node.Run.Version, node.Run.StartedAt.Format(time.RFC3339), finished)
+	}
+	for _, input := range node.Inputs {
+		logLineage(input, depth+1)
+	}
+}
+
+func printLineage() error {
+	if *lineageRunId == "" && (*lineageTable == "" || *lineageRowId <= 0) {
+		return &errs.ValidationError{Field: "-lineage-table", Reason: "pass -lineage-table and -lineage-id, or -lineage-run"}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	var node *lineageNode
+	if *lineageRunId != "" {
+		node, err = runLineage(db, *lineageTable, *lineageRunId)
+	} else {
+		node, err = rowLineage(db, *lineageTable, *lineageRowId)
+	}
+	if err != nil {
+		return err
+	}
+
+	logLineage(node, 0)
+	return nil
+}
+
+func PrintLineage(ctx context.Context, cfg *config.Config) error {
+	return printLineage()
+}
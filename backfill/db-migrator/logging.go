@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logs are free-form text lines by default. With LOG_FORMAT=json every line is a
+// JSON record carrying the command, including those logged with the log package,
+// and the events below carry their values as fields: progress with the batch
+// range, rows updated, percentage and rate, failures with the batch range and the
+// PostgreSQL error code. The text form of an event is the same line as before. LOG_LEVEL
+// (debug, info, warn or error) filters the events; free-form lines count as info.
+
+var (
+	jsonLogs  bool
+	logLevel  = new(slog.LevelVar)
+	logRecord = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	// Text events are written here, so they still show when free-form lines are
+	// filtered out
+	textLog = log.Default()
+)
+
+func initLogging(cfg *config.Config) error {
+	if err := logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return &errs.ValidationError{Field: "LOG_LEVEL", Reason: fmt.Sprintf("%q is not one of debug, info, warn, error", cfg.LogLevel)}
+	}
+
+	switch strings.ToLower(cfg.LogFormat) {
+	case "text", "":
+		jsonLogs = false
+		if logLevel.Level() > slog.LevelInfo {
+			textLog = log.New(log.Writer(), log.Prefix(), log.Flags())
+			log.SetOutput(io.Discard)
+		}
+	case "json":
+		jsonLogs = true
+		logRecord = logRecord.With("command", *command)
+		// Route the log package through the JSON handler too
+		slog.SetDefault(logRecord)
+	default:
+		return &errs.ValidationError{Field: "LOG_FORMAT", Reason: fmt.Sprintf("%q is not one of json, text", cfg.LogFormat)}
+	}
+	return nil
+}
+
+// logEvent logs text at level, with attrs as fields in JSON.
+func logEvent(level slog.Level, text string, attrs ...any) {
+	if jsonLogs {
+		logRecord.Log(context.Background(), level, text, attrs...)
+		return
+	}
+	if logLevel.Level() <= level {
+		textLog.Print(text)
+	}
+}
+
+// logProgress logs a progress line of a batch command.
+func logProgress(text string, batchStart, batchEnd int, rowsUpdated int64, percent, rowsPerSec float64) {
+	logEvent(slog.LevelInfo, text,
+		"batch_start", batchStart,
+		"batch_end", batchEnd,
+		"rows_updated", rowsUpdated,
+		"percent_complete", percent,
+		"rows_per_sec", rowsPerSec,
+	)
+	notifyBatchProgress(batchStart, batchEnd, percent)
+}
+
+// perSecond is the rate of n since start.
+func perSecond(n int64, start time.Time) float64 {
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / elapsed
+}
+
+// batchError is the failure of the batch [start, end].
+type batchError struct {
+	start, end int
+	err        error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("failed to process batch %d-%d: %v", e.start, e.end, e.err)
+}
+
+func (e *batchError) Unwrap() error { return e.err }
+
+// errorAttrs are the fields of err: the batch range and the PostgreSQL error code
+// when it has them.
+func errorAttrs(err error) []any {
+	var attrs []any
+	var batchErr *batchError
+	if errors.As(err, &batchErr) {
+		attrs = append(attrs, "batch_start", batchErr.start, "batch_end", batchErr.end)
+	}
+	if code := errs.SQLState(err); code != "" {
+		attrs = append(attrs, "pg_code", code)
+	}
+	return attrs
+}
@@ -1,38 +1,285 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"go-backfill/config"
-	"log"
+	"go-backfill/errs"
+	"os"
+	"strings"
+	"time"
 )
 
 var (
-	command = flag.String("command", "", "Migration command to run (code-to-text, creation-time, reconcile)")
-	envFile = flag.String("env", ".env", "Path to the .env file")
+	command               = flag.String("command", "", "Deprecated: migration command to run; pass it as the first argument instead")
+	envFile               = flag.String("env", ".env", "Path to the .env file")
+	strictEnv             = flag.Bool("strict-env", false, "Fail on duplicate keys in the .env file instead of warning")
+	resume                = flag.Bool("resume", false, "Continue below the last committed batch instead of starting over (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	codeBatch             = flag.Int("batch-size", codeBatchSize, "Rows per batch transaction (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	codeStart             = flag.Int("start-id", startTransactionIdForCode, "First TransactionDetails id to convert, hash, fill, verify or clean up (code-to-text, code-hash, gas-backfill, verify-code-to-text, cleanup-code)")
+	codeEnd               = flag.Int("end-id", 0, "Last TransactionDetails id to convert, hash, fill, verify or clean up, 0 for MAX(id) (code-to-text, code-hash, gas-backfill, verify-code-to-text, cleanup-code)")
+	codeWorkers           = flag.Int("workers", 1, "Batches processed concurrently, each on its own connection (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	verifyCodeMaxReported = flag.Int("verify-code-max-reported", 100, "Maximum number of mismatching ids listed individually (verify-code-to-text)")
+	maxRowsPerSec         = flag.Int("max-rows-per-sec", 0, "Cap on the rows updated per second across workers, 0 for none (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	sleepBetweenBatches   = flag.Duration("sleep-between-batches", 0, "Pause of every worker after each of its batches (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	pauseWindowFlag       = flag.String("pause-window", "", "Daily local-time window during which no batch is started, e.g. 09:00-18:00 (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	targetBatchMs         = flag.Int("target-batch-ms", 0, "Batch latency to size batches for, growing and shrinking them between -min-batch-size and -max-batch-size; 0 keeps -batch-size (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	minBatchSize          = flag.Int("min-batch-size", defaultMinBatchSize, "Smallest batch with -target-batch-ms (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	maxBatchSize          = flag.Int("max-batch-size", defaultMaxBatchSize, "Largest batch with -target-batch-ms (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	batchLockTimeout      = flag.String("batch-lock-timeout", "", "lock_timeout of every batch transaction, 0 for none; BATCH_LOCK_TIMEOUT or 5s when unset (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	batchStatementTimeout = flag.String("batch-statement-timeout", "", "statement_timeout of every batch transaction, 0 for none; BATCH_STATEMENT_TIMEOUT or 60s when unset (code-to-text, code-hash, gas-backfill, cleanup-code)")
+	backupFile            = flag.String("backup-file", "", "Append the id and code of every updated row to this gzip-compressed NDJSON file, e.g. backup.ndjson.gz (code-to-text)")
+	onInvalid             = flag.String("on-invalid", onInvalidAbort, "What to do with a code value that is neither a string nor {}: abort, skip or quarantine (code-to-text)")
+	batchAttempts         = flag.Int("batch-attempts", 5, "Attempts of a batch failing with a retryable database error before the run aborts (code-to-text, code-hash, gas-backfill, cleanup-code, creation-time)")
+	codeRepair            = flag.Bool("repair", false, "Also rewrite codetext values that don't match their code, instead of only filling missing ones (code-to-text)")
+	dryRun                = flag.Bool("dry-run", false, "Report what would change without modifying any rows (code-to-text, code-hash, gas-backfill, creation-time, reconcile, normalize-json, finalize-code-to-text)")
+	chains                = chainFilterFlag("chains", "Comma-separated chain ids of the network to restrict the rows to, all when empty (code-to-text, code-hash, gas-backfill, creation-time, reconcile)")
+
+	hashWith = flag.String("hash-with", codeHashClient, "Where to compute the sha256 of codetext: client, or pgcrypto for digest() in the database (code-hash)")
+
+	belowLiveWatermark = flag.Bool("below-live-watermark", false, "Cap the processing range at the current max id minus -live-margin to avoid rows the live indexer is writing")
+	liveMargin         = flag.Int("live-margin", 10000, "Safety margin of ids kept away from the live tip when -below-live-watermark is set")
+	allowTip           = flag.Bool("allow-tip", false, "Allow an explicit end id above the live watermark")
+	allowStandby       = flag.Bool("allow-standby", false, "Run a writing command even though the target database is a standby or read-only")
+
+	finalizeSkipDrop    = flag.Bool("skip-drop", false, "Keep the jsonb code column as code_jsonb instead of dropping it (finalize-code-to-text)")
+	finalizeViews       = flag.String("finalize-views", "", "Comma-separated views depending on the code column to recreate around the swap (finalize-code-to-text)")
+	finalizeLockTimeout = flag.String("finalize-lock-timeout", "5s", "Give up if the exclusive lock isn't granted within this time (finalize-code-to-text)")
+
+	rollbackBackup = flag.String("from-backup", "", "Restore code from this -backup-file of code-to-text (rollback-code-to-text)")
+	rollbackClear  = flag.Bool("clear-codetext", false, "Set codetext back to NULL (rollback-code-to-text)")
+	rollbackYes    = flag.Bool("yes", false, "Confirm the rollback or the cleanup (rollback-code-to-text, cleanup-code)")
+
+	cleanupVacuum = flag.Bool("vacuum", false, "Run VACUUM (ANALYZE) on TransactionDetails once done, as its owner or a superuser (cleanup-code)")
+
+	memoFunctions = flag.String("memo-functions", "", "Comma-separated additional function names to extract memos from (backfill-memos)")
+	memoMaxLength = flag.Int("memo-max-length", 256, "Memos longer than this many bytes are skipped (backfill-memos)")
+
+	rotationEvents = flag.String("rotation-events", "", "Comma-separated additional qualified event names signalling a guard change (backfill-rotations)")
+
+	auditMode        = flag.Bool("audit", false, "Record before/after row hashes of every modified row in the AuditTrail table (code-to-text, creation-time)")
+	auditRun         = flag.String("audit-run", "", "Only verify rows audited by this run id (audit-verify)")
+	auditMaxReported = flag.Int("audit-max-reported", 100, "Maximum number of changed rows listed individually (audit-verify)")
+
+	jsonColumns = flag.String("json-columns", "Events.params", "Comma-separated Table.column jsonb columns to canonicalize (normalize-json)")
+	jsonVerify  = flag.Bool("json-verify", false, "Only check that canonical forms parse back equal to the stored values (normalize-json)")
+
+	benchCommand           = flag.String("bench-command", "code-to-text", "Command to benchmark (bench)")
+	benchStartId           = flag.Int("bench-start-id", 1, "First id of the benchmarked range (bench)")
+	benchEndId             = flag.Int("bench-end-id", 0, "Last id of the benchmarked range (bench)")
+	benchBatchSizes        = flag.String("bench-batch-sizes", "500,1000,5000", "Comma-separated batch sizes to benchmark (bench)")
+	benchWorkers           = flag.String("bench-workers", "1,2,4", "Comma-separated worker counts to benchmark (bench)")
+	benchOutput            = flag.String("bench-output", "", "Write the benchmark results as JSON to this file (bench)")
+	benchConfirmDisposable = flag.String("i-confirm-disposable", "", "Name of the target database, confirming it is a disposable copy (bench)")
+
+	activeFull       = flag.Bool("active-full", false, "Drop the stored sketches and rebuild them from the first transaction (build-active-addresses)")
+	activeVerifyDays = flag.Int("active-verify-days", 0, "Compare this many randomly sampled day sketches with exact counts instead of building (build-active-addresses)")
+	activeRollup     = flag.String("active-rollup", "", "Print estimates merged per day, week or month instead of building (build-active-addresses)")
+
+	requestKeysOutput      = flag.String("requestkeys-output", "", "Write the request key report as JSON to this file (verify-requestkeys)")
+	requestKeysSamples     = flag.Int("requestkeys-samples", 5, "Transaction ids and keys kept per finding for drill-down (verify-requestkeys)")
+	requestKeysMaxReported = flag.Int("requestkeys-max-reported", 100, "Maximum number of mismatching request keys listed individually (verify-requestkeys)")
+
+	driftWindowHeights = flag.Int("drift-window-heights", 10000, "Heights per sampling window (detect-event-schema-drift)")
+	driftSamples       = flag.Int("drift-samples", 20, "Events sampled per event name and window (detect-event-schema-drift)")
+
+	braidingStartHeight = flag.Int("braiding-start-height", 0, "First block height to check (verify-braiding)")
+	braidingEndHeight   = flag.Int("braiding-end-height", -1, "Last block height to check, -1 for the live watermark (verify-braiding)")
+	braidingSample      = flag.Float64("braiding-sample", 1, "Fraction of blocks to check, sampled by block id (verify-braiding)")
+	braidingMaxReported = flag.Int("braiding-max-reported", 100, "Maximum number of findings logged individually (verify-braiding)")
+
+	pendingOutput        = flag.String("pending-output", "", "File to export pending cross-chain transfers to, .csv or .json (export-pending-crosschain)")
+	pendingChains        = flag.String("pending-chains", "", "Comma-separated source chains to export, all when empty (export-pending-crosschain)")
+	pendingMinAge        = flag.Duration("min-age", time.Hour, "Only export transfers started at least this long ago (export-pending-crosschain)")
+	pendingFinalityDepth = flag.Int("pending-finality-depth", 10, "Blocks the target chain must be indexed past the start height (export-pending-crosschain)")
+
+	reconcileFromHeight = flag.Int("from-height", 0, "First block height to scan (reconcile, gas-backfill)")
+	reconcileToHeight   = flag.Int("to-height", -1, "Last block height to scan, -1 for no bound (reconcile, gas-backfill)")
+	reconcileFromDate   = flag.String("from-date", "", "First UTC day, YYYY-MM-DD, of the blocks to scan, instead of -from-height (reconcile, gas-backfill)")
+	reconcileToDate     = flag.String("to-date", "", "Last UTC day, YYYY-MM-DD, of the blocks to scan, instead of -to-height (reconcile, gas-backfill)")
+	reconcileNodeURL    = flag.String("node-url", "", "Chainweb node to fetch the payloads of the scanned blocks from, e.g. https://api.chainweb.com: reconcile compares their events with Events and inserts the reconcile events missing; gas-backfill reads the gas of their transactions (reconcile, gas-backfill)")
+	reconcileReportOnly = flag.Bool("report-only", false, "With -node-url, print the differences with the node without inserting anything (reconcile)")
+	reconcileNodeJobs   = flag.Int("node-concurrency", 4, "Node requests in flight at once with -node-url (reconcile, gas-backfill)")
+
+	verifyCreationMaxReported = flag.Int("verify-creation-max-reported", 100, "Maximum number of offending rows listed individually (verify-creation-time)")
+
+	reindexTableName = flag.String("reindex-table", "", "Table whose indexes to rebuild (reindex)")
+
+	statusJson             = flag.Bool("json", false, "Print the report as JSON (status, verify-creation-time, code-to-text -count-only)")
+	statusExitIfIncomplete = flag.Bool("exit-nonzero-if-incomplete", false, "Fail when any migration has rows left, for deployment gates (status)")
+	statusSample           = flag.Int("sample", 0, "Estimate the counts from this many ids spread across each table instead of counting every row, 0 for exact counts (status)")
+
+	snapshotSample      = flag.Int("snapshot-sample", 0, "Plan the run: write this many random rows of every table the command changes to -snapshot-file and exit")
+	snapshotFilePath    = flag.String("snapshot-file", "", "Snapshot written by -snapshot-sample, checked before the real run and compared by snapshot-diff")
+	snapshotMaxReported = flag.Int("snapshot-max-reported", 100, "Maximum number of changed rows listed individually (snapshot-diff)")
+
+	timelineAccount = flag.String("account", "", "Only rebuild the timeline of this account (build-account-timeline)")
+
+	lineageTable = flag.String("lineage-table", "", "Derived table of the row to trace (lineage)")
+	lineageRowId = flag.Int64("lineage-id", 0, "Id of the row to trace (lineage)")
+	lineageRunId = flag.String("lineage-run", "", "Trace what this run wrote instead of a row (lineage)")
+
+	txOrderFromNode    = flag.Bool("from-node", false, "Fetch the transaction order of blocks whose rows don't match their payload from the node (build-tx-order)")
+	txOrderMaxReported = flag.Int("tx-order-max-reported", 100, "Maximum number of findings logged individually (build-tx-order)")
+
+	baselineMaxAge = flag.Duration("baseline-max-age", 30*24*time.Hour, "Ignore throughput baselines older than this for ETAs and bench estimates")
+
+	forceRun = flag.Bool("force", false, "Run even though another migrator instance is running the same command, or an earlier run of it went stale; cleanup-code also runs without a clean verify-code-to-text")
+
+	staleAfter = flag.Duration("stale-after", 5*time.Minute, "A run recorded as running whose last heartbeat is older than this is reported as possibly dead by status, and needs -force to be run over")
+
+	noBannerConfirm = flag.Bool("no-banner-confirm", false, "Don't ask for confirmation of destructive runs against production-looking hosts, for automation")
+
+	metricsAddr = flag.String("metrics-addr", "", "Serve Prometheus metrics of the run on /metrics at this address while the command runs (e.g. :9091)")
+
+	codeRoundTripSample = flag.Int("verify-round-trip", 0, "Check, before committing each batch, that the codetext of this many random rows turns back into their code with to_jsonb; 0 disables (code-to-text)")
+
+	codeCountOnly    = flag.Bool("count-only", false, "Only report the rows left to convert, their id bounds and an estimated duration, without writing (code-to-text)")
+	assumeRowsPerSec = flag.Int("assume-rows-per-sec", 0, "Throughput the -count-only estimate assumes; 0 uses the throughput baseline, else a sample (code-to-text)")
+	countSample      = flag.Duration("count-sample", 30*time.Second, "How long -count-only samples the conversion of real batches without a baseline; 0 disables (code-to-text)")
+
+	notifyEveryPercent = flag.Float64("notify-every-percent", 0, "Also notify NOTIFY_WEBHOOK_URL whenever the progress crosses another multiple of this percentage; 0 disables")
+
+	printConfig = flag.Bool("print-config", false, "Print the effective configuration, secrets redacted, and exit without running the command")
+
+	reportFile = flag.String("report-file", "", "Write the JSON report of the run to this file; migrator-report-<command>-<timestamp>.json when empty")
+
+	statusAddr = flag.String("status-addr", "", "Serve read-only migrator status as JSON on this address while the command runs (e.g. :9092)")
 )
 
-func initEnv() {
-	config.InitEnv(*envFile)
+// initEnv reads the configuration, failing with a ValidationError on a missing
+// or invalid setting or an unreadable env file.
+func initEnv() error {
+	load := config.InitEnv
+	if *strictEnv {
+		load = config.InitEnvStrict
+	}
+	err := load(*envFile)
+	var invalid *config.InvalidConfigError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &invalid):
+		return &errs.ValidationError{Field: "configuration", Reason: strings.Join(invalid.Problems, "; ")}
+	default:
+		return &errs.ValidationError{Field: "-env", Reason: err.Error()}
+	}
+}
+
+// printEffectiveConfig writes the configuration read from the env file and the
+// environment to stdout as JSON, with the password and tokens redacted.
+func printEffectiveConfig(env *config.Config) error {
+	data, err := json.MarshalIndent(env.Redacted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	fmt.Fprintln(os.Stdout, string(data))
+	return nil
 }
 
 func main() {
-	flag.Parse()
+	cmd := parseCommand(os.Args[1:])
 
-	if *command == "" {
-		log.Fatalf("Please specify a command to run. Available commands: code-to-text, creation-time, reconcile")
+	if *auditMode && *command != "code-to-text" && *command != "creation-time" {
+		fatal(&errs.ValidationError{Field: "-audit", Reason: "only supported by the code-to-text and creation-time commands"})
 	}
 
+	if *printConfig {
+		if err := initEnv(); err != nil {
+			fatal(err)
+		}
+		if err := printEffectiveConfig(config.GetConfig()); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	// Also written by fatal, on a failed or interrupted run
+	startRunReport()
+	defer finishRunReport(nil)
+
 	// Initialize environment first
-	initEnv()
-
-	switch *command {
-	case "code-to-text":
-		CodeToText()
-	case "creation-time":
-		DuplicateCreationTimes()
-	case "reconcile":
-		InsertReconcileEvents()
-	default:
-		log.Fatalf("Unknown command: %s", *command)
+	if err := initEnv(); err != nil {
+		fatal(err)
+	}
+	if err := initLogging(config.GetConfig()); err != nil {
+		fatal(err)
+	}
+	if err := chains.validate(config.GetConfig().NetworkInfo); err != nil {
+		fatal(err)
+	}
+	if err := startNotifier(config.GetConfig()); err != nil {
+		fatal(err)
+	}
+
+	if *snapshotSample > 0 {
+		if err := captureSnapshot(*command); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if err := guardAgainstStandby(*command); err != nil {
+		fatal(err)
+	}
+
+	if err := printBanner(*command); err != nil {
+		fatal(err)
+	}
+
+	instance, err := lockCommandInstance(*command)
+	if err != nil {
+		fatal(err)
+	}
+	if instance != nil {
+		// Also on a failed or interrupted run
+		onExit(instance.Close)
+		defer instance.Close()
+	}
+
+	locks, err := lockCommandTables(*command)
+	if err != nil {
+		fatal(err)
+	}
+	if locks != nil {
+		defer locks.Close()
+	}
+
+	if *snapshotFilePath != "" && *command != "snapshot-diff" {
+		if err := verifySnapshotPlan(*command); err != nil {
+			fatal(err)
+		}
+	}
+
+	if err := startRun(*command); err != nil {
+		fatal(err)
 	}
+
+	watchSignals(*command)
+
+	if *statusAddr != "" && *command != "serve-status" {
+		server, err := startStatusServer(*statusAddr)
+		if err != nil {
+			fatal(err)
+		}
+		defer server.Shutdown()
+	}
+
+	if *metricsAddr != "" {
+		server, err := startMetricsServer(*metricsAddr, *command)
+		if err != nil {
+			fatal(err)
+		}
+		defer server.Shutdown()
+	}
+
+	notifyStart()
+
+	if err := cmd.Run(shutdownCtx, config.GetConfig()); err != nil {
+		fatal(err)
+	}
+
+	finishRun(nil)
 }
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"go-backfill/safejson"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	memoBatchSize     = 1000
+	memosWatermarkKey = "backfill-memos"
+)
+
+// This script extracts the memo argument of transfer-with-memo style calls from the
+// transaction code into the Memos table, so deposit identifiers used by exchanges
+// become searchable. The memo is assumed to be the last argument of the call and
+// may be either a string literal or a (read-msg "key") / (read-string "key")
+// reference into the transaction env data.
+
+type memoCandidate struct {
+	DetailsId     int
+	TransactionId int
+	Code          string
+	Data          []byte
+}
+
+type extractedMemo struct {
+	TransactionId int
+	CallIndex     int
+	Function      string
+	Memo          string
+	Source        string
+	FromAcct      string
+	ToAcct        string
+}
+
+type memoTransfer struct {
+	Id       int
+	FromAcct string
+	ToAcct   string
+}
+
+func backfillMemos() error {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createMemosTables(db); err != nil {
+		return err
+	}
+
+	codeExpr, err := codeTextExpression(db)
+	if err != nil {
+		return err
+	}
+
+	functions := memoFunctionNames()
+	log.Printf("Extracting memos from calls to: %s", strings.Join(functions, ", "))
+
+	// Continue from where the previous run stopped
+	lastId, err := readWatermark(db, memosWatermarkKey)
+	if err != nil {
+		return err
+	}
+
+	var maxDetailsId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "TransactionDetails"`).Scan(&maxDetailsId); err != nil {
+		return fmt.Errorf("failed to get max transaction details ID: %w", err)
+	}
+
+	maxDetailsId, err = capToLiveWatermark(db, "TransactionDetails", maxDetailsId, false)
+	if err != nil {
+		return err
+	}
+
+	if maxDetailsId <= lastId {
+		logNothingToDo("TransactionDetails", lastId+1, maxDetailsId)
+		log.Printf("Memos are up to date (watermark at id %d)", lastId)
+		log.Println("Completed processing. Total memos stored: 0 (100.0%)")
+		return nil
+	}
+
+	skipped := make(skipCounts)
+	totalMemos := 0
+	totalIds := maxDetailsId - lastId
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to extract memos from transaction details ID %d to %d", lastId+1, maxDetailsId)
+
+	for currentId := lastId + 1; currentId <= maxDetailsId; currentId += memoBatchSize {
+		batchEnd := currentId + memoBatchSize - 1
+		if batchEnd > maxDetailsId {
+			batchEnd = maxDetailsId
+		}
+
+		inserted, err := processMemosBatch(db, codeExpr, functions, currentId, batchEnd, skipped)
+		if err != nil {
+			return fmt.Errorf("failed to process batch %d-%d: %w", currentId, batchEnd, err)
+		}
+		totalMemos += inserted
+
+		progressPercent := percentOf(batchEnd-lastId, totalIds)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, memos stored: %d", progressPercent, totalMemos)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total memos stored: %d (100.0%%)", totalMemos)
+	logSkipSummary("memo calls", skipped)
+	return nil
+}
+
+func createMemosTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "Memos" (
+			id SERIAL PRIMARY KEY,
+			"transactionId" INTEGER NOT NULL,
+			"transferId" INTEGER,
+			"callIndex" INTEGER NOT NULL,
+			function TEXT NOT NULL,
+			memo TEXT NOT NULL,
+			source TEXT NOT NULL,
+			"createdAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE ("transactionId", "callIndex")
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create Memos table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS memos_memo_idx ON "Memos" (memo)`)
+	if err != nil {
+		return fmt.Errorf("failed to create Memos memo index: %w", err)
+	}
+
+	if err := addLineageColumn(db, "Memos"); err != nil {
+		return err
+	}
+	return createWatermarksTable(db)
+}
+
+func memoFunctionNames() []string {
+	functions := []string{"transfer-with-memo"}
+	for _, name := range strings.Split(*memoFunctions, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && name != "transfer-with-memo" {
+			functions = append(functions, name)
+		}
+	}
+	return functions
+}
+
+func processMemosBatch(db *sql.DB, codeExpr string, functions []string, startId, endId int, skipped skipCounts) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	patterns := make([]string, len(functions))
+	for i, name := range functions {
+		patterns[i] = "%" + name + "%"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT td.id, td."transactionId", %s, td.data
+		FROM "TransactionDetails" td
+		WHERE td.id >= $1 AND td.id <= $2
+		AND td."transactionId" IS NOT NULL
+		AND %s LIKE ANY($3)
+		ORDER BY td.id
+	`, codeExpr, codeExpr)
+
+	rows, err := tx.Query(query, startId, endId, pq.Array(patterns))
+	if err != nil {
+		return 0, fmt.Errorf("failed to query candidate transactions: %w", err)
+	}
+
+	var candidates []memoCandidate
+	for rows.Next() {
+		var candidate memoCandidate
+		if err := rows.Scan(&candidate.DetailsId, &candidate.TransactionId, &candidate.Code, &candidate.Data); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan candidate: %w", err)
+		}
+		candidates = append(candidates, candidate)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("error iterating candidates: %w", err)
+	}
+	rows.Close()
+
+	var memos []extractedMemo
+	for _, candidate := range candidates {
+		memos = append(memos, extractMemos(candidate, functions, skipped)...)
+	}
+
+	transfers, err := fetchMemoTransfers(tx, memos)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO "Memos" ("transactionId", "transferId", "callIndex", function, memo, source, "lastRunId")
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT ("transactionId", "callIndex") DO UPDATE
+		SET "transferId" = EXCLUDED."transferId", function = EXCLUDED.function,
+			memo = EXCLUDED.memo, source = EXCLUDED.source, "lastRunId" = EXCLUDED."lastRunId"
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	linked := make(map[int]bool)
+	for _, memo := range memos {
+		transferId := linkMemoTransfer(memo, transfers[memo.TransactionId], linked)
+		if _, err := stmt.Exec(memo.TransactionId, transferId, memo.CallIndex, memo.Function, memo.Memo, memo.Source, runId); err != nil {
+			return 0, fmt.Errorf("failed to insert memo for transaction %d: %w", memo.TransactionId, err)
+		}
+	}
+
+	if err := writeWatermark(tx, memosWatermarkKey, endId); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return len(memos), nil
+}
+
+func extractMemos(candidate memoCandidate, functions []string, skipped skipCounts) []extractedMemo {
+	forms, err := parsePactCode(candidate.Code)
+	if err != nil {
+		skipped.add(skipUnparsableCode, 1)
+		return nil
+	}
+
+	calls := findPactCalls(forms, functions)
+	if len(calls) == 0 {
+		return nil
+	}
+
+	var envData map[string]interface{}
+	if len(candidate.Data) > 0 {
+		if err := safejson.Unmarshal(candidate.Data, &envData, jsonLimits()); err != nil {
+			if _, ok := jsonLimitBreached(err); ok {
+				skipped.add(skipJSONLimit, len(calls))
+				return nil
+			}
+			skipped.add(skipInvalidJSON, len(calls))
+			return nil
+		}
+	}
+
+	var memos []extractedMemo
+	for callIndex, call := range calls {
+		if len(call.Args) == 0 {
+			skipped.add(skipMissingArgument, 1)
+			continue
+		}
+
+		memo, source, reason := resolveStringArgument(call.Args[len(call.Args)-1], envData)
+		if reason == "" {
+			reason = validateMemo(memo)
+		}
+		if reason != "" {
+			skipped.add(reason, 1)
+			continue
+		}
+
+		extracted := extractedMemo{
+			TransactionId: candidate.TransactionId,
+			CallIndex:     callIndex,
+			Function:      call.Function,
+			Memo:          memo,
+			Source:        source,
+		}
+		if len(call.Args) >= 3 {
+			extracted.FromAcct, _, _ = resolveStringArgument(call.Args[0], envData)
+			extracted.ToAcct, _, _ = resolveStringArgument(call.Args[1], envData)
+		}
+		memos = append(memos, extracted)
+	}
+
+	return memos
+}
+
+// resolveStringArgument returns the string value of a call argument together with
+// where it came from, or a skip reason when it can't be resolved statically.
+func resolveStringArgument(arg pactValue, envData map[string]interface{}) (string, string, skipReason) {
+	if arg.Kind == pactString {
+		return arg.Text, "literal", ""
+	}
+
+	if arg.Kind == pactExpr && len(arg.Children) == 2 && arg.Children[0].Kind == pactAtom {
+		head := arg.Children[0].Text
+		key := arg.Children[1]
+		if (head == "read-msg" || head == "read-string") && (key.Kind == pactString || key.Kind == pactSymbol) {
+			value, ok := envData[key.Text]
+			if !ok {
+				return "", "", skipMissingKey
+			}
+			str, ok := value.(string)
+			if !ok {
+				return "", "", skipWrongType
+			}
+			return str, "env-data", ""
+		}
+	}
+
+	return "", "", skipUnsupportedArgument
+}
+
+func validateMemo(memo string) skipReason {
+	if memo == "" {
+		return skipEmptyValue
+	}
+	if len(memo) > *memoMaxLength {
+		return skipTooLong
+	}
+	if !utf8.ValidString(memo) {
+		return skipNotPrintable
+	}
+	for _, r := range memo {
+		if unicode.IsControl(r) {
+			return skipNotPrintable
+		}
+	}
+	return ""
+}
+
+func fetchMemoTransfers(tx *sql.Tx, memos []extractedMemo) (map[int][]memoTransfer, error) {
+	transfers := make(map[int][]memoTransfer)
+	if len(memos) == 0 {
+		return transfers, nil
+	}
+
+	ids := make([]int64, 0, len(memos))
+	for _, memo := range memos {
+		ids = append(ids, int64(memo.TransactionId))
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, "transactionId", from_acct, to_acct
+		FROM "Transfers"
+		WHERE "transactionId" = ANY($1)
+		ORDER BY "transactionId", "orderIndex", id
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query transfers: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			transfer      memoTransfer
+			transactionId int
+		)
+		if err := rows.Scan(&transfer.Id, &transactionId, &transfer.FromAcct, &transfer.ToAcct); err != nil {
+			return nil, fmt.Errorf("failed to scan transfer: %w", err)
+		}
+		transfers[transactionId] = append(transfers[transactionId], transfer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating transfers: %w", err)
+	}
+
+	return transfers, nil
+}
+
+// linkMemoTransfer picks the transfer a memo belongs to: the first not yet linked
+// transfer between the call's sender and receiver, or the only transfer of the
+// transaction when the accounts couldn't be resolved.
+func linkMemoTransfer(memo extractedMemo, transfers []memoTransfer, linked map[int]bool) *int {
+	if memo.FromAcct != "" && memo.ToAcct != "" {
+		for _, transfer := range transfers {
+			if !linked[transfer.Id] && transfer.FromAcct == memo.FromAcct && transfer.ToAcct == memo.ToAcct {
+				linked[transfer.Id] = true
+				return &transfer.Id
+			}
+		}
+		return nil
+	}
+
+	if len(transfers) == 1 && !linked[transfers[0].Id] {
+		linked[transfers[0].Id] = true
+		return &transfers[0].Id
+	}
+
+	return nil
+}
+
+func BackfillMemos(ctx context.Context, cfg *config.Config) error {
+	return backfillMemos()
+}
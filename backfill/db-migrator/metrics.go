@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With -metrics-addr, the migrator serves its progress in the Prometheus text
+// format on /metrics while the command runs, labeled by command: the lowest id
+// code-to-text has processed (it walks ids downward), rows updated and skipped,
+// batches committed and retried, and a histogram of batch durations. Dry runs
+// commit nothing, so they leave rows updated and batches committed at zero.
+// The rows examined and invalid and the cursor aren't served; they go to the
+// report file along with the rest.
+
+// batchDurationBuckets are the upper bounds of the batch duration histogram, in
+// seconds.
+var batchDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type migratorMetrics struct {
+	lowestProcessedId atomic.Int64
+	hasLowestId       atomic.Bool
+	rowsUpdated       atomic.Int64
+	rowsSkipped       atomic.Int64
+	batchesCommitted  atomic.Int64
+	batchRetries      atomic.Int64
+	rowsExamined      atomic.Int64
+	rowsInvalid       atomic.Int64
+	cursor            atomic.Int64
+	hasCursor         atomic.Bool
+
+	mu             sync.Mutex
+	durationCounts []int64
+	durationSum    float64
+	durationCount  int64
+}
+
+var metrics = &migratorMetrics{durationCounts: make([]int64, len(batchDurationBuckets))}
+
+// setLowestProcessedId records that every id from id up has been processed.
+func (m *migratorMetrics) setLowestProcessedId(id int) {
+	m.lowestProcessedId.Store(int64(id))
+	m.hasLowestId.Store(true)
+	m.setCursor(id)
+}
+
+// setCursor records the id a command has processed to, in the direction it
+// walks: the last id done when walking up, the lowest when walking down.
+func (m *migratorMetrics) setCursor(id int) {
+	m.cursor.Store(int64(id))
+	m.hasCursor.Store(true)
+	recordRunProgress()
+}
+
+// examined records rows or items a command looked at, whether or not it changed
+// them.
+func (m *migratorMetrics) examined(n int) {
+	m.rowsExamined.Add(int64(n))
+}
+
+// invalid records rows left out for holding an invalid value; they count as
+// skipped too.
+func (m *migratorMetrics) invalid(n int) {
+	m.rowsInvalid.Add(int64(n))
+}
+
+// batchCommitted records a batch that committed rows in elapsed.
+func (m *migratorMetrics) batchCommitted(rows int, elapsed time.Duration) {
+	m.batchesCommitted.Add(1)
+	m.rowsUpdated.Add(int64(rows))
+	m.observeBatch(elapsed)
+	recordRunProgress()
+}
+
+func (m *migratorMetrics) observeBatch(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range batchDurationBuckets {
+		if seconds <= bound {
+			m.durationCounts[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+func (m *migratorMetrics) skipped(n int) {
+	m.rowsSkipped.Add(int64(n))
+}
+
+func (m *migratorMetrics) retried() {
+	m.batchRetries.Add(1)
+}
+
+// write writes the metrics in the Prometheus text format, labeled by command.
+func (m *migratorMetrics) write(b *strings.Builder, command string) {
+	label := fmt.Sprintf(`command=%q`, command)
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	if m.hasLowestId.Load() {
+		metric("migrator_lowest_processed_id", "gauge", "Lowest id processed, every id above it is done.")
+		fmt.Fprintf(b, "migrator_lowest_processed_id{%s} %d\n", label, m.lowestProcessedId.Load())
+	}
+	metric("migrator_rows_updated_total", "counter", "Rows updated by committed batches.")
+	fmt.Fprintf(b, "migrator_rows_updated_total{%s} %d\n", label, m.rowsUpdated.Load())
+	metric("migrator_rows_skipped_total", "counter", "Rows or items left out, for any skip reason.")
+	fmt.Fprintf(b, "migrator_rows_skipped_total{%s} %d\n", label, m.rowsSkipped.Load())
+	metric("migrator_batches_committed_total", "counter", "Batches committed.")
+	fmt.Fprintf(b, "migrator_batches_committed_total{%s} %d\n", label, m.batchesCommitted.Load())
+	metric("migrator_batch_retries_total", "counter", "Batch attempts retried after a retryable error.")
+	fmt.Fprintf(b, "migrator_batch_retries_total{%s} %d\n", label, m.batchRetries.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metric("migrator_batch_duration_seconds", "histogram", "Duration of committed batches.")
+	for i, bound := range batchDurationBuckets {
+		fmt.Fprintf(b, "migrator_batch_duration_seconds_bucket{%s,le=\"%g\"} %d\n", label, bound, m.durationCounts[i])
+	}
+	fmt.Fprintf(b, "migrator_batch_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", label, m.durationCount)
+	fmt.Fprintf(b, "migrator_batch_duration_seconds_sum{%s} %g\n", label, roundSeconds(m.durationSum))
+	fmt.Fprintf(b, "migrator_batch_duration_seconds_count{%s} %d\n", label, m.durationCount)
+}
+
+func roundSeconds(seconds float64) float64 {
+	return math.Round(seconds*1e6) / 1e6
+}
+
+type metricsServer struct {
+	server *http.Server
+}
+
+func startMetricsServer(addr, command string) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var b strings.Builder
+		metrics.write(&b, command)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, b.String())
+	})
+
+	s := &metricsServer{server: &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Metrics server listening on %s", addr)
+	return s, nil
+}
+
+func (s *metricsServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down metrics server: %v", err)
+	}
+	log.Println("Metrics server shut down")
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"strings"
+)
+
+// This script reports how far code-to-text, creation-time and reconcile got,
+// without writing. For each it counts the rows the migration applies to and
+// those still left, and finds the lowest id left, with range predicates on the
+// primary key so the planner can walk it. reconcile leaves no mark on the events
+// it processed, so its count is of RECONCILE events whose transaction has no
+// token transfer yet. With -sample N the counts are estimated from 10 slices of
+// N/10 ids spread across the table, scaled up to its id span; the lowest id left
+// is still exact. -json prints the report as JSON, and
+// -exit-nonzero-if-incomplete fails the command when anything is left, for
+// deployment gates. The runs recorded as running in MigratorRuns are logged
+// after the report, those whose heartbeat is older than -stale-after flagged as
+// possibly dead; -json leaves them out of the report on stdout.
+
+const statusSampleSlices = 10
+
+// migrationProgress is the progress of a migration on one table.
+type migrationProgress struct {
+	Migration string `json:"migration"`
+	Table     string `json:"table"`
+	// State is complete, incomplete, finalized or unavailable
+	State              string `json:"state"`
+	Total              int64  `json:"total"`
+	Migrated           int64  `json:"migrated"`
+	Remaining          int64  `json:"remaining"`
+	LowestUnmigratedId *int64 `json:"lowestUnmigratedId"`
+	Estimated          bool   `json:"estimated"`
+	Note               string `json:"note,omitempty"`
+}
+
+// statusCheck tells, for rows of table, which the migration applies to and
+// which of those it hasn't done yet.
+type statusCheck struct {
+	migration string
+	table     string
+	from      string
+	candidate string
+	pending   string
+	// Columns the checks need, as table.column
+	requires []string
+	note     string
+}
+
+var statusChecks = []statusCheck{
+	{
+		migration: "code-to-text",
+		table:     "TransactionDetails",
+		from:      `"TransactionDetails"`,
+		candidate: codeCandidateCondition,
+		pending:   `codetext IS NULL`,
+	},
+	{
+		migration: "creation-time",
+		table:     "Events",
+		from:      `"Events"`,
+		candidate: `"transactionId" IS NOT NULL`,
+		pending:   `creationtime IS NULL`,
+		requires:  []string{"Events.creationtime"},
+	},
+	{
+		migration: "creation-time",
+		table:     "Transfers",
+		from:      `"Transfers"`,
+		candidate: `"transactionId" IS NOT NULL`,
+		pending:   `creationtime IS NULL`,
+		requires:  []string{"Transfers.creationtime"},
+	},
+	{
+		migration: "reconcile",
+		table:     "Events",
+		from:      `"Events"`,
+		candidate: `name = 'RECONCILE' AND module IN ('marmalade.ledger', 'marmalade-v2.ledger')`,
+		pending: `NOT EXISTS (
+			SELECT 1 FROM "Transfers" tr WHERE tr."transactionId" = "Events"."transactionId" AND tr."hasTokenId"
+		)`,
+		note: "RECONCILE events whose transaction has no token transfer",
+	},
+}
+
+func migrationStatus() ([]migrationProgress, []migratorRun, error) {
+	if *statusSample < 0 {
+		return nil, nil, &errs.ValidationError{Field: "-sample", Reason: fmt.Sprintf("%d must not be negative", *statusSample)}
+	}
+	if *statusSample > 0 && *statusSample < statusSampleSlices {
+		return nil, nil, &errs.ValidationError{Field: "-sample", Reason: fmt.Sprintf("%d must be at least %d, one id per slice", *statusSample, statusSampleSlices)}
+	}
+	if *staleAfter <= 0 {
+		return nil, nil, &errs.ValidationError{Field: "-stale-after", Reason: fmt.Sprintf("%s must be greater than 0", *staleAfter)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return nil, nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	var report []migrationProgress
+	for _, check := range statusChecks {
+		progress, err := checkMigration(db, check)
+		if err != nil {
+			return nil, nil, err
+		}
+		report = append(report, progress)
+	}
+
+	runs, err := activeMigratorRuns(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return report, runs, nil
+}
+
+// activeMigratorRuns returns the runs recorded as running, none when no run has
+// recorded a heartbeat yet.
+func activeMigratorRuns(db *sql.DB) ([]migratorRun, error) {
+	stateType, err := columnType(db, "MigratorRuns", "state")
+	if err != nil || stateType == "" {
+		return nil, err
+	}
+	return loadRunningRuns(db, `TRUE`)
+}
+
+func checkMigration(db *sql.DB, check statusCheck) (migrationProgress, error) {
+	progress := migrationProgress{Migration: check.migration, Table: check.table, Note: check.note}
+
+	exists, err := tableExists(db, check.table)
+	if err != nil {
+		return progress, err
+	}
+	if !exists {
+		progress.State = "unavailable"
+		progress.Note = fmt.Sprintf("table %s doesn't exist", check.table)
+		return progress, nil
+	}
+	for _, required := range check.requires {
+		table, column, _ := strings.Cut(required, ".")
+		dataType, err := columnType(db, table, column)
+		if err != nil {
+			return progress, err
+		}
+		if dataType == "" {
+			progress.State = "unavailable"
+			progress.Note = fmt.Sprintf("column %s doesn't exist", required)
+			return progress, nil
+		}
+	}
+
+	pending := check.pending
+	if check.migration == "code-to-text" {
+		codeType, err := columnType(db, "TransactionDetails", "code")
+		if err != nil {
+			return progress, err
+		}
+		codeTextType, err := columnType(db, "TransactionDetails", "codetext")
+		if err != nil {
+			return progress, err
+		}
+		switch {
+		case codeType == "text" && codeTextType == "":
+			progress.State = "finalized"
+			progress.Note = "code is already text"
+			return progress, nil
+		case codeTextType == "":
+			// Nothing converted yet
+			pending = "TRUE"
+		}
+	}
+
+	var minId, maxId sql.NullInt64
+	if err := db.QueryRow(fmt.Sprintf(`SELECT MIN(id), MAX(id) FROM %s`, check.from)).Scan(&minId, &maxId); err != nil {
+		return progress, errs.FromDB(fmt.Sprintf("failed to get the id range of %s", check.table), err)
+	}
+	if !minId.Valid {
+		progress.State = "complete"
+		return progress, nil
+	}
+
+	countQuery := fmt.Sprintf(`
+		SELECT COUNT(*) FILTER (WHERE %s), COUNT(*) FILTER (WHERE %s AND %s)
+		FROM %s
+		WHERE id >= $1 AND id <= $2
+	`, check.candidate, check.candidate, pending, check.from)
+
+	if *statusSample == 0 {
+		if err := db.QueryRow(countQuery, minId.Int64, maxId.Int64).Scan(&progress.Total, &progress.Remaining); err != nil {
+			return progress, errs.FromDB(fmt.Sprintf("failed to count %s of %s", check.migration, check.table), err)
+		}
+	} else {
+		progress.Estimated = true
+		if err := estimateMigration(db, countQuery, minId.Int64, maxId.Int64, &progress); err != nil {
+			return progress, fmt.Errorf("failed to estimate %s of %s: %w", check.migration, check.table, err)
+		}
+	}
+	progress.Migrated = progress.Total - progress.Remaining
+
+	var lowest int64
+	err = db.QueryRow(fmt.Sprintf(`SELECT id FROM %s WHERE %s AND %s ORDER BY id LIMIT 1`, check.from, check.candidate, pending)).Scan(&lowest)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return progress, errs.FromDB(fmt.Sprintf("failed to find the lowest unmigrated id of %s", check.table), err)
+	default:
+		progress.LowestUnmigratedId = &lowest
+	}
+
+	progress.State = "complete"
+	if progress.Remaining > 0 || progress.LowestUnmigratedId != nil {
+		progress.State = "incomplete"
+	}
+	return progress, nil
+}
+
+// estimateMigration counts over statusSampleSlices slices spread across
+// [minId, maxId], and scales the counts up to the whole span.
+func estimateMigration(db *sql.DB, countQuery string, minId, maxId int64, progress *migrationProgress) error {
+	span := maxId - minId + 1
+	sliceIds := int64(*statusSample / statusSampleSlices)
+	if sliceIds*statusSampleSlices >= span {
+		return db.QueryRow(countQuery, minId, maxId).Scan(&progress.Total, &progress.Remaining)
+	}
+
+	var sampledTotal, sampledRemaining int64
+	stride := span / statusSampleSlices
+	for i := int64(0); i < statusSampleSlices; i++ {
+		start := minId + i*stride
+		var total, remaining int64
+		if err := db.QueryRow(countQuery, start, start+sliceIds-1).Scan(&total, &remaining); err != nil {
+			return errs.FromDB(fmt.Sprintf("failed to count ids %d-%d", start, start+sliceIds-1), err)
+		}
+		sampledTotal += total
+		sampledRemaining += remaining
+	}
+
+	scale := float64(span) / float64(sliceIds*statusSampleSlices)
+	progress.Total = int64(float64(sampledTotal) * scale)
+	progress.Remaining = int64(float64(sampledRemaining) * scale)
+	return nil
+}
+
+func printMigrationStatus(report []migrationProgress) error {
+	if *statusJson {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode status: %w", err)
+		}
+		fmt.Fprintln(os.Stdout, string(data))
+		return nil
+	}
+
+	for _, progress := range report {
+		name := fmt.Sprintf("%s (%s)", progress.Migration, progress.Table)
+		if progress.State == "finalized" || progress.State == "unavailable" {
+			log.Printf("%s: %s, %s", name, progress.State, progress.Note)
+			continue
+		}
+
+		estimated := ""
+		if progress.Estimated {
+			estimated = " (estimated)"
+		}
+		lowest := "none"
+		if progress.LowestUnmigratedId != nil {
+			lowest = fmt.Sprint(*progress.LowestUnmigratedId)
+		}
+		log.Printf("%s: %s, total %s, migrated %s (%.1f%%), remaining %s%s, lowest unmigrated id %s",
+			name, progress.State, groupThousands(progress.Total), groupThousands(progress.Migrated),
+			percentOf(int(progress.Migrated), int(progress.Total)), groupThousands(progress.Remaining), estimated, lowest)
+		if progress.Note != "" {
+			log.Printf("  counting %s", progress.Note)
+		}
+	}
+	return nil
+}
+
+// logActiveRuns logs the runs recorded as running, flagging the stale ones.
+func logActiveRuns(runs []migratorRun) {
+	if len(runs) == 0 {
+		log.Println("Active runs: none")
+		return
+	}
+	for _, run := range runs {
+		if run.Stale {
+			log.Printf("Active run of %s: %s; POSSIBLY DEAD, no heartbeat for over %s", run.Command, run, *staleAfter)
+			continue
+		}
+		log.Printf("Active run of %s: %s", run.Command, run)
+	}
+}
+
+func MigrationStatus(ctx context.Context, cfg *config.Config) error {
+	report, runs, err := migrationStatus()
+	if err != nil {
+		return err
+	}
+	if err := printMigrationStatus(report); err != nil {
+		return err
+	}
+	logActiveRuns(runs)
+
+	if *statusExitIfIncomplete {
+		var incomplete []string
+		for _, progress := range report {
+			if progress.State == "incomplete" {
+				incomplete = append(incomplete, fmt.Sprintf("%s (%s)", progress.Migration, progress.Table))
+			}
+		}
+		if len(incomplete) > 0 {
+			return errors.New("incomplete migrations: " + strings.Join(incomplete, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Every run of a writing command is recorded in MigratorRuns, next to the
+// advisory lock of its instance: the host and pid running it, when it started,
+// its last heartbeat, the id it got to and its state. The heartbeat and cursor
+// are updated after every committed batch, and every runHeartbeatTick in
+// between, without holding up the batch. A run ends completed, stopped by a
+// signal or failed; one killed outright stays running while its heartbeat grows
+// old, and status reports it as possibly dead once that is older than
+// -stale-after. A new run of the same command over such a row refuses to start
+// unless -force is set, and then marks the row abandoned.
+
+// runHeartbeatTick is how often a run's heartbeat is recorded between batches.
+const runHeartbeatTick = 30 * time.Second
+
+// States of a run in MigratorRuns
+const (
+	runStateRunning   = "running"
+	runStateCompleted = "completed"
+	runStateStopped   = "stopped"
+	runStateFailed    = "failed"
+	runStateAbandoned = "abandoned"
+)
+
+// runRecorder keeps the MigratorRuns row of this process up to date.
+type runRecorder struct {
+	db      *sql.DB
+	beat    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	closed  sync.Once
+}
+
+// activeRun is the run of this process, nil when it isn't recorded.
+var activeRun *runRecorder
+
+// migratorRun is a MigratorRuns row still running.
+type migratorRun struct {
+	RunId           string
+	Command         string
+	Host            string
+	Pid             int
+	StartedAt       time.Time
+	HeartbeatAt     time.Time
+	LastProcessedId *int64
+	// Stale is set when the heartbeat is older than -stale-after
+	Stale bool
+}
+
+func (r migratorRun) String() string {
+	description := fmt.Sprintf("run %s, pid %d on %s, started %s, last heartbeat %s ago",
+		r.RunId, r.Pid, r.Host, r.StartedAt.Format(time.RFC3339), time.Since(r.HeartbeatAt).Round(time.Second))
+	if r.LastProcessedId != nil {
+		description += fmt.Sprintf(", at id %d", *r.LastProcessedId)
+	}
+	return description
+}
+
+// startRun records the start of a run of name. Commands that don't write aren't
+// recorded.
+func startRun(name string) error {
+	if !commandWrites(name) {
+		return nil
+	}
+	if *staleAfter <= 0 {
+		return &errs.ValidationError{Field: "-stale-after", Reason: fmt.Sprintf("%s must be greater than 0", *staleAfter)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := createMigratorRunsTable(db); err != nil {
+		db.Close()
+		return err
+	}
+	if err := takeOverStaleRuns(db, name); err != nil {
+		db.Close()
+		return err
+	}
+
+	host, _ := os.Hostname()
+	_, err = db.Exec(`
+		INSERT INTO "MigratorRuns" ("runId", command, version, host, pid, "heartbeatAt", state)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, $6)
+	`, runId, name, buildVersion(), host, os.Getpid(), runStateRunning)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to record run: %w", err)
+	}
+
+	activeRun = &runRecorder{db: db, beat: make(chan struct{}, 1), stop: make(chan struct{}), stopped: make(chan struct{})}
+	go activeRun.heartbeat()
+	return nil
+}
+
+// takeOverStaleRuns fails when an earlier run of name is still recorded as
+// running with a stale heartbeat, unless -force is set; the runs are then marked
+// abandoned.
+func takeOverStaleRuns(db *sql.DB, name string) error {
+	runs, err := loadRunningRuns(db, `command = $1`, name)
+	if err != nil {
+		return err
+	}
+	var (
+		stale []string
+		ids   []string
+	)
+	for _, run := range runs {
+		if run.Stale {
+			stale = append(stale, run.String())
+			ids = append(ids, run.RunId)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	if !*forceRun {
+		return fmt.Errorf("refusing to run %s: an earlier run is still recorded as running with no heartbeat for over %s, and may have died (%s); make sure it isn't running and pass -force",
+			name, *staleAfter, strings.Join(stale, "; "))
+	}
+	for _, run := range stale {
+		log.Printf("WARNING: an earlier %s run is still recorded as running with no heartbeat for over %s (%s); marking it %s and running anyway because of -force",
+			name, *staleAfter, run, runStateAbandoned)
+	}
+	_, err = db.Exec(`UPDATE "MigratorRuns" SET state = $2 WHERE "runId" = ANY($1)`, pq.Array(ids), runStateAbandoned)
+	if err != nil {
+		return fmt.Errorf("failed to mark the stale %s runs abandoned: %w", name, err)
+	}
+	return nil
+}
+
+// loadRunningRuns returns the runs recorded as running that match where, oldest
+// first.
+func loadRunningRuns(db *sql.DB, where string, args ...interface{}) ([]migratorRun, error) {
+	args = append(args, runStateRunning, staleAfter.Seconds())
+	query := fmt.Sprintf(`
+		SELECT "runId", command, host, pid, "startedAt", "heartbeatAt", "lastProcessedId",
+			"heartbeatAt" < CURRENT_TIMESTAMP - make_interval(secs => $%d)
+		FROM "MigratorRuns"
+		WHERE state = $%d AND %s
+		ORDER BY "startedAt"
+	`, len(args), len(args)-1, where)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errs.FromDB("failed to load the running migrator runs", err)
+	}
+	defer rows.Close()
+
+	var runs []migratorRun
+	for rows.Next() {
+		var (
+			run             migratorRun
+			lastProcessedId sql.NullInt64
+		)
+		err := rows.Scan(&run.RunId, &run.Command, &run.Host, &run.Pid, &run.StartedAt, &run.HeartbeatAt, &lastProcessedId, &run.Stale)
+		if err != nil {
+			return nil, errs.FromDB("failed to scan migrator run", err)
+		}
+		if lastProcessedId.Valid {
+			run.LastProcessedId = &lastProcessedId.Int64
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.FromDB("error iterating migrator runs", err)
+	}
+	return runs, nil
+}
+
+// recordRunProgress has the heartbeat of the run record the cursor now, without
+// waiting for the write.
+func recordRunProgress() {
+	if activeRun == nil {
+		return
+	}
+	select {
+	case activeRun.beat <- struct{}{}:
+	default:
+		// A heartbeat is pending already, and will carry the latest cursor
+	}
+}
+
+func (r *runRecorder) heartbeat() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(runHeartbeatTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.beat:
+		case <-r.stop:
+			return
+		}
+		_, err := r.db.Exec(`
+			UPDATE "MigratorRuns" SET "heartbeatAt" = CURRENT_TIMESTAMP, "lastProcessedId" = COALESCE($2, "lastProcessedId")
+			WHERE "runId" = $1
+		`, runId, runCursor())
+		if err != nil {
+			log.Printf("Warning: failed to record the heartbeat of run %s: %v", runId, err)
+		}
+	}
+}
+
+// runCursor is the cursor of the metrics, NULL until a command sets it.
+func runCursor() sql.NullInt64 {
+	return sql.NullInt64{Int64: metrics.cursor.Load(), Valid: metrics.hasCursor.Load()}
+}
+
+// finishRun records the end of the run of this process, ended by err when it
+// isn't nil: completed, stopped by a signal or failed. Only a completed run gets
+// a finish time, so lineage never follows the others. Only the first call does
+// anything.
+func finishRun(err error) {
+	r := activeRun
+	if r == nil {
+		return
+	}
+	r.closed.Do(func() {
+		close(r.stop)
+		<-r.stopped
+
+		var interruptErr *errs.Interrupted
+		state := runStateCompleted
+		switch {
+		case err == nil:
+		case errors.As(err, &interruptErr):
+			state = runStateStopped
+		default:
+			state = runStateFailed
+		}
+		_, dbErr := r.db.Exec(`
+			UPDATE "MigratorRuns"
+			SET state = $2, "heartbeatAt" = CURRENT_TIMESTAMP, "lastProcessedId" = COALESCE($3, "lastProcessedId"),
+				"finishedAt" = CASE WHEN $4 THEN CURRENT_TIMESTAMP END
+			WHERE "runId" = $1
+		`, runId, state, runCursor(), state == runStateCompleted)
+		if dbErr != nil {
+			log.Printf("Warning: failed to record the end of run %s: %v", runId, dbErr)
+		}
+		r.db.Close()
+	})
+}
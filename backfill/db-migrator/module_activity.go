@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"math"
+)
+
+const (
+	// Heights are synchronized across chains and blocks come every 30 seconds, so
+	// a UTC day spans about 2880 heights.
+	moduleActivityBatchHeights = 2880
+	moduleActivityLookback     = 2 * moduleActivityBatchHeights
+	moduleActivityWatermarkKey = "rollup-module-activity"
+	moduleActivityTopModules   = 10
+)
+
+// This script maintains the ModuleActivity table: per UTC day, chain and module,
+// the number of events, distinct senders and distinct transactions of canonical
+// blocks, so dashboards read a small rollup instead of grouping Events on every
+// page load. Blocks are walked in height windows and the watermark holds the last
+// height processed (not an id). Distinct counts don't add up across windows, so
+// every day a window touches is recomputed from all of its processed blocks and
+// replaces the stored rows; this also refreshes the current partial day on every
+// run.
+
+// moduleActivityDay is the UTC day of block b; creationTime is in microseconds.
+const moduleActivityDay = `(to_timestamp(b."creationTime" / 1000000.0) AT TIME ZONE 'UTC')::date`
+
+func rollupModuleActivity() error {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createModuleActivityTable(db); err != nil {
+		return err
+	}
+
+	lastHeight, err := readWatermark(db, moduleActivityWatermarkKey)
+	if err != nil {
+		return err
+	}
+
+	// The live watermark is on block ids; translate it into a height
+	upperBlockId, err := capToLiveWatermark(db, "Blocks", math.MaxInt32, false)
+	if err != nil {
+		return err
+	}
+	var maxHeight int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(height), 0) FROM "Blocks" WHERE id <= $1`, upperBlockId).Scan(&maxHeight); err != nil {
+		return fmt.Errorf("failed to get max block height: %w", err)
+	}
+
+	startHeight := 0
+	if lastHeight > 0 {
+		startHeight = lastHeight + 1
+	}
+	if maxHeight < startHeight {
+		logNothingToDo("Blocks heights", startHeight, maxHeight)
+		log.Println("Completed processing. Total module activity rows written: 0 (100.0%)")
+		return nil
+	}
+
+	totalRows := 0
+	totalHeights := maxHeight - startHeight + 1
+	lastProgressPrinted := -1.0
+	var firstDay, lastDay string
+
+	log.Printf("Starting to roll up module activity from height %d to %d", startHeight, maxHeight)
+
+	for currentHeight := startHeight; currentHeight <= maxHeight; currentHeight += moduleActivityBatchHeights {
+		batchEnd := currentHeight + moduleActivityBatchHeights - 1
+		if batchEnd > maxHeight {
+			batchEnd = maxHeight
+		}
+
+		days, written, err := processModuleActivityBatch(db, currentHeight, batchEnd)
+		if err != nil {
+			return fmt.Errorf("failed to process heights %d-%d: %w", currentHeight, batchEnd, err)
+		}
+		totalRows += written
+		if len(days) > 0 {
+			if firstDay == "" {
+				firstDay = days[0]
+			}
+			lastDay = days[len(days)-1]
+		}
+
+		progressPercent := percentOf(batchEnd-startHeight+1, totalHeights)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, height: %d, rows written: %d", progressPercent, batchEnd, totalRows)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total module activity rows written: %d (100.0%%)", totalRows)
+
+	if firstDay != "" {
+		if err := logTopModules(db, firstDay, lastDay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createModuleActivityTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "ModuleActivity" (
+			date DATE NOT NULL,
+			"chainId" INTEGER NOT NULL,
+			module TEXT NOT NULL,
+			"eventCount" INTEGER NOT NULL,
+			"distinctCallers" INTEGER NOT NULL,
+			"distinctTransactions" INTEGER NOT NULL,
+			"lastHeight" INTEGER NOT NULL,
+			"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (date, "chainId", module)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ModuleActivity table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS moduleactivity_module_date_idx ON "ModuleActivity" (module, date)`)
+	if err != nil {
+		return fmt.Errorf("failed to create ModuleActivity module index: %w", err)
+	}
+
+	if err := addLineageColumn(db, "ModuleActivity"); err != nil {
+		return err
+	}
+	return createWatermarksTable(db)
+}
+
+// processModuleActivityBatch recomputes every day that has a block in
+// [startHeight, endHeight] from all of that day's blocks up to endHeight, and
+// returns the recomputed days in order.
+func processModuleActivityBatch(db *sql.DB, startHeight, endHeight int) ([]string, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	rows, err := tx.Query(fmt.Sprintf(`
+		SELECT DISTINCT %s::text AS day
+		FROM "Blocks" b
+		WHERE b.height >= $1 AND b.height <= $2 AND b.canonical = true
+		ORDER BY day
+	`, moduleActivityDay), startHeight, endHeight)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query days: %w", err)
+	}
+
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("failed to scan day: %w", err)
+		}
+		days = append(days, day)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, 0, fmt.Errorf("error iterating days: %w", err)
+	}
+	rows.Close()
+
+	// A day's earlier blocks lie within the lookback below the window; two days of
+	// heights leave room for slow stretches and drift between chains
+	lowerHeight := startHeight - moduleActivityLookback
+	if lowerHeight < 0 {
+		lowerHeight = 0
+	}
+
+	insert := fmt.Sprintf(`
+		INSERT INTO "ModuleActivity" (date, "chainId", module, "eventCount", "distinctCallers", "distinctTransactions", "lastHeight", "updatedAt", "lastRunId")
+		SELECT $3::date, b."chainId", e.module, COUNT(*), COUNT(DISTINCT t.sender), COUNT(DISTINCT e."transactionId"),
+			MAX(b.height), CURRENT_TIMESTAMP, $4
+		FROM "Blocks" b
+		JOIN "Transactions" t ON t."blockId" = b.id
+		JOIN "Events" e ON e."transactionId" = t.id
+		WHERE b.height >= $1 AND b.height <= $2 AND b.canonical = true AND %s = $3::date
+		GROUP BY b."chainId", e.module
+	`, moduleActivityDay)
+
+	written := 0
+	for _, day := range days {
+		if _, err := tx.Exec(`DELETE FROM "ModuleActivity" WHERE date = $1::date`, day); err != nil {
+			return nil, 0, fmt.Errorf("failed to clear module activity of %s: %w", day, err)
+		}
+
+		result, err := tx.Exec(insert, lowerHeight, endHeight, day, runId)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to roll up module activity of %s: %w", day, err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get affected rows: %w", err)
+		}
+		written += int(affected)
+	}
+
+	if err := writeWatermark(tx, moduleActivityWatermarkKey, endHeight); err != nil {
+		return nil, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return days, written, nil
+}
+
+func logTopModules(db *sql.DB, firstDay, lastDay string) error {
+	rows, err := db.Query(`
+		SELECT module, SUM("eventCount") AS events, SUM("distinctTransactions") AS transactions
+		FROM "ModuleActivity"
+		WHERE date >= $1::date AND date <= $2::date
+		GROUP BY module
+		ORDER BY events DESC, module
+		LIMIT $3
+	`, firstDay, lastDay, moduleActivityTopModules)
+	if err != nil {
+		return fmt.Errorf("failed to query top modules: %w", err)
+	}
+	defer rows.Close()
+
+	type moduleTotal struct {
+		Module       string
+		Events       int
+		Transactions int
+	}
+	var top []moduleTotal
+	for rows.Next() {
+		var total moduleTotal
+		if err := rows.Scan(&total.Module, &total.Events, &total.Transactions); err != nil {
+			return fmt.Errorf("failed to scan top module: %w", err)
+		}
+		top = append(top, total)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating top modules: %w", err)
+	}
+
+	log.Printf("Top %d modules by events from %s to %s:", moduleActivityTopModules, firstDay, lastDay)
+	for i, total := range top {
+		log.Printf("  %2d. %s: %d events in %d transactions", i+1, total.Module, total.Events, total.Transactions)
+	}
+	return nil
+}
+
+func RollupModuleActivity(ctx context.Context, cfg *config.Config) error {
+	return rollupModuleActivity()
+}
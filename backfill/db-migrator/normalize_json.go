@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"go-backfill/safejson"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const normalizeJsonBatchSize = 1000
+
+// This script rewrites jsonb columns into a canonical serialization so that values
+// written by different ingester versions compare equal as text and in joins. jsonb
+// already normalizes whitespace and key order on storage, but it keeps numbers as
+// written (1.0 and 1.00 and 1 are stored and rendered differently), so the work
+// here is rendering every number in its shortest exact decimal form: no exponent,
+// no trailing fractional zeros, no leading zeros and no negative zero. Numbers are
+// handled as decimal strings, never as floats, so no precision is lost.
+
+// normalizableColumns is the whitelist of "Table.column" values -json-columns accepts.
+var normalizableColumns = map[string]bool{
+	"Events.params":                   true,
+	"Transactions.result":             true,
+	"TransactionDetails.data":         true,
+	"TransactionDetails.continuation": true,
+}
+
+type jsonColumn struct {
+	Table  string
+	Column string
+}
+
+func (c jsonColumn) String() string {
+	return c.Table + "." + c.Column
+}
+
+func parseJsonColumns(value string) ([]jsonColumn, error) {
+	var columns []jsonColumn
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !normalizableColumns[name] {
+			allowed := make([]string, 0, len(normalizableColumns))
+			for column := range normalizableColumns {
+				allowed = append(allowed, column)
+			}
+			sort.Strings(allowed)
+			return nil, &errs.ValidationError{Field: "-json-columns", Reason: fmt.Sprintf("column %s cannot be normalized, allowed columns: %s", name, strings.Join(allowed, ", "))}
+		}
+		table, column, _ := strings.Cut(name, ".")
+		columns = append(columns, jsonColumn{Table: table, Column: column})
+	}
+	if len(columns) == 0 {
+		return nil, &errs.ValidationError{Field: "-json-columns", Reason: "no columns selected"}
+	}
+	return columns, nil
+}
+
+// canonicalJSON re-serializes a JSON document with sorted keys and canonical
+// numbers, and reports whether any number changed in the process.
+func canonicalJSON(data []byte) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	canonical := canonicalizeValue(value, &changed)
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(canonical); err != nil {
+		return nil, false, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), changed, nil
+}
+
+func canonicalizeValue(value interface{}, changed *bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// encoding/json writes map keys in sorted order
+		for key, child := range v {
+			v[key] = canonicalizeValue(child, changed)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = canonicalizeValue(child, changed)
+		}
+		return v
+	case json.Number:
+		canonical := canonicalNumber(v.String())
+		if canonical != v.String() {
+			*changed = true
+		}
+		return json.Number(canonical)
+	default:
+		return v
+	}
+}
+
+// canonicalNumber renders a JSON number literal in its shortest exact decimal form.
+func canonicalNumber(literal string) string {
+	negative := strings.HasPrefix(literal, "-")
+	literal = strings.TrimPrefix(literal, "-")
+
+	mantissa, exponentPart, _ := strings.Cut(strings.ToLower(literal), "e")
+	exponent := 0
+	if exponentPart != "" {
+		if _, err := fmt.Sscanf(exponentPart, "%d", &exponent); err != nil || exponent > 1000 || exponent < -1000 {
+			// Not worth expanding; keep the literal as is
+			if negative {
+				return "-" + literal
+			}
+			return literal
+		}
+	}
+
+	intPart, fracPart, _ := strings.Cut(mantissa, ".")
+	digits := intPart + fracPart
+	// Position of the decimal point within digits
+	point := len(intPart) + exponent
+
+	if point < 0 {
+		digits = strings.Repeat("0", -point) + digits
+		point = 0
+	}
+	if point > len(digits) {
+		digits += strings.Repeat("0", point-len(digits))
+	}
+
+	integer := strings.TrimLeft(digits[:point], "0")
+	fraction := strings.TrimRight(digits[point:], "0")
+
+	if integer == "" {
+		integer = "0"
+	}
+	if integer == "0" && fraction == "" {
+		return "0"
+	}
+
+	result := integer
+	if fraction != "" {
+		result += "." + fraction
+	}
+	if negative {
+		result = "-" + result
+	}
+	return result
+}
+
+// jsonValuesEqual compares two decoded JSON documents, treating numbers as exact
+// decimals.
+func jsonValuesEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, child := range av {
+			other, ok := bv[key]
+			if !ok || !jsonValuesEqual(child, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonValuesEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		ar, aok := new(big.Rat).SetString(av.String())
+		br, bok := new(big.Rat).SetString(bv.String())
+		return aok && bok && ar.Cmp(br) == 0
+	default:
+		return a == b
+	}
+}
+
+func decodeJSONWithNumbers(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+func normalizeJson() (bool, error) {
+	columns, err := parseJsonColumns(*jsonColumns)
+	if err != nil {
+		return false, err
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return false, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if *dryRun {
+		log.Println("Dry run: no rows will be modified")
+	}
+
+	allEqual := true
+	for _, column := range columns {
+		equal, err := normalizeJsonColumn(db, column)
+		if err != nil {
+			return false, fmt.Errorf("failed to normalize %s: %w", column, err)
+		}
+		allEqual = allEqual && equal
+	}
+
+	return allEqual, nil
+}
+
+func normalizeJsonColumn(db *sql.DB, column jsonColumn) (bool, error) {
+	var maxId int
+	query := fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM "%s"`, column.Table)
+	if err := db.QueryRow(query).Scan(&maxId); err != nil {
+		return false, fmt.Errorf("failed to get max id: %w", err)
+	}
+
+	maxId, err := capToLiveWatermark(db, column.Table, maxId, false)
+	if err != nil {
+		return false, err
+	}
+
+	if maxId < 1 {
+		logNothingToDo(column.String(), 1, maxId)
+		log.Printf("Completed processing %s. Total rows rewritten: 0 (100.0%%)", column)
+		return true, nil
+	}
+
+	totalChanged := 0
+	totalMismatched := 0
+	skipped := make(skipCounts)
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to normalize %s from ID 1 to %d", column, maxId)
+
+	for currentId := 1; currentId <= maxId; currentId += normalizeJsonBatchSize {
+		batchEnd := currentId + normalizeJsonBatchSize - 1
+		if batchEnd > maxId {
+			batchEnd = maxId
+		}
+
+		changed, mismatched, err := processNormalizeJsonBatch(db, column, currentId, batchEnd, skipped)
+		if err != nil {
+			return false, fmt.Errorf("failed to process batch %d-%d: %w", currentId, batchEnd, err)
+		}
+		totalChanged += changed
+		totalMismatched += mismatched
+
+		progressPercent := percentOf(batchEnd, maxId)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, %s rows not canonical: %d", progressPercent, column, totalChanged)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	switch {
+	case *jsonVerify:
+		log.Printf("Completed verifying %s. Rows not yet canonical: %d, rows whose canonical form doesn't parse back equal: %d",
+			column, totalChanged, totalMismatched)
+	case *dryRun:
+		log.Printf("Completed dry run of %s. Rows that would be rewritten: %d", column, totalChanged)
+	default:
+		log.Printf("Completed processing %s. Total rows rewritten: %d (100.0%%)", column, totalChanged)
+	}
+	logSkipSummary(column.String()+" rows", skipped)
+
+	return totalMismatched == 0, nil
+}
+
+func processNormalizeJsonBatch(db *sql.DB, column jsonColumn, startId, endId int, skipped skipCounts) (int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	query := fmt.Sprintf(`
+		SELECT id, "%s"::text
+		FROM "%s"
+		WHERE id >= $1 AND id <= $2 AND "%s" IS NOT NULL
+		ORDER BY id
+	`, column.Column, column.Table, column.Column)
+
+	rows, err := tx.Query(query, startId, endId)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query rows: %w", err)
+	}
+
+	type rewrite struct {
+		Id        int
+		Canonical []byte
+	}
+
+	var rewrites []rewrite
+	mismatched := 0
+	for rows.Next() {
+		var (
+			id   int
+			data []byte
+		)
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if err := safejson.Check(data, jsonLimits()); err != nil {
+			log.Printf("Skipping %s of id %d: %v", column, id, err)
+			if _, ok := jsonLimitBreached(err); ok {
+				skipped.add(skipJSONLimit, 1)
+			} else {
+				skipped.add(skipInvalidJSON, 1)
+			}
+			continue
+		}
+
+		canonical, changed, err := canonicalJSON(data)
+		if err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to canonicalize %s of id %d: %w", column, id, err)
+		}
+		if !changed {
+			continue
+		}
+
+		if *jsonVerify {
+			original, err1 := decodeJSONWithNumbers(data)
+			reparsed, err2 := decodeJSONWithNumbers(canonical)
+			if err1 != nil || err2 != nil || !jsonValuesEqual(original, reparsed) {
+				log.Printf("Canonical form of %s at id %d doesn't parse back equal to the original", column, id)
+				mismatched++
+			}
+		}
+
+		rewrites = append(rewrites, rewrite{Id: id, Canonical: canonical})
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, 0, fmt.Errorf("error iterating rows: %w", err)
+	}
+	rows.Close()
+
+	if *dryRun || *jsonVerify || len(rewrites) == 0 {
+		return len(rewrites), mismatched, nil
+	}
+
+	update := fmt.Sprintf(`UPDATE "%s" SET "%s" = $2::jsonb WHERE id = $1`, column.Table, column.Column)
+	stmt, err := tx.Prepare(update)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range rewrites {
+		if _, err := stmt.Exec(r.Id, string(r.Canonical)); err != nil {
+			return 0, 0, fmt.Errorf("failed to rewrite id %d: %w", r.Id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return len(rewrites), mismatched, nil
+}
+
+func NormalizeJson(ctx context.Context, cfg *config.Config) error {
+	allEqual, err := normalizeJson()
+	if err != nil {
+		return err
+	}
+	if !allEqual {
+		return errors.New("verification failed: some canonical values don't parse back equal to the original")
+	}
+	return nil
+}
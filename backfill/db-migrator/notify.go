@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// With NOTIFY_WEBHOOK_URL set, the migrator POSTs a JSON notification to it when
+// a command starts and when it completes, fails or is interrupted, the latter
+// carrying the run report and, on an error, the range of the batch that failed
+// or else of the last batch logged. With -notify-every-percent N it also posts
+// whenever the progress logged crosses another multiple of N percent. Every
+// notification names the command and the host, and has a text field read by
+// Slack-compatible webhooks. A POST is tried notifyAttempts times; a
+// notification that still can't be delivered is logged and never changes the
+// exit code.
+
+// Events notified
+const (
+	notifyStarted  = "started"
+	notifyProgress = "progress"
+)
+
+const (
+	notifyAttempts = 3
+	notifyBackoff  = time.Second
+	notifyTimeout  = 10 * time.Second
+)
+
+type notification struct {
+	Event     string    `json:"event"`
+	Command   string    `json:"command"`
+	Host      string    `json:"host"`
+	Timestamp time.Time `json:"timestamp"`
+	Text      string    `json:"text"`
+	// Percent is the progress of a progress notification
+	Percent *float64           `json:"percent,omitempty"`
+	Batch   *notificationBatch `json:"batch,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	Report  *runReport         `json:"report,omitempty"`
+}
+
+type notificationBatch struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+var notifier struct {
+	url    string
+	host   string
+	client *http.Client
+
+	mu sync.Mutex
+	// lastBatch is the last batch logged, lastStep the multiple of
+	// -notify-every-percent notified last
+	lastBatch *notificationBatch
+	lastStep  int
+	// inFlight are the progress notifications being posted
+	inFlight sync.WaitGroup
+}
+
+// startNotifier reads NOTIFY_WEBHOOK_URL, leaving notifications off when it is
+// empty.
+func startNotifier(env *config.Config) error {
+	if *notifyEveryPercent < 0 || *notifyEveryPercent > 100 {
+		return &errs.ValidationError{Field: "-notify-every-percent", Reason: "must be between 0 and 100"}
+	}
+	if env.NotifyWebhookUrl == "" {
+		return nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	notifier.url = env.NotifyWebhookUrl
+	notifier.host = host
+	notifier.client = &http.Client{Timeout: notifyTimeout}
+	return nil
+}
+
+// notifyStart notifies the start of the command.
+func notifyStart() {
+	notify(notification{Event: notifyStarted, Text: fmt.Sprintf("%s started on %s", *command, notifier.host)})
+}
+
+// notifyBatchProgress records the batch logged, notifying its progress when it
+// crosses another multiple of -notify-every-percent. The POST doesn't hold up
+// the batch.
+func notifyBatchProgress(batchStart, batchEnd int, percent float64) {
+	if notifier.url == "" {
+		return
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	notifier.lastBatch = &notificationBatch{Start: batchStart, End: batchEnd}
+	if *notifyEveryPercent <= 0 {
+		return
+	}
+	step := int(math.Floor(percent / *notifyEveryPercent))
+	if step <= notifier.lastStep {
+		return
+	}
+	notifier.lastStep = step
+	n := notification{
+		Event:   notifyProgress,
+		Text:    fmt.Sprintf("%s on %s is %.1f%% done", *command, notifier.host, percent),
+		Percent: &percent,
+		Batch:   notifier.lastBatch,
+	}
+	notifier.inFlight.Add(1)
+	go func() {
+		defer notifier.inFlight.Done()
+		notify(n)
+	}()
+}
+
+// notifyFinish notifies the end of the command with its report, ended by err
+// when it isn't nil.
+func notifyFinish(report runReport, err error) {
+	if notifier.url == "" {
+		return
+	}
+	// Progress notifications still being posted go first
+	notifier.inFlight.Wait()
+
+	n := notification{Event: report.Status, Report: &report}
+	if err == nil {
+		n.Text = fmt.Sprintf("%s %s on %s: %d rows updated in %s", *command, report.Status, notifier.host,
+			report.Rows.Updated, report.FinishedAt.Sub(report.StartedAt).Round(time.Second))
+		notify(n)
+		return
+	}
+
+	n.Error = err.Error()
+	var batchErr *batchError
+	if errors.As(err, &batchErr) {
+		n.Batch = &notificationBatch{Start: batchErr.start, End: batchErr.end}
+	} else {
+		notifier.mu.Lock()
+		n.Batch = notifier.lastBatch
+		notifier.mu.Unlock()
+	}
+	n.Text = fmt.Sprintf("%s %s on %s: %v", *command, report.Status, notifier.host, err)
+	if n.Batch != nil {
+		n.Text += fmt.Sprintf(" (batch %d-%d)", n.Batch.Start, n.Batch.End)
+	}
+	notify(n)
+}
+
+// notify posts n, logging the failure when no attempt is delivered.
+func notify(n notification) {
+	if notifier.url == "" {
+		return
+	}
+	n.Command = *command
+	n.Host = notifier.host
+	n.Timestamp = time.Now().UTC()
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Warning: failed to encode %s notification: %v", n.Event, err)
+		return
+	}
+
+	backoff := notifyBackoff
+	for attempt := 1; ; attempt++ {
+		err = postNotification(body)
+		if err == nil {
+			return
+		}
+		if attempt == notifyAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	log.Printf("Warning: %s notification not delivered after %d attempts: %v", n.Event, notifyAttempts, err)
+}
+
+func postNotification(body []byte) error {
+	resp, err := notifier.client.Post(notifier.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A minimal reader for Pact s-expressions. It only understands enough of the
+// syntax to find function calls in transaction code and inspect their arguments;
+// it does not evaluate anything.
+
+const maxPactNestingDepth = 256
+
+type pactValueKind int
+
+const (
+	pactString pactValueKind = iota
+	pactSymbol
+	pactAtom
+	pactExpr
+	pactList
+	pactObject
+)
+
+type pactValue struct {
+	Kind     pactValueKind
+	Text     string // decoded string, symbol name or raw atom
+	Children []pactValue
+}
+
+type pactCall struct {
+	Function string
+	Args     []pactValue
+}
+
+type pactReader struct {
+	src   []rune
+	pos   int
+	depth int
+}
+
+func parsePactCode(code string) ([]pactValue, error) {
+	r := &pactReader{src: []rune(code)}
+
+	var forms []pactValue
+	for {
+		r.skipSpaceAndComments()
+		if r.pos >= len(r.src) {
+			return forms, nil
+		}
+		value, err := r.readValue()
+		if err != nil {
+			return nil, err
+		}
+		forms = append(forms, value)
+	}
+}
+
+func (r *pactReader) skipSpaceAndComments() {
+	for r.pos < len(r.src) {
+		c := r.src[r.pos]
+		if unicode.IsSpace(c) {
+			r.pos++
+			continue
+		}
+		if c == ';' {
+			for r.pos < len(r.src) && r.src[r.pos] != '\n' {
+				r.pos++
+			}
+			continue
+		}
+		return
+	}
+}
+
+func (r *pactReader) readValue() (pactValue, error) {
+	c := r.src[r.pos]
+	switch c {
+	case '(':
+		return r.readSequence(pactExpr, ')')
+	case '[':
+		return r.readSequence(pactList, ']')
+	case '{':
+		return r.readSequence(pactObject, '}')
+	case ')', ']', '}':
+		return pactValue{}, fmt.Errorf("unexpected %q at offset %d", c, r.pos)
+	case '"':
+		return r.readString()
+	case '\'':
+		r.pos++
+		atom := r.readAtom()
+		return pactValue{Kind: pactSymbol, Text: atom}, nil
+	default:
+		return pactValue{Kind: pactAtom, Text: r.readAtom()}, nil
+	}
+}
+
+func (r *pactReader) readSequence(kind pactValueKind, closing rune) (pactValue, error) {
+	r.depth++
+	if r.depth > maxPactNestingDepth {
+		return pactValue{}, fmt.Errorf("nesting deeper than %d levels", maxPactNestingDepth)
+	}
+	defer func() { r.depth-- }()
+
+	start := r.pos
+	r.pos++ // opening delimiter
+
+	value := pactValue{Kind: kind}
+	for {
+		r.skipSpaceAndComments()
+		if r.pos >= len(r.src) {
+			return pactValue{}, fmt.Errorf("unterminated %q opened at offset %d", r.src[start], start)
+		}
+		if r.src[r.pos] == closing {
+			r.pos++
+			return value, nil
+		}
+		// Object keys and values are separated by ':' and pairs by ','
+		if kind == pactObject && (r.src[r.pos] == ':' || r.src[r.pos] == ',') {
+			r.pos++
+			continue
+		}
+		child, err := r.readValue()
+		if err != nil {
+			return pactValue{}, err
+		}
+		value.Children = append(value.Children, child)
+	}
+}
+
+func (r *pactReader) readString() (pactValue, error) {
+	start := r.pos
+	r.pos++ // opening quote
+
+	var sb strings.Builder
+	for r.pos < len(r.src) {
+		c := r.src[r.pos]
+		switch c {
+		case '"':
+			r.pos++
+			return pactValue{Kind: pactString, Text: sb.String()}, nil
+		case '\\':
+			r.pos++
+			if r.pos >= len(r.src) {
+				break
+			}
+			switch e := r.src[r.pos]; e {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			case 'r':
+				sb.WriteRune('\r')
+			case '\n':
+				// Line continuation: skip the newline and leading whitespace up to the closing backslash
+				r.pos++
+				for r.pos < len(r.src) && unicode.IsSpace(r.src[r.pos]) {
+					r.pos++
+				}
+				if r.pos < len(r.src) && r.src[r.pos] == '\\' {
+					r.pos++
+				}
+				continue
+			default:
+				sb.WriteRune(e)
+			}
+			r.pos++
+		default:
+			sb.WriteRune(c)
+			r.pos++
+		}
+	}
+
+	return pactValue{}, fmt.Errorf("unterminated string starting at offset %d", start)
+}
+
+func (r *pactReader) readAtom() string {
+	start := r.pos
+	for r.pos < len(r.src) {
+		c := r.src[r.pos]
+		if unicode.IsSpace(c) || strings.ContainsRune("()[]{}\",:;", c) {
+			break
+		}
+		r.pos++
+	}
+	return string(r.src[start:r.pos])
+}
+
+// findPactCalls returns every call, at any nesting level, whose function is one
+// of names, either bare or qualified with a module (and namespace) prefix.
+func findPactCalls(forms []pactValue, names []string) []pactCall {
+	var calls []pactCall
+
+	var walk func(values []pactValue)
+	walk = func(values []pactValue) {
+		for _, value := range values {
+			if value.Kind == pactExpr && len(value.Children) > 0 && value.Children[0].Kind == pactAtom {
+				head := value.Children[0].Text
+				for _, name := range names {
+					if head == name || strings.HasSuffix(head, "."+name) {
+						calls = append(calls, pactCall{Function: head, Args: value.Children[1:]})
+						break
+					}
+				}
+			}
+			walk(value.Children)
+		}
+	}
+	walk(forms)
+
+	return calls
+}
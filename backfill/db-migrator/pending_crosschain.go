@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// This script exports the cross-chain transfers that were started but never
+// finished, for support to reach out to their owners. A transfer is started by a
+// successful TRANSFER_XCHAIN event in the first step of a defpact and finished by
+// a successful continuation (step 1 or later) whose pactid is the request key of
+// the starting transaction.
+//
+// A missing finish only means something if the target chain is indexed: a
+// transfer is left out when its target chain has a gap in its canonical blocks
+// at or after the start height, or hasn't reached -pending-finality-depth blocks
+// past it, since the finish may simply not be indexed yet. How many transfers are
+// left out per target chain is logged.
+
+// pendingStartedAt is the unix time of transaction t, NULL when unparseable.
+const pendingStartedAt = `(CASE WHEN t.creationtime ~ '^[0-9]+$' THEN t.creationtime::bigint END)`
+
+type pendingCrossChain struct {
+	Account     string `json:"account"`
+	Amount      string `json:"amount"`
+	SourceChain int    `json:"sourceChain"`
+	TargetChain int    `json:"targetChain"`
+	AgeSeconds  int64  `json:"ageSeconds"`
+
+	height int
+}
+
+// targetChainCoverage is how much of a chain is indexed without gaps.
+type targetChainCoverage struct {
+	// ContiguousFrom is the lowest height from which every canonical block up to
+	// MaxHeight is indexed
+	ContiguousFrom int
+	MaxHeight      int
+}
+
+func exportPendingCrossChain() error {
+	if *pendingOutput == "" {
+		return &errs.ValidationError{Field: "-pending-output", Reason: "an output file is required"}
+	}
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(*pendingOutput)), ".")
+	if format != "csv" && format != "json" {
+		return &errs.ValidationError{Field: "-pending-output", Reason: fmt.Sprintf("%q must end in .csv or .json", *pendingOutput)}
+	}
+	chains, err := parseChainList(*pendingChains)
+	if err != nil {
+		return &errs.ValidationError{Field: "-pending-chains", Reason: err.Error()}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	candidates, err := loadPendingCrossChain(db, chains)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d unfinished cross-chain transfers older than %s", len(candidates), *pendingMinAge)
+
+	coverage := make(map[int]targetChainCoverage)
+	oldestByChain := make(map[int]int)
+	for _, transfer := range candidates {
+		if oldest, ok := oldestByChain[transfer.TargetChain]; !ok || transfer.height < oldest {
+			oldestByChain[transfer.TargetChain] = transfer.height
+		}
+	}
+	for chain, oldest := range oldestByChain {
+		chainCoverage, err := loadTargetChainCoverage(db, chain, oldest)
+		if err != nil {
+			return err
+		}
+		coverage[chain] = chainCoverage
+	}
+
+	var pending []pendingCrossChain
+	excluded := make(map[int]int)
+	for _, transfer := range candidates {
+		chainCoverage, ok := coverage[transfer.TargetChain]
+		if !ok || transfer.height < chainCoverage.ContiguousFrom ||
+			chainCoverage.MaxHeight < transfer.height+*pendingFinalityDepth {
+			excluded[transfer.TargetChain]++
+			continue
+		}
+		pending = append(pending, transfer)
+	}
+
+	targetChains := make([]int, 0, len(excluded))
+	for chain := range excluded {
+		targetChains = append(targetChains, chain)
+	}
+	sort.Ints(targetChains)
+	for _, chain := range targetChains {
+		log.Printf("Left out %d transfers to chain %d: it isn't indexed far enough without gaps to rule out an unindexed finish",
+			excluded[chain], chain)
+	}
+
+	if err := writePendingCrossChain(*pendingOutput, format, pending); err != nil {
+		return err
+	}
+
+	log.Printf("Completed processing. Total pending cross-chain transfers exported: %d (100.0%%)", len(pending))
+	log.Printf("Pending cross-chain transfers written to %s", *pendingOutput)
+	return nil
+}
+
+// parseChainList parses comma-separated chain ids; an empty list means every
+// chain.
+func parseChainList(value string) ([]int64, error) {
+	var chains []int64
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		chain, err := strconv.Atoi(part)
+		if err != nil || chain < 0 {
+			return nil, fmt.Errorf("invalid chain %q", part)
+		}
+		chains = append(chains, int64(chain))
+	}
+	return chains, nil
+}
+
+// loadPendingCrossChain returns the started, unfinished transfers older than
+// -min-age from the given source chains, all chains when empty, oldest first.
+func loadPendingCrossChain(db *sql.DB, chains []int64) ([]pendingCrossChain, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT DISTINCT ON (e.id) tr.from_acct, tr.amount::text, t."chainId", e.params->>3, b.height,
+			EXTRACT(EPOCH FROM NOW())::bigint - %[1]s
+		FROM "Events" e
+		JOIN "Transactions" t ON t.id = e."transactionId"
+		JOIN "Blocks" b ON b.id = t."blockId"
+		LEFT JOIN "TransactionDetails" td ON td."transactionId" = t.id
+		JOIN "Transfers" tr ON tr."transactionId" = t.id AND tr.to_acct = '' AND tr.from_acct = e.params->>0
+		WHERE e.name = 'TRANSFER_XCHAIN'
+			AND e.params->>3 ~ '^[0-9]+$'
+			AND b.canonical = true
+			AND t.result->>'status' = 'success'
+			AND COALESCE(td.step, 0) = 0
+			AND %[1]s <= EXTRACT(EPOCH FROM NOW())::bigint - $1
+			AND (cardinality($2::int[]) = 0 OR t."chainId" = ANY($2::int[]))
+			AND NOT EXISTS (
+				SELECT 1
+				FROM "TransactionDetails" ftd
+				JOIN "Transactions" ft ON ft.id = ftd."transactionId"
+				JOIN "Blocks" fb ON fb.id = ft."blockId"
+				WHERE ftd.pactid = t.requestkey AND ftd.step >= 1
+					AND ft.result->>'status' = 'success' AND fb.canonical = true
+			)
+		ORDER BY e.id, tr.id
+	`, pendingStartedAt), int64(pendingMinAge.Seconds()), pq.Array(chains))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending cross-chain transfers: %w", err)
+	}
+	defer rows.Close()
+
+	var transfers []pendingCrossChain
+	for rows.Next() {
+		var (
+			transfer    pendingCrossChain
+			targetChain string
+		)
+		if err := rows.Scan(&transfer.Account, &transfer.Amount, &transfer.SourceChain, &targetChain,
+			&transfer.height, &transfer.AgeSeconds); err != nil {
+			return nil, fmt.Errorf("failed to scan pending cross-chain transfer: %w", err)
+		}
+		transfer.TargetChain, err = strconv.Atoi(targetChain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target chain %q: %w", targetChain, err)
+		}
+		transfer.Amount = canonicalNumber(transfer.Amount)
+		transfers = append(transfers, transfer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pending cross-chain transfers: %w", err)
+	}
+
+	sort.SliceStable(transfers, func(i, j int) bool { return transfers[i].AgeSeconds > transfers[j].AgeSeconds })
+	return transfers, nil
+}
+
+// loadTargetChainCoverage finds the last gap in the canonical blocks of chain
+// above fromHeight, and the highest indexed height.
+func loadTargetChainCoverage(db *sql.DB, chain, fromHeight int) (targetChainCoverage, error) {
+	var (
+		coverage targetChainCoverage
+		lastGap  sql.NullInt64
+	)
+	err := db.QueryRow(`
+		SELECT COALESCE((SELECT MAX(height) FROM "Blocks" WHERE "chainId" = $1 AND canonical = true), -1),
+			(SELECT MAX(b.height)
+			FROM "Blocks" b
+			WHERE b."chainId" = $1 AND b.canonical = true AND b.height > $2
+				AND NOT EXISTS (
+					SELECT 1 FROM "Blocks" p
+					WHERE p."chainId" = b."chainId" AND p.height = b.height - 1 AND p.canonical = true
+				))
+	`, chain, fromHeight).Scan(&coverage.MaxHeight, &lastGap)
+	if err != nil {
+		return targetChainCoverage{}, fmt.Errorf("failed to check coverage of chain %d: %w", chain, err)
+	}
+
+	coverage.ContiguousFrom = fromHeight
+	if lastGap.Valid {
+		coverage.ContiguousFrom = int(lastGap.Int64)
+	}
+	return coverage, nil
+}
+
+func writePendingCrossChain(path, format string, transfers []pendingCrossChain) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if format == "json" {
+		if transfers == nil {
+			transfers = []pendingCrossChain{}
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(transfers); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		return file.Close()
+	}
+
+	writer := csv.NewWriter(file)
+	records := [][]string{{"account", "amount", "sourceChain", "targetChain", "ageSeconds"}}
+	for _, transfer := range transfers {
+		records = append(records, []string{
+			transfer.Account,
+			transfer.Amount,
+			strconv.Itoa(transfer.SourceChain),
+			strconv.Itoa(transfer.TargetChain),
+			strconv.FormatInt(transfer.AgeSeconds, 10),
+		})
+	}
+	if err := writer.WriteAll(records); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+func ExportPendingCrossChain(ctx context.Context, cfg *config.Config) error {
+	return exportPendingCrossChain()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// perfBaselineRuns is how many recent runs a baseline averages
+	perfBaselineRuns = 5
+	// etaBlendTime is the elapsed time at which the live rate and the baseline
+	// weigh the same
+	etaBlendTime = 2 * time.Minute
+)
+
+// Completed runs record their throughput, in ids of the processed range per
+// second, in PerfBaselines by command, table and batch size. Later runs start
+// their ETA from that baseline and shift to the rate they measure as they go, and
+// bench compares its measurements with it. Baselines older than -baseline-max-age
+// are ignored.
+
+type perfBaseline struct {
+	IdsPerSec float64
+	Runs      int
+}
+
+func createPerfBaselinesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "PerfBaselines" (
+			id SERIAL PRIMARY KEY,
+			command TEXT NOT NULL,
+			"tableName" TEXT NOT NULL,
+			"batchSize" INTEGER NOT NULL,
+			"idsPerSec" DOUBLE PRECISION NOT NULL,
+			ids BIGINT NOT NULL,
+			"durationMs" BIGINT NOT NULL,
+			source TEXT NOT NULL,
+			"recordedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create PerfBaselines table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS perfbaselines_lookup_idx ON "PerfBaselines" (command, "tableName", "batchSize", "recordedAt")`)
+	if err != nil {
+		return fmt.Errorf("failed to create PerfBaselines lookup index: %w", err)
+	}
+	return nil
+}
+
+// recordPerfBaseline stores the throughput of a run over ids ids. Runs too short
+// to measure are not recorded.
+func recordPerfBaseline(db *sql.DB, command, table string, batchSize, ids int, duration time.Duration, source string) error {
+	if ids <= 0 || duration < time.Second {
+		return nil
+	}
+	_, err := db.Exec(`
+		INSERT INTO "PerfBaselines" (command, "tableName", "batchSize", "idsPerSec", ids, "durationMs", source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, command, table, batchSize, float64(ids)/duration.Seconds(), ids, duration.Milliseconds(), source)
+	if err != nil {
+		return fmt.Errorf("failed to record throughput baseline: %w", err)
+	}
+	return nil
+}
+
+// loadPerfBaseline averages the most recent baselines younger than
+// -baseline-max-age, and reports whether there were any.
+func loadPerfBaseline(db *sql.DB, command, table string, batchSize int) (perfBaseline, bool, error) {
+	var (
+		baseline perfBaseline
+		rate     sql.NullFloat64
+	)
+	err := db.QueryRow(`
+		SELECT AVG("idsPerSec"), COUNT(*)
+		FROM (
+			SELECT "idsPerSec"
+			FROM "PerfBaselines"
+			WHERE command = $1 AND "tableName" = $2 AND "batchSize" = $3
+				AND "recordedAt" >= NOW() - make_interval(secs => $4)
+			ORDER BY "recordedAt" DESC
+			LIMIT $5
+		) recent
+	`, command, table, batchSize, baselineMaxAge.Seconds(), perfBaselineRuns).Scan(&rate, &baseline.Runs)
+	if err != nil {
+		return perfBaseline{}, false, fmt.Errorf("failed to load throughput baseline: %w", err)
+	}
+	if !rate.Valid || baseline.Runs == 0 {
+		return perfBaseline{}, false, nil
+	}
+	baseline.IdsPerSec = rate.Float64
+	return baseline, true, nil
+}
+
+// etaEstimator estimates the remaining time of a run from a blend of the rate
+// measured so far and the historical baseline. The live rate weighs
+// elapsed / (elapsed + etaBlendTime), so the baseline dominates the first minutes
+// and fades out as the measurement gets reliable.
+type etaEstimator struct {
+	baseline    perfBaseline
+	hasBaseline bool
+	started     time.Time
+	total       int
+}
+
+func newEtaEstimator(baseline perfBaseline, hasBaseline bool, total int) *etaEstimator {
+	return &etaEstimator{baseline: baseline, hasBaseline: hasBaseline, started: time.Now(), total: total}
+}
+
+// estimate returns the remaining time, the blended rate and which source
+// dominates it, given done ids after elapsed.
+func (e *etaEstimator) estimate(done int, elapsed time.Duration) (time.Duration, float64, string) {
+	liveRate := 0.0
+	if elapsed > 0 {
+		liveRate = float64(done) / elapsed.Seconds()
+	}
+
+	rate, source := liveRate, "live"
+	if e.hasBaseline {
+		liveWeight := elapsed.Seconds() / (elapsed.Seconds() + etaBlendTime.Seconds())
+		if done == 0 {
+			liveWeight = 0
+		}
+		rate = liveWeight*liveRate + (1-liveWeight)*e.baseline.IdsPerSec
+		if liveWeight < 0.5 {
+			source = "baseline"
+		}
+	}
+
+	remaining := e.total - done
+	if rate <= 0 || remaining <= 0 {
+		return 0, rate, source
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), rate, source
+}
+
+// describe formats the estimate after done ids for a progress line.
+func (e *etaEstimator) describe(done int) string {
+	eta, rate, source := e.estimate(done, time.Since(e.started))
+	if rate <= 0 {
+		return "ETA: unknown"
+	}
+	return fmt.Sprintf("ETA: %s (%.0f ids/s, mostly %s)", eta.Round(time.Second), rate, source)
+}
+
+// startEta loads the baseline of a run and logs what the first estimate rests on.
+// Failing to read baselines only costs the estimate, so it is logged, not returned.
+func startEta(db *sql.DB, command, table string, batchSize, total int) *etaEstimator {
+	if err := createPerfBaselinesTable(db); err != nil {
+		log.Printf("Warning: %v; estimating from the live rate only", err)
+		return newEtaEstimator(perfBaseline{}, false, total)
+	}
+	baseline, hasBaseline, err := loadPerfBaseline(db, command, table, batchSize)
+	if err != nil {
+		log.Printf("Warning: %v; estimating from the live rate only", err)
+	}
+	if hasBaseline {
+		eta := time.Duration(float64(total) / baseline.IdsPerSec * float64(time.Second))
+		log.Printf("Throughput baseline: %.0f ids/s over the last %d run(s), estimated duration %s",
+			baseline.IdsPerSec, baseline.Runs, eta.Round(time.Second))
+	} else {
+		log.Println("No recent throughput baseline, estimating from the live rate only")
+	}
+	return newEtaEstimator(baseline, hasBaseline, total)
+}
+
+// finishEta records the throughput of a completed run as a baseline.
+func finishEta(db *sql.DB, e *etaEstimator, command, table string, batchSize int) {
+	if err := recordPerfBaseline(db, command, table, batchSize, e.total, time.Since(e.started), "run"); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEtaEstimate(t *testing.T) {
+	tests := []struct {
+		name        string
+		baseline    perfBaseline
+		hasBaseline bool
+		total       int
+		done        int
+		elapsed     time.Duration
+		wantRate    float64
+		wantEta     time.Duration
+		wantSource  string
+	}{
+		{name: "no baseline", total: 1000, done: 100, elapsed: 10 * time.Second, wantRate: 10, wantEta: 90 * time.Second, wantSource: "live"},
+		{name: "no baseline and no progress", total: 1000, wantSource: "live"},
+		{
+			name:        "one sample before any progress",
+			baseline:    perfBaseline{IdsPerSec: 50, Runs: 1},
+			hasBaseline: true,
+			total:       1000,
+			wantRate:    50,
+			wantEta:     20 * time.Second,
+			wantSource:  "baseline",
+		},
+		{
+			name:        "baseline weighs three quarters early on",
+			baseline:    perfBaseline{IdsPerSec: 50, Runs: 5},
+			hasBaseline: true,
+			total:       2000,
+			done:        400,
+			elapsed:     40 * time.Second,
+			wantRate:    40,
+			wantEta:     40 * time.Second,
+			wantSource:  "baseline",
+		},
+		{
+			name:        "even blend at the blend time",
+			baseline:    perfBaseline{IdsPerSec: 50, Runs: 5},
+			hasBaseline: true,
+			total:       3000,
+			done:        1200,
+			elapsed:     etaBlendTime,
+			wantRate:    30,
+			wantEta:     time.Minute,
+			wantSource:  "live",
+		},
+		{
+			name:        "live rate weighs three quarters later on",
+			baseline:    perfBaseline{IdsPerSec: 50, Runs: 5},
+			hasBaseline: true,
+			total:       4000,
+			done:        3600,
+			elapsed:     6 * time.Minute,
+			wantRate:    20,
+			wantEta:     20 * time.Second,
+			wantSource:  "live",
+		},
+		{
+			name:        "nothing remaining",
+			baseline:    perfBaseline{IdsPerSec: 50, Runs: 1},
+			hasBaseline: true,
+			total:       1200,
+			done:        1200,
+			elapsed:     etaBlendTime,
+			wantRate:    30,
+			wantSource:  "live",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEtaEstimator(tt.baseline, tt.hasBaseline, tt.total)
+			eta, rate, source := e.estimate(tt.done, tt.elapsed)
+			if math.Abs(rate-tt.wantRate) > 1e-9 {
+				t.Errorf("estimate(%d, %s) rate = %v, want %v", tt.done, tt.elapsed, rate, tt.wantRate)
+			}
+			if eta.Round(time.Millisecond) != tt.wantEta {
+				t.Errorf("estimate(%d, %s) = %s, want %s", tt.done, tt.elapsed, eta, tt.wantEta)
+			}
+			if source != tt.wantSource {
+				t.Errorf("estimate(%d, %s) source = %q, want %q", tt.done, tt.elapsed, source, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestEtaDescribe(t *testing.T) {
+	tests := []struct {
+		name        string
+		baseline    perfBaseline
+		hasBaseline bool
+		done        int
+		elapsed     time.Duration
+		want        string
+	}{
+		{name: "no rate yet", want: "ETA: unknown"},
+		{name: "baseline before any progress", baseline: perfBaseline{IdsPerSec: 50, Runs: 1}, hasBaseline: true, want: "ETA: 20s (50 ids/s, mostly baseline)"},
+		{name: "live rate later on", baseline: perfBaseline{IdsPerSec: 50, Runs: 1}, hasBaseline: true, done: 900, elapsed: 10 * time.Minute, want: "mostly live)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEtaEstimator(tt.baseline, tt.hasBaseline, 1000)
+			e.started = time.Now().Add(-tt.elapsed)
+			if got := e.describe(tt.done); !strings.Contains(got, tt.want) {
+				t.Errorf("describe(%d) = %q, want %q", tt.done, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartEtaWithoutBaselines(t *testing.T) {
+	logged := captureLog(t)
+	// The mock driver can't create the PerfBaselines table
+	db, err := sql.Open("standby-mock", "false off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	e := startEta(db, "code-to-text", "Transactions", 1000, 500)
+	if e.hasBaseline || e.total != 500 {
+		t.Errorf("startEta() = baseline %v, total %d, want no baseline and 500", e.hasBaseline, e.total)
+	}
+	if !strings.Contains(logged.String(), "estimating from the live rate only") {
+		t.Errorf("startEta() logged %q, want the live-rate warning", logged)
+	}
+}
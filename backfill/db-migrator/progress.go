@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// percentOf returns done as a percentage of total. An empty total counts as fully
+// processed, so progress never divides by zero.
+func percentOf(done, total int) float64 {
+	if total <= 0 {
+		return 100.0
+	}
+	return (float64(done) / float64(total)) * 100.0
+}
+
+// logNothingToDo reports a command whose range holds no rows to process.
+func logNothingToDo(what string, startId, endId int) {
+	if endId < startId {
+		log.Printf("Nothing to do for %s: empty range (start %d is past end %d)", what, startId, endId)
+		return
+	}
+	log.Printf("Nothing to do for %s range %d-%d: no rows found", what, startId, endId)
+}
+
+// hasRowsInRange reports whether table has any row whose id lies in [startId, endId].
+func hasRowsInRange(db *sql.DB, table string, startId, endId int) (bool, error) {
+	if endId < startId {
+		return false, nil
+	}
+
+	var exists bool
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM "%s" WHERE id >= $1 AND id <= $2)`, table)
+	if err := db.QueryRow(query, startId, endId).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check for rows in %s: %w", table, err)
+	}
+	return exists, nil
+}
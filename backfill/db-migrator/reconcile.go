@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go-backfill/batcher"
 	"go-backfill/config"
-	"io"
+	"go-backfill/errs"
+	"go-backfill/safejson"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
 
@@ -96,14 +105,134 @@ type TransactionPart1 struct {
 	TxId         int             `json:"txId"`
 }
 
-func InsertReconcileEvents() {
-	env := config.GetConfig()
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		env.DbHost, env.DbPort, env.DbUser, env.DbPassword, env.DbName)
+// reconcileScope is the blocks reconcile scans: those of -chains within the
+// -from-height/-to-height or -from-date/-to-date window, every block by default.
+// Days are UTC, and both ends of a window are included.
+type reconcileScope struct {
+	// condition selects the blocks, as b
+	condition   string
+	description string
+	// bounded is set when the scope leaves blocks out
+	bounded bool
+}
+
+func parseReconcileScope() (reconcileScope, error) {
+	byHeight := *reconcileFromHeight != 0 || *reconcileToHeight != -1
+	byDate := *reconcileFromDate != "" || *reconcileToDate != ""
+	if byHeight && byDate {
+		return reconcileScope{}, &errs.ValidationError{Field: "-from-date", Reason: "can't be combined with -from-height or -to-height"}
+	}
+
+	conditions := []string{chains.condition(`b."chainId"`)}
+	window := ""
+	switch {
+	case byHeight:
+		if *reconcileFromHeight < 0 {
+			return reconcileScope{}, &errs.ValidationError{Field: "-from-height", Reason: fmt.Sprintf("%d must not be negative", *reconcileFromHeight)}
+		}
+		if *reconcileToHeight != -1 && *reconcileToHeight < *reconcileFromHeight {
+			return reconcileScope{}, &errs.ValidationError{Field: "-to-height", Reason: fmt.Sprintf("%d is below -from-height %d", *reconcileToHeight, *reconcileFromHeight)}
+		}
+		conditions = append(conditions, fmt.Sprintf("b.height >= %d", *reconcileFromHeight))
+		window = fmt.Sprintf("heights from %d", *reconcileFromHeight)
+		if *reconcileToHeight != -1 {
+			conditions = append(conditions, fmt.Sprintf("b.height <= %d", *reconcileToHeight))
+			window += " to " + strconv.Itoa(*reconcileToHeight)
+		}
+	case byDate:
+		var from, to time.Time
+		window = "days"
+		if *reconcileFromDate != "" {
+			day, err := time.Parse("2006-01-02", *reconcileFromDate)
+			if err != nil {
+				return reconcileScope{}, &errs.ValidationError{Field: "-from-date", Reason: fmt.Sprintf("%q is not a YYYY-MM-DD day", *reconcileFromDate)}
+			}
+			from = day
+			window += " from " + *reconcileFromDate
+			// creationTime is in microseconds
+			conditions = append(conditions, fmt.Sprintf(`b."creationTime" >= %d`, from.UnixMicro()))
+		}
+		if *reconcileToDate != "" {
+			day, err := time.Parse("2006-01-02", *reconcileToDate)
+			if err != nil {
+				return reconcileScope{}, &errs.ValidationError{Field: "-to-date", Reason: fmt.Sprintf("%q is not a YYYY-MM-DD day", *reconcileToDate)}
+			}
+			to = day
+			window += " to " + *reconcileToDate
+			if !from.IsZero() && to.Before(from) {
+				return reconcileScope{}, &errs.ValidationError{Field: "-to-date", Reason: fmt.Sprintf("%s is before -from-date %s", *reconcileToDate, *reconcileFromDate)}
+			}
+			conditions = append(conditions, fmt.Sprintf(`b."creationTime" < %d`, to.AddDate(0, 0, 1).UnixMicro()))
+		}
+	}
+
+	scope := reconcileScope{condition: strings.Join(conditions, " AND "), description: chains.describe(), bounded: chains.active() || window != ""}
+	if window != "" {
+		scope.description += ", " + window
+	}
+	return scope, nil
+}
+
+// blockRange returns the ids of the first and last blocks of the scope up to
+// upperBlockId, 0 and 0 when it has none.
+func (s reconcileScope) blockRange(db *sql.DB, upperBlockId int) (int, int, error) {
+	var firstId, lastId sql.NullInt64
+	err := db.QueryRow(fmt.Sprintf(`SELECT MIN(b.id), MAX(b.id) FROM "Blocks" b WHERE b.id <= $1 AND %s`, s.condition), upperBlockId).
+		Scan(&firstId, &lastId)
+	if err != nil {
+		return 0, 0, errs.FromDB(fmt.Sprintf("failed to find the blocks of %s", s.description), err)
+	}
+	return int(firstId.Int64), int(lastId.Int64), nil
+}
+
+// countBlocks counts the blocks of the scope with ids in [startId, endId].
+func (s reconcileScope) countBlocks(db *sql.DB, startId, endId int) (int, error) {
+	var count int
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM "Blocks" b WHERE b.id >= $1 AND b.id <= $2 AND %s`, s.condition)
+	if err := db.QueryRow(query, startId, endId).Scan(&count); err != nil {
+		return 0, errs.FromDB(fmt.Sprintf("failed to count the blocks of %s", s.description), err)
+	}
+	return count, nil
+}
+
+// insertReconcileEvents runs reconcile on db until it is done or ctx is
+// canceled. Without -node-url, block payloads are fetched from the chainweb API
+// at apiURL, and the batches run on a pool of their own, connected to connStr.
+func insertReconcileEvents(ctx context.Context, db *sql.DB, connStr, apiURL string) error {
+	scope, err := parseReconcileScope()
+	if err != nil {
+		return err
+	}
+	if *reconcileReportOnly && *reconcileNodeURL == "" {
+		return &errs.ValidationError{Field: "-report-only", Reason: "only applies with -node-url"}
+	}
+	if *reconcileNodeJobs <= 0 {
+		return &errs.ValidationError{Field: "-node-concurrency", Reason: fmt.Sprintf("%d must be greater than 0", *reconcileNodeJobs)}
+	}
+
+	if *reconcileNodeURL != "" {
+		if err := reconcileFromNode(ctx, db, scope); err != nil {
+			return fmt.Errorf("failed to reconcile events with the node: %w", err)
+		}
+		log.Println("Finished reconciling events with the node")
+		return nil
+	}
+
+	// Process reconcile events in batches
+	if err := processReconcileEvents(ctx, db, connStr, scope, apiURL); err != nil {
+		return fmt.Errorf("failed to process reconcile events: %w", err)
+	}
+
+	log.Println("Finished processing reconcile events")
+	return nil
+}
+
+func InsertReconcileEvents(ctx context.Context, cfg *config.Config) error {
+	connStr := cfg.DSN()
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 	defer db.Close()
 
@@ -111,147 +240,264 @@ func InsertReconcileEvents() {
 
 	// Test database connection
 	if err := db.Ping(); err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+		return fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Process reconcile events in batches
-	if err := processReconcileEvents(db); err != nil {
-		log.Fatalf("Failed to process reconcile events: %v", err)
-	}
-
-	log.Println("Finished processing reconcile events")
+	return insertReconcileEvents(ctx, db, connStr, baseAPIURL)
 }
 
-func processReconcileEvents(db *sql.DB) error {
-	var lastBlockId int
+func processReconcileEvents(ctx context.Context, db *sql.DB, connStr string, scope reconcileScope, apiURL string) error {
+	lastBlockId := 0
 	totalProcessed := 0
+	totalTransfers := 0
+	// Transfers a previous run over the same blocks already inserted
+	totalPresent := 0
+	started := time.Now()
 
 	// log.Printf("Starting reconcile events processing from block ID 1 to %d", maxBlockId)
 
-	httpClient := &http.Client{
-		Timeout: 30 * time.Second,
+	// Block ids are unbounded unless capped below the live watermark
+	upperBlockId, err := capToLiveWatermark(db, "Blocks", math.MaxInt32, false)
+	if err != nil {
+		return err
 	}
 
-	for {
-		results, maxBlockIdFromBatch, err := fetchReconcileEventsBatch(db, lastBlockId, batchSize)
+	// A bounded scope is scanned between the ids of its first and last blocks,
+	// and progress counts its blocks instead of the ids spanned
+	var totalBlocks, blocksProcessed int
+	if scope.bounded {
+		firstId, lastId, err := scope.blockRange(db, upperBlockId)
 		if err != nil {
-			return fmt.Errorf("failed to fetch batch: %v", err)
+			return err
 		}
-
-		// If no results, we're done
-		if len(results) == 0 {
-			// log.Printf("No more records to process. Total processed: %d (100.0%%)", totalProcessed)
-			break
+		if firstId == 0 {
+			log.Printf("Nothing to do: no blocks of %s", scope.description)
+			log.Println("Completed processing. Total reconcile events processed: 0 (100.0%)")
+			return nil
+		}
+		lastBlockId, upperBlockId = firstId-1, lastId
+		if totalBlocks, err = scope.countBlocks(db, firstId, lastId); err != nil {
+			return err
 		}
+		log.Printf("Processing the reconcile events of %s: %d blocks, ids %d-%d", scope.description, totalBlocks, firstId, lastId)
+	}
+
+	// The batch transaction holds one connection, and paging the next batch
+	// takes one more
+	pool, err := openBatchPool(connStr, 2)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
 
-		// Calculate progress percentage
-		progress := float64(lastBlockId) / float64(maxBlockId) * 100.0
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+	}
 
-		// Process the batch
-		log.Printf("Processing batch of %d records (block ID: %d, progress: %.1f%%)", len(results), lastBlockId, progress)
+	var report *dryRunReport
+	if *dryRun {
+		report = newDryRunReport("transfers")
+	}
 
-		// Fetch payload data and extract request keys for each result
-		var allTransfers []TransferData
-		for _, result := range results {
-			transfers, err := processPayloadAndExtractRequestKeys(httpClient, db, result.PayloadHash, result.ChainId, result.BlockId)
+	var (
+		skipped = make(skipCounts)
+		// What the last attempt at the batch in flight did; a retry fetches its
+		// payloads again
+		attempt struct {
+			skipped   skipCounts
+			transfers int
+			// inserting is set once the transfers are sent, so that only a failing
+			// insert is logged and skipped and any other failure aborts the run
+			inserting bool
+		}
+	)
+	runner := &batcher.Runner{
+		Pool:  pool,
+		Start: lastBlockId + 1,
+		End:   upperBlockId,
+		Size:  batchSize,
+		// The blocks of the scope with a RECONCILE event
+		Table: "Blocks",
+		Pending: `EXISTS (
+			SELECT 1
+			FROM "Blocks" b
+			JOIN "Transactions" t ON t."blockId" = b.id
+			JOIN "Events" e ON e."transactionId" = t.id
+			WHERE b.id = "Blocks".id AND ` + scope.condition + `
+			AND e.name = 'RECONCILE'
+			AND (e.module = 'marmalade.ledger' OR e.module = 'marmalade-v2.ledger')
+		)`,
+		Rollback: *dryRun,
+		Attempts: *batchAttempts,
+		OnRetry: func(w batcher.Window, attempt int, backoff time.Duration, err error) {
+			logBatchRetry(w.String(), attempt, backoff, err)
+		},
+		Batch: func(ctx context.Context, tx *batcher.Tx, startId, endId int) (int, error) {
+			attempt.skipped, attempt.transfers, attempt.inserting = make(skipCounts), 0, false
+			ids := batcher.IDs(ctx)
+			results, err := fetchReconcileBlocks(ctx, pool, ids)
 			if err != nil {
-				log.Printf("Error processing payload %s on chain %d: %v", result.PayloadHash, result.ChainId, err)
-				continue
+				return 0, err
 			}
-			allTransfers = append(allTransfers, transfers...)
-		}
 
-		// Insert all transfers in a single database transaction
-		if len(allTransfers) > 0 {
-			err := insertTransfers(db, allTransfers)
-			if err != nil {
-				log.Printf("Error inserting transfers: %v", err)
-			} else {
-				log.Printf("Successfully inserted %d transfers", len(allTransfers))
+			// Calculate progress percentage
+			progress := percentOf(lastBlockId, maxBlockId)
+			if scope.bounded {
+				progress = percentOf(blocksProcessed, totalBlocks)
+			}
+
+			// Process the batch
+			logProgress(fmt.Sprintf("Processing batch of %d records (block ID: %d, progress: %.1f%%)", len(results), lastBlockId, progress),
+				startId, ids[len(ids)-1], int64(totalTransfers), progress, perSecond(int64(totalTransfers), started))
+
+			// Fetch payload data and extract request keys for each result, before
+			// the transaction begins
+			var allTransfers []TransferData
+			for _, result := range results {
+				transfers, err := processPayloadAndExtractRequestKeys(httpClient, db, apiURL, result.PayloadHash, result.ChainId, result.BlockId, attempt.skipped)
+				if err != nil {
+					logEvent(slog.LevelWarn, fmt.Sprintf("Error processing payload %s on chain %d: %v", result.PayloadHash, result.ChainId, err),
+						"payload_hash", result.PayloadHash, "chain_id", result.ChainId, "error", err.Error())
+					attempt.skipped.add(skipReasonOf(err), 1)
+					continue
+				}
+				allTransfers = append(allTransfers, transfers...)
+			}
+			if len(allTransfers) == 0 {
+				return 0, nil
 			}
-		}
 
-		totalProcessed += len(results)
-		lastBlockId = maxBlockIdFromBatch
+			// Insert all transfers in the batch transaction
+			attempt.transfers, attempt.inserting = len(allTransfers), true
+			return queueTransferInserts(ctx, tx, allTransfers)
+		},
+		Done: func(w batcher.Window, inserted int, elapsed time.Duration, err error) error {
+			if err != nil && !attempt.inserting {
+				return fmt.Errorf("failed to fetch batch: %w", err)
+			}
+			// Counted in the metrics as they were skipped
+			for reason, n := range attempt.skipped {
+				skipped[reason] += n
+			}
 
-		// If we got less than batchSize, we're likely done
-		if len(results) < batchSize {
-			// finalProgress := float64(lastBlockId) / float64(maxBlockId) * 100.0
-			// log.Printf("Last batch processed. Total processed: %d (%.1f%%)", totalProcessed, finalProgress)
-			break
+			label := fmt.Sprintf("from block %d", w.Start)
+			endId := w.IDs[len(w.IDs)-1]
+			if attempt.transfers > 0 {
+				switch {
+				case err != nil && report != nil:
+					report.abort(label, err)
+				case report != nil:
+					report.batch(label, inserted)
+				case err != nil:
+					logEvent(slog.LevelError, fmt.Sprintf("Error inserting transfers: %v", err),
+						append(errorAttrs(&batchError{start: w.Start, end: endId, err: err}), "error", err.Error())...)
+				default:
+					totalTransfers += inserted
+					totalPresent += attempt.transfers - inserted
+					metrics.batchCommitted(inserted, elapsed)
+					log.Printf("Successfully inserted %d transfers, %d already present", inserted, attempt.transfers-inserted)
+				}
+			}
+
+			totalProcessed += len(w.IDs)
+			metrics.examined(len(w.IDs))
+			if scope.bounded {
+				inBatch, err := scope.countBlocks(db, w.Start, endId)
+				if err != nil {
+					return err
+				}
+				blocksProcessed += inBatch
+			}
+			lastBlockId = endId
+			metrics.setCursor(lastBlockId)
+			return nil
+		},
+	}
+	if err := runner.Run(ctx); err != nil {
+		var stopped *batcher.Stopped
+		if errors.As(err, &stopped) {
+			log.Printf("Stopped: last completed batch ended at block id %d", stopped.Remaining.Start-1)
+			return &errs.Interrupted{Done: fmt.Sprintf("blocks above id %d remain", stopped.Remaining.Start-1)}
 		}
+		return err
+	}
+	if totalProcessed == 0 {
+		logNothingToDo("Blocks", runner.Start, upperBlockId)
 	}
 
+	log.Printf("Completed processing. Total reconcile events processed: %d (100.0%%)", totalProcessed)
+	if report == nil {
+		log.Printf("Transfers inserted: %d, already present and skipped: %d", totalTransfers, totalPresent)
+	}
+	logSkipSummary("payloads and transactions", skipped)
+	if report != nil {
+		return report.finish()
+	}
 	return nil
 }
 
-func fetchReconcileEventsBatch(db *sql.DB, lastBlockId int, limit int) ([]ReconcileResult, int, error) {
-	query := `
-		SELECT DISTINCT b."payloadHash", b."chainId", b.id
-		FROM "Events" e
-		JOIN public."Transactions" t ON t.id = e."transactionId"
-		JOIN "Blocks" b ON t."blockId" = b.id
-		WHERE e.name = 'RECONCILE' 
-		AND (e.module = 'marmalade.ledger' OR e.module = 'marmalade-v2.ledger')
-		AND b.id > $1
+// fetchReconcileBlocks loads the payload hash and chain of the blocks ids.
+func fetchReconcileBlocks(ctx context.Context, pool *pgxpool.Pool, ids []int) ([]ReconcileResult, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT b."payloadHash", b."chainId", b.id
+		FROM "Blocks" b
+		WHERE b.id = ANY($1::int[])
 		ORDER BY b.id
-		LIMIT $2
-	`
-
-	rows, err := db.Query(query, lastBlockId, limit)
+	`, ids)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to execute query: %v", err)
+		return nil, errs.FromDB("failed to execute query", err)
 	}
 	defer rows.Close()
 
 	var results []ReconcileResult
-	var maxBlockId int
-
 	for rows.Next() {
 		var result ReconcileResult
 
 		if err := rows.Scan(&result.PayloadHash, &result.ChainId, &result.BlockId); err != nil {
-			return nil, 0, fmt.Errorf("failed to scan row: %v", err)
+			return nil, errs.FromDB("failed to scan row", err)
 		}
 
 		results = append(results, result)
-		if result.BlockId > maxBlockId {
-			maxBlockId = result.BlockId
-		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, 0, fmt.Errorf("error iterating rows: %v", err)
+		return nil, errs.FromDB("error iterating rows", err)
 	}
 
-	return results, maxBlockId, nil
+	return results, nil
 }
 
-func processPayloadAndExtractRequestKeys(client *http.Client, db *sql.DB, payloadHash string, chainId int, blockId int) ([]TransferData, error) {
+func processPayloadAndExtractRequestKeys(client *http.Client, db *sql.DB, apiURL, payloadHash string, chainId int, blockId int, skipped skipCounts) ([]TransferData, error) {
 	// Use the payload endpoint to get transaction arrays
-	url := fmt.Sprintf("%s/chain/%d/payload/%s/outputs", baseAPIURL, chainId, payloadHash)
+	url := fmt.Sprintf("%s/chain/%d/payload/%s/outputs", apiURL, chainId, payloadHash)
 
 	// Make HTTP request
 	resp, err := client.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make HTTP request: %v", err)
+		return nil, &errs.NodeError{Endpoint: url, Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status code %d", resp.StatusCode)
+		return nil, &errs.NodeError{StatusCode: resp.StatusCode, Endpoint: url}
 	}
 
 	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	body, err := safejson.ReadAll(resp.Body, jsonLimits())
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		if limit, ok := jsonLimitBreached(err); ok {
+			return nil, &errs.LimitExceeded{Limit: limit, Err: err}
+		}
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	// Parse as the correct Payload structure
 	var apiResponse PayloadAPIResponse
-	if err := json.Unmarshal(body, &apiResponse); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON response: %v", err)
+	if err := safejson.Unmarshal(body, &apiResponse, jsonLimits()); err != nil {
+		if limit, ok := jsonLimitBreached(err); ok {
+			return nil, &errs.LimitExceeded{Limit: limit, Err: err}
+		}
+		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
 	}
 
 	var transfers []TransferData
@@ -267,46 +513,13 @@ func processPayloadAndExtractRequestKeys(client *http.Client, db *sql.DB, payloa
 		reqKey, events, err := extractRequestKeyAndEventsFromTransactionPart(transactionParts[1])
 		if err != nil {
 			log.Printf("Error extracting data from transaction %d: %v", i, err)
+			skipped.add(skipReasonOf(err), 1)
 			continue
 		}
 
 		// Filter and collect RECONCILE events
 		for orderIndex, event := range events {
 			if event.Name == "RECONCILE" && (*event.Module.Namespace == "marmalade-v2" || *event.Module.Namespace == "marmalade") {
-				// Handle module name with namespace if present
-				moduleName := event.Module.Name
-				if event.Module.Namespace != nil {
-					moduleName = *event.Module.Namespace + "." + event.Module.Name
-				}
-
-				// Extract additional properties from params
-				var amount, tokenId, fromAcct, toAcct string
-				if len(event.Params) >= 4 {
-					// tokenId: params[0]
-					if tokenIdVal, ok := event.Params[0].(string); ok {
-						tokenId = tokenIdVal
-					}
-
-					// amount: params[1]
-					if amountVal := event.Params[1]; amountVal != nil {
-						amount = fmt.Sprintf("%v", amountVal)
-					}
-
-					// from_acct: params[2].account
-					if params2, ok := event.Params[2].(map[string]interface{}); ok {
-						if accountVal, ok := params2["account"].(string); ok {
-							fromAcct = accountVal
-						}
-					}
-
-					// to_acct: params[3].account
-					if params3, ok := event.Params[3].(map[string]interface{}); ok {
-						if accountVal, ok := params3["account"].(string); ok {
-							toAcct = accountVal
-						}
-					}
-				}
-
 				// Get transaction ID from database using reqKey and the specific blockId we're processing
 				transactionId, err := getTransactionId(db, reqKey, blockId)
 				if err != nil {
@@ -314,22 +527,7 @@ func processPayloadAndExtractRequestKeys(client *http.Client, db *sql.DB, payloa
 					continue
 				}
 
-				// Create transfer data
-				transfer := TransferData{
-					TransactionId: transactionId,
-					Type:          "poly-fungible",
-					Amount:        amount,
-					ChainId:       chainId,
-					FromAcct:      fromAcct,
-					ModuleHash:    event.ModuleHash,
-					ModuleName:    moduleName,
-					RequestKey:    reqKey,
-					ToAcct:        toAcct,
-					HasTokenId:    true,
-					TokenId:       tokenId,
-					OrderIndex:    orderIndex,
-				}
-
+				transfer := reconcileTransfer(event, transactionId, chainId, reqKey, orderIndex)
 				transfers = append(transfers, transfer)
 			}
 		}
@@ -338,17 +536,70 @@ func processPayloadAndExtractRequestKeys(client *http.Client, db *sql.DB, payloa
 	return transfers, nil
 }
 
+// reconcileTransfer is the poly-fungible transfer of a RECONCILE event, the
+// orderIndex-th event of its transaction.
+func reconcileTransfer(event Event, transactionId, chainId int, reqKey string, orderIndex int) TransferData {
+	// Handle module name with namespace if present
+	moduleName := event.Module.Name
+	if event.Module.Namespace != nil {
+		moduleName = *event.Module.Namespace + "." + event.Module.Name
+	}
+
+	// Extract additional properties from params
+	var amount, tokenId, fromAcct, toAcct string
+	if len(event.Params) >= 4 {
+		// tokenId: params[0]
+		if tokenIdVal, ok := event.Params[0].(string); ok {
+			tokenId = tokenIdVal
+		}
+
+		// amount: params[1]
+		if amountVal := event.Params[1]; amountVal != nil {
+			amount = fmt.Sprintf("%v", amountVal)
+		}
+
+		// from_acct: params[2].account
+		if params2, ok := event.Params[2].(map[string]interface{}); ok {
+			if accountVal, ok := params2["account"].(string); ok {
+				fromAcct = accountVal
+			}
+		}
+
+		// to_acct: params[3].account
+		if params3, ok := event.Params[3].(map[string]interface{}); ok {
+			if accountVal, ok := params3["account"].(string); ok {
+				toAcct = accountVal
+			}
+		}
+	}
+
+	return TransferData{
+		TransactionId: transactionId,
+		Type:          "poly-fungible",
+		Amount:        amount,
+		ChainId:       chainId,
+		FromAcct:      fromAcct,
+		ModuleHash:    event.ModuleHash,
+		ModuleName:    moduleName,
+		RequestKey:    reqKey,
+		ToAcct:        toAcct,
+		HasTokenId:    true,
+		TokenId:       tokenId,
+		OrderIndex:    orderIndex,
+	}
+}
+
 func extractRequestKeyAndEventsFromTransactionPart(transactionPart string) (string, []Event, error) {
 	// Decode the base64 transaction part
 	decodedData, err := decodeBase64(transactionPart)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to decode base64 transaction part: %v", err)
+		return "", nil, fmt.Errorf("failed to decode base64 transaction part: %w", err)
 	}
 
 	// Parse as transaction part 1 (should contain reqKey and events)
 	var part1 TransactionPart1
-	if err := json.Unmarshal(decodedData, &part1); err != nil {
-		return "", nil, fmt.Errorf("failed to parse transaction part JSON: %v", err)
+	if err := safejson.Unmarshal(decodedData, &part1, jsonLimits()); err != nil {
+		return "", nil, fmt.Errorf("failed to parse transaction part JSON: %w", err)
 	}
 
 	return part1.ReqKey, part1.Events, nil
@@ -394,58 +645,119 @@ func getTransactionId(db *sql.DB, reqKey string, blockId int) (int, error) {
 	var transactionId int
 	err := db.QueryRow(query, reqKey, blockId).Scan(&transactionId)
 	if err != nil {
-		return 0, fmt.Errorf("failed to find transaction for reqKey %s in block %d: %v", reqKey, blockId, err)
+		return 0, fmt.Errorf("failed to find transaction for reqKey %s in block %d: %w", reqKey, blockId, err)
 	}
 
 	return transactionId, nil
 }
 
-func insertTransfers(db *sql.DB, transfers []TransferData) error {
+// insertTransferQuery inserts a transfer unless it is there already. A reconcile
+// transfer is identified by its transaction, request key and event ordinal, so a
+// run over blocks already reconciled inserts nothing.
+const insertTransferQuery = `
+	INSERT INTO "Transfers" (
+		"transactionId", type, amount, "chainId", from_acct, 
+		modulehash, modulename, requestkey, to_acct, 
+		"hasTokenId", "tokenId", "orderIndex"
+	)
+	SELECT $1::int, $2::text, $3::numeric, $4::int, $5::text, $6::text, $7::text, $8::text, $9::text, $10::boolean, $11::text, $12::int
+	WHERE NOT EXISTS (
+		SELECT 1 FROM "Transfers"
+		WHERE "transactionId" = $1 AND requestkey = $8 AND "orderIndex" = $12 AND type = $2
+	)
+`
+
+// insertArgs are the arguments of insertTransferQuery for the transfer.
+func (transfer TransferData) insertArgs() []interface{} {
+	return []interface{}{
+		transfer.TransactionId,
+		transfer.Type,
+		transfer.Amount,
+		transfer.ChainId,
+		transfer.FromAcct,
+		transfer.ModuleHash,
+		transfer.ModuleName,
+		transfer.RequestKey,
+		transfer.ToAcct,
+		transfer.HasTokenId,
+		transfer.TokenId,
+		transfer.OrderIndex,
+	}
+}
+
+// insertTransfers inserts the transfers that aren't there yet and returns how
+// many it inserted.
+func insertTransfers(db *sql.DB, transfers []TransferData) (int, error) {
 	// Begin database transaction
 	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return 0, errs.FromDB("failed to begin transaction", err)
 	}
 	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
 
 	// Prepare the insert statement
-	stmt, err := tx.Prepare(`
-		INSERT INTO "Transfers" (
-			"transactionId", type, amount, "chainId", from_acct, 
-			modulehash, modulename, requestkey, to_acct, 
-			"hasTokenId", "tokenId", "orderIndex"
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
-	`)
+	stmt, err := tx.Prepare(insertTransferQuery)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %v", err)
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
 	// Insert each transfer
+	inserted := 0
 	for _, transfer := range transfers {
-		_, err := stmt.Exec(
-			transfer.TransactionId,
-			transfer.Type,
-			transfer.Amount,
-			transfer.ChainId,
-			transfer.FromAcct,
-			transfer.ModuleHash,
-			transfer.ModuleName,
-			transfer.RequestKey,
-			transfer.ToAcct,
-			transfer.HasTokenId,
-			transfer.TokenId,
-			transfer.OrderIndex,
-		)
+		result, err := stmt.Exec(transfer.insertArgs()...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert transfer: %w", err)
+		}
+		affected, err := result.RowsAffected()
 		if err != nil {
-			return fmt.Errorf("failed to insert transfer: %v", err)
+			return 0, fmt.Errorf("failed to get inserted rows: %w", err)
 		}
+		inserted += int(affected)
+	}
+
+	if *dryRun {
+		// The deferred rollback discards the inserts
+		return inserted, nil
 	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return 0, errs.FromDB("failed to commit transaction", err)
 	}
 
-	return nil
+	return inserted, nil
+}
+
+// queueTransferInserts inserts the transfers that aren't there yet in tx, ending
+// it in the same round trip, and returns how many it inserted.
+func queueTransferInserts(ctx context.Context, tx *batcher.Tx, transfers []TransferData) (int, error) {
+	batch := &pgx.Batch{}
+	for _, transfer := range transfers {
+		batch.Queue(insertTransferQuery, transfer.insertArgs()...)
+	}
+	// A dry run's inserts are rolled back
+	tx.QueueEnd(batch)
+
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	// Insert each transfer
+	inserted := 0
+	for range transfers {
+		tag, err := results.Exec()
+		if err != nil {
+			return 0, errs.FromDB("failed to insert transfer", err)
+		}
+		inserted += int(tag.RowsAffected())
+	}
+
+	// Commit the transaction
+	if _, err := results.Exec(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+	if err := results.Close(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+	return inserted, nil
 }
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"go-backfill/safejson"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// With -node-url, reconcile doesn't start from the RECONCILE events already in
+// Events, which can't tell the events that were never ingested. It fetches the
+// payload outputs of every block of its scope from the node instead, and compares
+// the marmalade ledger RECONCILE events of each transaction with the rows of
+// Events. The events missing from Events are inserted from the node, with their
+// transfers; with -report-only the differences are only printed. Both inserts
+// skip the rows already there, so the command can be rerun over the same blocks.
+//
+// -node-concurrency requests are in flight at once, each timing out after
+// NODE_REQUEST_TIMEOUT. A request failing without a response or with a 5xx status
+// is retried up to SYNC_ATTEMPTS_MAX_RETRY attempts in total, waiting
+// SYNC_ATTEMPTS_INTERVAL_IN_MS before the second and twice as long before each
+// next one. A block whose payload can't be fetched is skipped and counted.
+
+const (
+	// reconcileNodeBatchSize is the number of blocks compared per batch
+	reconcileNodeBatchSize = 100
+	// reconcileModules are the modules whose RECONCILE events are compared
+	reconcileModules = `'marmalade.ledger', 'marmalade-v2.ledger'`
+)
+
+// Kinds of differences found with the node
+const (
+	// A RECONCILE event of the node that Events doesn't have
+	discrepancyMissingEvent = "missing_event"
+	// A RECONCILE event of the node whose transaction isn't indexed, so it can't
+	// be inserted
+	discrepancyMissingTransaction = "missing_transaction"
+	// A RECONCILE event of Events that the node doesn't have
+	discrepancyUnknownEvent = "unknown_event"
+)
+
+// nodeClient fetches payloads from a chainweb node.
+type nodeClient struct {
+	client   *http.Client
+	baseURL  string
+	attempts int
+	backoff  time.Duration
+}
+
+func newNodeClient(env *config.Config, nodeURL string) (*nodeClient, error) {
+	timeout, err := time.ParseDuration(env.NodeRequestTimeout)
+	if err != nil || timeout <= 0 {
+		return nil, &errs.ValidationError{Field: "NODE_REQUEST_TIMEOUT", Reason: fmt.Sprintf("%q is not a positive duration", env.NodeRequestTimeout)}
+	}
+	attempts := env.SyncAttemptsMaxRetry
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &nodeClient{
+		client:   &http.Client{Timeout: timeout},
+		baseURL:  fmt.Sprintf("%s/chainweb/0.0/%s", strings.TrimSuffix(nodeURL, "/"), env.Network),
+		attempts: attempts,
+		backoff:  time.Duration(env.SyncAttemptsIntervalInMs) * time.Millisecond,
+	}, nil
+}
+
+// payloadOutputs fetches the payload of a block with its outputs, retrying
+// failures without a response and 5xx statuses.
+func (c *nodeClient) payloadOutputs(ctx context.Context, chainId int, payloadHash string) (*PayloadAPIResponse, error) {
+	url := fmt.Sprintf("%s/chain/%d/payload/%s/outputs", c.baseURL, chainId, payloadHash)
+
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		payload, err := c.fetchPayload(ctx, url)
+		if err == nil || attempt >= c.attempts || !retryableNodeError(err) {
+			return payload, err
+		}
+
+		logEvent(slog.LevelDebug, fmt.Sprintf("Node request failed (attempt %d of %d), retrying in %s: %v", attempt, c.attempts, backoff, err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+		if backoff > batcher.MaxBackoff {
+			backoff = batcher.MaxBackoff
+		}
+	}
+}
+
+func (c *nodeClient) fetchPayload(ctx context.Context, url string) (*PayloadAPIResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &errs.NodeError{Endpoint: url, Err: err}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, &errs.NodeError{Endpoint: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &errs.NodeError{StatusCode: resp.StatusCode, Endpoint: url}
+	}
+
+	body, err := safejson.ReadAll(resp.Body, jsonLimits())
+	if err != nil {
+		if limit, ok := jsonLimitBreached(err); ok {
+			return nil, &errs.LimitExceeded{Limit: limit, Err: err}
+		}
+		return nil, &errs.NodeError{Endpoint: url, Err: err}
+	}
+
+	var payload PayloadAPIResponse
+	if err := safejson.Unmarshal(body, &payload, jsonLimits()); err != nil {
+		if limit, ok := jsonLimitBreached(err); ok {
+			return nil, &errs.LimitExceeded{Limit: limit, Err: err}
+		}
+		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
+	}
+	return &payload, nil
+}
+
+// retryableNodeError reports whether a node request may succeed when sent again:
+// it got no response, or a 5xx status.
+func retryableNodeError(err error) bool {
+	nodeErr, ok := err.(*errs.NodeError)
+	return ok && (nodeErr.StatusCode == 0 || nodeErr.StatusCode >= 500)
+}
+
+// isReconcileEvent reports whether event is a RECONCILE event of a marmalade
+// ledger, as the Events rows compared with the node are.
+func isReconcileEvent(event Event) bool {
+	if event.Name != "RECONCILE" || event.Module.Namespace == nil || event.Module.Name != "ledger" {
+		return false
+	}
+	return *event.Module.Namespace == "marmalade" || *event.Module.Namespace == "marmalade-v2"
+}
+
+type nodeBlock struct {
+	id          int
+	chainId     int
+	height      int
+	payloadHash string
+	canonical   bool
+	payload     *PayloadAPIResponse
+}
+
+// localTransaction is an indexed transaction of a block.
+type localTransaction struct {
+	id           int
+	creationTime string
+}
+
+// blockRequestKey identifies a transaction by its block and request key.
+type blockRequestKey struct {
+	blockId    int
+	requestKey string
+}
+
+// reconcileEventKey identifies a RECONCILE event: its block, its transaction's
+// request key and its position among the transaction's events.
+type reconcileEventKey struct {
+	blockId    int
+	requestKey string
+	orderIndex int
+}
+
+type reconcileDiscrepancy struct {
+	kind    string
+	block   nodeBlock
+	key     reconcileEventKey
+	details string
+}
+
+// nodeReconcileEvent is a RECONCILE event of the node to insert into Events.
+type nodeReconcileEvent struct {
+	transactionId int
+	chainId       int
+	module        string
+	params        json.RawMessage
+	requestKey    string
+	creationTime  string
+	orderIndex    int
+	canonical     bool
+}
+
+func reconcileFromNode(ctx context.Context, db *sql.DB, scope reconcileScope) error {
+	node, err := newNodeClient(config.GetConfig(), *reconcileNodeURL)
+	if err != nil {
+		return err
+	}
+
+	// Block ids are unbounded unless capped below the live watermark
+	upperBlockId, err := capToLiveWatermark(db, "Blocks", math.MaxInt32, false)
+	if err != nil {
+		return err
+	}
+	firstId, lastId, err := scope.blockRange(db, upperBlockId)
+	if err != nil {
+		return err
+	}
+	if firstId == 0 {
+		log.Printf("Nothing to do: no blocks of %s", scope.description)
+		log.Println("Completed processing. Total blocks compared with the node: 0 (100.0%)")
+		return nil
+	}
+	totalBlocks, err := scope.countBlocks(db, firstId, lastId)
+	if err != nil {
+		return err
+	}
+	log.Printf("Comparing the reconcile events of %s with %s: %d blocks, ids %d-%d", scope.description, node.baseURL, totalBlocks, firstId, lastId)
+	if *reconcileReportOnly {
+		log.Println("Report only: nothing will be inserted")
+	}
+
+	var report *dryRunReport
+	if *dryRun && !*reconcileReportOnly {
+		report = newDryRunReport("events and transfers")
+	}
+
+	var (
+		blocksCompared      int
+		totalEventsInserted int
+		totalTransfers      int
+		totalPresent        int
+		discrepancies       = make(map[string]int)
+		skipped             = make(skipCounts)
+		started             = time.Now()
+		lastProgressPrinted = -1.0
+	)
+	for lastBlockId := firstId - 1; lastBlockId < lastId; {
+		if ctx.Err() != nil {
+			log.Printf("Stopped: last completed batch ended at block id %d", lastBlockId)
+			return &errs.Interrupted{Done: fmt.Sprintf("blocks %d-%d remain", lastBlockId+1, lastId)}
+		}
+
+		blocks, err := loadNodeBlocks(db, scope, lastBlockId, lastId)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			break
+		}
+		batchStart, batchEnd := blocks[0].id, blocks[len(blocks)-1].id
+
+		// Node requests happen before anything is written
+		failures := fetchNodePayloads(ctx, node, blocks)
+		if ctx.Err() != nil {
+			// The requests canceled by the signal failed, so the batch isn't compared
+			log.Printf("Stopped: last completed batch ended at block id %d", lastBlockId)
+			return &errs.Interrupted{Done: fmt.Sprintf("blocks %d-%d remain", batchStart, lastId)}
+		}
+		for i, err := range failures {
+			if err != nil {
+				logEvent(slog.LevelWarn, fmt.Sprintf("Skipping block %d on chain %d: %v", blocks[i].id, blocks[i].chainId, err),
+					"block_id", blocks[i].id, "chain_id", blocks[i].chainId, "error", err.Error())
+				skipped.add(skipReasonOf(err), 1)
+			}
+		}
+
+		found, events, transfers, err := compareWithNode(db, blocks, skipped)
+		if err != nil {
+			return err
+		}
+		for _, discrepancy := range found {
+			discrepancies[discrepancy.kind]++
+			logEvent(slog.LevelWarn, fmt.Sprintf("Block %d (chain %d, height %d): %s: RECONCILE event %d of %s%s",
+				discrepancy.block.id, discrepancy.block.chainId, discrepancy.block.height, discrepancy.kind,
+				discrepancy.key.orderIndex, discrepancy.key.requestKey, discrepancy.details),
+				"block_id", discrepancy.block.id, "chain_id", discrepancy.block.chainId, "kind", discrepancy.kind,
+				"request_key", discrepancy.key.requestKey, "order_index", discrepancy.key.orderIndex)
+		}
+
+		if !*reconcileReportOnly && (len(events) > 0 || len(transfers) > 0) {
+			label := fmt.Sprintf("%d-%d", batchStart, batchEnd)
+			batchStarted := time.Now()
+			eventsInserted, err := insertNodeReconcileEvents(db, events)
+			var transfersInserted int
+			if err == nil {
+				transfersInserted, err = insertTransfers(db, transfers)
+			}
+			switch {
+			case err != nil && report != nil:
+				report.abort(label, err)
+			case err != nil:
+				return &batchError{start: batchStart, end: batchEnd, err: err}
+			case report != nil:
+				report.batch(label, eventsInserted+transfersInserted)
+			default:
+				totalEventsInserted += eventsInserted
+				totalTransfers += transfersInserted
+				totalPresent += len(transfers) - transfersInserted
+				metrics.batchCommitted(eventsInserted+transfersInserted, time.Since(batchStarted))
+			}
+		}
+
+		blocksCompared += len(blocks)
+		lastBlockId = batchEnd
+		metrics.examined(len(blocks))
+		metrics.setCursor(lastBlockId)
+
+		progressPercent := percentOf(blocksCompared, totalBlocks)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			logProgress(fmt.Sprintf("Progress: %.1f%%, blocks compared: %d, events inserted: %d", progressPercent, blocksCompared, totalEventsInserted),
+				batchStart, batchEnd, int64(totalEventsInserted+totalTransfers), progressPercent, perSecond(int64(blocksCompared), started))
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total blocks compared with the node: %d (100.0%%)", blocksCompared)
+	for _, kind := range []string{discrepancyMissingEvent, discrepancyMissingTransaction, discrepancyUnknownEvent} {
+		log.Printf("Differences with the node, %s: %d", kind, discrepancies[kind])
+	}
+	logSkipSummary("blocks and transactions", skipped)
+	if report != nil {
+		return report.finish()
+	}
+	if !*reconcileReportOnly {
+		log.Printf("Events inserted: %d, transfers inserted: %d, already present and skipped: %d", totalEventsInserted, totalTransfers, totalPresent)
+	}
+	return nil
+}
+
+// loadNodeBlocks returns the next blocks of the scope above lastBlockId.
+func loadNodeBlocks(db *sql.DB, scope reconcileScope, lastBlockId, upperBlockId int) ([]nodeBlock, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT b.id, b."chainId", b.height, b."payloadHash", COALESCE(b.canonical, true)
+		FROM "Blocks" b
+		WHERE b.id > $1 AND b.id <= $2 AND %s
+		ORDER BY b.id
+		LIMIT $3
+	`, scope.condition), lastBlockId, upperBlockId, reconcileNodeBatchSize)
+	if err != nil {
+		return nil, errs.FromDB("failed to load blocks", err)
+	}
+	defer rows.Close()
+
+	var blocks []nodeBlock
+	for rows.Next() {
+		var block nodeBlock
+		if err := rows.Scan(&block.id, &block.chainId, &block.height, &block.payloadHash, &block.canonical); err != nil {
+			return nil, errs.FromDB("failed to scan block", err)
+		}
+		blocks = append(blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.FromDB("error iterating blocks", err)
+	}
+	return blocks, nil
+}
+
+// fetchNodePayloads fetches the payload of every block, -node-concurrency at a
+// time, and returns the error of each block, nil for those fetched.
+func fetchNodePayloads(ctx context.Context, node *nodeClient, blocks []nodeBlock) []error {
+	failures := make([]error, len(blocks))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *reconcileNodeJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				blocks[index].payload, failures[index] = node.payloadOutputs(ctx, blocks[index].chainId, blocks[index].payloadHash)
+			}
+		}()
+	}
+	for i := range blocks {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return failures
+}
+
+// compareWithNode compares the RECONCILE events of the fetched blocks with
+// Events, and returns the differences, the events to insert and the transfers of
+// every RECONCILE event of the node whose transaction is indexed.
+func compareWithNode(db *sql.DB, blocks []nodeBlock, skipped skipCounts) ([]reconcileDiscrepancy, []nodeReconcileEvent, []TransferData, error) {
+	blockIds := make([]int64, 0, len(blocks))
+	for _, block := range blocks {
+		if block.payload != nil {
+			blockIds = append(blockIds, int64(block.id))
+		}
+	}
+	if len(blockIds) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	transactions := make(map[blockRequestKey]localTransaction)
+	rows, err := db.Query(`
+		SELECT t."blockId", t.requestkey, t.id, t.creationtime
+		FROM "Transactions" t
+		WHERE t."blockId" = ANY($1)
+	`, pq.Array(blockIds))
+	if err != nil {
+		return nil, nil, nil, errs.FromDB("failed to load transactions", err)
+	}
+	for rows.Next() {
+		var (
+			key         blockRequestKey
+			transaction localTransaction
+		)
+		if err := rows.Scan(&key.blockId, &key.requestKey, &transaction.id, &transaction.creationTime); err != nil {
+			rows.Close()
+			return nil, nil, nil, errs.FromDB("failed to scan transaction", err)
+		}
+		transactions[key] = transaction
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, errs.FromDB("error iterating transactions", err)
+	}
+
+	// The RECONCILE events already in Events, until matched with the node's
+	local := make(map[reconcileEventKey]bool)
+	rows, err = db.Query(`
+		SELECT t."blockId", t.requestkey, e."orderIndex"
+		FROM "Events" e
+		JOIN "Transactions" t ON t.id = e."transactionId"
+		WHERE t."blockId" = ANY($1) AND e.name = 'RECONCILE' AND e.module IN (`+reconcileModules+`)
+	`, pq.Array(blockIds))
+	if err != nil {
+		return nil, nil, nil, errs.FromDB("failed to load reconcile events", err)
+	}
+	for rows.Next() {
+		var key reconcileEventKey
+		if err := rows.Scan(&key.blockId, &key.requestKey, &key.orderIndex); err != nil {
+			rows.Close()
+			return nil, nil, nil, errs.FromDB("failed to scan reconcile event", err)
+		}
+		local[key] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, errs.FromDB("error iterating reconcile events", err)
+	}
+
+	var (
+		found     []reconcileDiscrepancy
+		events    []nodeReconcileEvent
+		transfers []TransferData
+	)
+	for _, block := range blocks {
+		if block.payload == nil {
+			continue
+		}
+		for i, transactionParts := range block.payload.Transactions {
+			reqKey, transactionEvents, err := extractRequestKeyAndEventsFromTransactionPart(transactionParts[1])
+			if err != nil {
+				log.Printf("Error extracting data from transaction %d of block %d: %v", i, block.id, err)
+				skipped.add(skipMalformedPayload, 1)
+				continue
+			}
+			for orderIndex, event := range transactionEvents {
+				if !isReconcileEvent(event) {
+					continue
+				}
+				key := reconcileEventKey{blockId: block.id, requestKey: reqKey, orderIndex: orderIndex}
+				transaction, indexed := transactions[blockRequestKey{blockId: block.id, requestKey: reqKey}]
+				switch {
+				case !indexed:
+					found = append(found, reconcileDiscrepancy{kind: discrepancyMissingTransaction, block: block, key: key})
+					continue
+				case local[key]:
+					delete(local, key)
+				default:
+					params, err := json.Marshal(event.Params)
+					if err != nil {
+						return nil, nil, nil, fmt.Errorf("failed to encode params of RECONCILE event %d of %s: %w", orderIndex, reqKey, err)
+					}
+					found = append(found, reconcileDiscrepancy{kind: discrepancyMissingEvent, block: block, key: key, details: fmt.Sprintf(", params %s", params)})
+					events = append(events, nodeReconcileEvent{
+						transactionId: transaction.id,
+						chainId:       block.chainId,
+						module:        *event.Module.Namespace + "." + event.Module.Name,
+						params:        params,
+						requestKey:    reqKey,
+						creationTime:  transaction.creationTime,
+						orderIndex:    orderIndex,
+						canonical:     block.canonical,
+					})
+				}
+				transfers = append(transfers, reconcileTransfer(event, transaction.id, block.chainId, reqKey, orderIndex))
+			}
+		}
+	}
+
+	// Events left unmatched aren't in the node's payloads
+	byId := make(map[int]nodeBlock, len(blocks))
+	for _, block := range blocks {
+		byId[block.id] = block
+	}
+	for key := range local {
+		found = append(found, reconcileDiscrepancy{kind: discrepancyUnknownEvent, block: byId[key.blockId], key: key})
+	}
+	return found, events, transfers, nil
+}
+
+// insertNodeReconcileEvents inserts the events that aren't in Events yet and
+// returns how many it inserted.
+func insertNodeReconcileEvents(db *sql.DB, events []nodeReconcileEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	// module doubles as qualname, as the indexer writes it
+	stmt, err := tx.Prepare(`
+		INSERT INTO "Events" (
+			"transactionId", "chainId", module, name, params, qualname, requestkey,
+			creationtime, "orderIndex", "createdAt", "updatedAt", canonical
+		)
+		SELECT $1::int, $2::int, $3::text, 'RECONCILE', $4::jsonb, $3::text, $5::text,
+			$6::text, $7::int, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, $8::boolean
+		WHERE NOT EXISTS (
+			SELECT 1 FROM "Events"
+			WHERE "transactionId" = $1 AND "orderIndex" = $7 AND name = 'RECONCILE'
+		)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	inserted := 0
+	for _, event := range events {
+		result, err := stmt.Exec(event.transactionId, event.chainId, event.module, string(event.params),
+			event.requestKey, event.creationTime, event.orderIndex, event.canonical)
+		if err != nil {
+			return 0, errs.FromDB(fmt.Sprintf("failed to insert RECONCILE event %d of %s", event.orderIndex, event.requestKey), err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get inserted rows: %w", err)
+		}
+		inserted += int(affected)
+	}
+
+	if *dryRun {
+		// The deferred rollback discards the inserts
+		return inserted, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errs.FromDB("failed to commit transaction", err)
+	}
+	return inserted, nil
+}
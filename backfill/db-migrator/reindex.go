@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	reindexProgressInterval = 10 * time.Second
+	reindexSwapSuffix       = "_reindex"
+)
+
+// This script rebuilds the indexes of one table after a bulk backfill left them
+// bloated. On PostgreSQL 12 and later every index is rebuilt with REINDEX INDEX
+// CONCURRENTLY, with progress read from pg_stat_progress_create_index. Older
+// servers get a swap instead: the index is created again concurrently under a
+// temporary name, the old one dropped concurrently and the new one renamed.
+// Indexes backing a constraint can't be swapped and are skipped there. Sizes
+// before and after are reported per index. The table is locked against migrator
+// commands writing to it for the duration of the run.
+
+// reindexableTables is the whitelist of tables -reindex-table accepts.
+var reindexableTables = map[string]bool{
+	"Blocks":             true,
+	"Transactions":       true,
+	"TransactionDetails": true,
+	"Events":             true,
+	"Transfers":          true,
+	"Signers":            true,
+	"Memos":              true,
+	"GuardChanges":       true,
+	"AccountTimeline":    true,
+}
+
+type tableIndex struct {
+	Name         string
+	Definition   string
+	Constraint   bool
+	SizeBefore   int64
+	SizeAfter    int64
+	Rebuilt      bool
+	SkippedCause string
+}
+
+func reindexTable() error {
+	table := *reindexTableName
+	if !reindexableTables[table] {
+		allowed := make([]string, 0, len(reindexableTables))
+		for name := range reindexableTables {
+			allowed = append(allowed, name)
+		}
+		sort.Strings(allowed)
+		return &errs.ValidationError{Field: "-reindex-table", Reason: fmt.Sprintf("table %q cannot be reindexed, allowed tables: %s", table, strings.Join(allowed, ", "))}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	exists, err := tableExists(db, table)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &errs.SchemaError{Missing: "table " + table}
+	}
+
+	locks, err := openTableLocks()
+	if err != nil {
+		return err
+	}
+	defer locks.Close()
+	acquired, err := locks.tryLock(table, true)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("refusing to reindex %s: another migrator command is writing to it", table)
+	}
+
+	var serverVersion int
+	if err := db.QueryRow(`SELECT current_setting('server_version_num')::int`).Scan(&serverVersion); err != nil {
+		return fmt.Errorf("failed to get server version: %w", err)
+	}
+	concurrently := serverVersion >= 120000
+
+	indexes, err := listTableIndexes(db, table)
+	if err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		log.Printf("Nothing to do for %s: the table has no indexes", table)
+		return nil
+	}
+
+	if concurrently {
+		log.Printf("Rebuilding %d indexes of %s with REINDEX CONCURRENTLY", len(indexes), table)
+	} else {
+		log.Printf("Server version %d has no REINDEX CONCURRENTLY, swapping %d indexes of %s", serverVersion, len(indexes), table)
+	}
+
+	for i := range indexes {
+		index := &indexes[i]
+		log.Printf("Index %d/%d: %s (%s)", i+1, len(indexes), index.Name, formatIndexSize(index.SizeBefore))
+
+		if !concurrently && index.Constraint {
+			index.SkippedCause = "backs a constraint, can't be swapped"
+			log.Printf("Skipping %s: it backs a constraint, rebuild it with REINDEX during a maintenance window", index.Name)
+			continue
+		}
+
+		started := time.Now()
+		done := make(chan struct{})
+		if concurrently {
+			go logReindexProgress(db, table, done)
+			err = execReindexStatement(db, fmt.Sprintf(`REINDEX INDEX CONCURRENTLY "%s"`, index.Name))
+		} else {
+			err = swapIndex(db, *index)
+		}
+		close(done)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild index %s: %w", index.Name, err)
+		}
+		index.Rebuilt = true
+
+		if err := db.QueryRow(`SELECT pg_relation_size(to_regclass($1))`, fmt.Sprintf(`"%s"`, index.Name)).Scan(&index.SizeAfter); err != nil {
+			return fmt.Errorf("failed to get size of index %s: %w", index.Name, err)
+		}
+		log.Printf("Rebuilt %s in %s: %s -> %s", index.Name, time.Since(started).Round(time.Second),
+			formatIndexSize(index.SizeBefore), formatIndexSize(index.SizeAfter))
+	}
+
+	var totalBefore, totalAfter int64
+	rebuilt := 0
+	log.Printf("Completed processing. Index sizes of %s:", table)
+	for _, index := range indexes {
+		if !index.Rebuilt {
+			log.Printf("  %-50s %10s  skipped: %s", index.Name, formatIndexSize(index.SizeBefore), index.SkippedCause)
+			continue
+		}
+		rebuilt++
+		totalBefore += index.SizeBefore
+		totalAfter += index.SizeAfter
+		log.Printf("  %-50s %10s -> %10s", index.Name, formatIndexSize(index.SizeBefore), formatIndexSize(index.SizeAfter))
+	}
+	log.Printf("Total indexes rebuilt: %d of %d, %s -> %s", rebuilt, len(indexes), formatIndexSize(totalBefore), formatIndexSize(totalAfter))
+	return nil
+}
+
+func listTableIndexes(db *sql.DB, table string) ([]tableIndex, error) {
+	rows, err := db.Query(`
+		SELECT i.relname, pg_get_indexdef(i.oid), c.oid IS NOT NULL, pg_relation_size(i.oid)
+		FROM pg_index x
+		JOIN pg_class i ON i.oid = x.indexrelid
+		LEFT JOIN pg_constraint c ON c.conindid = i.oid
+		WHERE x.indrelid = to_regclass($1)
+		ORDER BY i.relname
+	`, fmt.Sprintf(`"%s"`, table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indexes of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var indexes []tableIndex
+	for rows.Next() {
+		var index tableIndex
+		if err := rows.Scan(&index.Name, &index.Definition, &index.Constraint, &index.SizeBefore); err != nil {
+			return nil, fmt.Errorf("failed to scan index: %w", err)
+		}
+		if strings.HasSuffix(index.Name, reindexSwapSuffix) {
+			log.Printf("Ignoring %s: leftover of an interrupted swap, drop it once the original index is valid", index.Name)
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating indexes: %w", err)
+	}
+	return indexes, nil
+}
+
+func execReindexStatement(db *sql.DB, statement string) error {
+	log.Printf("  %s", statement)
+	if _, err := db.Exec(statement); err != nil {
+		return errs.FromDB(fmt.Sprintf("failed to execute %q", statement), err)
+	}
+	return nil
+}
+
+// swapIndex builds a copy of index concurrently and puts it in place of the
+// original.
+func swapIndex(db *sql.DB, index tableIndex) error {
+	tempName := index.Name + reindexSwapSuffix
+
+	// pg_get_indexdef renders CREATE [UNIQUE] INDEX name ON ...
+	prefix, rest, found := strings.Cut(index.Definition, " INDEX ")
+	if !found {
+		return fmt.Errorf("unexpected index definition %q", index.Definition)
+	}
+	_, rest, found = strings.Cut(rest, " ON ")
+	if !found {
+		return fmt.Errorf("unexpected index definition %q", index.Definition)
+	}
+	create := fmt.Sprintf(`%s INDEX CONCURRENTLY "%s" ON %s`, prefix, tempName, rest)
+
+	for _, statement := range []string{
+		create,
+		fmt.Sprintf(`DROP INDEX CONCURRENTLY "%s"`, index.Name),
+		fmt.Sprintf(`ALTER INDEX "%s" RENAME TO "%s"`, tempName, index.Name),
+	} {
+		if err := execReindexStatement(db, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logReindexProgress logs the progress of index builds on table until done is
+// closed.
+func logReindexProgress(db *sql.DB, table string, done <-chan struct{}) {
+	ticker := time.NewTicker(reindexProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		var (
+			phase                   string
+			blocksDone, blocksTotal int64
+			tuplesDone, tuplesTotal int64
+		)
+		err := db.QueryRow(`
+			SELECT phase, blocks_done, blocks_total, tuples_done, tuples_total
+			FROM pg_stat_progress_create_index
+			WHERE relid = to_regclass($1)
+			LIMIT 1
+		`, fmt.Sprintf(`"%s"`, table)).Scan(&phase, &blocksDone, &blocksTotal, &tuplesDone, &tuplesTotal)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read index build progress: %v", err)
+			continue
+		}
+
+		switch {
+		case blocksTotal > 0:
+			log.Printf("Progress: %.1f%%, phase: %s, blocks: %d/%d", percentOf(int(blocksDone), int(blocksTotal)), phase, blocksDone, blocksTotal)
+		case tuplesTotal > 0:
+			log.Printf("Progress: %.1f%%, phase: %s, tuples: %d/%d", percentOf(int(tuplesDone), int(tuplesTotal)), phase, tuplesDone, tuplesTotal)
+		default:
+			log.Printf("Progress: phase: %s", phase)
+		}
+	}
+}
+
+func formatIndexSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, suffix := float64(size)/unit, "kB"
+	for _, next := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+func ReindexTable(ctx context.Context, cfg *config.Config) error {
+	return reindexTable()
+}
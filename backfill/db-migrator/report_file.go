@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every command ends by writing a JSON report of what it did to -report-file,
+// ./migrator-report-<command>-<timestamp>.json by default, as evidence for the
+// change record: the flags it ran with, when it started and ended, the rows it
+// examined, updated, skipped and found invalid, the batches committed and
+// retried, the average throughput, the cursor it got to and the error that ended
+// it, if any. The counts are those of the metrics. The report is written as well
+// when the command fails or is stopped by a signal, so a partial run is
+// documented too; only a second signal exits without one. A report that can't be
+// written is logged and doesn't change the exit code.
+
+// Outcomes of a run in its report
+const (
+	runCompleted   = "completed"
+	runFailed      = "failed"
+	runInterrupted = "interrupted"
+)
+
+type runReport struct {
+	Command string `json:"command"`
+	// Flags holds the value of every flag the command accepts, FlagsSet those
+	// given on the command line
+	Flags      map[string]string `json:"flags"`
+	FlagsSet   []string          `json:"flagsSet"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt time.Time         `json:"finishedAt"`
+	Status     string            `json:"status"`
+	Rows       runReportRows     `json:"rows"`
+	Batches    int64             `json:"batches"`
+	Retries    int64             `json:"retries"`
+	// RowsPerSec is the rows updated per second of the whole run
+	RowsPerSec float64 `json:"rowsPerSec"`
+	// Cursor is the id the command got to, nil when it doesn't walk ids
+	Cursor *int64          `json:"cursor"`
+	Error  *runReportError `json:"error"`
+}
+
+type runReportRows struct {
+	Examined int64 `json:"examined"`
+	Updated  int64 `json:"updated"`
+	Skipped  int64 `json:"skipped"`
+	Invalid  int64 `json:"invalid"`
+}
+
+type runReportError struct {
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode"`
+}
+
+var (
+	runReportStarted time.Time
+	runReportOnce    sync.Once
+)
+
+// startRunReport marks the start of the run the report covers.
+func startRunReport() {
+	runReportStarted = time.Now().UTC()
+}
+
+// finishRunReport writes the report of the run, ended by err when it isn't nil,
+// and notifies it. Only the first call writes one.
+func finishRunReport(err error) {
+	runReportOnce.Do(func() {
+		if runReportStarted.IsZero() {
+			return
+		}
+		report := buildRunReport(*command, parsedFlags, runReportStarted, time.Now().UTC(), err)
+		path := *reportFile
+		if path == "" {
+			path = defaultReportFile(*command, runReportStarted)
+		}
+		if err := writeRunReport(path, report); err != nil {
+			log.Printf("Warning: %v", err)
+		} else {
+			log.Printf("Run report written to %s", path)
+		}
+		notifyFinish(report, err)
+	})
+}
+
+// defaultReportFile is the report path of a command started at started.
+func defaultReportFile(name string, started time.Time) string {
+	return fmt.Sprintf("migrator-report-%s-%s.json", name, started.Format("20060102T150405Z"))
+}
+
+// buildRunReport reports a run of name from started to finished with the flag
+// values of flags and the counts of the metrics.
+func buildRunReport(name string, flags *flag.FlagSet, started, finished time.Time, err error) runReport {
+	report := runReport{
+		Command:    name,
+		Flags:      map[string]string{},
+		FlagsSet:   []string{},
+		StartedAt:  started,
+		FinishedAt: finished,
+		Status:     runCompleted,
+		Rows: runReportRows{
+			Examined: metrics.rowsExamined.Load(),
+			Updated:  metrics.rowsUpdated.Load(),
+			Skipped:  metrics.rowsSkipped.Load(),
+			Invalid:  metrics.rowsInvalid.Load(),
+		},
+		Batches: metrics.batchesCommitted.Load(),
+		Retries: metrics.batchRetries.Load(),
+	}
+	if flags != nil {
+		flags.VisitAll(func(f *flag.Flag) {
+			report.Flags[f.Name] = f.Value.String()
+		})
+		flags.Visit(func(f *flag.Flag) {
+			report.FlagsSet = append(report.FlagsSet, f.Name)
+		})
+		sort.Strings(report.FlagsSet)
+	}
+	if elapsed := finished.Sub(started).Seconds(); elapsed > 0 {
+		report.RowsPerSec = float64(report.Rows.Updated) / elapsed
+	}
+	if metrics.hasCursor.Load() {
+		cursor := metrics.cursor.Load()
+		report.Cursor = &cursor
+	}
+
+	if err != nil {
+		var interruptErr *errs.Interrupted
+		report.Status = runFailed
+		if errors.As(err, &interruptErr) {
+			report.Status = runInterrupted
+		}
+		report.Error = &runReportError{Message: err.Error(), ExitCode: errs.ExitCode(err)}
+	}
+	return report
+}
+
+func writeRunReport(path string, report runReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-backfill/errs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// useMetrics replaces the metrics with rows examined, updated, skipped and
+// invalid, batches, retries and a cursor when cursor isn't negative, for the
+// rest of the test.
+func useMetrics(t *testing.T, examined, updated, skipped, invalid, batches, retries, cursor int64) {
+	t.Helper()
+	previous := metrics
+	metrics = &migratorMetrics{durationCounts: make([]int64, len(batchDurationBuckets))}
+	t.Cleanup(func() { metrics = previous })
+
+	metrics.rowsExamined.Store(examined)
+	metrics.rowsUpdated.Store(updated)
+	metrics.rowsSkipped.Store(skipped)
+	metrics.rowsInvalid.Store(invalid)
+	metrics.batchesCommitted.Store(batches)
+	metrics.batchRetries.Store(retries)
+	if cursor >= 0 {
+		metrics.cursor.Store(cursor)
+		metrics.hasCursor.Store(true)
+	}
+}
+
+// reportFlags is a flag set of -batch-size and -dry-run parsed from args.
+func reportFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	set := flag.NewFlagSet("code-to-text", flag.ContinueOnError)
+	set.Int("batch-size", 1000, "")
+	set.Bool("dry-run", false, "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestWriteRunReport(t *testing.T) {
+	started := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	finished := started.Add(time.Minute)
+
+	tests := []struct {
+		name   string
+		cursor int64
+		err    error
+		want   string
+	}{
+		{
+			name:   "completed",
+			cursor: 1000,
+			want: `{
+  "command": "code-to-text",
+  "flags": {
+    "batch-size": "500",
+    "dry-run": "false"
+  },
+  "flagsSet": [
+    "batch-size"
+  ],
+  "startedAt": "2026-03-01T10:00:00Z",
+  "finishedAt": "2026-03-01T10:01:00Z",
+  "status": "completed",
+  "rows": {
+    "examined": 1000,
+    "updated": 900,
+    "skipped": 100,
+    "invalid": 40
+  },
+  "batches": 2,
+  "retries": 1,
+  "rowsPerSec": 15,
+  "cursor": 1000,
+  "error": null
+}
+`,
+		},
+		{
+			name:   "aborted",
+			cursor: -1,
+			err:    &errs.ValidationError{RowID: 42, Field: "code", Reason: "not a string or {}"},
+			want: `{
+  "command": "code-to-text",
+  "flags": {
+    "batch-size": "500",
+    "dry-run": "false"
+  },
+  "flagsSet": [
+    "batch-size"
+  ],
+  "startedAt": "2026-03-01T10:00:00Z",
+  "finishedAt": "2026-03-01T10:01:00Z",
+  "status": "failed",
+  "rows": {
+    "examined": 1000,
+    "updated": 900,
+    "skipped": 100,
+    "invalid": 40
+  },
+  "batches": 2,
+  "retries": 1,
+  "rowsPerSec": 15,
+  "cursor": null,
+  "error": {
+    "message": "invalid code of row 42: not a string or {}",
+    "exitCode": 3
+  }
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMetrics(t, 1000, 900, 100, 40, 2, 1, tt.cursor)
+			report := buildRunReport("code-to-text", reportFlags(t, "-batch-size", "500"), started, finished, tt.err)
+
+			path := filepath.Join(t.TempDir(), "report.json")
+			if err := writeRunReport(path, report); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("report file =\n%s\nwant\n%s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRunReportOutcome(t *testing.T) {
+	started := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	deadlock := errs.FromDB("failed to update batch", &pq.Error{Code: "40P01", Message: "deadlock detected"})
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus string
+		wantCode   int
+	}{
+		{name: "completed", wantStatus: runCompleted},
+		{name: "interrupted", err: &errs.Interrupted{Done: "rows up to 500 converted"}, wantStatus: runInterrupted, wantCode: errs.ExitInterrupted},
+		{name: "wrapped interruption", err: fmt.Errorf("batch 1-500: %w", &errs.Interrupted{}), wantStatus: runInterrupted, wantCode: errs.ExitInterrupted},
+		{name: "retryable failure", err: deadlock, wantStatus: runFailed, wantCode: errs.ExitRetryable},
+		{name: "uncategorized failure", err: fmt.Errorf("unexpected"), wantStatus: runFailed, wantCode: errs.ExitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMetrics(t, 0, 0, 0, 0, 0, 0, -1)
+			report := buildRunReport("code-to-text", nil, started, started, tt.err)
+			if report.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", report.Status, tt.wantStatus)
+			}
+			// A run of no time has no throughput rather than an infinite one
+			if report.RowsPerSec != 0 {
+				t.Errorf("rowsPerSec = %v, want 0", report.RowsPerSec)
+			}
+			if tt.err == nil {
+				if report.Error != nil {
+					t.Errorf("error = %+v, want none", report.Error)
+				}
+				return
+			}
+			if report.Error == nil || report.Error.Message != tt.err.Error() || report.Error.ExitCode != tt.wantCode {
+				t.Errorf("error = %+v, want %q exiting with %d", report.Error, tt.err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestFinishRunReport(t *testing.T) {
+	useMetrics(t, 10, 10, 0, 0, 1, 0, 10)
+	path := filepath.Join(t.TempDir(), "report.json")
+	previousCommand, previousFile, previousFlags := *command, *reportFile, parsedFlags
+	*command, *reportFile, parsedFlags = "code-to-text", path, reportFlags(t, "-dry-run")
+	runReportStarted, runReportOnce = time.Now().UTC(), sync.Once{}
+	t.Cleanup(func() {
+		*command, *reportFile, parsedFlags = previousCommand, previousFile, previousFlags
+		runReportStarted, runReportOnce = time.Time{}, sync.Once{}
+	})
+
+	// The failure is reported; the deferred call after it writes nothing
+	finishRunReport(&errs.ValidationError{Field: "code", Reason: "not a string or {}"})
+	finishRunReport(nil)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report runReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("report isn't JSON: %v\n%s", err, data)
+	}
+	if report.Command != "code-to-text" || report.Status != runFailed || report.Error == nil || report.Error.ExitCode != errs.ExitValidation {
+		t.Errorf("report = %s, want the failed code-to-text run", data)
+	}
+	if report.Flags["dry-run"] != "true" || len(report.FlagsSet) != 1 || report.FlagsSet[0] != "dry-run" {
+		t.Errorf("report flags = %v set %v, want -dry-run set", report.Flags, report.FlagsSet)
+	}
+	if report.Cursor == nil || *report.Cursor != 10 {
+		t.Errorf("report cursor = %v, want 10", report.Cursor)
+	}
+}
+
+func TestDefaultReportFile(t *testing.T) {
+	started := time.Date(2026, 3, 1, 9, 5, 7, 0, time.UTC)
+	if got, want := defaultReportFile("gas-backfill", started), "migrator-report-gas-backfill-20260301T090507Z.json"; got != want {
+		t.Errorf("defaultReportFile() = %s, want %s", got, want)
+	}
+}
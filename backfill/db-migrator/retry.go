@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"go-backfill/batcher"
+	"log"
+	"time"
+)
+
+// A batch failing with a retryable database error (serialization failure,
+// deadlock, lost connection, ...) is rolled back, so it is run again from scratch,
+// up to -batch-attempts times in total with the backoff of batcher.Retry in
+// between. Any other error, or the last attempt failing, aborts the run.
+
+// retryBatch runs batch until it succeeds, fails with an error that isn't
+// retryable, runs out of attempts or ctx is canceled.
+func retryBatch(ctx context.Context, label string, batch func() (int, error)) (int, error) {
+	return batcher.Retry(ctx, *batchAttempts, func(attempt int, backoff time.Duration, err error) {
+		logBatchRetry(label, attempt, backoff, err)
+	}, batch)
+}
+
+// logBatchRetry counts and logs the failed attempt at the batch label, retried
+// after backoff.
+func logBatchRetry(label string, attempt int, backoff time.Duration, err error) {
+	metrics.retried()
+	log.Printf("Batch %s failed (attempt %d of %d), retrying in %s: %v", label, attempt, *batchAttempts, backoff, err)
+}
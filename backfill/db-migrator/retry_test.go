@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/errs"
+	"io"
+	"log"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// shortenRetries sets -batch-attempts to attempts and the backoff to
+// milliseconds for the rest of the test, and captures what retryBatch logs.
+func shortenRetries(t *testing.T, attempts int) *bytes.Buffer {
+	t.Helper()
+	previousAttempts, previousInitial, previousMax := *batchAttempts, batcher.InitialBackoff, batcher.MaxBackoff
+	*batchAttempts = attempts
+	batcher.InitialBackoff, batcher.MaxBackoff = time.Millisecond, 4*time.Millisecond
+
+	var logged bytes.Buffer
+	previousOutput, previousFlags := log.Writer(), log.Flags()
+	log.SetOutput(&logged)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		*batchAttempts = previousAttempts
+		batcher.InitialBackoff, batcher.MaxBackoff = previousInitial, previousMax
+		log.SetOutput(previousOutput)
+		log.SetFlags(previousFlags)
+	})
+	return &logged
+}
+
+// failingBatch is a batch failing with failures in turn, one per attempt, then
+// processing rows.
+type failingBatch struct {
+	failures []error
+	rows     int
+	attempts int
+}
+
+func (b *failingBatch) run() (int, error) {
+	b.attempts++
+	if b.attempts <= len(b.failures) {
+		return 0, b.failures[b.attempts-1]
+	}
+	return b.rows, nil
+}
+
+func TestRetryBatch(t *testing.T) {
+	serialization := errs.FromDB("failed to update batch", &pgconn.PgError{Code: "40001", Message: "could not serialize access"})
+	deadlock := errs.FromDB("failed to update batch", &pq.Error{Code: "40P01", Message: "deadlock detected"})
+	badConn := errs.FromDB("failed to commit", driver.ErrBadConn)
+	reset := errs.FromDB("failed to query batch", fmt.Errorf("read tcp: %w", syscall.ECONNRESET))
+	uniqueViolation := errs.FromDB("failed to insert", &pq.Error{Code: "23505", Message: "duplicate key"})
+	invalid := &errs.ValidationError{RowID: 42, Field: "code", Reason: "not a string or {}"}
+
+	tests := []struct {
+		name         string
+		failures     []error
+		attempts     int
+		wantAttempts int
+		wantRows     int
+		wantErr      error
+		wantRetries  int64
+	}{
+		{name: "succeeds at once", attempts: 5, wantAttempts: 1, wantRows: 10},
+		{name: "serialization failure then success", failures: []error{serialization}, attempts: 5, wantAttempts: 2, wantRows: 10, wantRetries: 1},
+		{
+			name:         "every transient failure is retried",
+			failures:     []error{serialization, deadlock, badConn, reset},
+			attempts:     5,
+			wantAttempts: 5,
+			wantRows:     10,
+			wantRetries:  4,
+		},
+		{name: "out of attempts", failures: []error{deadlock, deadlock, serialization}, attempts: 3, wantAttempts: 3, wantErr: serialization, wantRetries: 2},
+		{name: "a single attempt", failures: []error{badConn}, attempts: 1, wantAttempts: 1, wantErr: badConn},
+		{name: "permanent database error", failures: []error{uniqueViolation}, attempts: 5, wantAttempts: 1, wantErr: uniqueViolation},
+		{name: "validation error", failures: []error{deadlock, invalid}, attempts: 5, wantAttempts: 2, wantErr: invalid, wantRetries: 1},
+		{name: "uncategorized error", failures: []error{io.EOF}, attempts: 5, wantAttempts: 1, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shortenRetries(t, tt.attempts)
+			retriesBefore := metrics.batchRetries.Load()
+
+			batch := &failingBatch{failures: tt.failures, rows: 10}
+			rows, err := retryBatch(context.Background(), "1-10", batch.run)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("retryBatch() error = %v, want %v", err, tt.wantErr)
+			}
+			if rows != tt.wantRows {
+				t.Errorf("retryBatch() = %d rows, want %d", rows, tt.wantRows)
+			}
+			if batch.attempts != tt.wantAttempts {
+				t.Errorf("retryBatch() ran the batch %d times, want %d", batch.attempts, tt.wantAttempts)
+			}
+			if retries := metrics.batchRetries.Load() - retriesBefore; retries != tt.wantRetries {
+				t.Errorf("retryBatch() recorded %d retries, want %d", retries, tt.wantRetries)
+			}
+		})
+	}
+}
+
+func TestRetryBatchBacksOffExponentially(t *testing.T) {
+	logged := shortenRetries(t, 6)
+	transient := errs.FromDB("failed to update batch", &pgconn.PgError{Code: "40P01"})
+	batch := &failingBatch{failures: []error{transient, transient, transient, transient, transient}, rows: 1}
+
+	if _, err := retryBatch(context.Background(), "1-10", batch.run); err != nil {
+		t.Fatalf("retryBatch() error = %v", err)
+	}
+
+	var backoffs []string
+	for _, match := range regexp.MustCompile(`\(attempt (\d) of 6\), retrying in (\w+)`).FindAllStringSubmatch(logged.String(), -1) {
+		backoffs = append(backoffs, match[1]+":"+match[2])
+	}
+	// Doubling from 1ms, capped at 4ms
+	want := []string{"1:1ms", "2:2ms", "3:4ms", "4:4ms", "5:4ms"}
+	if fmt.Sprint(backoffs) != fmt.Sprint(want) {
+		t.Errorf("retryBatch() backed off %v, want %v\n%s", backoffs, want, logged)
+	}
+}
+
+func TestRetryBatchStopsWhenCanceled(t *testing.T) {
+	shortenRetries(t, 5)
+	batcher.InitialBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transient := errs.FromDB("failed to update batch", &pgconn.PgError{Code: "40001"})
+	batch := &failingBatch{failures: []error{transient, transient}}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		_, err = retryBatch(ctx, "1-10", batch.run)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retryBatch() kept waiting out its backoff after the context was canceled")
+	}
+	if !errors.Is(err, transient) {
+		t.Errorf("retryBatch() error = %v, want the last failure", err)
+	}
+	if batch.attempts != 1 {
+		t.Errorf("retryBatch() ran the batch %d times after the context was canceled, want 1", batch.attempts)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/batcher"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// This script undoes code-to-text before finalize-code-to-text has swapped the
+// columns. With -clear-codetext it sets codetext back to NULL over
+// -start-id..-end-id, from the highest id down, -batch-size rows at a time. With
+// -from-backup it restores code from a -backup-file of code-to-text and clears
+// codetext on the restored rows, -batch-size rows at a time. Both can be run
+// again with the same result. Since they throw work away, they only run with
+// -yes. Either mode clears the code-to-text checkpoints, those of runs
+// restricted by -chains included, so -resume doesn't skip the rows rolled back.
+
+func rollbackCodeToText(ctx context.Context, cfg *config.Config) error {
+	if *rollbackBackup == "" && !*rollbackClear {
+		return &errs.ValidationError{Field: "-from-backup", Reason: "pass -from-backup <file> or -clear-codetext"}
+	}
+	if *rollbackBackup != "" && *rollbackClear {
+		return &errs.ValidationError{Field: "-clear-codetext", Reason: "can't be combined with -from-backup"}
+	}
+	if !*rollbackYes {
+		return &errs.ValidationError{Field: "-yes", Reason: "rollback-code-to-text throws work away and only runs with -yes"}
+	}
+	if *dryRun {
+		return &errs.ValidationError{Field: "-dry-run", Reason: "rollback-code-to-text has no dry run"}
+	}
+	if *codeBatch <= 0 {
+		return &errs.ValidationError{Field: "-batch-size", Reason: fmt.Sprintf("%d must be greater than 0", *codeBatch)}
+	}
+	if *batchAttempts <= 0 {
+		return &errs.ValidationError{Field: "-batch-attempts", Reason: fmt.Sprintf("%d must be greater than 0", *batchAttempts)}
+	}
+	if *codeStart < 1 {
+		return &errs.ValidationError{Field: "-start-id", Reason: fmt.Sprintf("%d must be at least 1", *codeStart)}
+	}
+	if *codeEnd != 0 && *codeEnd < *codeStart {
+		return &errs.ValidationError{Field: "-end-id", Reason: fmt.Sprintf("%d is below -start-id %d", *codeEnd, *codeStart)}
+	}
+
+	connStr := cfg.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	codeType, err := columnType(db, "TransactionDetails", "code")
+	if err != nil {
+		return err
+	}
+	codeTextType, err := columnType(db, "TransactionDetails", "codetext")
+	if err != nil {
+		return err
+	}
+	if codeType != "jsonb" || codeTextType != "text" {
+		return &errs.SchemaError{Missing: "TransactionDetails.codetext",
+			Reason: fmt.Sprintf("expected jsonb code and text codetext columns, found code %q and codetext %q; a finalized code-to-text can't be rolled back", codeType, codeTextType)}
+	}
+
+	if *rollbackClear {
+		err = clearCodeText(ctx, db, connStr)
+	} else {
+		err = restoreCodeFromBackup(ctx, db, *rollbackBackup)
+	}
+	if err != nil {
+		return err
+	}
+
+	exists, err := tableExists(db, "MigratorWatermarks")
+	if err != nil {
+		return err
+	}
+	if exists {
+		// Also those of the runs restricted by -chains
+		if _, err := db.Exec(`DELETE FROM "MigratorWatermarks" WHERE command = $1 OR command LIKE $1 || ' chains %'`, codeCheckpointKey); err != nil {
+			return fmt.Errorf("failed to clear %s watermarks: %w", codeCheckpointKey, err)
+		}
+	}
+	return nil
+}
+
+// clearCodeText sets codetext to NULL from the end of the range down.
+func clearCodeText(ctx context.Context, db *sql.DB, connStr string) error {
+	endId := *codeEnd
+	if endId == 0 {
+		if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "TransactionDetails"`).Scan(&endId); err != nil {
+			return fmt.Errorf("failed to get max transaction details ID: %w", err)
+		}
+	}
+	if endId < *codeStart {
+		logNothingToDo("TransactionDetails", *codeStart, endId)
+		return nil
+	}
+
+	var cleaned int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM "TransactionDetails" WHERE id >= $1 AND id <= $2 AND `+codeCleanedCondition,
+		*codeStart, endId).Scan(&cleaned); err != nil {
+		return errs.FromDB("failed to count the rows cleanup-code cleared", err)
+	}
+	if cleaned > 0 {
+		log.Printf("Warning: %d rows of the range had their code cleared by cleanup-code and keep their codetext; restore them with -from-backup", cleaned)
+	}
+
+	pool, err := openBatchPool(connStr, 1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	run := &descendingRun{
+		command: "rollback-code-to-text",
+		table:   "TransactionDetails",
+		// A rollback clears every chain's rows, as it clears every checkpoint
+		inChains: "TRUE",
+		// The codetext of a row cleanup-code cleared is the only copy of its code
+		pending:   `codetext IS NOT NULL AND code IS NOT NULL`,
+		candidate: `code IS NOT NULL`,
+		verb:      "clear",
+		done:      "cleared",
+		startId:   *codeStart,
+		endId:     endId,
+		batchSize: *codeBatch,
+		workers:   1,
+		throttle:  newCodeThrottle(0, 0, nil),
+		sizer:     newBatchSizer(*codeBatch, 0, 0, 0),
+		batch:     clearCodeTextBatch,
+		summary: func(totals descendingTotals) {
+			log.Printf("Completed processing. Total TransactionDetails codetext cleared: %d (100.0%%)", totals.processed)
+		},
+	}
+	return run.run(ctx, db, pool)
+}
+
+// clearCodeTextBatch sets the codetext of the rows of the batch matching
+// pending to NULL.
+func clearCodeTextBatch(ctx context.Context, tx *batcher.Tx, startId, endId int, pending string) (codeBatchResult, error) {
+	ids := batcher.IDs(ctx)
+	cleared, err := execBatchUpdate(ctx, tx, fmt.Sprintf(`
+		UPDATE "TransactionDetails"
+		SET codetext = NULL
+		WHERE id = ANY($1::int[]) AND %s
+	`, pending), ids)
+	if err != nil {
+		return codeBatchResult{}, err
+	}
+	return codeBatchResult{updated: cleared, alreadyDone: len(ids) - cleared}, nil
+}
+
+// restoreCodeFromBackup writes the code of every backed-up row within the range
+// back, and clears its codetext. The file is read through once before anything
+// is written, so a corrupted one restores nothing. A last batch cut short by a
+// killed code-to-text isn't corruption: the rows up to its last whole one are
+// restored.
+func restoreCodeFromBackup(ctx context.Context, db *sql.DB, path string) error {
+	inRange := func(id int) bool {
+		return id >= *codeStart && (*codeEnd == 0 || id <= *codeEnd)
+	}
+
+	total := 0
+	truncated, err := readCodeBackup(path, func(row codeBackupRow) error {
+		if inRange(row.Id) {
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if truncated {
+		log.Printf("Warning: %s ends with a batch cut short by a killed code-to-text; that batch never committed, so the rows missing from it still have their code", path)
+	}
+	if total == 0 {
+		log.Printf("Nothing to do: %s has no rows within ids %d-%d", path, *codeStart, *codeEnd)
+		return nil
+	}
+	log.Printf("Restoring code of %d backed-up rows from %s", total, path)
+
+	var (
+		batch               = make(map[int]codeBackupRow)
+		read                = 0
+		totalRestored       = 0
+		lastProgressPrinted = -1.0
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids := make([]int64, 0, len(batch))
+		codes := make([]sql.NullString, 0, len(batch))
+		for id, row := range batch {
+			ids = append(ids, int64(id))
+			codes = append(codes, sql.NullString{String: string(row.Code), Valid: len(row.Code) > 0})
+		}
+
+		restored, err := retryBatch(ctx, fmt.Sprintf("of %d rows", len(batch)), func() (int, error) {
+			result, err := db.Exec(`
+				UPDATE "TransactionDetails" AS t
+				SET code = b.code::jsonb, codetext = NULL
+				FROM unnest($1::int[], $2::text[]) AS b(id, code)
+				WHERE t.id = b.id
+			`, pq.Array(ids), pq.Array(codes))
+			if err != nil {
+				return 0, errs.FromDB("failed to restore code", err)
+			}
+			affected, err := result.RowsAffected()
+			return int(affected), err
+		})
+		if err != nil {
+			return err
+		}
+		totalRestored += restored
+		batch = make(map[int]codeBackupRow)
+
+		progressPercent := percentOf(read, total)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, restored so far: %d", progressPercent, totalRestored)
+			lastProgressPrinted = progressPercent
+		}
+		return nil
+	}
+
+	_, err = readCodeBackup(path, func(row codeBackupRow) error {
+		if !inRange(row.Id) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return &errs.Interrupted{Done: fmt.Sprintf("%d of %d backed-up rows restored; rerun to restore the rest", read-len(batch), total)}
+		}
+		// A later run's backup of the same row holds the same code
+		batch[row.Id] = row
+		read++
+		if len(batch) >= *codeBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	log.Printf("Completed processing. Total TransactionDetails code restored: %d (100.0%%)", totalRestored)
+	return nil
+}
+
+func RollbackCodeToText(ctx context.Context, cfg *config.Config) error {
+	return rollbackCodeToText(ctx, cfg)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"go-backfill/safejson"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	rotationBatchSize     = 1000
+	rotationsWatermarkKey = "backfill-rotations"
+)
+
+// This script builds the GuardChanges table: one row every time an account's guard
+// was rotated, with the guard before and after the change. Rotations are detected
+// from ROTATE events and from successful transactions calling a module's rotate
+// function. The new guard comes from the event params or the keyset passed to the
+// rotate call; the old guard is the new guard of the previous rotation of the same
+// account. When either side can't be recovered it is stored as unknown instead of
+// being guessed.
+
+type guardRotation struct {
+	TransactionId int
+	EventId       *int
+	ChainId       int
+	Height        int
+	Module        string
+	Account       string
+	NewGuard      json.RawMessage
+	Source        string
+}
+
+func backfillRotations() error {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createGuardChangesTables(db); err != nil {
+		return err
+	}
+
+	codeExpr, err := codeTextExpression(db)
+	if err != nil {
+		return err
+	}
+
+	events := rotationEventNames()
+	log.Printf("Detecting rotations from events: %s", strings.Join(events, ", "))
+
+	lastId, err := readWatermark(db, rotationsWatermarkKey)
+	if err != nil {
+		return err
+	}
+
+	var maxTransactionId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "Transactions"`).Scan(&maxTransactionId); err != nil {
+		return fmt.Errorf("failed to get max transaction ID: %w", err)
+	}
+
+	maxTransactionId, err = capToLiveWatermark(db, "Transactions", maxTransactionId, false)
+	if err != nil {
+		return err
+	}
+
+	if maxTransactionId <= lastId {
+		logNothingToDo("Transactions", lastId+1, maxTransactionId)
+		log.Printf("Guard changes are up to date (watermark at id %d)", lastId)
+		log.Println("Completed processing. Total rotations recorded: 0 (100.0%)")
+		return nil
+	}
+
+	totalRotations := 0
+	unknownBefore := 0
+	unknownAfter := 0
+	skipped := make(skipCounts)
+	totalIds := maxTransactionId - lastId
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to detect rotations from transaction ID %d to %d", lastId+1, maxTransactionId)
+
+	for currentId := lastId + 1; currentId <= maxTransactionId; currentId += rotationBatchSize {
+		batchEnd := currentId + rotationBatchSize - 1
+		if batchEnd > maxTransactionId {
+			batchEnd = maxTransactionId
+		}
+
+		rotations, before, after, err := processRotationsBatch(db, codeExpr, events, currentId, batchEnd, skipped)
+		if err != nil {
+			return fmt.Errorf("failed to process batch %d-%d: %w", currentId, batchEnd, err)
+		}
+		totalRotations += rotations
+		unknownBefore += before
+		unknownAfter += after
+
+		progressPercent := percentOf(batchEnd-lastId, totalIds)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, rotations recorded: %d", progressPercent, totalRotations)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total rotations recorded: %d (100.0%%)", totalRotations)
+	log.Printf("Rotations with unknown old guard: %d, unknown new guard: %d", unknownBefore, unknownAfter)
+	logSkipSummary("rotation events and calls", skipped)
+	return nil
+}
+
+func createGuardChangesTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "GuardChanges" (
+			id SERIAL PRIMARY KEY,
+			"transactionId" INTEGER NOT NULL,
+			"eventId" INTEGER,
+			"chainId" INTEGER NOT NULL,
+			height BIGINT NOT NULL,
+			module TEXT NOT NULL,
+			account TEXT NOT NULL,
+			"oldGuard" JSONB,
+			"oldGuardStatus" TEXT NOT NULL,
+			"newGuard" JSONB,
+			"newGuardStatus" TEXT NOT NULL,
+			source TEXT NOT NULL,
+			"createdAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE ("transactionId", module, account)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create GuardChanges table: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS guardchanges_account_order_idx
+		ON "GuardChanges" (account, module, "chainId", height, "transactionId")
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create GuardChanges account index: %w", err)
+	}
+
+	if err := addLineageColumn(db, "GuardChanges"); err != nil {
+		return err
+	}
+	return createWatermarksTable(db)
+}
+
+func rotationEventNames() []string {
+	events := []string{"coin.ROTATE"}
+	for _, name := range strings.Split(*rotationEvents, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && name != "coin.ROTATE" {
+			events = append(events, name)
+		}
+	}
+	return events
+}
+
+func processRotationsBatch(db *sql.DB, codeExpr string, events []string, startId, endId int, skipped skipCounts) (int, int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, 0, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	fromEvents, err := fetchRotationEvents(tx, events, startId, endId, skipped)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	fromCalls, err := fetchRotateCalls(tx, codeExpr, startId, endId, skipped)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	rotations := mergeRotations(fromEvents, fromCalls)
+
+	unknownBefore := 0
+	unknownAfter := 0
+	for _, rotation := range rotations {
+		oldGuard, err := previousGuard(tx, rotation)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		oldStatus, newStatus := "known", "known"
+		if oldGuard == nil {
+			oldStatus = "unknown"
+			unknownBefore++
+		}
+		if rotation.NewGuard == nil {
+			newStatus = "unknown"
+			unknownAfter++
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO "GuardChanges" (
+				"transactionId", "eventId", "chainId", height, module, account,
+				"oldGuard", "oldGuardStatus", "newGuard", "newGuardStatus", source, "lastRunId"
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT ("transactionId", module, account) DO UPDATE
+			SET "eventId" = EXCLUDED."eventId", "chainId" = EXCLUDED."chainId", height = EXCLUDED.height,
+				"oldGuard" = EXCLUDED."oldGuard", "oldGuardStatus" = EXCLUDED."oldGuardStatus",
+				"newGuard" = EXCLUDED."newGuard", "newGuardStatus" = EXCLUDED."newGuardStatus",
+				source = EXCLUDED.source, "lastRunId" = EXCLUDED."lastRunId"
+		`, rotation.TransactionId, rotation.EventId, rotation.ChainId, rotation.Height, rotation.Module, rotation.Account,
+			nullableJSON(oldGuard), oldStatus, nullableJSON(rotation.NewGuard), newStatus, rotation.Source, runId)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to insert guard change for %s in transaction %d: %w", rotation.Account, rotation.TransactionId, err)
+		}
+	}
+
+	if err := writeWatermark(tx, rotationsWatermarkKey, endId); err != nil {
+		return 0, 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, 0, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return len(rotations), unknownBefore, unknownAfter, nil
+}
+
+func fetchRotationEvents(tx *sql.Tx, events []string, startId, endId int, skipped skipCounts) ([]guardRotation, error) {
+	rows, err := tx.Query(`
+		SELECT e.id, e."transactionId", e."chainId", b.height, e.module, e.params
+		FROM "Events" e
+		JOIN "Transactions" t ON t.id = e."transactionId"
+		JOIN "Blocks" b ON b.id = t."blockId"
+		WHERE e."transactionId" >= $1 AND e."transactionId" <= $2
+		AND e.qualname = ANY($3)
+		AND b.canonical IS NOT FALSE
+	`, startId, endId, pq.Array(events))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rotation events: %w", err)
+	}
+	defer rows.Close()
+
+	var rotations []guardRotation
+	for rows.Next() {
+		var (
+			rotation guardRotation
+			eventId  int
+			params   []byte
+		)
+		if err := rows.Scan(&eventId, &rotation.TransactionId, &rotation.ChainId, &rotation.Height, &rotation.Module, &params); err != nil {
+			return nil, fmt.Errorf("failed to scan rotation event: %w", err)
+		}
+		rotation.EventId = &eventId
+		rotation.Source = "event"
+
+		var decoded []json.RawMessage
+		if err := safejson.Unmarshal(params, &decoded, jsonLimits()); err != nil || len(decoded) == 0 {
+			if limit, ok := jsonLimitBreached(err); ok {
+				log.Printf("Skipping rotation event %d whose params exceed the JSON %s", eventId, limit)
+				skipped.add(skipJSONLimit, 1)
+			} else {
+				log.Printf("Skipping rotation event %d with unexpected params", eventId)
+				skipped.add(skipInvalidJSON, 1)
+			}
+			continue
+		}
+		if err := json.Unmarshal(decoded[0], &rotation.Account); err != nil {
+			log.Printf("Skipping rotation event %d whose account is not a string", eventId)
+			skipped.add(skipWrongType, 1)
+			continue
+		}
+		// Some fungibles include the new guard as the second parameter
+		if len(decoded) >= 2 && isGuardJSON(decoded[1]) {
+			rotation.NewGuard = decoded[1]
+		}
+
+		rotations = append(rotations, rotation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rotation events: %w", err)
+	}
+
+	return rotations, nil
+}
+
+func fetchRotateCalls(tx *sql.Tx, codeExpr string, startId, endId int, skipped skipCounts) ([]guardRotation, error) {
+	query := fmt.Sprintf(`
+		SELECT t.id, t."chainId", b.height, %s, td.data
+		FROM "TransactionDetails" td
+		JOIN "Transactions" t ON t.id = td."transactionId"
+		JOIN "Blocks" b ON b.id = t."blockId"
+		WHERE td."transactionId" >= $1 AND td."transactionId" <= $2
+		AND %s LIKE '%%.rotate%%'
+		AND t.result->>'status' = 'success'
+		AND b.canonical IS NOT FALSE
+	`, codeExpr, codeExpr)
+
+	rows, err := tx.Query(query, startId, endId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rotate calls: %w", err)
+	}
+	defer rows.Close()
+
+	var rotations []guardRotation
+	for rows.Next() {
+		var (
+			transactionId int
+			chainId       int
+			height        int
+			code          string
+			data          []byte
+		)
+		if err := rows.Scan(&transactionId, &chainId, &height, &code, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan rotate call: %w", err)
+		}
+
+		forms, err := parsePactCode(code)
+		if err != nil {
+			log.Printf("Skipping unparsable code of transaction %d: %v", transactionId, err)
+			skipped.add(skipUnparsableCode, 1)
+			continue
+		}
+
+		var envData map[string]json.RawMessage
+		if len(data) > 0 {
+			if err := safejson.Unmarshal(data, &envData, jsonLimits()); err != nil {
+				if limit, ok := jsonLimitBreached(err); ok {
+					log.Printf("Ignoring env data of transaction %d which exceeds the JSON %s", transactionId, limit)
+				}
+				envData = nil
+			}
+		}
+
+		for _, call := range findPactCalls(forms, []string{"rotate"}) {
+			// Only qualified calls can be attributed to a module
+			module, _, qualified := cutLast(call.Function, ".")
+			if !qualified {
+				skipped.add(skipUnqualifiedCall, 1)
+				continue
+			}
+			if len(call.Args) < 2 {
+				skipped.add(skipMissingArgument, 1)
+				continue
+			}
+
+			account, _, reason := resolveStringArgument(call.Args[0], stringValues(envData))
+			if reason != "" {
+				skipped.add(reason, 1)
+				continue
+			}
+
+			rotations = append(rotations, guardRotation{
+				TransactionId: transactionId,
+				ChainId:       chainId,
+				Height:        height,
+				Module:        module,
+				Account:       account,
+				NewGuard:      resolveGuardArgument(call.Args[1], envData),
+				Source:        "call",
+			})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rotate calls: %w", err)
+	}
+
+	return rotations, nil
+}
+
+// mergeRotations combines event and call detections of the same rotation, keeping
+// the event as the primary source and filling in the new guard from the call, and
+// orders the result so earlier rotations are stored before later ones.
+func mergeRotations(fromEvents, fromCalls []guardRotation) []guardRotation {
+	key := func(r guardRotation) string {
+		return fmt.Sprintf("%d|%s|%s", r.TransactionId, r.Module, r.Account)
+	}
+
+	merged := make(map[string]guardRotation)
+	for _, rotation := range fromEvents {
+		merged[key(rotation)] = rotation
+	}
+	for _, rotation := range fromCalls {
+		k := key(rotation)
+		if existing, ok := merged[k]; ok {
+			if existing.NewGuard == nil {
+				existing.NewGuard = rotation.NewGuard
+				merged[k] = existing
+			}
+			continue
+		}
+		merged[k] = rotation
+	}
+
+	rotations := make([]guardRotation, 0, len(merged))
+	for _, rotation := range merged {
+		rotations = append(rotations, rotation)
+	}
+	sort.Slice(rotations, func(i, j int) bool {
+		if rotations[i].Height != rotations[j].Height {
+			return rotations[i].Height < rotations[j].Height
+		}
+		if rotations[i].TransactionId != rotations[j].TransactionId {
+			return rotations[i].TransactionId < rotations[j].TransactionId
+		}
+		return key(rotations[i]) < key(rotations[j])
+	})
+
+	return rotations
+}
+
+func previousGuard(tx *sql.Tx, rotation guardRotation) (json.RawMessage, error) {
+	var guard []byte
+	err := tx.QueryRow(`
+		SELECT "newGuard"
+		FROM "GuardChanges"
+		WHERE "chainId" = $1 AND module = $2 AND account = $3
+		AND (height, "transactionId") < ($4, $5)
+		ORDER BY height DESC, "transactionId" DESC
+		LIMIT 1
+	`, rotation.ChainId, rotation.Module, rotation.Account, rotation.Height, rotation.TransactionId).Scan(&guard)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up previous guard of %s: %w", rotation.Account, err)
+	}
+	return guard, nil
+}
+
+// resolveGuardArgument returns the keyset passed to a rotate call when it is read
+// from the env data with read-keyset or read-msg.
+func resolveGuardArgument(arg pactValue, envData map[string]json.RawMessage) json.RawMessage {
+	if arg.Kind != pactExpr || len(arg.Children) != 2 || arg.Children[0].Kind != pactAtom {
+		return nil
+	}
+
+	head := arg.Children[0].Text
+	key := arg.Children[1]
+	if (head != "read-keyset" && head != "read-msg") || (key.Kind != pactString && key.Kind != pactSymbol) {
+		return nil
+	}
+
+	guard, ok := envData[key.Text]
+	if !ok || !isGuardJSON(guard) {
+		return nil
+	}
+	return guard
+}
+
+func isGuardJSON(value json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(value)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+func stringValues(envData map[string]json.RawMessage) map[string]interface{} {
+	values := make(map[string]interface{}, len(envData))
+	for key, raw := range envData {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err == nil {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func nullableJSON(value json.RawMessage) interface{} {
+	if value == nil {
+		return nil
+	}
+	return []byte(value)
+}
+
+func BackfillRotations(ctx context.Context, cfg *config.Config) error {
+	return backfillRotations()
+}
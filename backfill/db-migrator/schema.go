@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"go-backfill/errs"
+)
+
+// TransactionDetails.code is jsonb on databases that have not been through the
+// code-to-text migration yet and text afterwards. Commands that read the Pact
+// code use this expression so they work on either schema.
+func codeTextExpression(db *sql.DB) (string, error) {
+	dataType, err := columnType(db, "TransactionDetails", "code")
+	if err != nil {
+		return "", err
+	}
+
+	switch dataType {
+	case "jsonb":
+		return `td.code #>> '{}'`, nil
+	case "text":
+		return `td.code`, nil
+	case "":
+		return "", &errs.SchemaError{Missing: "TransactionDetails.code"}
+	default:
+		return "", &errs.SchemaError{Missing: "TransactionDetails.code", Reason: "unsupported column type " + dataType}
+	}
+}
+
+// columnType returns the data type of table.column, or "" when the column
+// doesn't exist.
+func columnType(db *sql.DB, table, column string) (string, error) {
+	var dataType string
+	err := db.QueryRow(`
+		SELECT data_type
+		FROM information_schema.columns
+		WHERE table_name = $1 AND column_name = $2
+	`, table, column).Scan(&dataType)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect %s.%s column: %w", table, column, err)
+	}
+	return dataType, nil
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, fmt.Sprintf(`"%s"`, table)).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if table %s exists: %w", table, err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// On SIGINT or SIGTERM, commands that support it stop handing out batches, let
+// the batches in flight commit, log what was completed and how to pick up from
+// there, and exit with errs.ExitInterrupted. A second signal exits immediately.
+// Other commands exit on the first signal; whatever transaction they had open is
+// rolled back by the server. Either way the exit hooks run and the run is
+// recorded as stopped before the process exits.
+
+// interruptibleCommands stop gracefully on the first signal.
+var interruptibleCommands = map[string]bool{
+	"code-to-text":          true,
+	"code-hash":             true,
+	"gas-backfill":          true,
+	"cleanup-code":          true,
+	"creation-time":         true,
+	"reconcile":             true,
+	"serve-status":          true,
+	"rollback-code-to-text": true,
+}
+
+// shutdownCtx is canceled by the first SIGINT or SIGTERM.
+var shutdownCtx = context.Background()
+
+func watchSignals(name string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdownCtx = ctx
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		if !interruptibleCommands[name] {
+			log.Printf("Received %s, exiting", received)
+			exitInterrupted(&errs.Interrupted{Done: fmt.Sprintf("received %s before the command completed", received)})
+		}
+		log.Printf("Received %s, stopping once the batches in flight have committed; signal again to exit immediately", received)
+		cancel()
+
+		received = <-signals
+		log.Printf("Received %s again, exiting without waiting for the batches in flight", received)
+		exitInterrupted(&errs.Interrupted{Done: fmt.Sprintf("received %s again before the batches in flight committed", received)})
+	}()
+}
+
+// interrupted reports whether a shutdown was requested.
+func interrupted() bool {
+	return shutdownCtx.Err() != nil
+}
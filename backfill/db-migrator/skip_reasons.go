@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-backfill/errs"
+	"log"
+	"sort"
+)
+
+// Commands classify every row or item they leave out with one of the skip
+// reasons registered here, so the summaries of different commands count the same
+// things under the same codes. A command needing a new reason registers it next
+// to the others; registering a code twice panics at startup.
+
+type skipReason string
+
+// skipReasons maps every registered code to its description.
+var skipReasons = make(map[skipReason]string)
+
+func registerSkipReason(code, description string) skipReason {
+	reason := skipReason(code)
+	if _, taken := skipReasons[reason]; taken {
+		panic(fmt.Sprintf("skip reason %q is registered twice", code))
+	}
+	skipReasons[reason] = description
+	return reason
+}
+
+var (
+	skipUnparsableCode      = registerSkipReason("unparsable_code", "code that doesn't parse as Pact")
+	skipInvalidJSON         = registerSkipReason("invalid_json", "JSON that doesn't decode to the expected shape")
+	skipJSONLimit           = registerSkipReason("json_limit", "JSON over a configured limit")
+	skipMissingArgument     = registerSkipReason("missing_argument", "call without the arguments needed")
+	skipUnsupportedArgument = registerSkipReason("unsupported_argument", "argument that can't be resolved statically")
+	skipUnqualifiedCall     = registerSkipReason("unqualified_call", "call that can't be attributed to a module")
+	skipMissingKey          = registerSkipReason("missing_key", "env data key that isn't present")
+	skipWrongType           = registerSkipReason("wrong_type", "value of an unexpected type")
+	skipEmptyValue          = registerSkipReason("empty_value", "empty value")
+	skipTooLong             = registerSkipReason("too_long", "value over a length cap")
+	skipNotPrintable        = registerSkipReason("not_printable", "binary or non-printable value")
+	skipMalformedPayload    = registerSkipReason("malformed_payload", "node payload that isn't shaped as expected")
+	skipNodeError           = registerSkipReason("node_error", "node request that failed")
+)
+
+// skipReasonOf classifies an error an item was skipped for by its category.
+func skipReasonOf(err error) skipReason {
+	if _, ok := jsonLimitBreached(err); ok {
+		return skipJSONLimit
+	}
+
+	var (
+		limitErr *errs.LimitExceeded
+		nodeErr  *errs.NodeError
+	)
+	switch {
+	case errors.As(err, &limitErr):
+		return skipJSONLimit
+	case errors.As(err, &nodeErr):
+		return skipNodeError
+	default:
+		return skipMalformedPayload
+	}
+}
+
+// skipCounts counts skipped items per reason.
+type skipCounts map[skipReason]int
+
+func (s skipCounts) add(reason skipReason, n int) {
+	s[reason] += n
+	metrics.skipped(n)
+}
+
+func (s skipCounts) total() int {
+	total := 0
+	for _, n := range s {
+		total += n
+	}
+	return total
+}
+
+// logSkipSummary logs how many of what were skipped per reason, in code order.
+func logSkipSummary(what string, skipped skipCounts) {
+	if skipped.total() == 0 {
+		log.Printf("No %s were skipped", what)
+		return
+	}
+
+	reasons := make([]string, 0, len(skipped))
+	for reason := range skipped {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+
+	log.Printf("Skipped %s per reason (%d in total):", what, skipped.total())
+	for _, reason := range reasons {
+		log.Printf("  %s (%s): %d", reason, skipReasons[skipReason(reason)], skipped[skipReason(reason)])
+	}
+}
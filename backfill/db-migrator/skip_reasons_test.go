@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go-backfill/errs"
+	"go-backfill/safejson"
+	"regexp"
+	"testing"
+)
+
+var skipReasonCode = regexp.MustCompile(`^[a-z]+(_[a-z]+)*$`)
+
+func TestSkipReasonsAreRegistered(t *testing.T) {
+	for reason, description := range skipReasons {
+		if !skipReasonCode.MatchString(string(reason)) {
+			t.Errorf("skip reason %q is not a snake_case code", reason)
+		}
+		if description == "" {
+			t.Errorf("skip reason %s has no description", reason)
+		}
+	}
+	for _, reason := range []skipReason{skipUnparsableCode, skipJSONLimit, skipMalformedPayload, skipNodeError} {
+		if _, ok := skipReasons[reason]; !ok {
+			t.Errorf("skip reason %s is not in the registry", reason)
+		}
+	}
+}
+
+func TestRegisterSkipReason(t *testing.T) {
+	// A new command adds its reason next to the others
+	reason := registerSkipReason("test_only_reason", "reason registered by the test")
+	t.Cleanup(func() { delete(skipReasons, reason) })
+	if skipReasons[reason] != "reason registered by the test" {
+		t.Errorf("registerSkipReason() didn't record the description")
+	}
+
+	// And can't take a code that is already registered
+	for _, code := range []string{string(skipTooLong), string(reason)} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("registerSkipReason(%s) of a taken code didn't panic", code)
+				} else if want := fmt.Sprintf("skip reason %q is registered twice", code); r != want {
+					t.Errorf("registerSkipReason(%s) panicked with %v, want %s", code, r, want)
+				}
+			}()
+			registerSkipReason(code, "colliding reason")
+		}()
+	}
+	if skipReasons[skipTooLong] != "value over a length cap" {
+		t.Errorf("a colliding registration replaced the description of %s", skipTooLong)
+	}
+}
+
+func TestSkipReasonOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want skipReason
+	}{
+		{name: "safejson limit", err: fmt.Errorf("payload: %w", &safejson.LimitError{Limit: safejson.LimitDepth, Max: 128}), want: skipJSONLimit},
+		{name: "limit exceeded", err: &errs.LimitExceeded{Limit: "payload", Err: errors.New("too large")}, want: skipJSONLimit},
+		{name: "node error", err: fmt.Errorf("block 7: %w", &errs.NodeError{StatusCode: 404, Endpoint: "/payload"}), want: skipNodeError},
+		{name: "anything else", err: errors.New("unexpected shape"), want: skipMalformedPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := skipReasonOf(tt.err); got != tt.want {
+				t.Errorf("skipReasonOf() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipCounts(t *testing.T) {
+	skipped := skipCounts{}
+	if skipped.total() != 0 {
+		t.Errorf("total() of no skips = %d", skipped.total())
+	}
+	skipped.add(skipTooLong, 2)
+	skipped.add(skipWrongType, 1)
+	skipped.add(skipTooLong, 3)
+	if skipped[skipTooLong] != 5 || skipped[skipWrongType] != 1 || skipped.total() != 6 {
+		t.Errorf("skipCounts = %v with total %d, want too_long 5 and wrong_type 1", skipped, skipped.total())
+	}
+}
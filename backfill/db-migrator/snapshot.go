@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Before a mutating run gets approved, -snapshot-sample=N plans it: N random rows
+// of every table the command writes are written with their current values to
+// -snapshot-file, the file's sha256 is recorded in MigratorSnapshots, and the
+// command exits without running. Columns listed in SNAPSHOT_MASK_COLUMNS
+// (Table.column, comma-separated) are replaced by a hash of their value.
+//
+// The real run passes the same -snapshot-file. It refuses to start unless the file
+// is a recorded snapshot of the same command and tables whose sampled rows still
+// hold the snapshotted values, so what was reviewed is what gets changed.
+// Afterwards snapshot-diff compares the sampled rows with the snapshot, column by
+// column, for a quick look at the transformation.
+
+type snapshotTable struct {
+	Table string `json:"table"`
+	// MaxId is the highest id of the table when the snapshot was taken
+	MaxId int               `json:"maxId"`
+	Rows  []json.RawMessage `json:"rows"`
+}
+
+type snapshotFile struct {
+	RunId     string          `json:"runId"`
+	Command   string          `json:"command"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Masked    []string        `json:"masked"`
+	Tables    []snapshotTable `json:"tables"`
+}
+
+func createSnapshotsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "MigratorSnapshots" (
+			id SERIAL PRIMARY KEY,
+			"runId" TEXT NOT NULL,
+			command TEXT NOT NULL,
+			file TEXT NOT NULL,
+			checksum TEXT NOT NULL UNIQUE,
+			"sampledRows" INTEGER NOT NULL,
+			"createdAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create MigratorSnapshots table: %w", err)
+	}
+	return nil
+}
+
+func openSnapshotDB() (*sql.DB, error) {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	return db, nil
+}
+
+// snapshotMaskColumns returns the masked columns by table.
+func snapshotMaskColumns() (map[string][]string, []string, error) {
+	masked := make(map[string][]string)
+	var names []string
+	for _, name := range strings.Split(config.GetConfig().SnapshotMaskColumns, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		table, column, found := strings.Cut(name, ".")
+		if !found || table == "" || column == "" {
+			return nil, nil, &errs.ValidationError{Field: "SNAPSHOT_MASK_COLUMNS", Reason: fmt.Sprintf("expected Table.column, got %q", name)}
+		}
+		masked[table] = append(masked[table], column)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return masked, names, nil
+}
+
+// maskSnapshotRow replaces the masked columns of a row by the sha256 of their
+// value, so masked rows can still be compared.
+func maskSnapshotRow(row json.RawMessage, columns []string) (json.RawMessage, error) {
+	if len(columns) == 0 {
+		return row, nil
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(row, &values); err != nil {
+		return nil, fmt.Errorf("failed to decode row: %w", err)
+	}
+	for _, column := range columns {
+		value, ok := values[column]
+		if !ok || string(value) == "null" {
+			continue
+		}
+		sum := sha256.Sum256(value)
+		masked, _ := json.Marshal("sha256:" + hex.EncodeToString(sum[:]))
+		values[column] = masked
+	}
+	return json.Marshal(values)
+}
+
+// captureSnapshot plans a run of name: it samples -snapshot-sample rows of every
+// table the command writes into -snapshot-file.
+func captureSnapshot(name string) error {
+	if *snapshotFilePath == "" {
+		return &errs.ValidationError{Field: "-snapshot-file", Reason: "a file to write the snapshot to is required with -snapshot-sample"}
+	}
+	tables := commandTables(name)
+	if len(tables) == 0 {
+		return &errs.ValidationError{Field: "-snapshot-sample", Reason: fmt.Sprintf("%s doesn't change any table that can be snapshotted", name)}
+	}
+	masked, maskedNames, err := snapshotMaskColumns()
+	if err != nil {
+		return err
+	}
+
+	db, err := openSnapshotDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := createSnapshotsTable(db); err != nil {
+		return err
+	}
+
+	snapshot := snapshotFile{RunId: runId, Command: name, CreatedAt: time.Now().UTC(), Masked: maskedNames}
+	sampled := 0
+	for _, table := range tables {
+		exists, err := tableExists(db, table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			log.Printf("Table %s doesn't exist yet, nothing to snapshot", table)
+			continue
+		}
+
+		sample, err := sampleSnapshotTable(db, table, *snapshotSample, masked[table])
+		if err != nil {
+			return err
+		}
+		snapshot.Tables = append(snapshot.Tables, sample)
+		sampled += len(sample.Rows)
+		log.Printf("Sampled %d rows of %s (ids up to %d)", len(sample.Rows), table, sample.MaxId)
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := os.WriteFile(*snapshotFilePath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *snapshotFilePath, err)
+	}
+	checksum := snapshotChecksum(data)
+
+	_, err = db.Exec(`
+		INSERT INTO "MigratorSnapshots" ("runId", command, file, checksum, "sampledRows")
+		VALUES ($1, $2, $3, $4, $5)
+	`, runId, name, *snapshotFilePath, checksum, sampled)
+	if err != nil {
+		return fmt.Errorf("failed to record snapshot: %w", err)
+	}
+
+	log.Printf("Completed processing. Total rows snapshotted: %d (100.0%%)", sampled)
+	log.Printf("Snapshot written to %s, sha256 %s; pass -snapshot-file=%s to the real run", *snapshotFilePath, checksum, *snapshotFilePath)
+	return nil
+}
+
+func snapshotChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sampleSnapshotTable picks up to n random rows of table below the live
+// watermark. Ids are drawn uniformly from the id range, oversampled to make up for
+// gaps.
+func sampleSnapshotTable(db *sql.DB, table string, n int, masked []string) (snapshotTable, error) {
+	sample := snapshotTable{Table: table, Rows: []json.RawMessage{}}
+
+	var maxId int
+	if err := db.QueryRow(fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM "%s"`, table)).Scan(&maxId); err != nil {
+		return snapshotTable{}, fmt.Errorf("failed to get max id of %s: %w", table, err)
+	}
+	maxId, err := capToLiveWatermark(db, table, maxId, false)
+	if err != nil {
+		return snapshotTable{}, err
+	}
+	sample.MaxId = maxId
+	if maxId < 1 {
+		return sample, nil
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT row FROM (
+			SELECT t.id, to_jsonb(t)::text AS row
+			FROM "%s" t
+			WHERE t.id IN (SELECT (1 + floor(random() * $1))::int FROM generate_series(1, $2))
+			ORDER BY random()
+			LIMIT $3
+		) sampled
+		ORDER BY id
+	`, table), maxId, n*4, n)
+	if err != nil {
+		return snapshotTable{}, fmt.Errorf("failed to sample %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row []byte
+		if err := rows.Scan(&row); err != nil {
+			return snapshotTable{}, fmt.Errorf("failed to scan row of %s: %w", table, err)
+		}
+		maskedRow, err := maskSnapshotRow(row, masked)
+		if err != nil {
+			return snapshotTable{}, fmt.Errorf("failed to mask row of %s: %w", table, err)
+		}
+		sample.Rows = append(sample.Rows, maskedRow)
+	}
+	if err := rows.Err(); err != nil {
+		return snapshotTable{}, fmt.Errorf("error iterating rows of %s: %w", table, err)
+	}
+	return sample, nil
+}
+
+// loadSnapshot reads a snapshot file and checks that it is recorded in
+// MigratorSnapshots unaltered.
+func loadSnapshot(db *sql.DB, path string) (snapshotFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshotFile{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if err := createSnapshotsTable(db); err != nil {
+		return snapshotFile{}, err
+	}
+	var recorded bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM "MigratorSnapshots" WHERE checksum = $1)`, snapshotChecksum(data)).Scan(&recorded)
+	if err != nil {
+		return snapshotFile{}, fmt.Errorf("failed to look up snapshot: %w", err)
+	}
+	if !recorded {
+		return snapshotFile{}, &errs.ValidationError{Field: "-snapshot-file", Reason: fmt.Sprintf("%s doesn't match any recorded snapshot; it was altered or taken against another database", path)}
+	}
+
+	var snapshot snapshotFile
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshotFile{}, &errs.ValidationError{Field: "-snapshot-file", Reason: fmt.Sprintf("failed to parse %s: %v", path, err)}
+	}
+	return snapshot, nil
+}
+
+type snapshotRowDiff struct {
+	Table   string
+	Id      int64
+	Missing bool
+	Columns []string
+}
+
+// diffSnapshot compares the sampled rows with their current values.
+func diffSnapshot(db *sql.DB, snapshot snapshotFile) ([]snapshotRowDiff, int, error) {
+	masked := make(map[string][]string)
+	for _, name := range snapshot.Masked {
+		table, column, _ := strings.Cut(name, ".")
+		masked[table] = append(masked[table], column)
+	}
+
+	var (
+		diffs   []snapshotRowDiff
+		checked int
+	)
+	for _, table := range snapshot.Tables {
+		before := make(map[int64]map[string]interface{}, len(table.Rows))
+		ids := make([]int64, 0, len(table.Rows))
+		for _, row := range table.Rows {
+			values, err := decodeSnapshotRow(row)
+			if err != nil {
+				return nil, 0, &errs.ValidationError{Field: "-snapshot-file", Reason: fmt.Sprintf("row of %s: %v", table.Table, err)}
+			}
+			id, err := snapshotRowId(values)
+			if err != nil {
+				return nil, 0, &errs.ValidationError{Field: "-snapshot-file", Reason: fmt.Sprintf("row of %s: %v", table.Table, err)}
+			}
+			before[id] = values
+			ids = append(ids, id)
+		}
+
+		rows, err := db.Query(fmt.Sprintf(`SELECT id, to_jsonb(t)::text FROM "%s" t WHERE id = ANY($1)`, table.Table), pq.Array(ids))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read current rows of %s: %w", table.Table, err)
+		}
+		after := make(map[int64]map[string]interface{}, len(ids))
+		for rows.Next() {
+			var (
+				id  int64
+				row []byte
+			)
+			if err := rows.Scan(&id, &row); err != nil {
+				rows.Close()
+				return nil, 0, fmt.Errorf("failed to scan row of %s: %w", table.Table, err)
+			}
+			maskedRow, err := maskSnapshotRow(row, masked[table.Table])
+			if err != nil {
+				rows.Close()
+				return nil, 0, fmt.Errorf("failed to mask row of %s: %w", table.Table, err)
+			}
+			values, err := decodeSnapshotRow(maskedRow)
+			if err != nil {
+				rows.Close()
+				return nil, 0, fmt.Errorf("failed to decode row %d of %s: %w", id, table.Table, err)
+			}
+			after[id] = values
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("error iterating rows of %s: %w", table.Table, err)
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			checked++
+			current, ok := after[id]
+			if !ok {
+				diffs = append(diffs, snapshotRowDiff{Table: table.Table, Id: id, Missing: true})
+				continue
+			}
+			if columns := changedColumns(before[id], current); len(columns) > 0 {
+				diffs = append(diffs, snapshotRowDiff{Table: table.Table, Id: id, Columns: columns})
+			}
+		}
+	}
+	return diffs, checked, nil
+}
+
+func decodeSnapshotRow(row []byte) (map[string]interface{}, error) {
+	decoded, err := decodeJSONWithNumbers(row)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("row is not a JSON object")
+	}
+	return values, nil
+}
+
+func snapshotRowId(values map[string]interface{}) (int64, error) {
+	number, ok := values["id"].(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("row has no numeric id")
+	}
+	return number.Int64()
+}
+
+// changedColumns lists the columns whose values differ, including columns only
+// one side has, in name order.
+func changedColumns(before, after map[string]interface{}) []string {
+	var columns []string
+	for column, value := range before {
+		if other, ok := after[column]; !ok || !jsonValuesEqual(value, other) {
+			columns = append(columns, column)
+		}
+	}
+	for column := range after {
+		if _, ok := before[column]; !ok {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// verifySnapshotPlan refuses a run of name whose -snapshot-file isn't a recorded
+// snapshot of the same command and tables, or whose sampled rows changed since.
+func verifySnapshotPlan(name string) error {
+	db, err := openSnapshotDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	snapshot, err := loadSnapshot(db, *snapshotFilePath)
+	if err != nil {
+		return err
+	}
+	if snapshot.Command != name {
+		return &errs.ValidationError{Field: "-snapshot-file", Reason: fmt.Sprintf("the snapshot plans %s, not %s", snapshot.Command, name)}
+	}
+
+	planned := make(map[string]bool)
+	for _, table := range snapshot.Tables {
+		planned[table.Table] = true
+	}
+	for _, table := range commandTables(name) {
+		exists, err := tableExists(db, table)
+		if err != nil {
+			return err
+		}
+		if exists && !planned[table] {
+			return &errs.ValidationError{Field: "-snapshot-file", Reason: fmt.Sprintf("%s would change %s, which the snapshot doesn't cover", name, table)}
+		}
+	}
+
+	diffs, checked, err := diffSnapshot(db, snapshot)
+	if err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		logSnapshotDiffs(diffs)
+		return &errs.ValidationError{Field: "-snapshot-file", Reason: fmt.Sprintf("%d of %d sampled rows changed since the snapshot of run %s; take a new snapshot", len(diffs), checked, snapshot.RunId)}
+	}
+
+	log.Printf("Snapshot of run %s verified: %d sampled rows unchanged since %s", snapshot.RunId, checked, snapshot.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+func logSnapshotDiffs(diffs []snapshotRowDiff) {
+	for i, diff := range diffs {
+		if i >= *snapshotMaxReported {
+			log.Printf("... and %d more changed rows", len(diffs)-i)
+			return
+		}
+		if diff.Missing {
+			log.Printf("%s id %d: row no longer exists", diff.Table, diff.Id)
+			continue
+		}
+		log.Printf("%s id %d: changed %s", diff.Table, diff.Id, strings.Join(diff.Columns, ", "))
+	}
+}
+
+func snapshotDiff() error {
+	if *snapshotFilePath == "" {
+		return &errs.ValidationError{Field: "-snapshot-file", Reason: "the snapshot to compare with is required"}
+	}
+
+	db, err := openSnapshotDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	snapshot, err := loadSnapshot(db, *snapshotFilePath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Comparing %s with the snapshot of %s taken by run %s at %s",
+		*snapshotFilePath, snapshot.Command, snapshot.RunId, snapshot.CreatedAt.Format(time.RFC3339))
+
+	diffs, checked, err := diffSnapshot(db, snapshot)
+	if err != nil {
+		return err
+	}
+	logSnapshotDiffs(diffs)
+
+	changedByColumn := make(map[string]int)
+	missing := 0
+	for _, diff := range diffs {
+		if diff.Missing {
+			missing++
+			continue
+		}
+		for _, column := range diff.Columns {
+			changedByColumn[diff.Table+"."+column]++
+		}
+	}
+	columns := make([]string, 0, len(changedByColumn))
+	for column := range changedByColumn {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		log.Printf("  %s: changed in %d rows", column, changedByColumn[column])
+	}
+
+	log.Printf("Completed processing. Total sampled rows compared: %d, changed: %d, missing: %d (100.0%%)",
+		checked, len(diffs)-missing, missing)
+	return nil
+}
+
+func SnapshotDiff(ctx context.Context, cfg *config.Config) error {
+	return snapshotDiff()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"log"
+)
+
+// Writing commands refuse to start against a hot standby or a read-only
+// connection: every read succeeds there and the first write fails, which can be
+// an hour into a run.
+
+// readOnlyCommands never write, so they may run against a standby.
+var readOnlyCommands = map[string]bool{
+	"audit-verify":              true,
+	"verify-code-to-text":       true,
+	"verify-creation-time":      true,
+	"export-pending-crosschain": true,
+	"serve-status":              true,
+	"snapshot-diff":             true,
+	"lineage":                   true,
+	"status":                    true,
+}
+
+func commandWrites(name string) bool {
+	if readOnlyCommands[name] {
+		return false
+	}
+	if (name == "normalize-json" || name == "finalize-code-to-text") && (*dryRun || *jsonVerify) {
+		return false
+	}
+	// creation-time and reconcile dry runs still write, in transactions that are
+	// rolled back
+	if (name == "code-to-text" || name == "code-hash") && *dryRun {
+		return false
+	}
+	// A -count-sample converts real batches, loading the database like a run, so
+	// it takes the instance lock and is recorded as one
+	if name == "code-to-text" && *codeCountOnly && (*countSample == 0 || *assumeRowsPerSec > 0) {
+		return false
+	}
+	if name == "reconcile" && *reconcileReportOnly {
+		return false
+	}
+	if name == "build-active-addresses" && (*activeVerifyDays > 0 || *activeRollup != "") {
+		return false
+	}
+	return true
+}
+
+type standbyStatus struct {
+	InRecovery bool
+	ReadOnly   bool
+}
+
+func (s standbyStatus) isStandby() bool {
+	return s.InRecovery || s.ReadOnly
+}
+
+func (s standbyStatus) String() string {
+	switch {
+	case s.InRecovery:
+		return "a standby in recovery (pg_is_in_recovery() is true)"
+	case s.ReadOnly:
+		return "read-only (default_transaction_read_only is on)"
+	default:
+		return "a writable primary"
+	}
+}
+
+func queryStandbyStatus(db *sql.DB) (standbyStatus, error) {
+	var (
+		status   standbyStatus
+		readOnly string
+	)
+	err := db.QueryRow(`SELECT pg_is_in_recovery(), current_setting('default_transaction_read_only')`).
+		Scan(&status.InRecovery, &readOnly)
+	if err != nil {
+		return standbyStatus{}, fmt.Errorf("failed to check whether the database is a standby: %w", err)
+	}
+	status.ReadOnly = readOnly == "on"
+	return status, nil
+}
+
+// checkStandby fails when a writing command targets a standby or read-only
+// database, unless -allow-standby is set. Read-only commands only log it.
+func checkStandby(db *sql.DB, name string) error {
+	status, err := queryStandbyStatus(db)
+	if err != nil {
+		return err
+	}
+	if !status.isStandby() {
+		return nil
+	}
+
+	if !commandWrites(name) {
+		log.Printf("Target database is %s; %s only reads, continuing", status, name)
+		return nil
+	}
+	if *allowStandby {
+		log.Printf("Target database is %s; continuing because -allow-standby is set, writes will fail", status)
+		return nil
+	}
+	return fmt.Errorf("refusing to run %s: target database is %s, point the migrator at the primary or pass -allow-standby",
+		name, status)
+}
+
+func guardAgainstStandby(name string) error {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return checkStandby(db, name)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// standbyDriver answers the standby query with the pg_is_in_recovery() and
+// default_transaction_read_only of its data source name, "<bool> <on|off>", or
+// fails it when the name is "fail".
+type standbyDriver struct{}
+
+func (standbyDriver) Open(name string) (driver.Conn, error) {
+	return standbyConn(name), nil
+}
+
+type standbyConn string
+
+func (c standbyConn) Prepare(query string) (driver.Stmt, error) {
+	if c == "fail" {
+		return nil, errors.New("connection refused")
+	}
+	return standbyStmt(c), nil
+}
+
+func (standbyConn) Close() error { return nil }
+
+func (standbyConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type standbyStmt string
+
+func (standbyStmt) Close() error  { return nil }
+func (standbyStmt) NumInput() int { return 0 }
+
+func (standbyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec not supported")
+}
+
+func (s standbyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	inRecovery, readOnly, _ := strings.Cut(string(s), " ")
+	return &standbyRows{values: []driver.Value{inRecovery == "true", readOnly}}, nil
+}
+
+type standbyRows struct {
+	values []driver.Value
+	read   bool
+}
+
+func (r *standbyRows) Columns() []string { return []string{"pg_is_in_recovery", "current_setting"} }
+func (r *standbyRows) Close() error      { return nil }
+
+func (r *standbyRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	copy(dest, r.values)
+	return nil
+}
+
+func init() {
+	sql.Register("standby-mock", standbyDriver{})
+}
+
+func TestCheckStandby(t *testing.T) {
+	tests := []struct {
+		name         string
+		response     string
+		command      string
+		allowStandby bool
+		wantErr      string
+	}{
+		{name: "writable primary", response: "false off", command: "code-to-text"},
+		{name: "standby in recovery", response: "true off", command: "code-to-text", wantErr: "target database is a standby in recovery"},
+		{name: "read-only connection", response: "false on", command: "creation-time", wantErr: "target database is read-only"},
+		{name: "recovery and read-only", response: "true on", command: "reconcile", wantErr: "a standby in recovery"},
+		{name: "read-only command on a standby", response: "true on", command: "verify-code-to-text"},
+		{name: "status on a standby", response: "true off", command: "status"},
+		{name: "allowed standby", response: "true on", command: "code-to-text", allowStandby: true},
+		{name: "failing query", response: "fail", command: "code-to-text", wantErr: "failed to check whether the database is a standby"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, allowStandby, tt.allowStandby)
+			db, err := sql.Open("standby-mock", tt.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			err = checkStandby(db, tt.command)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkStandby(%s) = %v, want nil", tt.command, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkStandby(%s) = %v, want %q", tt.command, err, tt.wantErr)
+			}
+		})
+	}
+}
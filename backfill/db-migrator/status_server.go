@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	statusDefaultPageSize = 100
+	statusMaxPageSize     = 1000
+)
+
+// The status server exposes the migrator's operational tables as read-only JSON so
+// dashboards can poll backfill state without database credentials. It runs on its
+// own connection opened with default_transaction_read_only, so no endpoint is able
+// to write even by accident.
+
+type statusServer struct {
+	db     *sql.DB
+	token  string
+	server *http.Server
+}
+
+type watermarkStatus struct {
+	Command   string    `json:"command"`
+	LastId    int       `json:"lastId"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type statusPage struct {
+	Items  interface{} `json:"items"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+func startStatusServer(addr string) (*statusServer, error) {
+	env := config.GetConfig()
+	connStr := env.DSN() + " default_transaction_read_only=on"
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	db.SetMaxOpenConns(2)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	s := &statusServer{db: db, token: env.StatusToken}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/watermarks", s.authorized(s.handleWatermarks))
+	mux.HandleFunc("/lineage", s.authorized(s.handleLineage))
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Status server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Status server listening on %s", addr)
+	return s, nil
+}
+
+func (s *statusServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down status server: %v", err)
+	}
+	s.db.Close()
+	log.Println("Status server shut down")
+}
+
+func (s *statusServer) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			expected := "Bearer " + s.token
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				writeStatusError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (s *statusServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatusError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		writeStatusError(w, http.StatusServiceUnavailable, "database unreachable")
+		return
+	}
+	writeStatusJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *statusServer) handleWatermarks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatusError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit, offset, err := parseStatusPagination(r)
+	if err != nil {
+		writeStatusError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	watermarks := []watermarkStatus{}
+	if exists, err := tableExists(s.db, "MigratorWatermarks"); err != nil {
+		writeStatusError(w, http.StatusInternalServerError, "failed to read watermarks")
+		return
+	} else if !exists {
+		writeStatusJSON(w, http.StatusOK, statusPage{Items: watermarks, Limit: limit, Offset: offset})
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT command, "lastId", "updatedAt"
+		FROM "MigratorWatermarks"
+		ORDER BY command
+		LIMIT $1 OFFSET $2
+	`, limit, offset)
+	if err != nil {
+		log.Printf("Status server failed to query watermarks: %v", err)
+		writeStatusError(w, http.StatusInternalServerError, "failed to read watermarks")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var watermark watermarkStatus
+		if err := rows.Scan(&watermark.Command, &watermark.LastId, &watermark.UpdatedAt); err != nil {
+			log.Printf("Status server failed to scan watermark: %v", err)
+			writeStatusError(w, http.StatusInternalServerError, "failed to read watermarks")
+			return
+		}
+		watermarks = append(watermarks, watermark)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Status server failed to iterate watermarks: %v", err)
+		writeStatusError(w, http.StatusInternalServerError, "failed to read watermarks")
+		return
+	}
+
+	writeStatusJSON(w, http.StatusOK, statusPage{Items: watermarks, Limit: limit, Offset: offset})
+}
+
+// handleLineage returns the production chain of a derived table row, given table
+// and id, or of what a run wrote, given run.
+func (s *statusServer) handleLineage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatusError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	var (
+		node *lineageNode
+		err  error
+	)
+	if run := query.Get("run"); run != "" {
+		node, err = runLineage(s.db, query.Get("table"), run)
+	} else {
+		id, parseErr := strconv.ParseInt(query.Get("id"), 10, 64)
+		if query.Get("table") == "" || parseErr != nil || id <= 0 {
+			writeStatusError(w, http.StatusBadRequest, "pass table and a positive id, or run")
+			return
+		}
+		node, err = rowLineage(s.db, query.Get("table"), id)
+	}
+
+	var validationErr *errs.ValidationError
+	if errors.As(err, &validationErr) {
+		writeStatusError(w, http.StatusNotFound, validationErr.Reason)
+		return
+	}
+	if err != nil {
+		log.Printf("Status server failed to trace lineage: %v", err)
+		writeStatusError(w, http.StatusInternalServerError, "failed to trace lineage")
+		return
+	}
+	writeStatusJSON(w, http.StatusOK, node)
+}
+
+func parseStatusPagination(r *http.Request) (int, int, error) {
+	limit := statusDefaultPageSize
+	offset := 0
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer")
+		}
+		limit = parsed
+	}
+	if limit > statusMaxPageSize {
+		limit = statusMaxPageSize
+	}
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = parsed
+	}
+
+	return limit, offset, nil
+}
+
+func writeStatusJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Status server failed to write response: %v", err)
+	}
+}
+
+func writeStatusError(w http.ResponseWriter, status int, message string) {
+	writeStatusJSON(w, status, map[string]string{"error": message})
+}
+
+func ServeStatus(ctx context.Context, cfg *config.Config) error {
+	addr := *statusAddr
+	if addr == "" {
+		addr = ":9092"
+	}
+
+	server, err := startStatusServer(addr)
+	if err != nil {
+		return err
+	}
+
+	// Serve until SIGINT or SIGTERM
+	<-ctx.Done()
+
+	server.Shutdown()
+	return nil
+}
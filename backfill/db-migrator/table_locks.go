@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"sort"
+)
+
+// Migrator commands announce the tables they write with a shared session-level
+// advisory lock per table, held until the process exits. The reindex command takes
+// the same lock exclusively, so a reindex and a bulk write on one table refuse to
+// run at the same time while writers still run alongside each other.
+
+// commandTables returns the tables a command writes, among those that can be
+// reindexed.
+func commandTables(name string) []string {
+	if !commandWrites(name) {
+		return nil
+	}
+
+	switch name {
+	case "code-to-text", "code-hash", "gas-backfill", "finalize-code-to-text", "rollback-code-to-text", "cleanup-code":
+		return []string{"TransactionDetails"}
+	case "creation-time":
+		return []string{"Events", "Transfers"}
+	case "reconcile":
+		if *reconcileNodeURL != "" {
+			// Events missing from the node's payloads are inserted too
+			return []string{"Events", "Transfers"}
+		}
+		return []string{"Transfers"}
+	case "backfill-memos":
+		return []string{"Memos"}
+	case "backfill-rotations":
+		return []string{"GuardChanges"}
+	case "build-account-timeline":
+		return []string{"AccountTimeline"}
+	case "build-tx-order":
+		return []string{"Transactions"}
+	case "rollup-module-activity":
+		return []string{"ModuleActivity"}
+	case "build-active-addresses":
+		return []string{"ActiveAddressSketches"}
+	case "normalize-json":
+		columns, err := parseJsonColumns(*jsonColumns)
+		if err != nil {
+			// normalize-json reports the flag error itself
+			return nil
+		}
+		seen := make(map[string]bool)
+		var tables []string
+		for _, column := range columns {
+			if !seen[column.Table] {
+				seen[column.Table] = true
+				tables = append(tables, column.Table)
+			}
+		}
+		sort.Strings(tables)
+		return tables
+	default:
+		return nil
+	}
+}
+
+// tableLockKey is the advisory lock key of a table, shared by all migrator
+// processes.
+const tableLockKey = `hashtext('go-backfill migrator table ' || $1)`
+
+// tableLocks holds advisory locks on a dedicated connection.
+type tableLocks struct {
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+func openTableLocks() (*tableLocks, error) {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open lock connection: %w", err)
+	}
+	return &tableLocks{db: db, conn: conn}, nil
+}
+
+// tryLock takes the lock of table, shared or exclusive, and reports whether it
+// was free.
+func (l *tableLocks) tryLock(table string, exclusive bool) (bool, error) {
+	function := "pg_try_advisory_lock_shared"
+	if exclusive {
+		function = "pg_try_advisory_lock"
+	}
+
+	var acquired bool
+	err := l.conn.QueryRowContext(context.Background(), fmt.Sprintf(`SELECT %s(%s)`, function, tableLockKey), table).Scan(&acquired)
+	if err != nil {
+		return false, fmt.Errorf("failed to take advisory lock on %s: %w", table, err)
+	}
+	return acquired, nil
+}
+
+// Close releases every lock by ending the session.
+func (l *tableLocks) Close() {
+	l.conn.Close()
+	l.db.Close()
+}
+
+// lockCommandTables takes the shared lock of every table the command writes. It
+// fails when a reindex of one of them is running.
+func lockCommandTables(name string) (*tableLocks, error) {
+	tables := commandTables(name)
+	if len(tables) == 0 {
+		return nil, nil
+	}
+
+	locks, err := openTableLocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		acquired, err := locks.tryLock(table, false)
+		if err != nil {
+			locks.Close()
+			return nil, err
+		}
+		if !acquired {
+			locks.Close()
+			return nil, fmt.Errorf("refusing to run %s: %s is being reindexed by another migrator process", name, table)
+		}
+	}
+	return locks, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-backfill/errs"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// code-to-text shares its database with the live indexer, so its load can be
+// capped. -max-rows-per-sec is a token bucket refilled at that rate, holding at
+// most a second's worth: every batch takes the rows it updated, and the worker
+// waits until the bucket is no longer in debt before its next batch.
+// -sleep-between-batches makes every worker sleep after each of its batches.
+// -pause-window 09:00-18:00 stops handing out batches during that local-time
+// window every day, and resumes after it; a window may wrap past midnight.
+
+type codeThrottle struct {
+	maxRowsPerSec int
+	sleep         time.Duration
+	pause         *pauseWindow
+
+	mu         sync.Mutex
+	tokens     float64
+	refilled   time.Time
+	throttling bool
+}
+
+func newCodeThrottle(maxRowsPerSec int, sleep time.Duration, pause *pauseWindow) *codeThrottle {
+	return &codeThrottle{
+		maxRowsPerSec: maxRowsPerSec,
+		sleep:         sleep,
+		pause:         pause,
+		tokens:        float64(maxRowsPerSec),
+		refilled:      time.Now(),
+	}
+}
+
+// active reports whether anything slows the run down.
+func (t *codeThrottle) active() bool {
+	return t.maxRowsPerSec > 0 || t.sleep > 0 || t.pause != nil
+}
+
+// afterBatch holds a worker back after a batch that updated rows, as long as
+// the rate cap and the sleep between batches say, or until ctx is canceled.
+func (t *codeThrottle) afterBatch(ctx context.Context, rows int) {
+	wait := t.sleep
+	if rateWait := t.take(rows); rateWait > wait {
+		wait = rateWait
+	}
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+	}
+}
+
+// take takes rows from the bucket, and returns how long until it is out of debt.
+func (t *codeThrottle) take(rows int) time.Duration {
+	if t.maxRowsPerSec <= 0 {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(t.maxRowsPerSec)
+	t.tokens += now.Sub(t.refilled).Seconds() * rate
+	if t.tokens > rate {
+		t.tokens = rate
+	}
+	t.refilled = now
+	t.tokens -= float64(rows)
+
+	if t.tokens >= 0 {
+		if t.throttling {
+			log.Printf("Throttle: back under -max-rows-per-sec %d", t.maxRowsPerSec)
+			t.throttling = false
+		}
+		return 0
+	}
+	if !t.throttling {
+		log.Printf("Throttle: holding batches back to -max-rows-per-sec %d", t.maxRowsPerSec)
+		t.throttling = true
+	}
+	return time.Duration(-t.tokens / rate * float64(time.Second))
+}
+
+// waitOutsidePause blocks while the pause window is open, and reports whether it
+// paused at all. It returns early when ctx is canceled.
+func (t *codeThrottle) waitOutsidePause(ctx context.Context) bool {
+	if t.pause == nil {
+		return false
+	}
+	wait := t.pause.remaining(time.Now())
+	if wait <= 0 {
+		return false
+	}
+
+	log.Printf("Pausing for -pause-window %s, resuming at %s", t.pause, time.Now().Add(wait).Format("2006-01-02 15:04"))
+	select {
+	case <-time.After(wait):
+		log.Println("Pause window over, resuming")
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// wallTime is how long work takes once the pause windows in the way are added.
+func (t *codeThrottle) wallTime(from time.Time, work time.Duration) time.Duration {
+	if t.pause == nil {
+		return work
+	}
+	return t.pause.wallTime(from, work)
+}
+
+// pauseWindow is a daily window of local time, start and end being offsets from
+// midnight. end is below start for a window wrapping past midnight.
+type pauseWindow struct {
+	start, end time.Duration
+}
+
+func parsePauseWindow(value string) (*pauseWindow, error) {
+	if value == "" {
+		return nil, nil
+	}
+	invalid := &errs.ValidationError{Field: "-pause-window", Reason: fmt.Sprintf("%q is not of the form HH:MM-HH:MM", value)}
+
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, invalid
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, invalid
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, invalid
+	}
+	window := &pauseWindow{
+		start: time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+		end:   time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute,
+	}
+	if window.start == window.end {
+		return nil, &errs.ValidationError{Field: "-pause-window", Reason: fmt.Sprintf("%q is empty", value)}
+	}
+	return window, nil
+}
+
+func (p *pauseWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	return clock(p.start) + "-" + clock(p.end)
+}
+
+// remaining is how long the window stays open after now, 0 when it is closed.
+func (p *pauseWindow) remaining(now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	clock := now.Sub(midnight)
+
+	switch {
+	case p.start < p.end && clock >= p.start && clock < p.end:
+		return p.end - clock
+	case p.start > p.end && clock >= p.start:
+		return 24*time.Hour - clock + p.end
+	case p.start > p.end && clock < p.end:
+		return p.end - clock
+	}
+	return 0
+}
+
+// untilOpen is how long after now the window next opens.
+func (p *pauseWindow) untilOpen(now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	clock := now.Sub(midnight)
+	if clock < p.start {
+		return p.start - clock
+	}
+	return 24*time.Hour - clock + p.start
+}
+
+// wallTime is how long work takes from from, skipping the windows.
+func (p *pauseWindow) wallTime(from time.Time, work time.Duration) time.Duration {
+	now := from
+	for work > 0 {
+		if paused := p.remaining(now); paused > 0 {
+			now = now.Add(paused)
+			continue
+		}
+		open := p.untilOpen(now)
+		if work <= open {
+			now = now.Add(work)
+			break
+		}
+		now = now.Add(open)
+		work -= open
+	}
+	return now.Sub(from)
+}
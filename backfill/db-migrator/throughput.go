@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// throughputWindowBatches is how many of the latest batches the rate of a
+// throughputTracker is measured over
+const throughputWindowBatches = 20
+
+// throughputTracker measures rows per second over the latest batches, and
+// estimates the time left from the span that remains. The span is first turned
+// into rows at the density observed so far (rows updated per unit covered), which
+// keeps sparse ranges from skewing the estimate. code-to-text pages the rows to
+// convert, so its span counts those rows rather than ids.
+type throughputTracker struct {
+	started time.Time
+	total   int
+	// Caps the rate and adds the pause windows to the estimate, when set
+	throttle *codeThrottle
+	// When the window started filling, past any pause
+	windowFrom time.Time
+
+	rows    int64
+	covered int64
+	// The latest batches, oldest first, up to throughputWindowBatches + 1: the
+	// oldest only marks when the window starts
+	window []throughputSample
+}
+
+type throughputSample struct {
+	at   time.Time
+	rows int64
+}
+
+func newThroughputTracker(total int) *throughputTracker {
+	now := time.Now()
+	return &throughputTracker{started: now, total: total, windowFrom: now}
+}
+
+// resetWindow starts measuring the rate over again, so that a pause doesn't
+// count as slowness.
+func (t *throughputTracker) resetWindow() {
+	t.window = nil
+	t.windowFrom = time.Now()
+}
+
+// add records a batch that covered span ids and updated rows of them.
+func (t *throughputTracker) add(span, rows int) {
+	t.rows += int64(rows)
+	t.covered += int64(span)
+	t.window = append(t.window, throughputSample{at: time.Now(), rows: int64(rows)})
+	if len(t.window) > throughputWindowBatches+1 {
+		t.window = t.window[1:]
+	}
+}
+
+// rowsPerSec is the rate over the window, or since it started filling until it
+// is full.
+func (t *throughputTracker) rowsPerSec() float64 {
+	if len(t.window) == 0 {
+		return 0
+	}
+	from, samples := t.windowFrom, t.window
+	if len(t.window) > throughputWindowBatches {
+		from, samples = t.window[0].at, t.window[1:]
+	}
+	elapsed := t.window[len(t.window)-1].at.Sub(from).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	var rows int64
+	for _, sample := range samples {
+		rows += sample.rows
+	}
+	return float64(rows) / elapsed
+}
+
+// eta estimates the time left, and reports whether there is enough measured to.
+func (t *throughputTracker) eta() (time.Duration, bool) {
+	remaining := int64(t.total) - t.covered
+	if remaining <= 0 {
+		return 0, true
+	}
+	rate := t.rowsPerSec()
+	if t.throttle != nil && t.throttle.maxRowsPerSec > 0 && rate > float64(t.throttle.maxRowsPerSec) {
+		rate = float64(t.throttle.maxRowsPerSec)
+	}
+	if t.covered == 0 || t.rows == 0 || rate <= 0 {
+		return 0, false
+	}
+	remainingRows := float64(remaining) * float64(t.rows) / float64(t.covered)
+	work := time.Duration(remainingRows / rate * float64(time.Second))
+	if t.throttle != nil {
+		return t.throttle.wallTime(time.Now(), work), true
+	}
+	return work, true
+}
+
+// describe formats the rate, elapsed time and estimate for a progress line.
+func (t *throughputTracker) describe() string {
+	eta := "unknown"
+	if left, ok := t.eta(); ok {
+		eta = shortDuration(left)
+	}
+	return fmt.Sprintf("%s rows/s | elapsed %s | ETA %s",
+		groupThousands(int64(t.rowsPerSec())), shortDuration(time.Since(t.started)), eta)
+}
+
+// summary formats the wall time and average throughput of the whole run.
+func (t *throughputTracker) summary() string {
+	elapsed := time.Since(t.started)
+	average := 0.0
+	if elapsed > 0 {
+		average = float64(t.rows) / elapsed.Seconds()
+	}
+	return fmt.Sprintf("Wall time: %s, average throughput: %s rows/s", shortDuration(elapsed), groupThousands(int64(average)))
+}
+
+// shortDuration formats d as 2h14m, 14m or 42s.
+func shortDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	d = d.Round(time.Minute)
+	hours, minutes := int64(d/time.Hour), int64(d%time.Hour/time.Minute)
+	if hours == 0 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return fmt.Sprintf("%dh%dm", hours, minutes)
+}
+
+// groupThousands formats n with comma thousands separators.
+func groupThousands(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return sign + digits
+}
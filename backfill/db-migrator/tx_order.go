@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"go-backfill/safejson"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	txOrderBatchSize    = 1000
+	txOrderWatermarkKey = "build-tx-order"
+)
+
+// This script records the position of every transaction within its block in the
+// "blockOrdinal" column of Transactions, and the edge from the transaction that
+// started a defpact to each of its continuation steps in TxDependencies.
+//
+// Payload transactions are saved in payload order, so a block's ordinals are the
+// ranks by id of its non-coinbase rows, starting at 0. The coinbase isn't part of
+// the payload transactions and keeps a NULL ordinal. That order is only trusted
+// when the block has as many rows as its "transactionsCount"; other blocks are
+// recorded as count-mismatch findings and left alone, unless -from-node is set,
+// in which case their order is fetched from the node's payload outputs and matched
+// by request key. Payload transactions without a row are then recorded as
+// missing-row findings, gaps in the ordinals of the block.
+//
+// A continuation (step 1 or later) depends on the transaction whose request key
+// is its pactid, the canonical one if there are several. Continuations whose
+// defpact start isn't indexed are recorded as missing-initiator findings.
+//
+// Findings go to TxOrderFindings under the run id, like the braiding findings.
+// Runs are incremental from the build-tx-order watermark on block ids, and
+// re-running a range rewrites the same ordinals and edges.
+
+type txOrderBlock struct {
+	id, chainId, height int
+	payloadHash         string
+	transactionsCount   int
+	rows                int
+	// nodeRequestKeys is the payload order fetched with -from-node
+	nodeRequestKeys []string
+}
+
+type txOrderFinding struct {
+	Kind          string
+	BlockId       int
+	ChainId       int
+	Height        int
+	TransactionId sql.NullInt64
+	Detail        string
+}
+
+func buildTxOrder() error {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createTxOrderTables(db); err != nil {
+		return err
+	}
+
+	lastId, err := readWatermark(db, txOrderWatermarkKey)
+	if err != nil {
+		return err
+	}
+
+	var maxBlockId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "Blocks"`).Scan(&maxBlockId); err != nil {
+		return fmt.Errorf("failed to get max block ID: %w", err)
+	}
+
+	maxBlockId, err = capToLiveWatermark(db, "Blocks", maxBlockId, false)
+	if err != nil {
+		return err
+	}
+
+	if maxBlockId <= lastId {
+		logNothingToDo("Blocks", lastId+1, maxBlockId)
+		log.Printf("Transaction order is up to date (watermark at block id %d)", lastId)
+		log.Println("Completed processing. Total transactions ordered: 0 (100.0%)")
+		return nil
+	}
+
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	totalOrdered := 0
+	totalEdges := 0
+	totalFindings := 0
+	findingsByKind := make(map[string]int)
+	totalIds := maxBlockId - lastId
+	lastProgressPrinted := -1.0
+
+	log.Printf("Starting to order transactions from block ID %d to %d", lastId+1, maxBlockId)
+
+	for currentId := lastId + 1; currentId <= maxBlockId; currentId += txOrderBatchSize {
+		batchEnd := currentId + txOrderBatchSize - 1
+		if batchEnd > maxBlockId {
+			batchEnd = maxBlockId
+		}
+
+		blocks, err := loadTxOrderBlocks(db, currentId, batchEnd)
+		if err != nil {
+			return err
+		}
+
+		// Node requests happen before the batch transaction is opened
+		if *txOrderFromNode {
+			for i := range blocks {
+				if blocks[i].rows == blocks[i].transactionsCount {
+					continue
+				}
+				keys, err := fetchPayloadRequestKeys(httpClient, blocks[i].chainId, blocks[i].payloadHash)
+				if err != nil {
+					return fmt.Errorf("failed to fetch payload of block %d: %w", blocks[i].id, err)
+				}
+				blocks[i].nodeRequestKeys = keys
+			}
+		}
+
+		ordered, edges, findings, err := processTxOrderBatch(db, blocks, currentId, batchEnd)
+		if err != nil {
+			return fmt.Errorf("failed to process batch %d-%d: %w", currentId, batchEnd, err)
+		}
+		totalOrdered += ordered
+		totalEdges += edges
+
+		for i, finding := range findings {
+			findingsByKind[finding.Kind]++
+			if totalFindings+i < *txOrderMaxReported {
+				log.Printf("Block %d (chain %d, height %d): %s: %s", finding.BlockId, finding.ChainId, finding.Height, finding.Kind, finding.Detail)
+			}
+		}
+		totalFindings += len(findings)
+
+		progressPercent := percentOf(batchEnd-lastId, totalIds)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, transactions ordered: %d, dependency edges: %d, findings: %d",
+				progressPercent, totalOrdered, totalEdges, totalFindings)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total transactions ordered: %d, dependency edges: %d (100.0%%)", totalOrdered, totalEdges)
+	for _, kind := range []string{"count-mismatch", "missing-row", "not-in-payload", "missing-initiator"} {
+		if findingsByKind[kind] > 0 {
+			log.Printf("%s: %d", kind, findingsByKind[kind])
+		}
+	}
+	if totalFindings > 0 {
+		log.Printf("WARNING: %d findings; see TxOrderFindings for run %s", totalFindings, runId)
+	}
+	return nil
+}
+
+func createTxOrderTables(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE "Transactions" ADD COLUMN IF NOT EXISTS "blockOrdinal" INTEGER`)
+	if err != nil {
+		return fmt.Errorf("failed to add blockOrdinal column: %w", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS "TxDependencies" (
+			id SERIAL PRIMARY KEY,
+			"initiatingTransactionId" INTEGER NOT NULL,
+			"stepTransactionId" INTEGER NOT NULL UNIQUE,
+			pactid TEXT NOT NULL,
+			step INTEGER NOT NULL,
+			"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create TxDependencies table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS txdependencies_initiating_idx ON "TxDependencies" ("initiatingTransactionId")`)
+	if err != nil {
+		return fmt.Errorf("failed to create TxDependencies initiating index: %w", err)
+	}
+
+	if err := addLineageColumn(db, "TxDependencies"); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS "TxOrderFindings" (
+			id SERIAL PRIMARY KEY,
+			"runId" TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			"blockId" INTEGER NOT NULL,
+			"chainId" INTEGER NOT NULL,
+			height BIGINT NOT NULL,
+			"transactionId" INTEGER,
+			detail TEXT,
+			"recordedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create TxOrderFindings table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS txorderfindings_run_idx ON "TxOrderFindings" ("runId", kind)`)
+	if err != nil {
+		return fmt.Errorf("failed to create TxOrderFindings run index: %w", err)
+	}
+
+	return createWatermarksTable(db)
+}
+
+// loadTxOrderBlocks returns the blocks of the id range with their number of
+// non-coinbase transaction rows.
+func loadTxOrderBlocks(db *sql.DB, startId, endId int) ([]txOrderBlock, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b."chainId", b.height, b."payloadHash", b."transactionsCount",
+			COUNT(t.id) FILTER (WHERE t.sender <> 'coinbase')
+		FROM "Blocks" b
+		LEFT JOIN "Transactions" t ON t."blockId" = b.id
+		WHERE b.id >= $1 AND b.id <= $2
+		GROUP BY b.id
+		ORDER BY b.id
+	`, startId, endId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	var blocks []txOrderBlock
+	for rows.Next() {
+		var block txOrderBlock
+		if err := rows.Scan(&block.id, &block.chainId, &block.height, &block.payloadHash,
+			&block.transactionsCount, &block.rows); err != nil {
+			return nil, fmt.Errorf("failed to scan block: %w", err)
+		}
+		blocks = append(blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating blocks: %w", err)
+	}
+	return blocks, nil
+}
+
+// fetchPayloadRequestKeys returns the request keys of a block's payload
+// transactions in payload order.
+func fetchPayloadRequestKeys(client *http.Client, chainId int, payloadHash string) ([]string, error) {
+	nodeURL := baseAPIURL
+	if env := config.GetConfig(); env.SyncBaseUrl != "" {
+		nodeURL = fmt.Sprintf("%s/%s", env.SyncBaseUrl, env.Network)
+	}
+	url := fmt.Sprintf("%s/chain/%d/payload/%s/outputs", nodeURL, chainId, payloadHash)
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, &errs.NodeError{Endpoint: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &errs.NodeError{StatusCode: resp.StatusCode, Endpoint: url}
+	}
+
+	body, err := safejson.ReadAll(resp.Body, jsonLimits())
+	if err != nil {
+		if limit, ok := jsonLimitBreached(err); ok {
+			return nil, &errs.LimitExceeded{Limit: limit, Err: err}
+		}
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	var apiResponse PayloadAPIResponse
+	if err := safejson.Unmarshal(body, &apiResponse, jsonLimits()); err != nil {
+		if limit, ok := jsonLimitBreached(err); ok {
+			return nil, &errs.LimitExceeded{Limit: limit, Err: err}
+		}
+		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
+	}
+
+	keys := make([]string, len(apiResponse.Transactions))
+	for i, transactionParts := range apiResponse.Transactions {
+		reqKey, _, err := extractRequestKeyAndEventsFromTransactionPart(transactionParts[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode transaction %d: %w", i, err)
+		}
+		keys[i] = reqKey
+	}
+	return keys, nil
+}
+
+// processTxOrderBatch writes the ordinals and dependency edges of the blocks of a
+// batch, their findings and the watermark in a single transaction.
+func processTxOrderBatch(db *sql.DB, blocks []txOrderBlock, startId, endId int) (int, int, []txOrderFinding, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, nil, errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	var (
+		findings     []txOrderFinding
+		storedOrder  []int64
+		orderedTotal int
+	)
+	for _, block := range blocks {
+		switch {
+		case block.rows == block.transactionsCount:
+			storedOrder = append(storedOrder, int64(block.id))
+		case block.nodeRequestKeys != nil:
+			ordered, blockFindings, err := orderFromNode(tx, block)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			orderedTotal += ordered
+			findings = append(findings, blockFindings...)
+		default:
+			findings = append(findings, txOrderFinding{
+				Kind:    "count-mismatch",
+				BlockId: block.id,
+				ChainId: block.chainId,
+				Height:  block.height,
+				Detail:  fmt.Sprintf("block has %d payload transactions but %d rows", block.transactionsCount, block.rows),
+			})
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE "Transactions" t
+		SET "blockOrdinal" = o.ordinal
+		FROM (
+			SELECT id, (ROW_NUMBER() OVER (PARTITION BY "blockId" ORDER BY id) - 1)::integer AS ordinal
+			FROM "Transactions"
+			WHERE "blockId" = ANY($1::int[]) AND sender <> 'coinbase'
+		) o
+		WHERE t.id = o.id AND t."blockOrdinal" IS DISTINCT FROM o.ordinal
+	`, pq.Array(storedOrder))
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to update ordinals: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	orderedTotal += int(updated)
+
+	edges, edgeFindings, err := writeTxDependencies(tx, startId, endId)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	findings = append(findings, edgeFindings...)
+
+	if err := recordTxOrderFindings(tx, findings); err != nil {
+		return 0, 0, nil, err
+	}
+
+	if err := writeWatermark(tx, txOrderWatermarkKey, endId); err != nil {
+		return 0, 0, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, nil, errs.FromDB("failed to commit transaction", err)
+	}
+
+	return orderedTotal, edges, findings, nil
+}
+
+// orderFromNode sets the ordinals of a block from the payload order fetched from
+// the node, and reports the payload transactions and rows that don't match up.
+func orderFromNode(tx *sql.Tx, block txOrderBlock) (int, []txOrderFinding, error) {
+	rows, err := tx.Query(`
+		WITH payload AS (
+			SELECT requestkey, (ordinality - 1)::integer AS ordinal
+			FROM unnest($2::text[]) WITH ORDINALITY AS k(requestkey, ordinality)
+		),
+		updated AS (
+			UPDATE "Transactions" t
+			SET "blockOrdinal" = p.ordinal
+			FROM payload p
+			WHERE t."blockId" = $1 AND t.sender <> 'coinbase' AND t.requestkey = p.requestkey
+			RETURNING t.id
+		)
+		SELECT 'missing-row', NULL::integer, p.requestkey, p.ordinal
+		FROM payload p
+		WHERE NOT EXISTS (
+			SELECT 1 FROM "Transactions" t
+			WHERE t."blockId" = $1 AND t.sender <> 'coinbase' AND t.requestkey = p.requestkey
+		)
+		UNION ALL
+		SELECT 'not-in-payload', t.id, t.requestkey, NULL
+		FROM "Transactions" t
+		WHERE t."blockId" = $1 AND t.sender <> 'coinbase' AND t.requestkey <> ALL($2::text[])
+		UNION ALL
+		SELECT 'updated', COUNT(*)::integer, NULL, NULL FROM updated
+	`, block.id, pq.Array(block.nodeRequestKeys))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to order block %d from the node payload: %w", block.id, err)
+	}
+	defer rows.Close()
+
+	var (
+		findings []txOrderFinding
+		ordered  int
+	)
+	for rows.Next() {
+		var (
+			kind          string
+			transactionId sql.NullInt64
+			requestKey    sql.NullString
+			ordinal       sql.NullInt64
+		)
+		if err := rows.Scan(&kind, &transactionId, &requestKey, &ordinal); err != nil {
+			return 0, nil, fmt.Errorf("failed to scan node order of block %d: %w", block.id, err)
+		}
+
+		finding := txOrderFinding{Kind: kind, BlockId: block.id, ChainId: block.chainId, Height: block.height}
+		switch kind {
+		case "updated":
+			ordered = int(transactionId.Int64)
+			continue
+		case "missing-row":
+			finding.Detail = fmt.Sprintf("payload transaction %d (%s) has no row", ordinal.Int64, requestKey.String)
+		default:
+			finding.TransactionId = transactionId
+			finding.Detail = fmt.Sprintf("request key %s is not in the node payload", requestKey.String)
+		}
+		findings = append(findings, finding)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("error iterating node order of block %d: %w", block.id, err)
+	}
+	return ordered, findings, nil
+}
+
+// writeTxDependencies links the continuations of the block range to their defpact
+// start and returns the continuations whose start isn't indexed.
+func writeTxDependencies(tx *sql.Tx, startId, endId int) (int, []txOrderFinding, error) {
+	result, err := tx.Exec(`
+		INSERT INTO "TxDependencies" ("initiatingTransactionId", "stepTransactionId", pactid, step, "updatedAt", "lastRunId")
+		SELECT DISTINCT ON (t.id) i.id, t.id, td.pactid, td.step, CURRENT_TIMESTAMP, $3
+		FROM "Transactions" t
+		JOIN "TransactionDetails" td ON td."transactionId" = t.id
+		JOIN "Transactions" i ON i.requestkey = td.pactid
+		JOIN "Blocks" ib ON ib.id = i."blockId"
+		WHERE t."blockId" >= $1 AND t."blockId" <= $2 AND td.step >= 1 AND td.pactid IS NOT NULL
+		ORDER BY t.id, ib.canonical DESC, i.id
+		ON CONFLICT ("stepTransactionId") DO UPDATE SET
+			"initiatingTransactionId" = EXCLUDED."initiatingTransactionId",
+			pactid = EXCLUDED.pactid,
+			step = EXCLUDED.step,
+			"updatedAt" = EXCLUDED."updatedAt",
+			"lastRunId" = EXCLUDED."lastRunId"
+	`, startId, endId, runId)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to write dependency edges: %w", err)
+	}
+	edges, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+
+	rows, err := tx.Query(`
+		SELECT t.id, b.id, b."chainId", b.height, td.pactid, td.step
+		FROM "Transactions" t
+		JOIN "TransactionDetails" td ON td."transactionId" = t.id
+		JOIN "Blocks" b ON b.id = t."blockId"
+		WHERE t."blockId" >= $1 AND t."blockId" <= $2 AND td.step >= 1 AND td.pactid IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM "Transactions" i WHERE i.requestkey = td.pactid)
+		ORDER BY t.id
+	`, startId, endId)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query continuations without a start: %w", err)
+	}
+	defer rows.Close()
+
+	var findings []txOrderFinding
+	for rows.Next() {
+		var (
+			finding txOrderFinding
+			pactId  string
+			step    int
+		)
+		if err := rows.Scan(&finding.TransactionId, &finding.BlockId, &finding.ChainId, &finding.Height, &pactId, &step); err != nil {
+			return 0, nil, fmt.Errorf("failed to scan continuation: %w", err)
+		}
+		finding.Kind = "missing-initiator"
+		finding.Detail = fmt.Sprintf("step %d of pact %s has no indexed start", step, pactId)
+		findings = append(findings, finding)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("error iterating continuations: %w", err)
+	}
+
+	return int(edges), findings, nil
+}
+
+func recordTxOrderFindings(tx *sql.Tx, findings []txOrderFinding) error {
+	if len(findings) == 0 {
+		return nil
+	}
+
+	insert, err := tx.Prepare(`
+		INSERT INTO "TxOrderFindings" ("runId", kind, "blockId", "chainId", height, "transactionId", detail)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer insert.Close()
+
+	for _, finding := range findings {
+		if _, err := insert.Exec(runId, finding.Kind, finding.BlockId, finding.ChainId, finding.Height,
+			finding.TransactionId, finding.Detail); err != nil {
+			return fmt.Errorf("failed to record finding of block %d: %w", finding.BlockId, err)
+		}
+	}
+	return nil
+}
+
+func BuildTxOrder(ctx context.Context, cfg *config.Config) error {
+	return buildTxOrder()
+}
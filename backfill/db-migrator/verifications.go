@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// verify-code-to-text records the outcome of each completed run in the
+// MigratorVerifications table, one row per verify command holding its latest
+// run, so that cleanup-code can tell whether the range it clears was verified.
+// Verify commands don't otherwise write: the record is kept on a best-effort
+// basis, and a run against a standby only logs why it couldn't be kept.
+
+type verification struct {
+	StartId     int
+	EndId       int
+	Mismatched  int
+	NotMigrated int
+	VerifiedAt  time.Time
+}
+
+func createVerificationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "MigratorVerifications" (
+			command TEXT PRIMARY KEY,
+			"startId" INTEGER NOT NULL,
+			"endId" INTEGER NOT NULL,
+			mismatched BIGINT NOT NULL,
+			"notMigrated" BIGINT NOT NULL,
+			"verifiedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create MigratorVerifications table: %w", err)
+	}
+	return nil
+}
+
+// recordVerification keeps v as the latest run of command, logging instead of
+// failing when it can't.
+func recordVerification(db *sql.DB, command string, v verification) {
+	if err := createVerificationsTable(db); err != nil {
+		log.Printf("Warning: the result of %s isn't recorded: %v", command, err)
+		return
+	}
+	_, err := db.Exec(`
+		INSERT INTO "MigratorVerifications" (command, "startId", "endId", mismatched, "notMigrated", "verifiedAt")
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+		ON CONFLICT (command) DO UPDATE
+		SET "startId" = EXCLUDED."startId", "endId" = EXCLUDED."endId", mismatched = EXCLUDED.mismatched,
+			"notMigrated" = EXCLUDED."notMigrated", "verifiedAt" = EXCLUDED."verifiedAt"
+	`, command, v.StartId, v.EndId, v.Mismatched, v.NotMigrated)
+	if err != nil {
+		log.Printf("Warning: the result of %s isn't recorded: %v", command, err)
+	}
+}
+
+// readVerification returns the latest recorded run of command, nil when there
+// is none.
+func readVerification(db *sql.DB, command string) (*verification, error) {
+	exists, err := tableExists(db, "MigratorVerifications")
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var v verification
+	err = db.QueryRow(`
+		SELECT "startId", "endId", mismatched, "notMigrated", "verifiedAt"
+		FROM "MigratorVerifications"
+		WHERE command = $1
+	`, command).Scan(&v.StartId, &v.EndId, &v.Mismatched, &v.NotMigrated, &v.VerifiedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the result of %s: %w", command, err)
+	}
+	return &v, nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-backfill/chaingraph"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const braidingBatchHeights = 1000
+
+// This script checks the braiding of the stored blocks: every block must carry
+// one adjacent hash per neighbor of its chain in the chain graph in effect at its
+// height (the Petersen graph first, the 20-chain graph from the transition height
+// of the network), and each adjacent hash must be the block at height-1 on
+// that neighbor chain. Findings are recorded in BraidingFindings under the run id,
+// like the request key findings, and the command fails when there are any.
+//
+// Adjacent hashes pointing below the first height of the neighbor chain are the
+// genesis parents of a chain that didn't exist yet and are not looked up, and
+// genesis blocks are skipped. At the transition height both graphs are accepted
+// since chains switch over with their first block there.
+
+type braidingFinding struct {
+	Kind          string
+	BlockId       int
+	ChainId       int
+	Height        int
+	NeighborChain interface{}
+	AdjacentHash  sql.NullString
+	Detail        string
+}
+
+type braidingChainSummary struct {
+	Blocks   int
+	Edges    int
+	Findings map[string]int
+}
+
+type braidingBlock struct {
+	id, chainId, height int
+	edges               []braidingEdge
+}
+
+type braidingEdge struct {
+	key                 string
+	hash                sql.NullString
+	refChain, refHeight sql.NullInt64
+}
+
+// braidingSchedule returns the chain graphs of the configured network.
+func braidingSchedule(network config.NetworkInfo) (chaingraph.Schedule, error) {
+	for _, graph := range []chaingraph.Graph{chaingraph.Petersen, chaingraph.TwentyChain} {
+		if err := graph.Validate(); err != nil {
+			return chaingraph.Schedule{}, err
+		}
+	}
+	schedule, err := chaingraph.ScheduleFor(network.ChainCount, network.TransitionHeight)
+	if err != nil {
+		return chaingraph.Schedule{}, &errs.ValidationError{Field: "NETWORK_CHAIN_COUNT", Reason: err.Error()}
+	}
+	return schedule, nil
+}
+
+func verifyBraiding() (bool, error) {
+	if *braidingSample <= 0 || *braidingSample > 1 {
+		return false, &errs.ValidationError{Field: "-braiding-sample", Reason: fmt.Sprintf("%v, expected a fraction in (0, 1]", *braidingSample)}
+	}
+
+	env := config.GetConfig()
+	schedule, err := braidingSchedule(env.NetworkInfo)
+	if err != nil {
+		return false, err
+	}
+
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return false, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createBraidingFindingsTable(db); err != nil {
+		return false, err
+	}
+
+	// The live watermark is on block ids; translate it into a height
+	upperBlockId, err := capToLiveWatermark(db, "Blocks", math.MaxInt32, false)
+	if err != nil {
+		return false, err
+	}
+	var maxHeight int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(height), -1) FROM "Blocks" WHERE id <= $1`, upperBlockId).Scan(&maxHeight); err != nil {
+		return false, fmt.Errorf("failed to get max block height: %w", err)
+	}
+
+	startHeight := *braidingStartHeight
+	endHeight := maxHeight
+	if *braidingEndHeight >= 0 && *braidingEndHeight < endHeight {
+		endHeight = *braidingEndHeight
+	}
+	if endHeight < startHeight {
+		logNothingToDo("Blocks heights", startHeight, endHeight)
+		log.Println("Completed processing. Total blocks checked: 0 (100.0%)")
+		return true, nil
+	}
+
+	// Blocks are sampled by id so that a re-run checks the same blocks
+	sampleThreshold := int(math.Round(*braidingSample * 10000))
+
+	summaries := make(map[int]*braidingChainSummary)
+	totalBlocks, totalFindings := 0, 0
+	totalHeights := endHeight - startHeight + 1
+	lastProgressPrinted := -1.0
+
+	log.Printf("Checking braiding of blocks from height %d to %d (sample %.2f%%)", startHeight, endHeight, *braidingSample*100)
+
+	for currentHeight := startHeight; currentHeight <= endHeight; currentHeight += braidingBatchHeights {
+		batchEnd := currentHeight + braidingBatchHeights - 1
+		if batchEnd > endHeight {
+			batchEnd = endHeight
+		}
+
+		blocks, err := loadBraidingBlocks(db, currentHeight, batchEnd, sampleThreshold)
+		if err != nil {
+			return false, fmt.Errorf("failed to load blocks of heights %d-%d: %w", currentHeight, batchEnd, err)
+		}
+
+		var findings []braidingFinding
+		for _, block := range blocks {
+			summary, ok := summaries[block.chainId]
+			if !ok {
+				summary = &braidingChainSummary{Findings: make(map[string]int)}
+				summaries[block.chainId] = summary
+			}
+			summary.Blocks++
+			summary.Edges += len(block.edges)
+
+			blockFindings := checkBraiding(block, schedule, env.NetworkInfo)
+			for _, finding := range blockFindings {
+				summary.Findings[finding.Kind]++
+			}
+			findings = append(findings, blockFindings...)
+		}
+		totalBlocks += len(blocks)
+
+		if err := recordBraidingFindings(db, findings, totalFindings); err != nil {
+			return false, err
+		}
+		totalFindings += len(findings)
+
+		progressPercent := percentOf(batchEnd-startHeight+1, totalHeights)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, height: %d, blocks checked: %d, findings: %d", progressPercent, batchEnd, totalBlocks, totalFindings)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total blocks checked: %d (100.0%%)", totalBlocks)
+	logBraidingSummary(summaries)
+
+	return totalFindings == 0, nil
+}
+
+func createBraidingFindingsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "BraidingFindings" (
+			id SERIAL PRIMARY KEY,
+			"runId" TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			"blockId" INTEGER NOT NULL,
+			"chainId" INTEGER NOT NULL,
+			height BIGINT NOT NULL,
+			"neighborChain" INTEGER,
+			"adjacentHash" TEXT,
+			detail TEXT,
+			"recordedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create BraidingFindings table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS braidingfindings_run_idx ON "BraidingFindings" ("runId", kind)`)
+	if err != nil {
+		return fmt.Errorf("failed to create BraidingFindings run index: %w", err)
+	}
+	return nil
+}
+
+// loadBraidingBlocks returns the sampled canonical blocks of the height range with
+// their adjacent hashes and the chain and height of the blocks they reference.
+func loadBraidingBlocks(db *sql.DB, startHeight, endHeight, sampleThreshold int) ([]braidingBlock, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b."chainId", b.height, adj.key, adj.value, ref."chainId", ref.height
+		FROM "Blocks" b
+		LEFT JOIN LATERAL jsonb_each_text(COALESCE(b.adjacents, '{}'::jsonb)) adj ON true
+		LEFT JOIN LATERAL (
+			SELECT n."chainId", n.height
+			FROM "Blocks" n
+			WHERE n.hash = adj.value
+			ORDER BY n.height = b.height - 1 DESC
+			LIMIT 1
+		) ref ON true
+		WHERE b.height >= $1 AND b.height <= $2 AND b.canonical = true AND b.id % 10000 < $3
+		ORDER BY b.id, adj.key
+	`, startHeight, endHeight, sampleThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks: %w", err)
+	}
+	defer rows.Close()
+
+	var blocks []braidingBlock
+	for rows.Next() {
+		var (
+			id, chainId, height int
+			key                 sql.NullString
+			edge                braidingEdge
+		)
+		if err := rows.Scan(&id, &chainId, &height, &key, &edge.hash, &edge.refChain, &edge.refHeight); err != nil {
+			return nil, fmt.Errorf("failed to scan block adjacent: %w", err)
+		}
+		if len(blocks) == 0 || blocks[len(blocks)-1].id != id {
+			blocks = append(blocks, braidingBlock{id: id, chainId: chainId, height: height})
+		}
+		if key.Valid {
+			edge.key = key.String
+			blocks[len(blocks)-1].edges = append(blocks[len(blocks)-1].edges, edge)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating blocks: %w", err)
+	}
+	return blocks, nil
+}
+
+// checkBraiding compares the adjacents of a block with the graph in effect at its
+// height.
+func checkBraiding(block braidingBlock, schedule chaingraph.Schedule, network config.NetworkInfo) []braidingFinding {
+	if network.HasChain(block.chainId) && block.height == network.GenesisHeight(block.chainId) {
+		return nil
+	}
+
+	newFinding := func(kind string, neighbor interface{}, hash sql.NullString, detail string) braidingFinding {
+		return braidingFinding{
+			Kind:          kind,
+			BlockId:       block.id,
+			ChainId:       block.chainId,
+			Height:        block.height,
+			NeighborChain: neighbor,
+			AdjacentHash:  hash,
+			Detail:        detail,
+		}
+	}
+
+	graph, _ := schedule.At(block.height)
+	if !graph.HasChain(block.chainId) {
+		return []braidingFinding{newFinding("unknown-chain", nil, sql.NullString{},
+			fmt.Sprintf("chain %d is not part of the %s graph", block.chainId, graph.Name))}
+	}
+	if schedule.IsTransition(block.height) {
+		if previous, _ := schedule.At(block.height - 1); matchesNeighbors(block, previous) {
+			graph = previous
+		}
+	}
+
+	var findings []braidingFinding
+	seen := make(map[int]bool)
+	for _, edge := range block.edges {
+		neighbor, err := strconv.Atoi(edge.key)
+		if err != nil || !graph.IsNeighbor(block.chainId, neighbor) {
+			var neighborChain interface{}
+			if err == nil {
+				neighborChain = neighbor
+			}
+			findings = append(findings, newFinding("unexpected-chain", neighborChain, edge.hash,
+				fmt.Sprintf("chain %q is not a neighbor of chain %d in the %s graph", edge.key, block.chainId, graph.Name)))
+			continue
+		}
+		seen[neighbor] = true
+
+		// The neighbor chain didn't exist yet, the hash is its genesis parent
+		if block.height-1 < network.GenesisHeight(neighbor) {
+			continue
+		}
+
+		switch {
+		case !edge.refChain.Valid:
+			findings = append(findings, newFinding("missing-block", neighbor, edge.hash,
+				"no block with this hash"))
+		case int(edge.refChain.Int64) != neighbor:
+			findings = append(findings, newFinding("wrong-chain", neighbor, edge.hash,
+				fmt.Sprintf("hash is a block of chain %d", edge.refChain.Int64)))
+		case int(edge.refHeight.Int64) != block.height-1:
+			findings = append(findings, newFinding("wrong-height", neighbor, edge.hash,
+				fmt.Sprintf("hash is a block at height %d, expected %d", edge.refHeight.Int64, block.height-1)))
+		}
+	}
+
+	for _, neighbor := range graph.Neighbors(block.chainId) {
+		if !seen[neighbor] {
+			findings = append(findings, newFinding("missing-edge", neighbor, sql.NullString{},
+				fmt.Sprintf("no adjacent hash for neighbor chain %d", neighbor)))
+		}
+	}
+	return findings
+}
+
+// matchesNeighbors reports whether the adjacents of a block are exactly the
+// neighbors of its chain in graph.
+func matchesNeighbors(block braidingBlock, graph chaingraph.Graph) bool {
+	neighbors := graph.Neighbors(block.chainId)
+	if len(neighbors) == 0 || len(block.edges) != len(neighbors) {
+		return false
+	}
+	for _, edge := range block.edges {
+		neighbor, err := strconv.Atoi(edge.key)
+		if err != nil || !graph.IsNeighbor(block.chainId, neighbor) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordBraidingFindings stores the findings of a batch and logs them until
+// -braiding-max-reported findings have been logged in total.
+func recordBraidingFindings(db *sql.DB, findings []braidingFinding, reportedSoFar int) error {
+	if len(findings) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errs.FromDB("failed to begin transaction", err)
+	}
+	defer tx.Rollback() // Will be ignored if tx.Commit() succeeds
+
+	insert, err := tx.Prepare(`
+		INSERT INTO "BraidingFindings" ("runId", kind, "blockId", "chainId", height, "neighborChain", "adjacentHash", detail)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer insert.Close()
+
+	for i, finding := range findings {
+		if _, err := insert.Exec(runId, finding.Kind, finding.BlockId, finding.ChainId, finding.Height,
+			finding.NeighborChain, finding.AdjacentHash, finding.Detail); err != nil {
+			return fmt.Errorf("failed to record finding of block %d: %w", finding.BlockId, err)
+		}
+
+		if reportedSoFar+i < *braidingMaxReported {
+			log.Printf("Block %d (chain %d, height %d): %s: %s", finding.BlockId, finding.ChainId, finding.Height, finding.Kind, finding.Detail)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errs.FromDB("failed to commit transaction", err)
+	}
+	return nil
+}
+
+func logBraidingSummary(summaries map[int]*braidingChainSummary) {
+	chains := make([]int, 0, len(summaries))
+	for chain := range summaries {
+		chains = append(chains, chain)
+	}
+	sort.Ints(chains)
+
+	for _, chain := range chains {
+		summary := summaries[chain]
+		kinds := make([]string, 0, len(summary.Findings))
+		for kind := range summary.Findings {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		line := fmt.Sprintf("Chain %d: %d blocks, %d edges checked", chain, summary.Blocks, summary.Edges)
+		for _, kind := range kinds {
+			line += fmt.Sprintf(", %s: %d", kind, summary.Findings[kind])
+		}
+		log.Println(line)
+	}
+}
+
+func VerifyBraiding(ctx context.Context, cfg *config.Config) error {
+	consistent, err := verifyBraiding()
+	if err != nil {
+		return err
+	}
+	if !consistent {
+		return fmt.Errorf("verification failed: some blocks are not braided as the chain graph requires; see BraidingFindings for run %s", runId)
+	}
+	log.Println("Every checked block is braided as the chain graph requires")
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+)
+
+// This script proves a code-to-text run correct before the jsonb code column is
+// dropped. It walks TransactionDetails in batches over -start-id..-end-id and
+// counts every row as matched (codetext equals the string in code), null-expected
+// (code is NULL or {} and codetext is NULL), not-yet-migrated (codetext is NULL
+// where code holds a string), cleaned (cleanup-code cleared code, leaving
+// codetext) or mismatched (codetext differs from the string in code). Mismatching
+// ids are listed up to -verify-code-max-reported, and the command exits non-zero
+// when there is any. The counts are recorded in MigratorVerifications for
+// cleanup-code.
+
+const verifyCodeBatchSize = 10000
+
+type codeTextCounts struct {
+	Matched      int
+	NullExpected int
+	NotMigrated  int
+	Cleaned      int
+	Mismatched   int
+}
+
+func (c *codeTextCounts) add(other codeTextCounts) {
+	c.Matched += other.Matched
+	c.NullExpected += other.NullExpected
+	c.NotMigrated += other.NotMigrated
+	c.Cleaned += other.Cleaned
+	c.Mismatched += other.Mismatched
+}
+
+func verifyCodeToText() (bool, error) {
+	if *codeStart < 1 {
+		return false, &errs.ValidationError{Field: "-start-id", Reason: fmt.Sprintf("%d must be at least 1", *codeStart)}
+	}
+	if *codeEnd != 0 && *codeEnd < *codeStart {
+		return false, &errs.ValidationError{Field: "-end-id", Reason: fmt.Sprintf("%d is below -start-id %d", *codeEnd, *codeStart)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return false, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	codeType, err := columnType(db, "TransactionDetails", "codetext")
+	if err != nil {
+		return false, err
+	}
+	if codeType == "" {
+		return false, &errs.SchemaError{Missing: "TransactionDetails.codetext", Reason: "run code-to-text first; after finalize-code-to-text there is nothing left to verify"}
+	}
+
+	endId := *codeEnd
+	if endId == 0 {
+		if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "TransactionDetails"`).Scan(&endId); err != nil {
+			return false, fmt.Errorf("failed to get max transaction details ID: %w", err)
+		}
+	}
+	if endId < *codeStart {
+		logNothingToDo("TransactionDetails", *codeStart, endId)
+		return true, nil
+	}
+
+	counts, err := verifyCodeTextRange(db, *codeStart, endId)
+	if err != nil {
+		return false, err
+	}
+
+	recordVerification(db, "verify-code-to-text", verification{
+		StartId: *codeStart, EndId: endId, Mismatched: counts.Mismatched, NotMigrated: counts.NotMigrated,
+	})
+
+	return counts.Mismatched == 0, nil
+}
+
+// verifyCodeTextRange counts the rows of startId..endId by how their codetext
+// compares to their code, logging the first -verify-code-max-reported
+// mismatching ids and the totals.
+func verifyCodeTextRange(db *sql.DB, startId, endId int) (codeTextCounts, error) {
+	countQuery := `
+		SELECT
+			COUNT(*) FILTER (WHERE codetext IS NOT NULL AND codetext = (` + codeTextConversion + `)),
+			COUNT(*) FILTER (WHERE codetext IS NULL AND (` + codeTextConversion + `) IS NULL),
+			COUNT(*) FILTER (WHERE codetext IS NULL AND (` + codeTextConversion + `) IS NOT NULL),
+			COUNT(*) FILTER (WHERE ` + codeCleanedCondition + `),
+			COUNT(*) FILTER (WHERE codetext IS NOT NULL AND codetext IS DISTINCT FROM (` + codeTextConversion + `) AND NOT (` + codeCleanedCondition + `))
+		FROM "TransactionDetails"
+		WHERE id >= $1 AND id <= $2
+	`
+	mismatchQuery := `
+		SELECT id
+		FROM "TransactionDetails"
+		WHERE id >= $1 AND id <= $2
+		AND codetext IS NOT NULL AND codetext IS DISTINCT FROM (` + codeTextConversion + `) AND NOT (` + codeCleanedCondition + `)
+		ORDER BY id
+		LIMIT $3
+	`
+
+	var (
+		counts              codeTextCounts
+		reported            int
+		lastProgressPrinted = -1.0
+		total               = endId - startId + 1
+	)
+
+	log.Printf("Verifying codetext of TransactionDetails ID %d to %d", startId, endId)
+
+	for currentId := startId; currentId <= endId; currentId += verifyCodeBatchSize {
+		batchEnd := currentId + verifyCodeBatchSize - 1
+		if batchEnd > endId {
+			batchEnd = endId
+		}
+
+		var batch codeTextCounts
+		if err := db.QueryRow(countQuery, currentId, batchEnd).Scan(&batch.Matched, &batch.NullExpected, &batch.NotMigrated, &batch.Cleaned, &batch.Mismatched); err != nil {
+			return codeTextCounts{}, errs.FromDB(fmt.Sprintf("failed to verify batch %d-%d", currentId, batchEnd), err)
+		}
+		counts.add(batch)
+
+		if batch.Mismatched > 0 && reported < *verifyCodeMaxReported {
+			ids, err := loadCodeTextMismatches(db, mismatchQuery, currentId, batchEnd, *verifyCodeMaxReported-reported)
+			if err != nil {
+				return codeTextCounts{}, err
+			}
+			for _, id := range ids {
+				log.Printf("Mismatch: TransactionDetails id %d has a codetext different from its code", id)
+			}
+			reported += len(ids)
+		}
+
+		progressPercent := percentOf(batchEnd-startId+1, total)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			log.Printf("Progress: %.1f%%, not yet migrated: %d, mismatched: %d", progressPercent, counts.NotMigrated, counts.Mismatched)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	log.Printf("Completed processing. Total TransactionDetails verified: %d (100.0%%)",
+		counts.Matched+counts.NullExpected+counts.NotMigrated+counts.Cleaned+counts.Mismatched)
+	log.Printf("  matched:          %d", counts.Matched)
+	log.Printf("  null expected:    %d", counts.NullExpected)
+	log.Printf("  not yet migrated: %d", counts.NotMigrated)
+	log.Printf("  cleaned:          %d", counts.Cleaned)
+	log.Printf("  mismatched:       %d", counts.Mismatched)
+	if counts.Mismatched > reported {
+		log.Printf("Listed %d of %d mismatching ids (-verify-code-max-reported)", reported, counts.Mismatched)
+	}
+	return counts, nil
+}
+
+func loadCodeTextMismatches(db *sql.DB, query string, startId, endId, limit int) ([]int, error) {
+	rows, err := db.Query(query, startId, endId, limit)
+	if err != nil {
+		return nil, errs.FromDB(fmt.Sprintf("failed to list mismatches of batch %d-%d", startId, endId), err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan mismatch: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating mismatches: %w", err)
+	}
+	return ids, nil
+}
+
+func VerifyCodeToText(ctx context.Context, cfg *config.Config) error {
+	consistent, err := verifyCodeToText()
+	if err != nil {
+		return err
+	}
+	if !consistent {
+		return errors.New("verification failed: some codetext values don't match their code")
+	}
+	log.Println("Every migrated codetext value matches its code")
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"go-backfill/errs"
+	"log"
+	"os"
+	"time"
+)
+
+// This script checks what creation-time duplicated. It walks Transactions in
+// batches and compares the creationtime of every Events and Transfers row with
+// its transaction's, counting the rows where they differ (mismatched), where the
+// row has none though the transaction has one (missing), where the row has one
+// though the transaction has none (unexpected), and where the row's is not a
+// Unix time between Kadena's genesis and an hour from now (implausible). A row
+// may count in several categories. Offending rows are listed up to
+// -verify-creation-max-reported, and the command exits non-zero when there is any.
+// With -json the report is printed as JSON.
+
+const (
+	verifyCreationTimeBatchSize = 10000
+	// kadenaGenesisUnix is the day of the mainnet genesis, 2019-10-30 UTC
+	kadenaGenesisUnix = 1572393600
+)
+
+// Categories of creationtime discrepancies
+const (
+	creationTimeMismatched  = "mismatched"
+	creationTimeMissing     = "missing"
+	creationTimeUnexpected  = "unexpected"
+	creationTimeImplausible = "implausible"
+)
+
+type creationTimeReport struct {
+	StartId int                       `json:"startId"`
+	EndId   int                       `json:"endId"`
+	Tables  []*creationTimeTableCheck `json:"tables"`
+}
+
+type creationTimeTableCheck struct {
+	Table       string                 `json:"table"`
+	Checked     int                    `json:"checked"`
+	Mismatched  int                    `json:"mismatched"`
+	Missing     int                    `json:"missing"`
+	Unexpected  int                    `json:"unexpected"`
+	Implausible int                    `json:"implausible"`
+	Offending   []creationTimeOffender `json:"offending"`
+}
+
+type creationTimeOffender struct {
+	Id            int64  `json:"id"`
+	TransactionId int    `json:"transactionId"`
+	Category      string `json:"category"`
+	CreationTime  string `json:"creationtime"`
+	Expected      string `json:"expected"`
+}
+
+func (c *creationTimeTableCheck) discrepancies() int {
+	return c.Mismatched + c.Missing + c.Unexpected + c.Implausible
+}
+
+// creationTimeImplausibleCondition holds for a creationtime of r that isn't a
+// Unix time between $3 and $4. CASE keeps the cast from seeing anything but digits.
+const creationTimeImplausibleCondition = `r.creationtime IS NOT NULL AND CASE
+		WHEN r.creationtime ~ '^[0-9]{1,15}$' THEN r.creationtime::bigint NOT BETWEEN $3 AND $4
+		ELSE true
+	END`
+
+func verifyCreationTime() (bool, error) {
+	if *verifyCreationMaxReported < 0 {
+		return false, &errs.ValidationError{Field: "-verify-creation-max-reported", Reason: fmt.Sprintf("%d must not be negative", *verifyCreationMaxReported)}
+	}
+
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return false, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	var endId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "Transactions"`).Scan(&endId); err != nil {
+		return false, fmt.Errorf("failed to get max transaction ID: %w", err)
+	}
+	endId, err = capToLiveWatermark(db, "Transactions", endId, false)
+	if err != nil {
+		return false, err
+	}
+
+	report := creationTimeReport{StartId: startTransactionId, EndId: endId}
+	for _, table := range []string{"Events", "Transfers"} {
+		report.Tables = append(report.Tables, &creationTimeTableCheck{Table: table, Offending: []creationTimeOffender{}})
+	}
+	if endId < startTransactionId {
+		logNothingToDo("Transactions", startTransactionId, endId)
+		return true, printCreationTimeReport(report)
+	}
+
+	// A creationtime up to an hour ahead passes, for clock skew
+	latest := time.Now().Add(time.Hour).Unix()
+	var (
+		reported            int
+		lastProgressPrinted = -1.0
+		total               = endId - startTransactionId + 1
+	)
+
+	log.Printf("Verifying the creationtime of Events and Transfers for Transactions ID %d to %d", startTransactionId, endId)
+
+	for currentId := startTransactionId; currentId <= endId; currentId += verifyCreationTimeBatchSize {
+		batchEnd := currentId + verifyCreationTimeBatchSize - 1
+		if batchEnd > endId {
+			batchEnd = endId
+		}
+
+		for _, check := range report.Tables {
+			var batch creationTimeTableCheck
+			err := db.QueryRow(fmt.Sprintf(`
+				SELECT
+					COUNT(*),
+					COUNT(*) FILTER (WHERE r.creationtime IS NOT NULL AND t.creationtime IS NOT NULL AND r.creationtime <> t.creationtime),
+					COUNT(*) FILTER (WHERE r.creationtime IS NULL AND t.creationtime IS NOT NULL),
+					COUNT(*) FILTER (WHERE r.creationtime IS NOT NULL AND t.creationtime IS NULL),
+					COUNT(*) FILTER (WHERE %s)
+				FROM "%s" r
+				JOIN "Transactions" t ON t.id = r."transactionId"
+				WHERE t.id >= $1 AND t.id <= $2
+			`, creationTimeImplausibleCondition, check.Table), currentId, batchEnd, kadenaGenesisUnix, latest).
+				Scan(&batch.Checked, &batch.Mismatched, &batch.Missing, &batch.Unexpected, &batch.Implausible)
+			if err != nil {
+				return false, errs.FromDB(fmt.Sprintf("failed to verify %s of batch %d-%d", check.Table, currentId, batchEnd), err)
+			}
+			check.Checked += batch.Checked
+			check.Mismatched += batch.Mismatched
+			check.Missing += batch.Missing
+			check.Unexpected += batch.Unexpected
+			check.Implausible += batch.Implausible
+
+			if batch.discrepancies() > 0 && reported < *verifyCreationMaxReported {
+				offenders, err := loadCreationTimeOffenders(db, check.Table, currentId, batchEnd, latest, *verifyCreationMaxReported-reported)
+				if err != nil {
+					return false, err
+				}
+				for _, offender := range offenders {
+					log.Printf("%s: %s id %d has creationtime %q, its transaction %d has %q",
+						offender.Category, check.Table, offender.Id, offender.CreationTime, offender.TransactionId, offender.Expected)
+				}
+				check.Offending = append(check.Offending, offenders...)
+				reported += len(offenders)
+			}
+		}
+
+		progressPercent := percentOf(batchEnd-startTransactionId+1, total)
+		if progressPercent-lastProgressPrinted >= 0.1 {
+			discrepancies := 0
+			for _, check := range report.Tables {
+				discrepancies += check.discrepancies()
+			}
+			log.Printf("Progress: %.1f%%, discrepancies: %d", progressPercent, discrepancies)
+			lastProgressPrinted = progressPercent
+		}
+	}
+
+	consistent := true
+	for _, check := range report.Tables {
+		if check.discrepancies() > 0 {
+			consistent = false
+		}
+	}
+	return consistent, printCreationTimeReport(report)
+}
+
+// loadCreationTimeOffenders lists the rows of table in the batch failing a check,
+// each under the first category it fails.
+func loadCreationTimeOffenders(db *sql.DB, table string, startId, endId int, latest int64, limit int) ([]creationTimeOffender, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT id, "transactionId", category, creationtime, expected FROM (
+			SELECT r.id, r."transactionId", COALESCE(r.creationtime, '') AS creationtime, COALESCE(t.creationtime, '') AS expected,
+				CASE
+					WHEN r.creationtime IS NOT NULL AND t.creationtime IS NOT NULL AND r.creationtime <> t.creationtime THEN '%[2]s'
+					WHEN r.creationtime IS NULL AND t.creationtime IS NOT NULL THEN '%[3]s'
+					WHEN r.creationtime IS NOT NULL AND t.creationtime IS NULL THEN '%[4]s'
+					WHEN %[5]s THEN '%[6]s'
+				END AS category
+			FROM "%[1]s" r
+			JOIN "Transactions" t ON t.id = r."transactionId"
+			WHERE t.id >= $1 AND t.id <= $2
+		) checked
+		WHERE category IS NOT NULL
+		ORDER BY id
+		LIMIT $5
+	`, table, creationTimeMismatched, creationTimeMissing, creationTimeUnexpected, creationTimeImplausibleCondition, creationTimeImplausible),
+		startId, endId, kadenaGenesisUnix, latest, limit)
+	if err != nil {
+		return nil, errs.FromDB(fmt.Sprintf("failed to list the discrepancies of %s in batch %d-%d", table, startId, endId), err)
+	}
+	defer rows.Close()
+
+	var offenders []creationTimeOffender
+	for rows.Next() {
+		var offender creationTimeOffender
+		if err := rows.Scan(&offender.Id, &offender.TransactionId, &offender.Category, &offender.CreationTime, &offender.Expected); err != nil {
+			return nil, fmt.Errorf("failed to scan discrepancy: %w", err)
+		}
+		offenders = append(offenders, offender)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating discrepancies: %w", err)
+	}
+	return offenders, nil
+}
+
+func printCreationTimeReport(report creationTimeReport) error {
+	if *statusJson {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode report: %w", err)
+		}
+		fmt.Fprintln(os.Stdout, string(data))
+		return nil
+	}
+
+	reported, discrepancies := 0, 0
+	for _, check := range report.Tables {
+		log.Printf("Completed processing. Total %s verified: %d (100.0%%)", check.Table, check.Checked)
+		log.Printf("  mismatched:  %d", check.Mismatched)
+		log.Printf("  missing:     %d", check.Missing)
+		log.Printf("  unexpected:  %d", check.Unexpected)
+		log.Printf("  implausible: %d", check.Implausible)
+		reported += len(check.Offending)
+		discrepancies += check.discrepancies()
+	}
+	if discrepancies > reported {
+		log.Printf("Listed %d offending rows (-verify-creation-max-reported)", reported)
+	}
+	return nil
+}
+
+func VerifyCreationTime(ctx context.Context, cfg *config.Config) error {
+	consistent, err := verifyCreationTime()
+	if err != nil {
+		return err
+	}
+	if !consistent {
+		return errors.New("verification failed: some events or transfers don't carry their transaction's creationtime")
+	}
+	log.Println("Every event and transfer carries its transaction's creationtime")
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-backfill/config"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// This script checks request keys for corruption. A request key is the hash of a
+// command, so two transactions with the same key on the same chain must carry the
+// same command; when their payloads differ the data is corrupt or a hash was
+// computed wrongly, and the command fails. The same key on several chains is normal
+// for cross-chain continuations, so that is only reported as a distribution to
+// know the baseline. Grouping happens in the database and results are streamed,
+// so memory stays bounded by the number of samples kept.
+
+// requestKeyPayloadHash fingerprints the command of transaction t, given its
+// details td.
+const requestKeyPayloadHash = `md5(concat_ws('|', t.hash, td.code::text, td.data::text, td.nonce, t.sender))`
+
+type requestKeyMismatch struct {
+	RequestKey     string   `json:"requestKey"`
+	ChainId        int      `json:"chainId"`
+	Transactions   int      `json:"transactions"`
+	Payloads       int      `json:"payloads"`
+	TransactionIds []int64  `json:"transactionIds"`
+	PayloadHashes  []string `json:"payloadHashes"`
+}
+
+type requestKeyReuse struct {
+	Chains      int      `json:"chains"`
+	RequestKeys int      `json:"requestKeys"`
+	Samples     []string `json:"samples"`
+}
+
+type requestKeyReport struct {
+	RunId               string               `json:"runId"`
+	StartedAt           time.Time            `json:"startedAt"`
+	MaxTransactionId    int                  `json:"maxTransactionId"`
+	SameChainMismatch   int                  `json:"sameChainMismatches"`
+	Mismatches          []requestKeyMismatch `json:"mismatches"`
+	CrossChainReuse     []requestKeyReuse    `json:"crossChainReuse"`
+	MismatchesTruncated bool                 `json:"mismatchesTruncated,omitempty"`
+}
+
+func verifyRequestKeys() (bool, error) {
+	env := config.GetConfig()
+	connStr := env.DSN()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	log.Println("Connected to database")
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		return false, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	if err := createRequestKeyFindingsTable(db); err != nil {
+		return false, err
+	}
+
+	var maxTransactionId int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM "Transactions"`).Scan(&maxTransactionId); err != nil {
+		return false, fmt.Errorf("failed to get max transaction ID: %w", err)
+	}
+
+	maxTransactionId, err = capToLiveWatermark(db, "Transactions", maxTransactionId, false)
+	if err != nil {
+		return false, err
+	}
+
+	if maxTransactionId < 1 {
+		logNothingToDo("Transactions", 1, maxTransactionId)
+		return true, nil
+	}
+
+	report := requestKeyReport{
+		RunId:            runId,
+		StartedAt:        time.Now().UTC(),
+		MaxTransactionId: maxTransactionId,
+	}
+
+	log.Printf("Checking request keys of transactions 1 to %d", maxTransactionId)
+
+	if err := findSameChainMismatches(db, maxTransactionId, &report); err != nil {
+		return false, err
+	}
+	if err := measureCrossChainReuse(db, maxTransactionId, &report); err != nil {
+		return false, err
+	}
+
+	for _, reuse := range report.CrossChainReuse {
+		log.Printf("Request keys on %d chain(s): %d", reuse.Chains, reuse.RequestKeys)
+	}
+	log.Printf("Same-chain request keys with different payloads: %d", report.SameChainMismatch)
+
+	if *requestKeysOutput != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return false, fmt.Errorf("failed to encode request key report: %w", err)
+		}
+		if err := os.WriteFile(*requestKeysOutput, data, 0644); err != nil {
+			return false, fmt.Errorf("failed to write request key report: %w", err)
+		}
+		log.Printf("Request key report written to %s", *requestKeysOutput)
+	}
+
+	return report.SameChainMismatch == 0, nil
+}
+
+func createRequestKeyFindingsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "RequestKeyFindings" (
+			id SERIAL PRIMARY KEY,
+			"runId" TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			requestkey TEXT NOT NULL,
+			"chainId" INTEGER,
+			chains INTEGER,
+			"transactionIds" BIGINT[],
+			"payloadHashes" TEXT[],
+			"recordedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create RequestKeyFindings table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS requestkeyfindings_run_idx ON "RequestKeyFindings" ("runId", kind)`)
+	if err != nil {
+		return fmt.Errorf("failed to create RequestKeyFindings run index: %w", err)
+	}
+	return nil
+}
+
+// findSameChainMismatches records every (requestkey, chainId) group whose
+// transactions don't all share one payload, with up to -requestkeys-samples
+// transaction ids and payload hashes to drill into.
+func findSameChainMismatches(db *sql.DB, maxTransactionId int, report *requestKeyReport) error {
+	query := fmt.Sprintf(`
+		SELECT t.requestkey, t."chainId", COUNT(*), COUNT(DISTINCT %s),
+			(array_agg(t.id ORDER BY t.id))[1:$2],
+			(array_agg(DISTINCT %s))[1:$2]
+		FROM "Transactions" t
+		LEFT JOIN "TransactionDetails" td ON td."transactionId" = t.id
+		WHERE t.id <= $1
+		GROUP BY t.requestkey, t."chainId"
+		HAVING COUNT(*) > 1 AND COUNT(DISTINCT %s) > 1
+	`, requestKeyPayloadHash, requestKeyPayloadHash, requestKeyPayloadHash)
+
+	rows, err := db.Query(query, maxTransactionId, *requestKeysSamples)
+	if err != nil {
+		return fmt.Errorf("failed to group request keys by chain: %w", err)
+	}
+	defer rows.Close()
+
+	insert, err := db.Prepare(`
+		INSERT INTO "RequestKeyFindings" ("runId", kind, requestkey, "chainId", "transactionIds", "payloadHashes")
+		VALUES ($1, 'same-chain-payload-mismatch', $2, $3, $4, $5)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer insert.Close()
+
+	for rows.Next() {
+		var mismatch requestKeyMismatch
+		if err := rows.Scan(&mismatch.RequestKey, &mismatch.ChainId, &mismatch.Transactions, &mismatch.Payloads,
+			pq.Array(&mismatch.TransactionIds), pq.Array(&mismatch.PayloadHashes)); err != nil {
+			return fmt.Errorf("failed to scan request key group: %w", err)
+		}
+
+		if _, err := insert.Exec(runId, mismatch.RequestKey, mismatch.ChainId,
+			pq.Array(mismatch.TransactionIds), pq.Array(mismatch.PayloadHashes)); err != nil {
+			return fmt.Errorf("failed to record mismatch of %s: %w", mismatch.RequestKey, err)
+		}
+
+		report.SameChainMismatch++
+		if report.SameChainMismatch <= *requestKeysMaxReported {
+			log.Printf("Request key %s on chain %d has %d transactions with %d different payloads (ids %v)",
+				mismatch.RequestKey, mismatch.ChainId, mismatch.Transactions, mismatch.Payloads, mismatch.TransactionIds)
+			report.Mismatches = append(report.Mismatches, mismatch)
+		} else {
+			report.MismatchesTruncated = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating request key groups: %w", err)
+	}
+	return nil
+}
+
+// measureCrossChainReuse counts request keys by the number of chains they appear
+// on, keeping a few sample keys for every chain count above one.
+func measureCrossChainReuse(db *sql.DB, maxTransactionId int, report *requestKeyReport) error {
+	rows, err := db.Query(`
+		SELECT chains, COUNT(*),
+			-- single-chain keys are the bulk of the table, don't aggregate them
+			(array_agg(requestkey) FILTER (WHERE chains > 1))[1:$2]
+		FROM (
+			SELECT requestkey, COUNT(DISTINCT "chainId") AS chains
+			FROM "Transactions"
+			WHERE id <= $1
+			GROUP BY requestkey
+		) k
+		GROUP BY chains
+		ORDER BY chains
+	`, maxTransactionId, *requestKeysSamples)
+	if err != nil {
+		return fmt.Errorf("failed to measure cross-chain request key reuse: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reuse requestKeyReuse
+		if err := rows.Scan(&reuse.Chains, &reuse.RequestKeys, pq.Array(&reuse.Samples)); err != nil {
+			return fmt.Errorf("failed to scan cross-chain reuse: %w", err)
+		}
+		report.CrossChainReuse = append(report.CrossChainReuse, reuse)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating cross-chain reuse: %w", err)
+	}
+
+	for _, reuse := range report.CrossChainReuse {
+		for _, key := range reuse.Samples {
+			_, err := db.Exec(`
+				INSERT INTO "RequestKeyFindings" ("runId", kind, requestkey, chains)
+				VALUES ($1, 'cross-chain-reuse-sample', $2, $3)
+			`, runId, key, reuse.Chains)
+			if err != nil {
+				return fmt.Errorf("failed to record cross-chain sample %s: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func VerifyRequestKeys(ctx context.Context, cfg *config.Config) error {
+	consistent, err := verifyRequestKeys()
+	if err != nil {
+		return err
+	}
+	if !consistent {
+		return errors.New("verification failed: some request keys carry different payloads on the same chain")
+	}
+	log.Println("No request key carries different payloads on the same chain")
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"go-backfill/errs"
+	"log"
+)
+
+// The live indexer keeps appending rows at the top of the id range. When running
+// with -below-live-watermark every command caps its processing range at the
+// watermark captured here at startup, so we never touch rows the live writer may
+// still be updating.
+
+func liveWatermark(db *sql.DB, table string) (int, error) {
+	var maxId int
+	query := fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM "%s"`, table)
+	if err := db.QueryRow(query).Scan(&maxId); err != nil {
+		return 0, fmt.Errorf("failed to get max id of %s: %w", table, err)
+	}
+
+	watermark := maxId - *liveMargin
+	if watermark < 0 {
+		watermark = 0
+	}
+
+	log.Printf("Live watermark for %s: max id %d, safety margin %d, processing capped at id %d",
+		table, maxId, *liveMargin, watermark)
+	return watermark, nil
+}
+
+// capToLiveWatermark returns the end id a command may process up to. A derived end
+// id (e.g. MAX(id)) is silently capped, while an explicitly requested end id above
+// the watermark is refused unless -allow-tip is set.
+func capToLiveWatermark(db *sql.DB, table string, endId int, explicit bool) (int, error) {
+	if !*belowLiveWatermark {
+		return endId, nil
+	}
+
+	watermark, err := liveWatermark(db, table)
+	if err != nil {
+		return 0, err
+	}
+
+	if endId <= watermark {
+		return endId, nil
+	}
+
+	if explicit {
+		if !*allowTip {
+			return 0, &errs.ValidationError{Field: "end id", Reason: fmt.Sprintf("%d is above the live watermark %d of %s; pass -allow-tip to process it anyway",
+				endId, watermark, table)}
+		}
+		log.Printf("WARNING: end id %d is above the live watermark %d of %s, continuing because -allow-tip is set",
+			endId, watermark, table)
+		return endId, nil
+	}
+
+	return watermark, nil
+}
+
+// Incremental commands keep the highest id they have fully processed in the
+// MigratorWatermarks table. The watermark is written in the same transaction as
+// the batch it covers, so a crash never leaves it ahead of the data. code-to-text,
+// which runs downward, keeps the lowest id of its last committed batch instead.
+
+func createWatermarksTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS "MigratorWatermarks" (
+			command TEXT PRIMARY KEY,
+			"lastId" INTEGER NOT NULL,
+			"updatedAt" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create MigratorWatermarks table: %w", err)
+	}
+	return nil
+}
+
+func readWatermark(db *sql.DB, command string) (int, error) {
+	var lastId int
+	err := db.QueryRow(`SELECT COALESCE(MAX("lastId"), 0) FROM "MigratorWatermarks" WHERE command = $1`, command).Scan(&lastId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s watermark: %w", command, err)
+	}
+	return lastId, nil
+}
+
+// watermarkWriter is a batch transaction, or the database for progress recorded
+// after a batch committed.
+type watermarkWriter interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func writeWatermark(w watermarkWriter, command string, lastId int) error {
+	_, err := w.Exec(`
+		INSERT INTO "MigratorWatermarks" (command, "lastId", "updatedAt")
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (command) DO UPDATE SET "lastId" = EXCLUDED."lastId", "updatedAt" = EXCLUDED."updatedAt"
+	`, command, lastId)
+	if err != nil {
+		return fmt.Errorf("failed to update %s watermark: %w", command, err)
+	}
+	return nil
+}
+
+// clearWatermark removes the watermark of command, so its next run starts over.
+func clearWatermark(db *sql.DB, command string) error {
+	if _, err := db.Exec(`DELETE FROM "MigratorWatermarks" WHERE command = $1`, command); err != nil {
+		return fmt.Errorf("failed to clear %s watermark: %w", command, err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Package errs defines the categories of errors the backfill and the migrator
+// act on. Callers wrap errors with %w so the category survives and dispatch with
+// errors.As instead of matching messages.
+package errs
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// RetryableDBError is a database failure that may succeed when retried: a lost
+// connection, a serialization failure or deadlock, a lock timeout or a server
+// shutting down.
+type RetryableDBError struct {
+	Op  string
+	Err error
+}
+
+func (e *RetryableDBError) Error() string {
+	return fmt.Sprintf("%s: %v (retryable)", e.Op, e.Err)
+}
+
+func (e *RetryableDBError) Unwrap() error { return e.Err }
+
+// ValidationError is input that doesn't meet expectations: a row whose data
+// can't be processed, or a flag with an invalid value. RowID is 0 when the input
+// isn't a row.
+type ValidationError struct {
+	RowID  int64
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	switch {
+	case e.RowID != 0 && e.Field != "":
+		return fmt.Sprintf("invalid %s of row %d: %s", e.Field, e.RowID, e.Reason)
+	case e.RowID != 0:
+		return fmt.Sprintf("invalid row %d: %s", e.RowID, e.Reason)
+	case e.Field != "":
+		return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+	default:
+		return "invalid input: " + e.Reason
+	}
+}
+
+// SchemaError is a database schema that doesn't have what a command needs, such
+// as a missing table or a column of the wrong type.
+type SchemaError struct {
+	Missing string
+	Reason  string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("schema error: %s not found", e.Missing)
+	}
+	return fmt.Sprintf("schema error: %s: %s", e.Missing, e.Reason)
+}
+
+// NodeError is a failed request to a chainweb node. StatusCode is 0 when no
+// response was received.
+type NodeError struct {
+	StatusCode int
+	Endpoint   string
+	Err        error
+}
+
+func (e *NodeError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("node request to %s failed: %v", e.Endpoint, e.Err)
+	}
+	return fmt.Sprintf("node request to %s returned status %d", e.Endpoint, e.StatusCode)
+}
+
+func (e *NodeError) Unwrap() error { return e.Err }
+
+// LimitExceeded is input larger than a configured limit allows.
+type LimitExceeded struct {
+	Limit string
+	Err   error
+}
+
+func (e *LimitExceeded) Error() string {
+	return fmt.Sprintf("%s limit exceeded: %v", e.Limit, e.Err)
+}
+
+func (e *LimitExceeded) Unwrap() error { return e.Err }
+
+// Interrupted is a run stopped by a signal once its in-flight work committed.
+// Done describes how far it got, so the run can be picked up from there.
+type Interrupted struct {
+	Done string
+}
+
+func (e *Interrupted) Error() string {
+	return "interrupted: " + e.Done
+}
+
+// Exit codes of the categories. Uncategorized errors exit with 1.
+const (
+	ExitFailure     = 1
+	ExitValidation  = 3
+	ExitSchema      = 4
+	ExitNode        = 5
+	ExitLimit       = 6
+	ExitRetryable   = 75  // EX_TEMPFAIL, a later attempt may succeed
+	ExitInterrupted = 130 // 128 + SIGINT, as shells report it
+)
+
+// ExitCode maps err to the exit code of its category.
+func ExitCode(err error) int {
+	var (
+		validationErr *ValidationError
+		schemaErr     *SchemaError
+		nodeErr       *NodeError
+		limitErr      *LimitExceeded
+		retryableErr  *RetryableDBError
+		interruptErr  *Interrupted
+	)
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &interruptErr):
+		return ExitInterrupted
+	case errors.As(err, &validationErr):
+		return ExitValidation
+	case errors.As(err, &schemaErr):
+		return ExitSchema
+	case errors.As(err, &limitErr):
+		return ExitLimit
+	case errors.As(err, &retryableErr):
+		return ExitRetryable
+	case errors.As(err, &nodeErr):
+		if IsRetryable(err) {
+			return ExitRetryable
+		}
+		return ExitNode
+	default:
+		return ExitFailure
+	}
+}
+
+// IsRetryable reports whether retrying the operation that failed with err may
+// succeed.
+func IsRetryable(err error) bool {
+	var retryableErr *RetryableDBError
+	if errors.As(err, &retryableErr) {
+		return true
+	}
+	var nodeErr *NodeError
+	if errors.As(err, &nodeErr) {
+		return nodeErr.StatusCode == 0 ||
+			nodeErr.StatusCode == http.StatusTooManyRequests ||
+			nodeErr.StatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// retryableSQLStates are the PostgreSQL error codes and classes worth retrying.
+var retryableSQLStates = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available, e.g. lock_timeout
+	"57014": true, // query_canceled, e.g. statement_timeout
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// FromDB wraps a database error of op in a RetryableDBError when it is worth
+// retrying, and with op as context otherwise.
+func FromDB(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &RetryableDBError{Op: op, Err: err}
+	}
+	// pgx knows when a failed statement never reached the server
+	if pgconn.SafeToRetry(err) {
+		return &RetryableDBError{Op: op, Err: err}
+	}
+	if code := SQLState(err); retryableSQLStates[code] || strings.HasPrefix(code, "08") {
+		return &RetryableDBError{Op: op, Err: err}
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// SQLState returns the PostgreSQL error code of err, from lib/pq or pgx, or ""
+// when it has none.
+func SQLState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
@@ -0,0 +1,271 @@
+package errs
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// safeToRetryErr is an error pgx reports for a statement that never reached the
+// server.
+type safeToRetryErr struct{}
+
+func (safeToRetryErr) Error() string     { return "conn closed before the query was sent" }
+func (safeToRetryErr) SafeToRetry() bool { return true }
+
+func TestFromDB(t *testing.T) {
+	type fromDBTest struct {
+		name      string
+		err       error
+		retryable bool
+	}
+	tests := []fromDBTest{
+		{name: "bad connection", err: driver.ErrBadConn, retryable: true},
+		{name: "connection reset", err: fmt.Errorf("read tcp: %w", syscall.ECONNRESET), retryable: true},
+		{name: "unexpected EOF", err: io.ErrUnexpectedEOF, retryable: true},
+		{name: "pgx safe to retry", err: safeToRetryErr{}, retryable: true},
+		{name: "no rows", err: sql.ErrNoRows},
+		{name: "plain error", err: errors.New("boom")},
+	}
+	states := []struct {
+		code      string
+		retryable bool
+	}{
+		{code: "40001", retryable: true}, // serialization_failure
+		{code: "40P01", retryable: true}, // deadlock_detected
+		{code: "55P03", retryable: true}, // lock_not_available
+		{code: "57014", retryable: true}, // query_canceled
+		{code: "57P01", retryable: true}, // admin_shutdown
+		{code: "57P02", retryable: true}, // crash_shutdown
+		{code: "57P03", retryable: true}, // cannot_connect_now
+		{code: "08000", retryable: true}, // connection_exception
+		{code: "08006", retryable: true}, // connection_failure
+		{code: "23505"},                  // unique_violation
+		{code: "42P01"},                  // undefined_table
+		{code: "22P02"},                  // invalid_text_representation
+		{code: "40002"},                  // transaction_integrity_constraint_violation
+	}
+	for _, state := range states {
+		tests = append(tests,
+			fromDBTest{name: "lib/pq " + state.code, err: &pq.Error{Code: pq.ErrorCode(state.code), Message: "failed"}, retryable: state.retryable},
+			fromDBTest{name: "pgx " + state.code, err: &pgconn.PgError{Code: state.code, Message: "failed"}, retryable: state.retryable},
+		)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := FromDB("failed to update batch", tt.err)
+			var retryableErr *RetryableDBError
+			if got := errors.As(err, &retryableErr); got != tt.retryable {
+				t.Errorf("FromDB() = %v, retryable %t, want %t", err, got, tt.retryable)
+			}
+			if got := IsRetryable(err); got != tt.retryable {
+				t.Errorf("IsRetryable() = %t, want %t", got, tt.retryable)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("FromDB() doesn't wrap %v", tt.err)
+			}
+			if !strings.HasPrefix(err.Error(), "failed to update batch: ") {
+				t.Errorf("FromDB() = %s, want the op as context", err)
+			}
+			if got, want := SQLState(err), SQLState(tt.err); got != want {
+				t.Errorf("SQLState() = %q, want %q", got, want)
+			}
+		})
+	}
+
+	if err := FromDB("op", nil); err != nil {
+		t.Errorf("FromDB(nil) = %v, want nil", err)
+	}
+}
+
+func TestSQLState(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "lib/pq", err: &pq.Error{Code: "40001"}, want: "40001"},
+		{name: "pgx", err: &pgconn.PgError{Code: "40P01"}, want: "40P01"},
+		{name: "wrapped", err: fmt.Errorf("batch: %w", &pgconn.PgError{Code: "57014"}), want: "57014"},
+		{name: "none", err: errors.New("boom"), want: ""},
+		{name: "nil", err: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SQLState(tt.err); got != tt.want {
+				t.Errorf("SQLState() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "retryable database error", err: &RetryableDBError{Op: "op", Err: io.ErrUnexpectedEOF}, want: true},
+		{name: "wrapped retryable database error", err: fmt.Errorf("batch 1-10: %w", &RetryableDBError{Op: "op", Err: io.ErrUnexpectedEOF}), want: true},
+		{name: "node unreachable", err: &NodeError{Endpoint: "/payload", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "node rate limited", err: &NodeError{StatusCode: 429, Endpoint: "/payload"}, want: true},
+		{name: "node server error", err: &NodeError{StatusCode: 503, Endpoint: "/payload"}, want: true},
+		{name: "node not found", err: &NodeError{StatusCode: 404, Endpoint: "/payload"}, want: false},
+		{name: "node bad request", err: &NodeError{StatusCode: 400, Endpoint: "/payload"}, want: false},
+		{name: "validation", err: &ValidationError{RowID: 7, Reason: "bad"}, want: false},
+		{name: "schema", err: &SchemaError{Missing: "table X"}, want: false},
+		{name: "limit", err: &LimitExceeded{Limit: "json", Err: errors.New("too deep")}, want: false},
+		{name: "interrupted", err: &Interrupted{Done: "ids 1-10 remain"}, want: false},
+		{name: "uncategorized", err: errors.New("boom"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", err: nil, want: 0},
+		{name: "uncategorized", err: errors.New("boom"), want: ExitFailure},
+		{name: "validation", err: &ValidationError{Field: "-batch-size", Reason: "must be greater than 0"}, want: ExitValidation},
+		{name: "wrapped validation", err: fmt.Errorf("code-to-text: %w", &ValidationError{RowID: 3, Reason: "bad"}), want: ExitValidation},
+		{name: "schema", err: &SchemaError{Missing: `column "codetext"`}, want: ExitSchema},
+		{name: "limit", err: &LimitExceeded{Limit: "json", Err: errors.New("too deep")}, want: ExitLimit},
+		{name: "retryable database error", err: FromDB("op", &pq.Error{Code: "40001"}), want: ExitRetryable},
+		{name: "permanent database error", err: FromDB("op", &pq.Error{Code: "23505"}), want: ExitFailure},
+		{name: "node not found", err: &NodeError{StatusCode: 404, Endpoint: "/payload"}, want: ExitNode},
+		{name: "node unavailable", err: &NodeError{StatusCode: 503, Endpoint: "/payload"}, want: ExitRetryable},
+		{name: "node unreachable", err: &NodeError{Endpoint: "/payload", Err: syscall.ECONNREFUSED}, want: ExitRetryable},
+		{name: "interrupted", err: &Interrupted{Done: "ids 1-10 remain"}, want: ExitInterrupted},
+		{name: "interrupted wins", err: errors.Join(&RetryableDBError{Op: "op", Err: io.ErrUnexpectedEOF}, &Interrupted{Done: "x"}), want: ExitInterrupted},
+		{name: "validation beats retryable", err: errors.Join(&RetryableDBError{Op: "op", Err: io.ErrUnexpectedEOF}, &ValidationError{Reason: "bad"}), want: ExitValidation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &ValidationError{RowID: 7, Field: "code", Reason: "not a string"}, want: "invalid code of row 7: not a string"},
+		{err: &ValidationError{RowID: 7, Reason: "not a string"}, want: "invalid row 7: not a string"},
+		{err: &ValidationError{Field: "-batch-size", Reason: "0 must be greater than 0"}, want: "invalid -batch-size: 0 must be greater than 0"},
+		{err: &ValidationError{Reason: "bad"}, want: "invalid input: bad"},
+		{err: &SchemaError{Missing: `table "Events"`}, want: `schema error: table "Events" not found`},
+		{err: &SchemaError{Missing: `column "code"`, Reason: "is text, expected jsonb"}, want: `schema error: column "code": is text, expected jsonb`},
+		{err: &NodeError{Endpoint: "/payload/outputs", Err: errors.New("timeout")}, want: "node request to /payload/outputs failed: timeout"},
+		{err: &NodeError{StatusCode: 502, Endpoint: "/payload/outputs"}, want: "node request to /payload/outputs returned status 502"},
+		{err: &LimitExceeded{Limit: "json", Err: errors.New("max depth")}, want: "json limit exceeded: max depth"},
+		{err: &RetryableDBError{Op: "failed to commit", Err: io.ErrUnexpectedEOF}, want: "failed to commit: unexpected EOF (retryable)"},
+		{err: &Interrupted{Done: "ids 1-10 remain"}, want: "interrupted: ids 1-10 remain"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+// flagMention matches a command-line flag in an error message, such as -batch-size.
+var flagMention = regexp.MustCompile(`(^|[\s(:,])-[a-z][a-z0-9]*(-[a-z0-9]+)*\b`)
+
+// invalidValue matches the wording of a message about an invalid value.
+var invalidValue = regexp.MustCompile(`\b(must|invalid|expected)\b`)
+
+// TestFlagErrorsAreValidationErrors fails for an error built with fmt.Errorf or
+// errors.New that reports an invalid flag value, which must be a
+// ValidationError to exit with ExitValidation. It checks the packages next to
+// this one, so new command packages are covered as they are added.
+func TestFlagErrorsAreValidationErrors(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("..", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	checked := 0
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range files {
+			if strings.HasSuffix(path, "_test.go") {
+				continue
+			}
+			file, err := parser.ParseFile(fset, path, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checked++
+			ast.Inspect(file, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok || len(call.Args) == 0 || !isBareErrorCall(call) {
+					return true
+				}
+				literal, ok := call.Args[0].(*ast.BasicLit)
+				if !ok || literal.Kind != token.STRING {
+					return true
+				}
+				message, err := strconv.Unquote(literal.Value)
+				if err != nil {
+					return true
+				}
+				if flagMention.MatchString(message) && invalidValue.MatchString(message) {
+					t.Errorf("%s: %q reports an invalid flag value; return an *errs.ValidationError", fset.Position(call.Pos()), message)
+				}
+				return true
+			})
+		}
+	}
+	if checked == 0 {
+		t.Fatal("no source files checked")
+	}
+}
+
+// isBareErrorCall reports whether call is fmt.Errorf or errors.New.
+func isBareErrorCall(call *ast.CallExpr) bool {
+	selector, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := selector.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	return (pkg.Name == "fmt" && selector.Sel.Name == "Errorf") || (pkg.Name == "errors" && selector.Sel.Name == "New")
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"go-backfill/config"
+	"go-backfill/errs"
 	"io"
 	"log"
 	"net/http"
@@ -58,14 +59,14 @@ func FetchPayloadsWithHeaders(network string, chainId int, Hash string, minHeigh
 
 	paramJSON, err := json.Marshal(param)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload hashes to JSON: %v", err)
+		return nil, fmt.Errorf("failed to marshal payload hashes to JSON: %w", err)
 	}
 
 	attempt := 1
 	for attempt <= env.SyncAttemptsMaxRetry {
 		req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(paramJSON))
 		if err != nil {
-			return nil, fmt.Errorf("failed to create request: %v", err)
+			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
 
 		req.Header.Set("Content-Type", "application/json")
@@ -76,7 +77,7 @@ func FetchPayloadsWithHeaders(network string, chainId int, Hash string, minHeigh
 		if err != nil {
 			log.Printf("Attempt %d: Error making POST request for payloads: %v\n", attempt, err)
 			if attempt == env.SyncAttemptsMaxRetry {
-				return nil, err
+				return nil, &errs.NodeError{Endpoint: endpoint, Err: err}
 			}
 
 			attempt++
@@ -87,8 +88,10 @@ func FetchPayloadsWithHeaders(network string, chainId int, Hash string, minHeigh
 
 		if resp.StatusCode != http.StatusOK {
 			log.Printf("Attempt %d: Received non-OK HTTP status %d\n", attempt, resp.StatusCode)
-			if attempt == env.SyncAttemptsMaxRetry {
-				return nil, fmt.Errorf("received non-OK HTTP status: %d", resp.StatusCode)
+			nodeErr := &errs.NodeError{StatusCode: resp.StatusCode, Endpoint: endpoint}
+			// A client error won't go away by asking again
+			if attempt == env.SyncAttemptsMaxRetry || !errs.IsRetryable(nodeErr) {
+				return nil, nodeErr
 			}
 
 			attempt++
@@ -98,13 +101,13 @@ func FetchPayloadsWithHeaders(network string, chainId int, Hash string, minHeigh
 
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read response body: %v", err)
+			return nil, fmt.Errorf("failed to read response body: %w", err)
 		}
 
 		var payload FetchResponse
 		err = json.Unmarshal(body, &payload)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal JSON response: %v", err)
+			return nil, fmt.Errorf("failed to unmarshal JSON response: %w", err)
 		}
 
 		if len(payload.Items) == 0 {
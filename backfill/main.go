@@ -4,12 +4,15 @@ import (
 	"flag"
 	"go-backfill/config"
 	"go-backfill/run"
+	"log"
 )
 
 func main() {
 	envFile := flag.String("env", ".env", "Path to the .env file")
 	flag.Parse()
-	config.InitEnv(*envFile)
+	if err := config.InitEnv(*envFile); err != nil {
+		log.Fatal(err)
+	}
 	env := config.GetConfig()
 
 	pool := config.InitDatabase()
@@ -20,7 +20,6 @@ const maxConcurrency = 4
 func RunParallelChainBackfill(pool *pgxpool.Pool) {
 	env := config.GetConfig()
 	cuts := fetch.FetchCuts()
-	chainGenesisHeights := config.GetMinHeights(env.Network)
 
 	startTime := time.Now()
 	var wg sync.WaitGroup
@@ -33,7 +32,7 @@ func RunParallelChainBackfill(pool *pgxpool.Pool) {
 			continue
 		}
 
-		if chainID < 0 || chainID > 19 {
+		if !env.NetworkInfo.HasChain(chainID) {
 			continue
 		}
 
@@ -50,7 +49,7 @@ func RunParallelChainBackfill(pool *pgxpool.Pool) {
 			if env.SyncMinHeight > 0 {
 				effectiveSyncMinHeight = env.SyncMinHeight
 			} else {
-				effectiveSyncMinHeight = chainGenesisHeights[id]
+				effectiveSyncMinHeight = env.NetworkInfo.GenesisHeight(id)
 			}
 
 			fmt.Printf("Starting backfill for chain %d from height %d\n", id, height)
@@ -18,8 +18,7 @@ func RunSingleChainBackfill(pool *pgxpool.Pool) {
 	if env.SyncMinHeight > 0 {
 		effectiveSyncMinHeight = env.SyncMinHeight
 	} else {
-		chainGenesisHeights := config.GetMinHeights(env.Network)
-		effectiveSyncMinHeight = chainGenesisHeights[ChainId]
+		effectiveSyncMinHeight = env.NetworkInfo.GenesisHeight(ChainId)
 	}
 
 	process.StartBackfill(cut.Height, cut.Hash, ChainId, effectiveSyncMinHeight, pool)
@@ -0,0 +1,108 @@
+// Package safejson decodes untrusted JSON payloads under limits on nesting depth,
+// string length and total size. The limits are checked by a single pass over the
+// raw bytes before anything is decoded, so a pathological payload is rejected
+// without allocating for it.
+package safejson
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Limits bounds a payload; a zero field disables that limit.
+type Limits struct {
+	MaxDepth        int
+	MaxStringLength int
+	MaxBytes        int
+}
+
+// Names of the limits reported by LimitError
+const (
+	LimitDepth        = "max depth"
+	LimitStringLength = "max string length"
+	LimitBytes        = "max size"
+)
+
+// LimitError reports the limit a payload breached.
+type LimitError struct {
+	Limit  string
+	Max    int
+	Offset int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("json payload exceeds %s of %d (at byte %d)", e.Limit, e.Max, e.Offset)
+}
+
+// Check verifies data against the limits without decoding it. Malformed JSON is
+// left for the decoder to report.
+func Check(data []byte, limits Limits) error {
+	if limits.MaxBytes > 0 && len(data) > limits.MaxBytes {
+		return &LimitError{Limit: LimitBytes, Max: limits.MaxBytes, Offset: limits.MaxBytes}
+	}
+
+	depth := 0
+	inString := false
+	escaped := false
+	stringLength := 0
+
+	for offset, c := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+				continue
+			case c == '"':
+				inString = false
+				continue
+			}
+			stringLength++
+			if limits.MaxStringLength > 0 && stringLength > limits.MaxStringLength {
+				return &LimitError{Limit: LimitStringLength, Max: limits.MaxStringLength, Offset: offset}
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+			stringLength = 0
+		case '[', '{':
+			depth++
+			if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+				return &LimitError{Limit: LimitDepth, Max: limits.MaxDepth, Offset: offset}
+			}
+		case ']', '}':
+			depth--
+		}
+	}
+	return nil
+}
+
+// Unmarshal is json.Unmarshal behind Check.
+func Unmarshal(data []byte, v interface{}, limits Limits) error {
+	if err := Check(data, limits); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ReadAll reads r like io.ReadAll but stops with a LimitError as soon as more than
+// MaxBytes have been read, instead of buffering the whole stream.
+func ReadAll(r io.Reader, limits Limits) ([]byte, error) {
+	if limits.MaxBytes <= 0 {
+		return io.ReadAll(r)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(limits.MaxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limits.MaxBytes {
+		return nil, &LimitError{Limit: LimitBytes, Max: limits.MaxBytes, Offset: limits.MaxBytes}
+	}
+	return data, nil
+}
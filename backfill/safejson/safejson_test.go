@@ -0,0 +1,251 @@
+package safejson
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var testLimits = Limits{MaxDepth: 8, MaxStringLength: 64, MaxBytes: 4096}
+
+// Pathological payloads of the kind embedded in scam-token transactions
+var (
+	deepArrays    = []byte(strings.Repeat("[", 1<<20) + strings.Repeat("]", 1<<20))
+	deepObjects   = []byte(strings.Repeat(`{"a":`, 1<<18) + "1" + strings.Repeat("}", 1<<18))
+	longString    = []byte(`{"code":"` + strings.Repeat("x", 1<<20) + `"}`)
+	escapedString = []byte(`["` + strings.Repeat(`\n`, 1<<20) + `"]`)
+	hugeArray     = []byte("[" + strings.Repeat("1,", 1<<20) + "1]")
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		limits Limits
+		// want is the limit breached, empty when the payload passes
+		want   string
+		offset int
+	}{
+		{name: "within limits", data: `{"a":[1,{"b":"text"}]}`, limits: testLimits},
+		{name: "depth at the limit", data: `[[[1]]]`, limits: Limits{MaxDepth: 3}},
+		{name: "depth over the limit", data: `[[[[1]]]]`, limits: Limits{MaxDepth: 3}, want: LimitDepth, offset: 3},
+		{name: "objects count towards depth", data: `{"a":{"b":{"c":{}}}}`, limits: Limits{MaxDepth: 3}, want: LimitDepth, offset: 15},
+		{name: "siblings don't add depth", data: `[[1],[2],[3],[4]]`, limits: Limits{MaxDepth: 2}},
+		{name: "brackets in strings are ignored", data: `["[[[[{{{{"]`, limits: Limits{MaxDepth: 1}},
+		{name: "string at the limit", data: `"abcd"`, limits: Limits{MaxStringLength: 4}},
+		{name: "string over the limit", data: `"abcde"`, limits: Limits{MaxStringLength: 4}, want: LimitStringLength, offset: 5},
+		{name: "keys are strings", data: `{"abcde":1}`, limits: Limits{MaxStringLength: 4}, want: LimitStringLength, offset: 6},
+		{name: "escaped quote doesn't end the string", data: `"ab\"cd"`, limits: Limits{MaxStringLength: 4}, want: LimitStringLength, offset: 6},
+		{name: "escape counts once", data: `"a\nb\\"`, limits: Limits{MaxStringLength: 4}},
+		{name: "length resets per string", data: `["abcd","efgh"]`, limits: Limits{MaxStringLength: 4}},
+		{name: "size at the limit", data: `[1,2]`, limits: Limits{MaxBytes: 5}},
+		{name: "size over the limit", data: `[1,2,3]`, limits: Limits{MaxBytes: 5}, want: LimitBytes, offset: 5},
+		{name: "zero limits are disabled", data: strings.Repeat("[", 100) + strings.Repeat("]", 100), limits: Limits{}},
+		{name: "malformed JSON is left to the decoder", data: `{"a":`, limits: testLimits},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check([]byte(tt.data), tt.limits)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Check() error = %v", err)
+				}
+				return
+			}
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("Check() error = %v, want a LimitError", err)
+			}
+			if limitErr.Limit != tt.want || limitErr.Offset != tt.offset {
+				t.Errorf("Check() = %s at byte %d, want %s at byte %d", limitErr.Limit, limitErr.Offset, tt.want, tt.offset)
+			}
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	var decoded struct {
+		Code string `json:"code"`
+	}
+	if err := Unmarshal([]byte(`{"code":"(coin.transfer \"k:a\" \"k:b\" 1.0)"}`), &decoded, testLimits); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if want := `(coin.transfer "k:a" "k:b" 1.0)`; decoded.Code != want {
+		t.Errorf("Unmarshal() code = %s, want %s", decoded.Code, want)
+	}
+
+	var limitErr *LimitError
+	if err := Unmarshal(longString, &decoded, testLimits); !errors.As(err, &limitErr) || limitErr.Limit != LimitBytes {
+		t.Errorf("Unmarshal() of a long string error = %v, want %s", err, LimitBytes)
+	}
+
+	if err := Unmarshal([]byte(`{"code":`), &decoded, testLimits); err == nil || errors.As(err, &limitErr) {
+		t.Errorf("Unmarshal() of malformed JSON error = %v, want a syntax error", err)
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	err := &LimitError{Limit: LimitDepth, Max: 128, Offset: 4096}
+	if got, want := err.Error(), "json payload exceeds max depth of 128 (at byte 4096)"; got != want {
+		t.Errorf("Error() = %s, want %s", got, want)
+	}
+}
+
+// TestRejectsPathologicalPayloadsWithoutAllocating checks each fixture is
+// rejected, with its specific limit, allocating for the error alone, however
+// large the payload is.
+func TestRejectsPathologicalPayloadsWithoutAllocating(t *testing.T) {
+	// No size limit, so the scan has to reach the breach
+	limits := Limits{MaxDepth: 128, MaxStringLength: 1 << 16}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "deep arrays", data: deepArrays, want: LimitDepth},
+		{name: "deep objects", data: deepObjects, want: LimitDepth},
+		{name: "long string", data: longString, want: LimitStringLength},
+		{name: "escaped string", data: escapedString, want: LimitStringLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			var err error
+			allocs := testing.AllocsPerRun(10, func() {
+				err = Unmarshal(tt.data, &v, limits)
+			})
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != tt.want {
+				t.Fatalf("Unmarshal() error = %v, want %s", err, tt.want)
+			}
+			if allocs > 1 {
+				t.Errorf("Unmarshal() allocated %.0f times rejecting %d bytes, want only the error", allocs, len(tt.data))
+			}
+		})
+	}
+
+	t.Run("huge payload", func(t *testing.T) {
+		var v interface{}
+		var err error
+		allocs := testing.AllocsPerRun(10, func() {
+			err = Unmarshal(hugeArray, &v, Limits{MaxBytes: 1 << 20})
+		})
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != LimitBytes {
+			t.Fatalf("Unmarshal() error = %v, want %s", err, LimitBytes)
+		}
+		if allocs > 1 {
+			t.Errorf("Unmarshal() allocated %.0f times rejecting %d bytes, want only the error", allocs, len(hugeArray))
+		}
+	})
+}
+
+// endless is a reader that never ends, as a node streaming a payload forever.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '['
+	}
+	return len(p), nil
+}
+
+func TestReadAll(t *testing.T) {
+	data, err := ReadAll(strings.NewReader(`{"a":1}`), Limits{MaxBytes: 7})
+	if err != nil || string(data) != `{"a":1}` {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+
+	data, err = ReadAll(strings.NewReader(`{"a":1}`), Limits{})
+	if err != nil || string(data) != `{"a":1}` {
+		t.Errorf("ReadAll() without a limit = %q, %v", data, err)
+	}
+
+	var limitErr *LimitError
+	if _, err := ReadAll(strings.NewReader(`{"a":12}`), Limits{MaxBytes: 7}); !errors.As(err, &limitErr) || limitErr.Limit != LimitBytes {
+		t.Errorf("ReadAll() over the limit error = %v, want %s", err, LimitBytes)
+	}
+}
+
+// TestReadAllStopsAtTheLimit checks an endless stream is cut at MaxBytes, with
+// allocations bounded by the limit rather than by the stream.
+func TestReadAllStopsAtTheLimit(t *testing.T) {
+	const maxBytes = 1 << 20
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err := ReadAll(io.Reader(endless{}), Limits{MaxBytes: maxBytes})
+	runtime.ReadMemStats(&after)
+
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != LimitBytes {
+		t.Fatalf("ReadAll() error = %v, want %s", err, LimitBytes)
+	}
+	// io.ReadAll grows its buffer by doubling, so a few times the limit at most
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*maxBytes {
+		t.Errorf("ReadAll() allocated %d bytes for a limit of %d", allocated, maxBytes)
+	}
+}
+
+// FuzzCheck checks that whatever Check accepts decodes within the limits.
+func FuzzCheck(f *testing.F) {
+	for _, seed := range []string{
+		`{"a":[1,{"b":"text"}]}`, `[[[[[[[[[1]]]]]]]]]`, `"é😀"`, `{"\"":"\\"}`,
+		`["[[["]`, `"` + strings.Repeat("x", 100) + `"`, `{"a":`, `]]]]`,
+	} {
+		f.Add([]byte(seed))
+	}
+	limits := Limits{MaxDepth: 8, MaxStringLength: 64, MaxBytes: 1024}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if Check(data, limits) != nil {
+			return
+		}
+		var v interface{}
+		if err := Unmarshal(data, &v, limits); err != nil {
+			return // malformed, reported by the decoder
+		}
+		if depth := decodedDepth(v); depth > limits.MaxDepth {
+			t.Errorf("Check() accepted %q, which decodes %d deep", data, depth)
+		}
+		if length := longestString(v); length > limits.MaxStringLength {
+			t.Errorf("Check() accepted %q, which decodes to a string of %d bytes", data, length)
+		}
+	})
+}
+
+func decodedDepth(v interface{}) int {
+	deepest := 0
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			deepest = max(deepest, decodedDepth(item))
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			deepest = max(deepest, decodedDepth(item))
+		}
+	default:
+		return 0
+	}
+	return deepest + 1
+}
+
+func longestString(v interface{}) int {
+	longest := 0
+	switch v := v.(type) {
+	case string:
+		return len(v)
+	case []interface{}:
+		for _, item := range v {
+			longest = max(longest, longestString(item))
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			longest = max(longest, len(key), longestString(item))
+		}
+	}
+	return longest
+}